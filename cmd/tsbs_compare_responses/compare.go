@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queryResponse is a response as printed by tsbs_run_queries_cassandra,
+// one per line of JSON.
+type queryResponse struct {
+	ID         uint64   `json:"id"`
+	HumanLabel string   `json:"human_label"`
+	Buckets    []bucket `json:"buckets"`
+}
+
+// bucket is a time bucket of a queryResponse. Absent values are null.
+type bucket struct {
+	Start        time.Time  `json:"start"`
+	End          time.Time  `json:"end"`
+	Values       []*float64 `json:"values"`
+	Series       string     `json:"series"`
+	Points       []point    `json:"points"`
+	Measurement  string     `json:"measurement"`
+	Tags         []string   `json:"tags"`
+	ValueSeries  []string   `json:"value_series"`
+	Aggregations []string   `json:"aggregations"`
+}
+
+// point is a point of the series of a raw bucket.
+type point struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// bucketKey identifies a bucket within a queryResponse: queries of several
+// measurements, grouped by tag or raw have several buckets per time
+// interval.
+type bucketKey struct {
+	start, end  int64
+	measurement string
+	tags        string
+	series      string
+}
+
+func (b *bucket) key() bucketKey {
+	return bucketKey{
+		start:       b.Start.UnixNano(),
+		end:         b.End.UnixNano(),
+		measurement: b.Measurement,
+		tags:        strings.Join(b.Tags, ","),
+		series:      b.Series,
+	}
+}
+
+// readResponses reads the queryResponses from r, by ID. Lines that are not
+// JSON objects, such as other messages printed to stderr, are skipped.
+func readResponses(r io.Reader) (map[uint64]*queryResponse, error) {
+	responses := make(map[uint64]*queryResponse)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+		resp := &queryResponse{}
+		if err := json.Unmarshal(line, resp); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if _, ok := responses[resp.ID]; ok {
+			return nil, fmt.Errorf("line %d: duplicate query ID %d", n, resp.ID)
+		}
+		responses[resp.ID] = resp
+	}
+	return responses, scanner.Err()
+}
+
+// A mismatch is a difference between two dumps of responses. Bucket is nil
+// if a whole query is missing from one side; A or B is nil if that side
+// lacks the query or bucket.
+type mismatch struct {
+	ID         uint64
+	HumanLabel string
+	Bucket     *bucketKey
+	A, B       *bucket
+	missingA   bool
+	missingB   bool
+}
+
+// String formats a mismatch for reporting.
+func (m mismatch) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "ID %d (%s)", m.ID, m.HumanLabel)
+	if m.Bucket != nil {
+		fmt.Fprintf(&b, " [%s, %s)",
+			time.Unix(0, m.Bucket.start).UTC().Format(time.RFC3339Nano),
+			time.Unix(0, m.Bucket.end).UTC().Format(time.RFC3339Nano))
+		for _, s := range []string{m.Bucket.measurement, m.Bucket.tags, m.Bucket.series} {
+			if len(s) > 0 {
+				b.WriteString(" " + s)
+			}
+		}
+	}
+	b.WriteString(": ")
+	b.WriteString(formatSide(m.A, m.missingA))
+	b.WriteString(" vs ")
+	b.WriteString(formatSide(m.B, m.missingB))
+	return b.String()
+}
+
+// formatSide formats the values of a bucket, prefixed by their aggregation
+// and series if any, or its points for a raw bucket.
+func formatSide(b *bucket, missing bool) string {
+	if missing {
+		return "missing"
+	}
+	if b == nil {
+		return "[]"
+	}
+	if len(b.Series) > 0 {
+		parts := make([]string, len(b.Points))
+		for i, p := range b.Points {
+			parts[i] = p.Timestamp.UTC().Format(time.RFC3339Nano) + "=" + strconv.FormatFloat(p.Value, 'g', -1, 64)
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	}
+	parts := make([]string, len(b.Values))
+	for i, v := range b.Values {
+		if v == nil {
+			parts[i] = "null"
+		} else {
+			parts[i] = strconv.FormatFloat(*v, 'g', -1, 64)
+		}
+		var names []string
+		if i < len(b.Aggregations) {
+			names = append(names, b.Aggregations[i])
+		}
+		if i < len(b.ValueSeries) {
+			names = append(names, b.ValueSeries[i])
+		}
+		if len(names) > 0 {
+			parts[i] = strings.Join(names, ":") + "=" + parts[i]
+		}
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// compareResponses returns the mismatches between two dumps of responses,
+// ordered by query ID, then time.
+func compareResponses(a, b map[uint64]*queryResponse, tolerance float64) []mismatch {
+	ids := make([]uint64, 0, len(a)+len(b))
+	for id := range a {
+		ids = append(ids, id)
+	}
+	for id := range b {
+		if _, ok := a[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	mismatches := []mismatch{}
+	for _, id := range ids {
+		ra, rb := a[id], b[id]
+		switch {
+		case ra == nil:
+			mismatches = append(mismatches, mismatch{ID: id, HumanLabel: rb.HumanLabel, missingA: true})
+		case rb == nil:
+			mismatches = append(mismatches, mismatch{ID: id, HumanLabel: ra.HumanLabel, missingB: true})
+		default:
+			mismatches = append(mismatches, compareBuckets(ra, rb, tolerance)...)
+		}
+	}
+	return mismatches
+}
+
+// compareBuckets returns the mismatches between the buckets of two
+// responses to the same query.
+func compareBuckets(ra, rb *queryResponse, tolerance float64) []mismatch {
+	bs := make(map[bucketKey]*bucket, len(rb.Buckets))
+	for i := range rb.Buckets {
+		bs[rb.Buckets[i].key()] = &rb.Buckets[i]
+	}
+
+	mismatches := []mismatch{}
+	seen := make(map[bucketKey]bool, len(ra.Buckets))
+	for i := range ra.Buckets {
+		ba := &ra.Buckets[i]
+		k := ba.key()
+		seen[k] = true
+		m := mismatch{ID: ra.ID, HumanLabel: ra.HumanLabel, Bucket: &k, A: ba}
+		bb, ok := bs[k]
+		if !ok {
+			m.missingB = true
+			mismatches = append(mismatches, m)
+			continue
+		}
+		if !bucketsEqual(ba, bb, tolerance) {
+			m.B = bb
+			mismatches = append(mismatches, m)
+		}
+	}
+	for i := range rb.Buckets {
+		bb := &rb.Buckets[i]
+		k := bb.key()
+		if !seen[k] {
+			mismatches = append(mismatches, mismatch{ID: ra.ID, HumanLabel: ra.HumanLabel, Bucket: &k, missingA: true, B: bb})
+		}
+	}
+	sort.SliceStable(mismatches, func(i, j int) bool {
+		return mismatches[i].Bucket.start < mismatches[j].Bucket.start
+	})
+	return mismatches
+}
+
+// bucketsEqual reports whether two buckets with the same key have equal
+// values, of the same aggregations and series, and equal points, within the
+// tolerance.
+func bucketsEqual(a, b *bucket, tolerance float64) bool {
+	if !stringsEqual(a.ValueSeries, b.ValueSeries) || !stringsEqual(a.Aggregations, b.Aggregations) {
+		return false
+	}
+	if !valuesEqual(a.Values, b.Values, tolerance) || len(a.Points) != len(b.Points) {
+		return false
+	}
+	for i := range a.Points {
+		pa, pb := a.Points[i], b.Points[i]
+		if !pa.Timestamp.Equal(pb.Timestamp) || !floatsEqual(pa.Value, pb.Value, tolerance) {
+			return false
+		}
+	}
+	return true
+}
+
+// valuesEqual reports whether two sets of values are equal within the
+// tolerance.
+func valuesEqual(a, b []*float64, tolerance float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] == nil || b[i] == nil {
+			if a[i] != b[i] {
+				return false
+			}
+			continue
+		}
+		if !floatsEqual(*a[i], *b[i], tolerance) {
+			return false
+		}
+	}
+	return true
+}
+
+// floatsEqual reports whether two values are equal within the tolerance:
+// absolutely for values up to 1, relatively above.
+func floatsEqual(x, y, tolerance float64) bool {
+	scale := math.Max(1, math.Max(math.Abs(x), math.Abs(y)))
+	return math.Abs(x-y) <= tolerance*scale
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testResponsesA = `{"id":1,"human_label":"max cpu","buckets":[{"start":"2016-01-01T00:00:00Z","end":"2016-01-01T01:00:00Z","values":[1.5]},{"start":"2016-01-01T01:00:00Z","end":"2016-01-01T02:00:00Z","values":[2]}]}
+query 3 timed out after 12.5ms
+{"id":2,"human_label":"avg cpu","buckets":[{"start":"2016-01-01T00:00:00Z","end":"2016-01-01T01:00:00Z","values":[null]},{"start":"2016-01-01T01:00:00Z","end":"2016-01-01T02:00:00Z","values":[1000000]}]}
+{"id":4,"human_label":"only in A","buckets":[]}
+`
+
+const testResponsesB = `{"id":1,"human_label":"max cpu","buckets":[{"start":"2016-01-01T00:00:00Z","end":"2016-01-01T01:00:00Z","values":[1.5000000001]},{"start":"2016-01-01T01:00:00Z","end":"2016-01-01T02:00:00Z","values":[2.5]},{"start":"2016-01-01T02:00:00Z","end":"2016-01-01T03:00:00Z","values":[3]}]}
+{"id":2,"human_label":"avg cpu","buckets":[{"start":"2016-01-01T00:00:00Z","end":"2016-01-01T01:00:00Z","values":[0]},{"start":"2016-01-01T01:00:00Z","end":"2016-01-01T02:00:00Z","values":[1000000.0001]}]}
+{"id":5,"human_label":"only in B","buckets":[]}
+`
+
+func TestCompareResponses(t *testing.T) {
+	a, err := readResponses(strings.NewReader(testResponsesA))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := readResponses(strings.NewReader(testResponsesB))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(a) != 3 || len(b) != 3 {
+		t.Fatalf("incorrect number of responses: got %d and %d want 3 and 3", len(a), len(b))
+	}
+
+	mismatches := compareResponses(a, b, 1e-9)
+	got := make([]string, len(mismatches))
+	for i, m := range mismatches {
+		got[i] = m.String()
+	}
+	want := []string{
+		"ID 1 (max cpu) [2016-01-01T01:00:00Z, 2016-01-01T02:00:00Z): [2] vs [2.5]",
+		"ID 1 (max cpu) [2016-01-01T02:00:00Z, 2016-01-01T03:00:00Z): missing vs [3]",
+		"ID 2 (avg cpu) [2016-01-01T00:00:00Z, 2016-01-01T01:00:00Z): [null] vs [0]",
+		"ID 4 (only in A): [] vs missing",
+		"ID 5 (only in B): missing vs []",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("incorrect mismatches:\ngot\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// a larger tolerance hides the mismatch of 2 vs 2.5, but not the others:
+	if got := len(compareResponses(a, b, 0.2)); got != 4 {
+		t.Errorf("incorrect number of mismatches with a large tolerance: got %d want %d", got, 4)
+	}
+}
+
+const testGroupedResponsesA = `{"id":1,"human_label":"max cpu by host","buckets":[{"start":"2016-01-01T00:00:00Z","end":"2016-01-01T01:00:00Z","values":[1],"tags":["hostname=host_0"]},{"start":"2016-01-01T00:00:00Z","end":"2016-01-01T01:00:00Z","values":[2],"tags":["hostname=host_1"]}]}
+{"id":2,"human_label":"raw cpu","buckets":[{"start":"2016-01-01T00:00:00Z","end":"2016-01-01T01:00:00Z","values":[],"series":"cpu,hostname=host_0#usage_user","points":[{"timestamp":"2016-01-01T00:00:00Z","value":1},{"timestamp":"2016-01-01T00:00:10Z","value":2}]},{"start":"2016-01-01T00:00:00Z","end":"2016-01-01T01:00:00Z","values":[],"series":"cpu,hostname=host_1#usage_user","points":[{"timestamp":"2016-01-01T00:00:00Z","value":3}]}]}
+{"id":3,"human_label":"min max cpu","buckets":[{"start":"2016-01-01T00:00:00Z","end":"2016-01-01T01:00:00Z","values":[1,2],"aggregations":["min","max"]}]}
+`
+
+const testGroupedResponsesB = `{"id":1,"human_label":"max cpu by host","buckets":[{"start":"2016-01-01T00:00:00Z","end":"2016-01-01T01:00:00Z","values":[2],"tags":["hostname=host_1"]},{"start":"2016-01-01T00:00:00Z","end":"2016-01-01T01:00:00Z","values":[1],"tags":["hostname=host_0"]}]}
+{"id":2,"human_label":"raw cpu","buckets":[{"start":"2016-01-01T00:00:00Z","end":"2016-01-01T01:00:00Z","values":[],"series":"cpu,hostname=host_0#usage_user","points":[{"timestamp":"2016-01-01T00:00:00Z","value":1},{"timestamp":"2016-01-01T00:00:20Z","value":2}]},{"start":"2016-01-01T00:00:00Z","end":"2016-01-01T01:00:00Z","values":[],"series":"cpu,hostname=host_1#usage_user","points":[{"timestamp":"2016-01-01T00:00:00Z","value":3}]}]}
+{"id":3,"human_label":"min max cpu","buckets":[{"start":"2016-01-01T00:00:00Z","end":"2016-01-01T01:00:00Z","values":[1,2],"aggregations":["max","min"]}]}
+`
+
+func TestCompareResponsesGroupedAndRaw(t *testing.T) {
+	a, err := readResponses(strings.NewReader(testGroupedResponsesA))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := readResponses(strings.NewReader(testGroupedResponsesB))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := compareResponses(a, a, 0); len(got) != 0 {
+		t.Errorf("incorrect mismatches of a dump with itself: got %v want none", got)
+	}
+
+	mismatches := compareResponses(a, b, 1e-9)
+	got := make([]string, len(mismatches))
+	for i, m := range mismatches {
+		got[i] = m.String()
+	}
+	want := []string{
+		"ID 2 (raw cpu) [2016-01-01T00:00:00Z, 2016-01-01T01:00:00Z) cpu,hostname=host_0#usage_user: [2016-01-01T00:00:00Z=1 2016-01-01T00:00:10Z=2] vs [2016-01-01T00:00:00Z=1 2016-01-01T00:00:20Z=2]",
+		"ID 3 (min max cpu) [2016-01-01T00:00:00Z, 2016-01-01T01:00:00Z): [min=1 max=2] vs [max=1 min=2]",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("incorrect mismatches:\ngot\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestReadResponsesDuplicate(t *testing.T) {
+	in := `{"id":1,"buckets":[]}` + "\n" + `{"id":1,"buckets":[]}` + "\n"
+	if _, err := readResponses(strings.NewReader(in)); err == nil {
+		t.Errorf("expected error for duplicate IDs but did not get one")
+	}
+}
@@ -0,0 +1,68 @@
+// tsbs_compare_responses compares two dumps of query responses, as printed
+// by tsbs_run_queries_cassandra with -print-responses and
+// -print-responses-format=json, and reports the time buckets whose values
+// differ.
+//
+// It exits with a non-zero status if the dumps differ, so it can be used for
+// regression testing.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/pflag"
+)
+
+// Program option vars:
+var (
+	tolerance float64
+)
+
+// Parse args:
+func init() {
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <responses A> <responses B>\n", os.Args[0])
+		pflag.PrintDefaults()
+	}
+	pflag.Float64Var(&tolerance, "tolerance", 1e-9, "Maximum difference between values considered equal, relative to their magnitude when above 1.")
+	pflag.Parse()
+}
+
+func main() {
+	if pflag.NArg() != 2 {
+		pflag.Usage()
+		os.Exit(2)
+	}
+	a := mustReadResponsesFile(pflag.Arg(0))
+	b := mustReadResponsesFile(pflag.Arg(1))
+
+	out := bufio.NewWriter(os.Stdout)
+	mismatches := compareResponses(a, b, tolerance)
+	for _, m := range mismatches {
+		fmt.Fprintln(out, m)
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "compared %d and %d queries: %d mismatches\n", len(a), len(b), len(mismatches))
+	if len(mismatches) > 0 {
+		os.Exit(1)
+	}
+}
+
+func mustReadResponsesFile(name string) map[uint64]*queryResponse {
+	f, err := os.Open(name)
+	if err != nil {
+		log.Fatalf("cannot open responses: %v", err)
+	}
+	defer f.Close()
+	responses, err := readResponses(f)
+	if err != nil {
+		log.Fatalf("cannot read responses from %s: %v", name, err)
+	}
+	return responses
+}
@@ -83,6 +83,7 @@ func (d *Devops) GroupByOrderByLimit(qi query.Query) {
 	q.GroupByDuration = time.Minute
 	q.OrderBy = []byte("timestamp_ns DESC")
 	q.Limit = 5
+	q.GroupLimit = 5
 }
 
 // GroupByTimeAndPrimaryTag selects the AVG of numMetrics metrics under 'cpu' per device per hour for a day,
@@ -102,6 +103,7 @@ func (d *Devops) GroupByTimeAndPrimaryTag(qi query.Query, numMetrics int) {
 	d.fillInQuery(qi, humanLabel, humanDesc, "avg", metrics, interval, nil)
 	q := qi.(*query.Cassandra)
 	q.GroupByDuration = time.Hour
+	q.GroupByTagKeys = []byte("hostname")
 }
 
 // MaxAllCPU selects the MAX of all metrics under 'cpu' per hour for nhosts hosts,
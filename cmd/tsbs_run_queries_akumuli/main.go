@@ -7,6 +7,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -50,6 +51,9 @@ func init() {
 
 func main() {
 	runner.Run(&query.HTTPPool, newProcessor)
+	if n := runner.Regressions(); n > 0 {
+		log.Fatalf("%d regressions from the baseline", n)
+	}
 }
 
 type processor struct {
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// States of a circuitBreaker.
+const (
+	breakerClosed   = iota // queries are dispatched
+	breakerOpen            // queries wait for the end of the cooldown
+	breakerHalfOpen        // a probe query is in flight, the others wait
+)
+
+// A circuitBreaker pauses the dispatch of queries by all workers once the
+// error rate of the last queries exceeds a threshold (set by
+// -breaker-threshold), so that a failing cluster is not hammered with more
+// of them: after a cooldown (-breaker-cooldown), a single probe query is
+// dispatched, and the others resume if it succeeds, otherwise the breaker
+// opens again.
+type circuitBreaker struct {
+	threshold float64       // error rate over the window, from 0 to 1
+	cooldown  time.Duration // of the breaker once open
+	window    []bool        // of the outcomes of the last queries, failed or not
+	now       func() time.Time
+
+	mu        sync.Mutex
+	state     int
+	next      int           // in window, of the next outcome
+	n         int           // outcomes in window
+	errors    int           // failed ones
+	openUntil time.Time     // while open
+	probeDone chan struct{} // closed once the probe of a half-open breaker ends
+	trips     uint64
+}
+
+// newCircuitBreaker returns a closed circuitBreaker opening when more than
+// threshold of the last window queries failed.
+func newCircuitBreaker(threshold float64, cooldown time.Duration, window int) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		window:    make([]bool, window),
+		now:       time.Now,
+	}
+}
+
+// wait blocks while the breaker is open, or a probe is in flight, or until
+// ctx is done. It reports whether the query of the caller is the probe,
+// whose outcome must be observed to close the breaker again.
+func (b *circuitBreaker) wait(ctx context.Context) (probe bool, err error) {
+	for {
+		b.mu.Lock()
+		switch b.state {
+		case breakerClosed:
+			b.mu.Unlock()
+			return false, nil
+		case breakerOpen:
+			if d := b.openUntil.Sub(b.now()); d > 0 {
+				b.mu.Unlock()
+				if err := sleepContext(ctx, d); err != nil {
+					return false, err
+				}
+				continue
+			}
+			b.state = breakerHalfOpen
+			b.probeDone = make(chan struct{})
+			b.mu.Unlock()
+			return true, nil
+		default:
+			done := b.probeDone
+			b.mu.Unlock()
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return false, ctx.Err()
+			}
+		}
+	}
+}
+
+// observe records the outcome of a query dispatched after wait, reporting
+// whether it opened the breaker. The outcomes of the queries in flight when
+// the breaker opened are ignored, so that they do not count twice.
+func (b *circuitBreaker) observe(probe, failed bool) (tripped bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		close(b.probeDone)
+		if failed {
+			b.trip()
+			return true
+		}
+		b.state = breakerClosed
+		b.next, b.n, b.errors = 0, 0, 0
+		return false
+	}
+	if b.state != breakerClosed {
+		return false
+	}
+	if b.n == len(b.window) {
+		if b.window[b.next] {
+			b.errors--
+		}
+	} else {
+		b.n++
+	}
+	b.window[b.next] = failed
+	if failed {
+		b.errors++
+	}
+	b.next = (b.next + 1) % len(b.window)
+	if b.n == len(b.window) && float64(b.errors) > b.threshold*float64(b.n) {
+		b.trip()
+		return true
+	}
+	return false
+}
+
+// trip opens the breaker for its cooldown. b.mu must be held.
+func (b *circuitBreaker) trip() {
+	b.state = breakerOpen
+	b.openUntil = b.now().Add(b.cooldown)
+	b.trips++
+}
+
+// Trips returns the number of times the breaker opened, including after
+// failed probes.
+func (b *circuitBreaker) Trips() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.trips
+}
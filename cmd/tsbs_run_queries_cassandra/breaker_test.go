@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/timescale/tsbs/query"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(0.5, 20*time.Millisecond, 4)
+	ctx := context.Background()
+
+	// 2 errors out of the last 4 queries are not over the threshold, 3 are:
+	for i, failed := range []bool{false, true, true, false, true} {
+		if probe, err := b.wait(ctx); probe || err != nil {
+			t.Fatalf("query %d: closed breaker: got probe %v (%v)", i, probe, err)
+		}
+		if tripped := b.observe(false, failed); tripped != (i == 4) {
+			t.Errorf("query %d: incorrect trip: got %v", i, tripped)
+		}
+	}
+	if b.Trips() != 1 {
+		t.Errorf("incorrect number of trips: got %d want 1", b.Trips())
+	}
+
+	// once open, the next query waits for the cooldown, as the probe:
+	start := time.Now()
+	probe, err := b.wait(ctx)
+	if !probe || err != nil {
+		t.Fatalf("open breaker: got probe %v (%v)", probe, err)
+	}
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("probe dispatched before the cooldown: after %v", elapsed)
+	}
+	// the others wait for the probe, or until their context is done:
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	if _, err := b.wait(waitCtx); err != context.DeadlineExceeded {
+		t.Errorf("incorrect error while probing: got %v want %v", err, context.DeadlineExceeded)
+	}
+
+	// a failed probe opens it again, a successful one closes it:
+	if !b.observe(true, true) {
+		t.Errorf("failed probe: breaker not tripped")
+	}
+	if probe, err := b.wait(ctx); !probe || err != nil {
+		t.Fatalf("reopened breaker: got probe %v (%v)", probe, err)
+	}
+	if b.observe(true, false) {
+		t.Errorf("successful probe: breaker tripped")
+	}
+	if probe, err := b.wait(ctx); probe || err != nil {
+		t.Errorf("closed breaker: got probe %v (%v)", probe, err)
+	}
+	if b.Trips() != 2 {
+		t.Errorf("incorrect number of trips: got %d want 2", b.Trips())
+	}
+	// the window restarts once closed:
+	if b.observe(false, true) {
+		t.Errorf("breaker tripped by the errors before it opened")
+	}
+}
+
+func TestRunnerCircuitBreaker(t *testing.T) {
+	const numQueries, failing = 50, 10
+	dir, err := ioutil.TempDir("", "tsbs_run_queries_cassandra")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := writeTestQueryFile(t, dir, numQueries)
+
+	// the cluster fails the first queries, then recovers:
+	var calls int64
+	mock := &mockQueryExecutor{respond: func(stmt string, args []interface{}) ([][]interface{}, error) {
+		if atomic.AddInt64(&calls, 1) <= failing {
+			return nil, errors.New("unavailable")
+		}
+		return serverAggregationRows(stmt, args)
+	}}
+
+	oldRunner, oldCSI, oldQE, oldAggrPlan, oldBreaker := runner, csi, qe, aggrPlan, breaker
+	defer func() {
+		runner, csi, qe, aggrPlan, breaker = oldRunner, oldCSI, oldQE, oldAggrPlan, oldBreaker
+		atomic.StoreUint64(&failed, 0)
+	}()
+	runner = query.NewBenchmarkRunner(query.BenchmarkRunnerConfig{Workers: 2, FileName: fileName})
+	csi = newTestClientSideIndex(1, 1, "usage_user")
+	qe = mock
+	aggrPlan = AggrPlanTypeWithServerAggregation
+	breaker = newCircuitBreaker(0.5, 10*time.Millisecond, 4)
+
+	// failed queries do not end the run:
+	runner.Run(&query.CassandraPool, newProcessor)
+
+	if got := mock.Calls(); got != numQueries {
+		t.Errorf("incorrect number of CQL queries: got %d want %d", got, numQueries)
+	}
+	if got := atomic.LoadUint64(&failed); got != failing {
+		t.Errorf("incorrect number of failed queries: got %d want %d", got, failing)
+	}
+	// tripped by the errors, then by failed probes until the recovery:
+	if got := breaker.Trips(); got < 2 {
+		t.Errorf("incorrect number of trips: got %d want at least 2", got)
+	}
+	if probe, err := breaker.wait(context.Background()); probe || err != nil {
+		t.Errorf("breaker not closed after the recovery: got probe %v (%v)", probe, err)
+	}
+}
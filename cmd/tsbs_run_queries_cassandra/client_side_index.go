@@ -1,12 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"regexp"
 	"strings"
 	"time"
 
-	"github.com/gocql/gocql"
 	"github.com/timescale/tsbs/internal/utils"
 )
 
@@ -20,6 +21,15 @@ type ClientSideIndex struct {
 
 	seriesCollection []Series
 	seriesIds        []string
+
+	// TableName resolves the tables that CQL queries read series from, if
+	// set: by default, the Table of each series is read.
+	TableName TableNameResolver
+
+	// ReadKeyspace qualifies, if set, the tables of all CQL queries instead
+	// of the Keyspace of each series, e.g. to read a snapshot of the
+	// keyspace the index was built from (see -read-keyspace).
+	ReadKeyspace string
 }
 
 // NewClientSideIndex constructs a ClientSideIndex from a precomputed
@@ -81,6 +91,32 @@ func NewClientSideIndex(seriesCollection []Series) *ClientSideIndex {
 	}
 }
 
+// NewSyntheticClientSideIndex builds a ClientSideIndex of synthetic series
+// of the cpu measurement in the series_double table, without a cluster: one
+// per host (tagged hostname=host_0, host_1, ...), field and day from start,
+// e.g. to measure query planning on an index of a given size.
+func NewSyntheticClientSideIndex(start time.Time, hosts, days int, fields ...string) *ClientSideIndex {
+	series := make([]Series, 0, hosts*days*len(fields))
+	for h := 0; h < hosts; h++ {
+		for _, f := range fields {
+			for d := 0; d < days; d++ {
+				day := start.Add(time.Duration(d) * BucketDuration).Format(BucketTimeLayout)
+				id := fmt.Sprintf("cpu,hostname=host_%d#%s#%s", h, f, day)
+				series = append(series, NewSeries("series_double", id))
+			}
+		}
+	}
+	return NewClientSideIndex(series)
+}
+
+// subIndex returns an index of some of the series of csi, e.g. those of a
+// tag group (see HLQueryExecutor.plan), whose tables are resolved alike.
+func (csi *ClientSideIndex) subIndex(series []Series) *ClientSideIndex {
+	sub := NewClientSideIndex(series)
+	sub.TableName, sub.ReadKeyspace = csi.TableName, csi.ReadKeyspace
+	return sub
+}
+
 // CopyOfSeriesCollection returns a copy of the internal Series data. Its
 // output slice can be safely altered, but the Series objects within may not!
 func (csi *ClientSideIndex) CopyOfSeriesCollection() []Series {
@@ -89,6 +125,42 @@ func (csi *ClientSideIndex) CopyOfSeriesCollection() []Series {
 	return ret
 }
 
+// unknownSeriesIds returns the ids, of rows or of series without their day
+// (see HLQuery.SeriesIds), that are not in the index.
+func (csi *ClientSideIndex) unknownSeriesIds(ids []string) []string {
+	known := make(map[string]struct{}, 2*len(csi.seriesIds))
+	for _, id := range csi.seriesIds {
+		known[id] = struct{}{}
+		known[seriesKey(id)] = struct{}{}
+	}
+	unknown := []string{}
+	for _, id := range ids {
+		if _, ok := known[id]; !ok {
+			unknown = append(unknown, id)
+		}
+	}
+	return unknown
+}
+
+// tableName returns the table to query the rows of series from for ti (see
+// TableNameResolver), qualified by the ReadKeyspace of the index if set,
+// otherwise by the Keyspace of the series if it has one.
+func (csi *ClientSideIndex) tableName(series Series, ti *utils.TimeInterval) string {
+	name := ""
+	if csi.TableName == nil {
+		name = seriesTableName(series, ti)
+	} else {
+		name = csi.TableName(series, ti)
+	}
+	if len(csi.ReadKeyspace) > 0 {
+		return csi.ReadKeyspace + "." + name
+	}
+	if len(series.Keyspace) > 0 {
+		return series.Keyspace + "." + name
+	}
+	return name
+}
+
 // SeriesForMeasurementAndField filters the series choices based on a key of
 // Measurement name and Field name. Using this dramatically speeds up query
 // planning when the database has many series.
@@ -97,17 +169,30 @@ func (csi *ClientSideIndex) SeriesForMeasurementAndField(measurementName, fieldN
 	return csi.nameMapping[key]
 }
 
+const (
+	// tagNegationPrefix marks a tag in a tagset that a Series must not have.
+	tagNegationPrefix = "!"
+	// tagRegexpMarker separates the key and pattern of a regular
+	// expression tag, e.g. "hostname=~/host_1.*/".
+	tagRegexpMarker = "=~/"
+)
+
 // A Series maps 1-to-1 to a time series 'wide row' in Cassandra. All data in
 // this type comes directly from a Cassandra database.
 type Series struct {
-	Table string // e.g. "series_bigint"
-	Id    string // e.g. "cpu,hostname=host_0,region=eu-central-1#usage_idle#2016-01-01"
+	Keyspace string // e.g. "tenant_1", or empty for the keyspace of the session
+	Table    string // e.g. "series_bigint"
+	Id       string // e.g. "cpu,hostname=host_0,region=eu-central-1#usage_idle#2016-01-01"
 
 	// parsed fields
 	Measurement  string              // e.g. "cpu"
 	Tags         map[string]struct{} // e.g. {"hostname": "host_3"}
 	Field        string              // e.g. "usage_idle"
 	TimeInterval *utils.TimeInterval // (UTC) e.g. "2016-01-01"
+
+	Rollups []Rollup // pre-aggregated tables of the series, coarsest first
+
+	GroupColumn *GroupColumn // of the table of the series, if any
 }
 
 // NewSeries parses a new Series from the given Cassandra data.
@@ -166,52 +251,287 @@ func (s *Series) MatchesTimeInterval(ti *utils.TimeInterval) bool {
 	return s.TimeInterval.Overlap(ti)
 }
 
+// tagGroup returns the tags of the Series with the given keys, in their
+// order, or false if it lacks one of them.
+func (s *Series) tagGroup(keys []string) ([]string, bool) {
+	tags := make([]string, len(keys))
+	for i, key := range keys {
+		prefix := key + "="
+		for tag := range s.Tags {
+			if strings.HasPrefix(tag, prefix) {
+				tags[i] = tag
+				break
+			}
+		}
+		if len(tags[i]) == 0 {
+			return nil, false
+		}
+	}
+	return tags, true
+}
+
+// coveredDuration returns the duration of [start, end) covered by this
+// Series, i.e. of the points its row may hold.
+func (s *Series) coveredDuration(start, end time.Time) time.Duration {
+	if s.TimeInterval.Start().After(start) {
+		start = s.TimeInterval.Start()
+	}
+	if s.TimeInterval.End().Before(end) {
+		end = s.TimeInterval.End()
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
 // MatchesMeasurementName determines whether this Series measurement name matches
 // the provided name.
 func (s *Series) MatchesMeasurementName(m string) bool {
 	return s.Measurement == m
 }
 
+// MatchesMeasurementNames determines whether this Series measurement name is
+// one of the provided names.
+func (s *Series) MatchesMeasurementNames(ms []string) bool {
+	for _, m := range ms {
+		if s.MatchesMeasurementName(m) {
+			return true
+		}
+	}
+	return false
+}
+
 // MatchesFieldName determines whether this Series field name matches
 // the provided name.
 func (s *Series) MatchesFieldName(f string) bool {
 	return s.Field == f
 }
 
-// MatchesTagSets checks whether this Series matches the given tagsets.
+// MatchesFieldNames determines whether this Series field name is one of the
+// provided names.
+func (s *Series) MatchesFieldNames(fields []string) bool {
+	for _, f := range fields {
+		if s.MatchesFieldName(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesTagSets checks whether this Series matches the given tagsets (see
+// TagSetMatcher). A Series does not match tagsets that are invalid.
+//
+// When matching many Series against the same tagsets, use a TagSetMatcher
+// instead, so that the tagsets are only parsed once.
 func (s *Series) MatchesTagSets(tagsets [][]string) bool {
-	for _, tagset := range tagsets {
-		// each tagset must have at least one match
-		match := false
-		for _, tag := range tagset {
+	m, err := NewTagSetMatcher(tagsets)
+	if err != nil {
+		return false
+	}
+	return m.Matches(s)
+}
+
+// hasTagWithValue reports whether the Series has a value for the tag key
+// that satisfies the regular expression.
+func (s *Series) hasTagWithValue(key string, re *regexp.Regexp) bool {
+	prefix := key + "="
+	for tag := range s.Tags {
+		if strings.HasPrefix(tag, prefix) && re.MatchString(tag[len(prefix):]) {
+			return true
+		}
+	}
+	return false
+}
+
+// A TagSetMatcher checks whether Series match the tagsets of an HLQuery. It
+// is built once per query, so that regular expressions in the tagsets are
+// compiled once rather than for every Series.
+//
+// Every tagset must match. A tag prefixed with "!" is negated, meaning the
+// Series must not have that tag. Within a tagset, the plain tags are OR'ed
+// and the negated tags are AND'ed, so a Series matches a tagset if it has at
+// least one of its plain tags (when it has any) and none of its negated tags.
+// For example, ["!hostname=host_0", "!hostname=host_1"] matches all but those
+// two hosts, and ["region=eu-west-1", "!hostname=host_0"] matches the hosts
+// in eu-west-1 other than host_0.
+//
+// A tag of the form "key=~/pattern/" matches a Series that has a value for
+// the key matching the regular expression, analogous to InfluxDB's =~
+// operator. As there, the pattern is unanchored unless it uses ^ or $.
+//
+// The exact tags of each tagset are put into sets when the matcher is built,
+// so that checking a tagset costs a lookup per tag of the Series (or per tag
+// of the tagset, if it has fewer), however many values it ORs.
+type TagSetMatcher struct {
+	tagsets []tagSetMatcher
+}
+
+// A tagSetMatcher matches the Series of one tagset of a TagSetMatcher.
+type tagSetMatcher struct {
+	empty          bool // no tag at all, which matches no Series
+	plain, negated exactTags
+	plainRegexps   []tagRegexp
+	negatedRegexps []tagRegexp
+}
+
+// exactTags are the exact tags of a tagset, plain or negated, as a slice and
+// as a set, to look up the fewest of those of the tagset and of a Series.
+type exactTags struct {
+	tags []string
+	set  map[string]struct{}
+}
+
+func (t *exactTags) add(tag string) {
+	if t.set == nil {
+		t.set = map[string]struct{}{}
+	}
+	if _, ok := t.set[tag]; !ok {
+		t.tags = append(t.tags, tag)
+		t.set[tag] = struct{}{}
+	}
+}
+
+// matchAny reports whether the Series has any of the tags.
+func (t *exactTags) matchAny(s *Series) bool {
+	if len(t.tags) <= len(s.Tags) {
+		for _, tag := range t.tags {
 			if _, ok := s.Tags[tag]; ok {
-				match = true
-				break
+				return true
 			}
 		}
-		if !match {
+		return false
+	}
+	for tag := range s.Tags {
+		if _, ok := t.set[tag]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+type tagRegexp struct {
+	key string
+	re  *regexp.Regexp
+}
+
+// NewTagSetMatcher builds a TagSetMatcher for the given tagsets. It fails if
+// a regular expression tag does not compile.
+func NewTagSetMatcher(tagsets [][]string) (*TagSetMatcher, error) {
+	m := &TagSetMatcher{tagsets: make([]tagSetMatcher, len(tagsets))}
+	regexps := map[string]tagRegexp{} // by tag, compiled once
+	for i, tagset := range tagsets {
+		ts := &m.tagsets[i]
+		ts.empty = len(tagset) == 0
+		for _, tag := range tagset {
+			negated := strings.HasPrefix(tag, tagNegationPrefix)
+			tag = strings.TrimPrefix(tag, tagNegationPrefix)
+			key, pattern, ok := parseTagRegexp(tag)
+			if !ok {
+				if negated {
+					ts.negated.add(tag)
+				} else {
+					ts.plain.add(tag)
+				}
+				continue
+			}
+			r, ok := regexps[tag]
+			if !ok {
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("invalid regular expression in tag %q: %v", tag, err)
+				}
+				r = tagRegexp{key: key, re: re}
+				regexps[tag] = r
+			}
+			if negated {
+				ts.negatedRegexps = append(ts.negatedRegexps, r)
+			} else {
+				ts.plainRegexps = append(ts.plainRegexps, r)
+			}
+		}
+	}
+	return m, nil
+}
+
+// parseTagRegexp splits a regular expression tag of the form
+// "key=~/pattern/" into its key and pattern.
+func parseTagRegexp(tag string) (key, pattern string, ok bool) {
+	i := strings.Index(tag, tagRegexpMarker)
+	if i < 0 || len(tag) < i+len(tagRegexpMarker)+1 || !strings.HasSuffix(tag, "/") {
+		return "", "", false
+	}
+	return tag[:i], tag[i+len(tagRegexpMarker) : len(tag)-1], true
+}
+
+// Matches checks whether the Series matches all the tagsets.
+func (m *TagSetMatcher) Matches(s *Series) bool {
+	for i := range m.tagsets {
+		if !m.tagsets[i].matches(s) {
 			return false
 		}
 	}
 	return true
 }
 
+func (ts *tagSetMatcher) matches(s *Series) bool {
+	if ts.empty {
+		return false
+	}
+	if ts.negated.matchAny(s) {
+		return false
+	}
+	for _, r := range ts.negatedRegexps {
+		if s.hasTagWithValue(r.key, r.re) {
+			return false
+		}
+	}
+	if len(ts.plain.tags) == 0 && len(ts.plainRegexps) == 0 {
+		return true
+	}
+	if ts.plain.matchAny(s) {
+		return true
+	}
+	for _, r := range ts.plainRegexps {
+		if s.hasTagWithValue(r.key, r.re) {
+			return true
+		}
+	}
+	return false
+}
+
 // FetchSeriesCollection returns all series in Cassandra that can be used for
-// fulfilling a query.
-func FetchSeriesCollection(session *gocql.Session) []Series {
+// fulfilling a query, read from the BlessedTables with qe (typically a
+// gocqlQueryExecutor).
+//
+// The tables are those of the keyspace of the session, unless keyspaces
+// (sharing the same schema, e.g. one per tenant) are given, in which case
+// the tables of each of them are read, and their series have their Keyspace
+// set.
+func FetchSeriesCollection(ctx context.Context, qe QueryExecutor, keyspaces ...string) ([]Series, error) {
 	seriesCollection := []Series{}
+	if len(keyspaces) == 0 {
+		keyspaces = []string{""}
+	}
 
-	for _, tableName := range BlessedTables {
-		var seriesID string
-		iter := session.Query(fmt.Sprintf(`SELECT DISTINCT series_id FROM %s`, tableName)).Iter()
-		for iter.Scan(&seriesID) {
-			s := NewSeries(tableName, seriesID)
-			seriesCollection = append(seriesCollection, s)
-		}
-		if err := iter.Close(); err != nil {
-			log.Fatal(err)
+	for _, keyspace := range keyspaces {
+		for _, tableName := range BlessedTables {
+			from := tableName
+			if len(keyspace) > 0 {
+				from = keyspace + "." + tableName
+			}
+			var seriesID string
+			iter := qe.Query(ctx, fmt.Sprintf(`SELECT DISTINCT series_id FROM %s`, from))
+			for iter.Scan(&seriesID) {
+				s := NewSeries(tableName, seriesID)
+				s.Keyspace = keyspace
+				seriesCollection = append(seriesCollection, s)
+			}
+			if err := iter.Close(); err != nil {
+				return nil, fmt.Errorf("cannot read the series of %s: %v", from, err)
+			}
 		}
 	}
 
-	return seriesCollection
+	return seriesCollection, nil
 }
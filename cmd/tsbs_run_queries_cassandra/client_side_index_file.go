@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+// clientSideIndexFormatVersion is the version of the format written by
+// SerializeTo. It must be incremented whenever the format changes. Version 2
+// added the Keyspace of series: version 1 files are still read, with series
+// in the keyspace of the session.
+const clientSideIndexFormatVersion = 2
+
+// clientSideIndexHeader starts a serialized ClientSideIndex.
+type clientSideIndexHeader struct {
+	Version     int
+	SeriesCount int
+}
+
+// seriesRecord is the serialized form of a Series.
+type seriesRecord struct {
+	Keyspace    string
+	Table       string
+	Id          string
+	Measurement string
+	Field       string
+	Tags        []string
+	Start, End  time.Time
+}
+
+// SerializeTo writes the series collection of the index to w, so that it can
+// be reloaded with LoadClientSideIndex instead of reading it from Cassandra.
+func (csi *ClientSideIndex) SerializeTo(w io.Writer) error {
+	enc := gob.NewEncoder(w)
+	header := clientSideIndexHeader{
+		Version:     clientSideIndexFormatVersion,
+		SeriesCount: len(csi.seriesCollection),
+	}
+	if err := enc.Encode(&header); err != nil {
+		return err
+	}
+	for _, s := range csi.seriesCollection {
+		rec := seriesRecord{
+			Keyspace:    s.Keyspace,
+			Table:       s.Table,
+			Id:          s.Id,
+			Measurement: s.Measurement,
+			Field:       s.Field,
+			Tags:        make([]string, 0, len(s.Tags)),
+			Start:       s.TimeInterval.Start(),
+			End:         s.TimeInterval.End(),
+		}
+		for tag := range s.Tags {
+			rec.Tags = append(rec.Tags, tag)
+		}
+		sort.Strings(rec.Tags)
+		if err := enc.Encode(&rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadClientSideIndex reads a ClientSideIndex written by SerializeTo.
+func LoadClientSideIndex(r io.Reader) (*ClientSideIndex, error) {
+	dec := gob.NewDecoder(r)
+	var header clientSideIndexHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("cannot read client side index header: %v", err)
+	}
+	if header.Version < 1 || header.Version > clientSideIndexFormatVersion {
+		return nil, fmt.Errorf("unsupported client side index format version %d (want %d or earlier)", header.Version, clientSideIndexFormatVersion)
+	}
+	if header.SeriesCount <= 0 {
+		return nil, fmt.Errorf("client side index has no series")
+	}
+
+	seriesCollection := make([]Series, header.SeriesCount)
+	for i := range seriesCollection {
+		var rec seriesRecord
+		if err := dec.Decode(&rec); err != nil {
+			return nil, fmt.Errorf("cannot read series %d of client side index: %v", i, err)
+		}
+		ti, err := utils.NewTimeInterval(rec.Start, rec.End)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time interval of series %s: %v", rec.Id, err)
+		}
+		tags := make(map[string]struct{}, len(rec.Tags))
+		for _, tag := range rec.Tags {
+			tags[tag] = struct{}{}
+		}
+		seriesCollection[i] = Series{
+			Keyspace:     rec.Keyspace,
+			Table:        rec.Table,
+			Id:           rec.Id,
+			Measurement:  rec.Measurement,
+			Tags:         tags,
+			Field:        rec.Field,
+			TimeInterval: ti,
+		}
+	}
+	return NewClientSideIndex(seriesCollection), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+)
+
+func TestClientSideIndexSerializeRoundTrip(t *testing.T) {
+	// 50 hosts * 10 fields * 7 days = 3500 series
+	series := newTestClientSideIndex(50, 7, "usage_user", "usage_system", "usage_idle", "usage_nice", "usage_iowait",
+		"usage_irq", "usage_softirq", "usage_steal", "usage_guest", "usage_guest_nice").CopyOfSeriesCollection()
+	series[0].Keyspace = "tenant_1"
+	csi := NewClientSideIndex(series)
+
+	var buf bytes.Buffer
+	if err := csi.SerializeTo(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	loaded, err := LoadClientSideIndex(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, want := loaded.CopyOfSeriesCollection(), csi.CopyOfSeriesCollection()
+	if len(got) != 3500 {
+		t.Fatalf("incorrect number of series: got %d want %d", len(got), 3500)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded series collection differs from the serialized one")
+	}
+	if got, want := loaded.SeriesForMeasurementAndField("cpu", "usage_idle"), csi.SeriesForMeasurementAndField("cpu", "usage_idle"); !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded index differs from the serialized one")
+	}
+}
+
+func TestLoadClientSideIndexErrors(t *testing.T) {
+	encode := func(header clientSideIndexHeader) *bytes.Buffer {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&header); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return &buf
+	}
+	cases := []struct {
+		desc string
+		in   *bytes.Buffer
+	}{
+		{desc: "empty", in: &bytes.Buffer{}},
+		{desc: "wrong version", in: encode(clientSideIndexHeader{Version: clientSideIndexFormatVersion + 1, SeriesCount: 1})},
+		{desc: "no series", in: encode(clientSideIndexHeader{Version: clientSideIndexFormatVersion})},
+		{desc: "truncated", in: encode(clientSideIndexHeader{Version: clientSideIndexFormatVersion, SeriesCount: 1})},
+	}
+	for _, c := range cases {
+		if _, err := LoadClientSideIndex(c.in); err == nil {
+			t.Errorf("%s: expected error but did not get one", c.desc)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeriesMatchesTagSets(t *testing.T) {
+	s := NewSeries(testTable, "cpu,hostname=host_0,region=eu-west-1#usage_user#2016-01-01")
+	cases := []struct {
+		desc    string
+		tagsets [][]string
+		want    bool
+	}{
+		{
+			desc: "no tagsets",
+			want: true,
+		},
+		{
+			desc:    "empty tagset",
+			tagsets: [][]string{{}},
+			want:    false,
+		},
+		{
+			desc:    "plain match",
+			tagsets: [][]string{{"hostname=host_1", "hostname=host_0"}},
+			want:    true,
+		},
+		{
+			desc:    "plain no match",
+			tagsets: [][]string{{"hostname=host_1", "hostname=host_2"}},
+			want:    false,
+		},
+		{
+			desc:    "negated match",
+			tagsets: [][]string{{"!hostname=host_0"}},
+			want:    false,
+		},
+		{
+			desc:    "negated no match",
+			tagsets: [][]string{{"!hostname=host_1"}},
+			want:    true,
+		},
+		{
+			desc:    "all negated, none match",
+			tagsets: [][]string{{"!hostname=host_1", "!hostname=host_2"}},
+			want:    true,
+		},
+		{
+			desc:    "all negated, one matches",
+			tagsets: [][]string{{"!hostname=host_1", "!hostname=host_0"}},
+			want:    false,
+		},
+		{
+			desc:    "mixed, plain matches and negated does not",
+			tagsets: [][]string{{"region=eu-west-1", "!hostname=host_1"}},
+			want:    true,
+		},
+		{
+			desc:    "mixed, plain and negated both match",
+			tagsets: [][]string{{"region=eu-west-1", "!hostname=host_0"}},
+			want:    false,
+		},
+		{
+			desc:    "mixed, neither matches",
+			tagsets: [][]string{{"region=us-east-1", "!hostname=host_1"}},
+			want:    false,
+		},
+		{
+			desc:    "mixed, only negated matches",
+			tagsets: [][]string{{"region=us-east-1", "!hostname=host_0"}},
+			want:    false,
+		},
+		{
+			desc:    "AND of plain and negated tagsets",
+			tagsets: [][]string{{"region=eu-west-1"}, {"!hostname=host_1"}},
+			want:    true,
+		},
+		{
+			desc:    "AND with failing negated tagset",
+			tagsets: [][]string{{"region=eu-west-1"}, {"!hostname=host_0"}},
+			want:    false,
+		},
+	}
+	for _, c := range cases {
+		if got := s.MatchesTagSets(c.tagsets); got != c.want {
+			t.Errorf("%s: incorrect match: got %v want %v", c.desc, got, c.want)
+		}
+	}
+}
+
+func TestTagSetMatcherRegexp(t *testing.T) {
+	s := NewSeries(testTable, "cpu,hostname=host_12,region=eu-west-1#usage_user#2016-01-01")
+	cases := []struct {
+		desc    string
+		tagsets [][]string
+		want    bool
+	}{
+		{
+			desc:    "unanchored prefix",
+			tagsets: [][]string{{"hostname=~/host_1.*/"}},
+			want:    true,
+		},
+		{
+			desc:    "unanchored substring",
+			tagsets: [][]string{{"hostname=~/_1/"}},
+			want:    true,
+		},
+		{
+			desc:    "anchored full match",
+			tagsets: [][]string{{"hostname=~/^host_1$/"}},
+			want:    false,
+		},
+		{
+			desc:    "anchored start",
+			tagsets: [][]string{{"hostname=~/^host_12/"}},
+			want:    true,
+		},
+		{
+			desc:    "other key",
+			tagsets: [][]string{{"region=~/host_1.*/"}},
+			want:    false,
+		},
+		{
+			desc:    "missing key",
+			tagsets: [][]string{{"rack=~/.*/"}},
+			want:    false,
+		},
+		{
+			desc:    "ORed with exact",
+			tagsets: [][]string{{"hostname=host_0", "region=~/^eu-/"}},
+			want:    true,
+		},
+		{
+			desc:    "negated",
+			tagsets: [][]string{{"!hostname=~/^host_1/"}},
+			want:    false,
+		},
+		{
+			desc:    "exact value that looks like a regexp",
+			tagsets: [][]string{{"hostname=~/host_12"}},
+			want:    false,
+		},
+	}
+	for _, c := range cases {
+		m, err := NewTagSetMatcher(c.tagsets)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if got := m.Matches(&s); got != c.want {
+			t.Errorf("%s: incorrect match: got %v want %v", c.desc, got, c.want)
+		}
+		if got := s.MatchesTagSets(c.tagsets); got != c.want {
+			t.Errorf("%s: incorrect MatchesTagSets: got %v want %v", c.desc, got, c.want)
+		}
+	}
+}
+
+func TestTagSetMatcherInvalidRegexp(t *testing.T) {
+	tagsets := [][]string{{"hostname=~/host_(/"}}
+	if _, err := NewTagSetMatcher(tagsets); err == nil {
+		t.Errorf("expected error but did not get one")
+	}
+
+	s := NewSeries(testTable, "cpu,hostname=host_0#usage_user#2016-01-01")
+	if s.MatchesTagSets(tagsets) {
+		t.Errorf("series matched invalid tagsets")
+	}
+
+	csi := NewClientSideIndex([]Series{s})
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Hour), time.Minute)
+	q.TagSets = tagsets
+	if _, err := q.ToQueryPlanWithServerAggregation(csi); err == nil {
+		t.Errorf("server aggregation plan: expected error but did not get one")
+	}
+	if _, err := q.ToQueryPlanWithoutServerAggregation(csi); err == nil {
+		t.Errorf("client aggregation plan: expected error but did not get one")
+	}
+}
+
+// referenceMatchesTagSets matches a Series against tagsets as specified by
+// TagSetMatcher, by looking up each tag of each tagset in turn.
+func referenceMatchesTagSets(s *Series, tagsets [][]string) bool {
+	hasTag := func(tag string) bool {
+		if key, pattern, ok := parseTagRegexp(tag); ok {
+			return s.hasTagWithValue(key, regexp.MustCompile(pattern))
+		}
+		_, ok := s.Tags[tag]
+		return ok
+	}
+	for _, tagset := range tagsets {
+		hasPlain, match := false, false
+		for _, tag := range tagset {
+			if strings.HasPrefix(tag, tagNegationPrefix) {
+				if hasTag(strings.TrimPrefix(tag, tagNegationPrefix)) {
+					return false
+				}
+				continue
+			}
+			hasPlain = true
+			match = match || hasTag(tag)
+		}
+		if len(tagset) == 0 || hasPlain && !match {
+			return false
+		}
+	}
+	return true
+}
+
+// testTagSetSeries returns series of n hosts, spread over 4 regions and 5
+// racks.
+func testTagSetSeries(n int) []Series {
+	series := make([]Series, n)
+	for i := range series {
+		series[i] = NewSeries(testTable, fmt.Sprintf("cpu,hostname=host_%d,region=region_%d,rack=%d#usage_user#2016-01-01", i, i%4, i%5))
+	}
+	return series
+}
+
+func TestTagSetMatcherSemantics(t *testing.T) {
+	series := testTagSetSeries(20)
+	rng := rand.New(rand.NewSource(1))
+	randomTag := func() string {
+		var tag string
+		switch rng.Intn(4) {
+		case 0:
+			tag = fmt.Sprintf("hostname=host_%d", rng.Intn(25))
+		case 1:
+			tag = fmt.Sprintf("region=region_%d", rng.Intn(5))
+		case 2:
+			tag = fmt.Sprintf("rack=%d", rng.Intn(6))
+		default:
+			tag = fmt.Sprintf("hostname=~/^host_%d/", rng.Intn(3))
+		}
+		if rng.Intn(3) == 0 {
+			tag = tagNegationPrefix + tag
+		}
+		return tag
+	}
+	for i := 0; i < 500; i++ {
+		tagsets := make([][]string, rng.Intn(4))
+		for j := range tagsets {
+			tagsets[j] = []string{}
+			for k := rng.Intn(8); k > 0; k-- {
+				tagsets[j] = append(tagsets[j], randomTag())
+			}
+		}
+		m, err := NewTagSetMatcher(tagsets)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", tagsets, err)
+		}
+		for _, s := range series {
+			if got, want := m.Matches(&s), referenceMatchesTagSets(&s, tagsets); got != want {
+				t.Errorf("%v: incorrect match of %s: got %v want %v", tagsets, s.Id, got, want)
+			}
+		}
+	}
+}
+
+// BenchmarkTagSetMatcher matches series against 3 AND-groups of tagsets,
+// each ORing a number of values, with a TagSetMatcher and with the lookup of
+// each tag of referenceMatchesTagSets (without its regular expressions).
+func BenchmarkTagSetMatcher(b *testing.B) {
+	series := testTagSetSeries(1000)
+	for _, values := range []int{1, 10, 100, 1000} {
+		tagsets := make([][]string, 3)
+		for i := 0; i < values; i++ {
+			tagsets[0] = append(tagsets[0], fmt.Sprintf("hostname=host_%d", i))
+			tagsets[1] = append(tagsets[1], fmt.Sprintf("region=region_%d", i))
+			tagsets[2] = append(tagsets[2], fmt.Sprintf("rack=%d", i))
+		}
+		m, err := NewTagSetMatcher(tagsets)
+		if err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+		b.Run(fmt.Sprintf("values=%d/matcher", values), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for j := range series {
+					m.Matches(&series[j])
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("values=%d/reference", values), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for j := range series {
+					referenceMatchesTagSets(&series[j], tagsets)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchSeriesCollection(t *testing.T) {
+	ids := map[string][]string{
+		"series_double": {"cpu,hostname=host_0#usage_user#2016-01-01", "cpu,hostname=host_1#usage_user#2016-01-01"},
+		"series_bigint": {"mem,hostname=host_0#total#2016-01-01"},
+	}
+	qe := &mockQueryExecutor{respond: func(stmt string, _ []interface{}) ([][]interface{}, error) {
+		rows := [][]interface{}{}
+		table := strings.TrimPrefix(stmt, "SELECT DISTINCT series_id FROM ")
+		for _, id := range ids[table] {
+			rows = append(rows, []interface{}{id})
+		}
+		return rows, nil
+	}}
+	series, err := FetchSeriesCollection(context.Background(), qe)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := qe.Calls(); got != len(BlessedTables) {
+		t.Errorf("incorrect number of CQL queries: got %d want %d", got, len(BlessedTables))
+	}
+	got := map[string][]string{}
+	for _, s := range series {
+		got[s.Table] = append(got[s.Table], s.Id)
+	}
+	if !reflect.DeepEqual(got, ids) {
+		t.Errorf("incorrect series: got %v want %v", got, ids)
+	}
+
+	// the tables of each of several keyspaces are read:
+	qe = &mockQueryExecutor{respond: func(stmt string, _ []interface{}) ([][]interface{}, error) {
+		if stmt != "SELECT DISTINCT series_id FROM tenant_1.series_double" {
+			return nil, nil
+		}
+		return [][]interface{}{{ids["series_double"][0]}}, nil
+	}}
+	series, err = FetchSeriesCollection(context.Background(), qe, "tenant_0", "tenant_1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := qe.Calls(); got != 2*len(BlessedTables) {
+		t.Errorf("keyspaces: incorrect number of CQL queries: got %d want %d", got, 2*len(BlessedTables))
+	}
+	if len(series) != 1 || series[0].Keyspace != "tenant_1" || series[0].Table != "series_double" {
+		t.Errorf("keyspaces: incorrect series: got %+v", series)
+	}
+
+	// errors are returned rather than fatal, naming the table:
+	qe = &mockQueryExecutor{respond: func(string, []interface{}) ([][]interface{}, error) {
+		return nil, errors.New("unconfigured table")
+	}}
+	if _, err := FetchSeriesCollection(context.Background(), qe); err == nil || !strings.Contains(err.Error(), BlessedTables[0]) {
+		t.Errorf("incorrect error: got %v", err)
+	}
+}
@@ -1,23 +1,205 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/gocql/gocql"
 )
 
+// SessionOptions configures the sessions made by NewCassandraSession.
+type SessionOptions struct {
+	Consistency    gocql.Consistency
+	DCAwareRouting bool                // prefer hosts in LocalDC
+	LocalDC        string              // only used with DCAwareRouting
+	TokenAware     bool                // prefer replicas of the partition key of each query
+	ConnsPerHost   int                 // connections to each host, if positive
+	TLS            *gocql.SslOptions   // encrypts the connections, if set
+	Authenticator  gocql.Authenticator // of the connections, if set (see newAuthenticator)
+
+	// ConnectTimeout bounds the initial dial to each host, and the probe
+	// query run on new sessions, if positive.
+	ConnectTimeout time.Duration
+}
+
 // NewCassandraSession creates a new Cassandra session. It is goroutine-safe
-// by default, and uses a connection pool.
-func NewCassandraSession(daemonURL, keyspace string, timeout time.Duration) *gocql.Session {
-	cluster := gocql.NewCluster(daemonURL)
+// by default, and uses a connection pool. daemonURL is a comma-separated
+// list of hosts. It exits at once, with the unreachable hosts, if the
+// cluster cannot be queried.
+func NewCassandraSession(daemonURL, keyspace string, timeout time.Duration, opts SessionOptions) *gocql.Session {
+	session, err := newProbedSession(daemonURL, keyspace, timeout, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return session
+}
+
+// newProbedSession creates a new Cassandra session, and checks that it can
+// be queried with a trivial query.
+func newProbedSession(daemonURL, keyspace string, timeout time.Duration, opts SessionOptions) (*gocql.Session, error) {
+	cluster := newClusterConfig(daemonURL, keyspace, timeout, opts)
+	session, err := cluster.CreateSession()
+	if err == nil {
+		ctx := context.Background()
+		if opts.ConnectTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, opts.ConnectTimeout)
+			defer cancel()
+		}
+		err = session.Query(probeStatement).WithContext(ctx).Exec()
+		if err != nil {
+			session.Close()
+		}
+	}
+	if err != nil {
+		return nil, &ConnectError{
+			Hosts:       cluster.Hosts,
+			Keyspace:    keyspace,
+			Unreachable: unreachableHosts(cluster.Hosts, cluster.Port, cluster.ConnectTimeout),
+			AuthFailed:  isAuthError(err),
+			Err:         err,
+		}
+	}
+	return session, nil
+}
+
+// checkKeyspace fails if the keyspace does not exist in the cluster that qe
+// queries.
+func checkKeyspace(ctx context.Context, qe QueryExecutor, keyspace string) error {
+	iter := qe.Query(ctx, "SELECT keyspace_name FROM system_schema.keyspaces WHERE keyspace_name = ?", keyspace)
+	var name string
+	found := iter.Scan(&name)
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("cannot look up keyspace %q: %v", keyspace, err)
+	}
+	if !found {
+		return fmt.Errorf("keyspace %q does not exist", keyspace)
+	}
+	return nil
+}
+
+// A ConnectError is returned when a new session cannot query the cluster.
+type ConnectError struct {
+	Hosts       []string
+	Keyspace    string
+	Unreachable []string // hosts that could not be dialled
+	AuthFailed  bool     // the cluster rejected the credentials, or requires some
+	Err         error
+}
+
+func (e *ConnectError) Error() string {
+	msg := fmt.Sprintf("cannot query keyspace %q on Cassandra hosts %s: %v", e.Keyspace, strings.Join(e.Hosts, ","), e.Err)
+	if len(e.Unreachable) > 0 {
+		msg += fmt.Sprintf(" (unreachable hosts: %s)", strings.Join(e.Unreachable, ", "))
+	}
+	if e.AuthFailed {
+		msg += fmt.Sprintf(" (authentication failed: check -username and -password, or %s and %s, and -auth-provider)", usernameEnv, passwordEnv)
+	}
+	return msg
+}
+
+// unreachableHosts returns the hosts that cannot be dialled within timeout,
+// on defaultPort if they have no port.
+func unreachableHosts(hosts []string, defaultPort int, timeout time.Duration) []string {
+	unreachable := []string{}
+	for _, h := range hosts {
+		addr := h
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			addr = net.JoinHostPort(h, fmt.Sprint(defaultPort))
+		}
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			unreachable = append(unreachable, h)
+			continue
+		}
+		conn.Close()
+	}
+	return unreachable
+}
+
+// newClusterConfig creates the configuration of the sessions made by
+// NewCassandraSession.
+func newClusterConfig(daemonURL, keyspace string, timeout time.Duration, opts SessionOptions) *gocql.ClusterConfig {
+	cluster := gocql.NewCluster(strings.Split(daemonURL, ",")...)
 	cluster.Keyspace = keyspace
-	cluster.Consistency = gocql.One
+	cluster.Consistency = opts.Consistency
 	cluster.ProtoVersion = 4
 	cluster.Timeout = timeout
-	session, err := cluster.CreateSession()
+	if opts.ConnectTimeout > 0 {
+		cluster.ConnectTimeout = opts.ConnectTimeout
+	}
+	if opts.ConnsPerHost > 0 {
+		cluster.NumConns = opts.ConnsPerHost
+	}
+	var policy gocql.HostSelectionPolicy
+	if opts.DCAwareRouting {
+		policy = gocql.DCAwareRoundRobinPolicy(opts.LocalDC)
+	}
+	if opts.TokenAware {
+		// The routing key of prepared statements is bound from their
+		// partition key, i.e. the series_id of each CQLQuery.
+		if policy == nil {
+			policy = gocql.RoundRobinHostPolicy()
+		}
+		policy = gocql.TokenAwareHostPolicy(policy)
+	}
+	cluster.PoolConfig.HostSelectionPolicy = policy
+	cluster.SslOpts = opts.TLS
+	cluster.Authenticator = opts.Authenticator
+	return cluster
+}
+
+// describePool describes the connection pool of the sessions made by
+// NewCassandraSession with the given options, for a number of workers
+// sharing it.
+func describePool(daemonURL string, opts SessionOptions, workers uint) string {
+	cluster := newClusterConfig(daemonURL, "", 0, opts)
+	return fmt.Sprintf("CQL connection pool: %d connections per host (%d hosts given), shared by %d workers", cluster.NumConns, len(cluster.Hosts), workers)
+}
+
+// parseReadConsistency parses a consistency level for reads. Write-only
+// consistency levels (ANY, EACH_QUORUM) are rejected, as Cassandra would
+// reject every query using them.
+func parseReadConsistency(s string) (gocql.Consistency, error) {
+	c, err := gocql.ParseConsistencyWrapper(s)
 	if err != nil {
-		log.Fatal(err)
+		return c, err
 	}
-	return session
+	if c == gocql.Any || c == gocql.EachQuorum {
+		return c, fmt.Errorf("consistency %s is not supported for reads", c)
+	}
+	return c, nil
+}
+
+// A QueryExecutor executes CQL statements. It abstracts over gocql.Session
+// so that query plans can be executed against a mock in tests. Statements
+// are cancelled when their context is done.
+type QueryExecutor interface {
+	Query(ctx context.Context, stmt string, args ...interface{}) ResultIter
+}
+
+// A ResultIter iterates over the rows returned by a CQL statement. It is
+// satisfied by *gocql.Iter.
+type ResultIter interface {
+	Scan(dest ...interface{}) bool
+	Close() error
+}
+
+// gocqlQueryExecutor is a QueryExecutor backed by a gocql.Session.
+type gocqlQueryExecutor struct {
+	session *gocql.Session
+}
+
+// NewGocqlQueryExecutor wraps a gocql.Session as a QueryExecutor.
+func NewGocqlQueryExecutor(session *gocql.Session) QueryExecutor {
+	return &gocqlQueryExecutor{session: session}
+}
+
+// Query executes a CQL statement and returns an iterator over its rows.
+func (e *gocqlQueryExecutor) Query(ctx context.Context, stmt string, args ...interface{}) ResultIter {
+	return gocqlIter(ctx, e.session, e.session.Query(stmt, args...))
 }
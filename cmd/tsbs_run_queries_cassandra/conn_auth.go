@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gocql/gocql"
+	"github.com/spf13/viper"
+)
+
+// Environment variables of the credentials, read if -username and -password
+// are not set, so that they do not show in process listings.
+const (
+	usernameEnv = "CASSANDRA_USERNAME"
+	passwordEnv = "CASSANDRA_PASSWORD"
+)
+
+// credential returns the value of the flag key, e.g. set on the command
+// line or by its TSBS_ environment variable (see utils.BindEnv), falling
+// back to the environment variable env if it is empty.
+func credential(key, env string) string {
+	if v := viper.GetString(key); len(v) > 0 {
+		return v
+	}
+	return os.Getenv(env)
+}
+
+// authProviders are the authenticators that -auth-provider selects, by
+// name. Other authenticators (e.g. GSSAPI) are added here, building their
+// gocql.Authenticator from the credentials.
+var authProviders = map[string]func(username, password string) (gocql.Authenticator, error){
+	"password": func(username, password string) (gocql.Authenticator, error) {
+		if len(username) == 0 {
+			return nil, fmt.Errorf("the password authenticator needs a username")
+		}
+		return gocql.PasswordAuthenticator{Username: username, Password: password}, nil
+	},
+}
+
+// newAuthenticator returns the authenticator of the sessions made by
+// NewCassandraSession, from the provider of that name and the credentials.
+// It returns nil, i.e. no authentication, without credentials.
+func newAuthenticator(provider, username, password string) (gocql.Authenticator, error) {
+	if len(username) == 0 && len(password) == 0 {
+		return nil, nil
+	}
+	newAuth, ok := authProviders[provider]
+	if !ok {
+		names := make([]string, 0, len(authProviders))
+		for name := range authProviders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown auth provider %q (choices: %s)", provider, strings.Join(names, ", "))
+	}
+	return newAuth(username, password)
+}
+
+// isAuthError reports whether a session could not be created because the
+// cluster rejected its credentials, or requires some.
+func isAuthError(err error) bool {
+	// (0x0100 is the code of the bad credentials errors of the protocol)
+	if reqErr, ok := err.(gocql.RequestError); ok && reqErr.Code() == 0x0100 {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "authentication") || strings.Contains(msg, "username and/or password")
+}
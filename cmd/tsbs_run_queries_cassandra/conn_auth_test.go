@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/spf13/viper"
+)
+
+func TestNewAuthenticator(t *testing.T) {
+	auth, err := newAuthenticator("password", "", "")
+	if err != nil || auth != nil {
+		t.Errorf("no credentials: got %v (%v) want nil", auth, err)
+	}
+
+	auth, err = newAuthenticator("password", "cassandra", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cluster := newClusterConfig("localhost:9042", "benchmark", time.Second, SessionOptions{Authenticator: auth})
+	want := gocql.PasswordAuthenticator{Username: "cassandra", Password: "secret"}
+	if got, ok := cluster.Authenticator.(gocql.PasswordAuthenticator); !ok || got != want {
+		t.Errorf("incorrect authenticator: got %#v want %#v", cluster.Authenticator, want)
+	}
+
+	if _, err := newAuthenticator("password", "", "secret"); err == nil {
+		t.Errorf("password without username: expected an error")
+	}
+	if _, err := newAuthenticator("gssapi", "cassandra", "secret"); err == nil || !strings.Contains(err.Error(), "choices: password") {
+		t.Errorf("unknown provider: incorrect error: %v", err)
+	}
+}
+
+func TestConnectErrorAuthFailed(t *testing.T) {
+	err := errors.New("authentication required (using \"org.apache.cassandra.auth.PasswordAuthenticator\")")
+	if !isAuthError(err) {
+		t.Errorf("not an authentication error: %v", err)
+	}
+	if isAuthError(errors.New("no connections were made when creating the session")) {
+		t.Errorf("unexpected authentication error")
+	}
+	cerr := &ConnectError{Hosts: []string{"localhost"}, Keyspace: "benchmark", AuthFailed: true, Err: err}
+	if msg := cerr.Error(); !strings.Contains(msg, "authentication failed: check -username and -password") {
+		t.Errorf("incorrect error message: %s", msg)
+	}
+}
+
+func TestCredential(t *testing.T) {
+	const env = "TSBS_TEST_CREDENTIAL"
+	defer os.Unsetenv(env)
+	defer viper.Set("username", viper.GetString("username"))
+	os.Setenv(env, "from_env")
+
+	viper.Set("username", "")
+	if got := credential("username", env); got != "from_env" {
+		t.Errorf("incorrect fallback: got %q want from_env", got)
+	}
+	// e.g. set by -username or TSBS_USERNAME:
+	viper.Set("username", "from_flag")
+	if got := credential("username", env); got != "from_flag" {
+		t.Errorf("incorrect credential: got %q want from_flag", got)
+	}
+}
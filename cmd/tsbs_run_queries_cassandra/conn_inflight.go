@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// inFlightLimiter is a QueryExecutor bounding the number of CQL statements
+// in flight at once across all workers, independently of their number and
+// of -subquery-parallelism. A statement holds its slot from its execution
+// until its iterator is closed, so that all of its pages are fetched under
+// the limit.
+type inFlightLimiter struct {
+	qe    QueryExecutor
+	slots chan struct{}
+
+	mu       sync.Mutex
+	inFlight int
+	max      int // of inFlight since the limiter was created
+}
+
+// newInFlightLimiter wraps a QueryExecutor so that at most limit statements
+// are in flight at once.
+func newInFlightLimiter(qe QueryExecutor, limit int) *inFlightLimiter {
+	return &inFlightLimiter{qe: qe, slots: make(chan struct{}, limit)}
+}
+
+// Query waits for a free slot, or until ctx is done, then executes the
+// statement.
+func (l *inFlightLimiter) Query(ctx context.Context, stmt string, args ...interface{}) ResultIter {
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return &errIter{err: ctx.Err()}
+	}
+	l.mu.Lock()
+	l.inFlight++
+	if l.inFlight > l.max {
+		l.max = l.inFlight
+	}
+	l.mu.Unlock()
+	return &inFlightIter{iter: l.qe.Query(ctx, stmt, args...), l: l}
+}
+
+// MaxInFlight returns the maximum number of statements observed in flight
+// at once.
+func (l *inFlightLimiter) MaxInFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.max
+}
+
+func (l *inFlightLimiter) release() {
+	l.mu.Lock()
+	l.inFlight--
+	l.mu.Unlock()
+	<-l.slots
+}
+
+// inFlightIter is the ResultIter of an inFlightLimiter, releasing the slot
+// of its statement when it is closed.
+type inFlightIter struct {
+	iter   ResultIter
+	l      *inFlightLimiter
+	closed bool
+}
+
+// Scan copies the columns of the next row into dest.
+func (it *inFlightIter) Scan(dest ...interface{}) bool {
+	return it.iter.Scan(dest...)
+}
+
+// Close closes the underlying iterator and releases the slot, once.
+func (it *inFlightIter) Close() error {
+	err := it.iter.Close()
+	if !it.closed {
+		it.closed = true
+		it.l.release()
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingQueryExecutor is a QueryExecutor counting the statements whose
+// iterators are not closed yet, and the maximum of them.
+type countingQueryExecutor struct {
+	mu     sync.Mutex
+	active int
+	max    int
+	calls  int
+}
+
+func (e *countingQueryExecutor) Query(ctx context.Context, stmt string, args ...interface{}) ResultIter {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.calls++
+	e.active++
+	if e.active > e.max {
+		e.max = e.active
+	}
+	return &countingIter{e: e}
+}
+
+func (e *countingQueryExecutor) stats() (calls, max int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.calls, e.max
+}
+
+type countingIter struct {
+	e *countingQueryExecutor
+}
+
+func (it *countingIter) Scan(dest ...interface{}) bool { return false }
+
+func (it *countingIter) Close() error {
+	it.e.mu.Lock()
+	it.e.active--
+	it.e.mu.Unlock()
+	return nil
+}
+
+func TestInFlightLimiter(t *testing.T) {
+	const limit, queries = 3, 10
+	inner := &countingQueryExecutor{}
+	l := newInFlightLimiter(inner, limit)
+
+	// each query is blocked between its execution and its close:
+	unblock := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			iter := l.Query(context.Background(), "SELECT 1")
+			<-unblock
+			iter.Close()
+		}()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if calls, _ := inner.stats(); calls == limit {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queries did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if calls, _ := inner.stats(); calls != limit {
+		t.Errorf("incorrect queries executed while blocked: got %d want %d", calls, limit)
+	}
+
+	close(unblock)
+	wg.Wait()
+	calls, max := inner.stats()
+	if calls != queries {
+		t.Errorf("incorrect queries executed: got %d want %d", calls, queries)
+	}
+	if max != limit {
+		t.Errorf("incorrect max concurrent queries: got %d want %d", max, limit)
+	}
+	if got := l.MaxInFlight(); got != limit {
+		t.Errorf("incorrect max in flight: got %d want %d", got, limit)
+	}
+}
+
+func TestInFlightLimiterContextDone(t *testing.T) {
+	l := newInFlightLimiter(&countingQueryExecutor{}, 1)
+	held := l.Query(context.Background(), "SELECT 1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Query(ctx, "SELECT 1").Close(); err != context.DeadlineExceeded {
+		t.Errorf("incorrect error waiting for a slot: got %v want %v", err, context.DeadlineExceeded)
+	}
+
+	// closing twice releases the slot once:
+	held.Close()
+	held.Close()
+	iter := l.Query(context.Background(), "SELECT 1")
+	if err := iter.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got := len(l.slots); got != 0 {
+		t.Errorf("incorrect slots held: got %d want 0", got)
+	}
+}
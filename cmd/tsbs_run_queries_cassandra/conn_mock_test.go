@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// mockQueryExecutor is a QueryExecutor that answers each statement with the
+// rows (or error) produced by its respond function, after an optional delay.
+// The rows are paged as set by the queryPaging of the context, if any. It is
+// safe for concurrent use.
+type mockQueryExecutor struct {
+	respond func(stmt string, args []interface{}) ([][]interface{}, error)
+	delay   time.Duration // interrupted when the context is done
+	scanned int           // rows traced as scanned by each statement
+
+	mu    sync.Mutex
+	calls int
+}
+
+// Query records the call and returns an iterator over the mocked rows.
+func (e *mockQueryExecutor) Query(ctx context.Context, stmt string, args ...interface{}) ResultIter {
+	e.mu.Lock()
+	e.calls++
+	e.mu.Unlock()
+
+	if err := sleepContext(ctx, e.delay); err != nil {
+		return &mockIter{err: err}
+	}
+
+	rows, err := e.respond(stmt, args)
+	it := &mockIter{rows: rows, err: err}
+	if p := queryPagingFrom(ctx); p != nil {
+		p.addPage()
+		it.paging = p
+	}
+	if t := queryTracingFrom(ctx); t != nil {
+		t.addRows(e.scanned)
+	}
+	return it
+}
+
+// Calls returns the number of statements executed so far.
+func (e *mockQueryExecutor) Calls() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.calls
+}
+
+// mockIter is a ResultIter over a fixed set of rows, followed by an optional
+// error. If paging is set, the rows are split into pages of its pageSize,
+// each counted when its first row is scanned (the first is counted by the
+// mockQueryExecutor).
+type mockIter struct {
+	rows   [][]interface{}
+	pos    int
+	err    error
+	paging *queryPaging
+}
+
+// Scan copies the columns of the next row into dest.
+func (it *mockIter) Scan(dest ...interface{}) bool {
+	if it.pos >= len(it.rows) {
+		return false
+	}
+	if p := it.paging; p != nil && p.pageSize > 0 && it.pos > 0 && it.pos%p.pageSize == 0 {
+		p.addPage()
+	}
+	row := it.rows[it.pos]
+	it.pos++
+	for i, d := range dest {
+		switch d := d.(type) {
+		case *float64:
+			*d = row[i].(float64)
+		case **float64:
+			if row[i] == nil {
+				*d = nil
+			} else {
+				v := row[i].(float64)
+				*d = &v
+			}
+		case *int64:
+			*d = row[i].(int64)
+		case *string:
+			*d = row[i].(string)
+		default:
+			panic(fmt.Sprintf("mockIter: unsupported scan type %T", d))
+		}
+	}
+	return true
+}
+
+// Close returns the mocked error, if any.
+func (it *mockIter) Close() error {
+	return it.err
+}
+
+// mockPreparer is a Preparer whose statements are executed by a
+// mockQueryExecutor. It counts Prepare calls and can fail them.
+type mockPreparer struct {
+	qe  *mockQueryExecutor
+	err error
+
+	mu       sync.Mutex
+	prepares int
+}
+
+// Prepare records the call and returns a statement bound to stmt.
+func (p *mockPreparer) Prepare(stmt string) (PreparedStatement, error) {
+	p.mu.Lock()
+	p.prepares++
+	p.mu.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &mockStatement{qe: p.qe, stmt: stmt}, nil
+}
+
+// Prepares returns the number of statements prepared so far.
+func (p *mockPreparer) Prepares() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.prepares
+}
+
+// mockStatement is the PreparedStatement of a mockPreparer.
+type mockStatement struct {
+	qe   *mockQueryExecutor
+	stmt string
+}
+
+func (s *mockStatement) Query(ctx context.Context, args ...interface{}) ResultIter {
+	return s.qe.Query(ctx, s.stmt, args...)
+}
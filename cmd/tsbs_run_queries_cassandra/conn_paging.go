@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/gocql/gocql"
+)
+
+// queryPaging sets the page size of the statements executed with a context
+// (see withQueryPaging), and counts the pages they fetch. It is carried by
+// the context so that it passes through QueryExecutor wrappers (retries,
+// prepared statements) unchanged.
+type queryPaging struct {
+	pageSize int   // rows per page, or the session default if not positive
+	pages    int64 // accessed atomically
+}
+
+type queryPagingKey struct{}
+
+// withQueryPaging returns a context whose statements are paged by p.
+func withQueryPaging(ctx context.Context, p *queryPaging) context.Context {
+	return context.WithValue(ctx, queryPagingKey{}, p)
+}
+
+// queryPagingFrom returns the queryPaging of a context, or nil if it has
+// none.
+func queryPagingFrom(ctx context.Context) *queryPaging {
+	p, _ := ctx.Value(queryPagingKey{}).(*queryPaging)
+	return p
+}
+
+// Pages returns the number of pages fetched so far.
+func (p *queryPaging) Pages() int {
+	return int(atomic.LoadInt64(&p.pages))
+}
+
+func (p *queryPaging) addPage() {
+	atomic.AddInt64(&p.pages, 1)
+}
+
+// gocqlIter executes a gocql.Query of the session with the context,
+// applying and counting the pages of its queryPaging if any, and tracing it
+// for its queryTracing if any.
+func gocqlIter(ctx context.Context, session *gocql.Session, q *gocql.Query) ResultIter {
+	q = q.WithContext(ctx)
+	if t := queryTracingFrom(ctx); t != nil {
+		q = q.Trace(&rowsTracer{session: session, tracing: t})
+	}
+	p := queryPagingFrom(ctx)
+	if p == nil {
+		return q.Iter()
+	}
+	if p.pageSize > 0 {
+		q = q.PageSize(p.pageSize)
+	}
+	// the first page is fetched by Iter:
+	p.addPage()
+	return &pagingIter{iter: q.Iter(), paging: p}
+}
+
+// pagingIter is a ResultIter over a *gocql.Iter counting the pages it
+// fetches.
+type pagingIter struct {
+	iter   *gocql.Iter
+	paging *queryPaging
+}
+
+// Scan copies the columns of the next row into dest, counting the page
+// fetched if it is the first of a page.
+func (it *pagingIter) Scan(dest ...interface{}) bool {
+	if it.iter.WillSwitchPage() {
+		it.paging.addPage()
+	}
+	return it.iter.Scan(dest...)
+}
+
+// Close closes the underlying iterator.
+func (it *pagingIter) Close() error {
+	return it.iter.Close()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueryPaging(t *testing.T) {
+	// 2 series, each with 3 points in the day:
+	csi := newTestClientSideIndex(2, 1, "usage_user")
+	cases := []struct {
+		desc      string
+		pageSize  int
+		wantPages int
+	}{
+		{desc: "default page size", pageSize: 0, wantPages: 2},
+		{desc: "one row per page", pageSize: 1, wantPages: 6},
+		{desc: "several pages", pageSize: 2, wantPages: 4},
+		{desc: "a single full page", pageSize: 3, wantPages: 2},
+		{desc: "a single partial page", pageSize: 10, wantPages: 2},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery("", "usage_user", testStart, testStart.Add(day), 0)
+		qp, err := q.ToQueryPlanRaw(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		paging := &queryPaging{pageSize: c.pageSize}
+		ctx := withQueryPaging(context.Background(), paging)
+		results, err := qp.Execute(ctx, &mockQueryExecutor{respond: rawRows})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if got := paging.Pages(); got != c.wantPages {
+			t.Errorf("%s: incorrect number of pages: got %d want %d", c.desc, got, c.wantPages)
+		}
+		// all pages are drained:
+		for _, r := range results {
+			if got := len(r.Points); got != 3 {
+				t.Errorf("%s: incorrect number of points of %s: got %d want %d", c.desc, r.Series, got, 3)
+			}
+		}
+	}
+}
+
+func TestHLQueryExecutorPageSize(t *testing.T) {
+	csi := newTestClientSideIndex(2, 1, "usage_user")
+	hlqe := NewHLQueryExecutor(&mockQueryExecutor{respond: rawRows}, csi, 0)
+	opts := HLQueryExecutorDoOptions{
+		AggregationPlan: AggrPlanTypeWithoutServerAggregation,
+		PageSize:        1,
+	}
+
+	// the page size only applies to raw queries:
+	for _, c := range []struct {
+		aggr      string
+		wantPages int
+	}{
+		{aggr: "", wantPages: 6},
+		{aggr: "max", wantPages: 2},
+	} {
+		q := newTestHLQuery(c.aggr, "usage_user", testStart, testStart.Add(day), time.Hour)
+		_, _, info, err := hlqe.Do(q, opts)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", c.aggr, err)
+		}
+		if info.Pages != c.wantPages {
+			t.Errorf("%q: incorrect number of pages: got %d want %d", c.aggr, info.Pages, c.wantPages)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gocql/gocql"
+)
+
+// A Preparer prepares CQL statements for repeated execution.
+type Preparer interface {
+	Prepare(stmt string) (PreparedStatement, error)
+}
+
+// A PreparedStatement is a CQL statement that can be executed with different
+// arguments.
+type PreparedStatement interface {
+	Query(ctx context.Context, args ...interface{}) ResultIter
+}
+
+// NewGocqlPreparer wraps a gocql.Session as a Preparer.
+func NewGocqlPreparer(session *gocql.Session) Preparer {
+	return &gocqlQueryExecutor{session: session}
+}
+
+// errPrepared aborts the execution of a statement once the driver has
+// prepared it (see gocqlQueryExecutor.Prepare).
+var errPrepared = errors.New("prepared")
+
+// Prepare prepares stmt on a connection of the session, returning the error
+// of Cassandra if it is invalid, e.g. for a missing table. gocql has no API
+// to only prepare a statement: it is bound without executing it, which
+// prepares it first. The driver then keeps the prepared statement of each
+// connection, that later queries of the statement execute without preparing
+// it again there.
+func (e *gocqlQueryExecutor) Prepare(stmt string) (PreparedStatement, error) {
+	var args int
+	err := e.session.Bind(stmt, func(info *gocql.QueryInfo) ([]interface{}, error) {
+		args = len(info.Args)
+		return nil, errPrepared
+	}).Exec()
+	if err != errPrepared {
+		if err == nil {
+			// not a statement that the driver prepares:
+			err = fmt.Errorf("cannot prepare %q", stmt)
+		}
+		return nil, err
+	}
+	return &gocqlStatement{session: e.session, stmt: stmt, args: args}, nil
+}
+
+// gocqlStatement is the PreparedStatement of a gocqlQueryExecutor.
+type gocqlStatement struct {
+	session *gocql.Session
+	stmt    string
+	args    int // bound by the statement, as prepared
+}
+
+// Query executes the statement with the given arguments.
+func (s *gocqlStatement) Query(ctx context.Context, args ...interface{}) ResultIter {
+	if len(args) != s.args {
+		return &errIter{err: fmt.Errorf("%q binds %d arguments, got %d", s.stmt, s.args, len(args))}
+	}
+	return gocqlIter(ctx, s.session, s.session.Query(s.stmt, args...))
+}
+
+// preparedStatementCache is a QueryExecutor that prepares each distinct
+// statement (i.e. each PreparableQueryString) once, and reuses it for all
+// later queries. It is safe for concurrent use.
+type preparedStatementCache struct {
+	p Preparer
+
+	mu    sync.Mutex
+	stmts map[string]*cachedStatement
+
+	hits   uint64 // accessed atomically
+	misses uint64 // accessed atomically
+}
+
+// cachedStatement is an entry of a preparedStatementCache. Concurrent
+// lookups of a new statement all wait for the same Prepare call.
+type cachedStatement struct {
+	once sync.Once
+	ps   PreparedStatement
+	err  error
+}
+
+func newPreparedStatementCache(p Preparer) *preparedStatementCache {
+	return &preparedStatementCache{
+		p:     p,
+		stmts: make(map[string]*cachedStatement),
+	}
+}
+
+// Query executes a CQL statement, preparing it first if it is not cached.
+func (c *preparedStatementCache) Query(ctx context.Context, stmt string, args ...interface{}) ResultIter {
+	ps, err := c.prepared(stmt)
+	if err != nil {
+		return &errIter{err: err}
+	}
+	return ps.Query(ctx, args...)
+}
+
+// prepared returns the cached PreparedStatement of stmt. Failed statements
+// are evicted so that they are prepared again on the next query.
+func (c *preparedStatementCache) prepared(stmt string) (PreparedStatement, error) {
+	c.mu.Lock()
+	cs, ok := c.stmts[stmt]
+	if !ok {
+		cs = &cachedStatement{}
+		c.stmts[stmt] = cs
+	}
+	c.mu.Unlock()
+
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	cs.once.Do(func() {
+		cs.ps, cs.err = c.p.Prepare(stmt)
+	})
+	if cs.err != nil {
+		c.mu.Lock()
+		if c.stmts[stmt] == cs {
+			delete(c.stmts, stmt)
+		}
+		c.mu.Unlock()
+	}
+	return cs.ps, cs.err
+}
+
+// Stats returns the number of cache hits and misses so far.
+func (c *preparedStatementCache) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// errIter is a ResultIter of a statement that could not be executed.
+type errIter struct {
+	err error
+}
+
+func (it *errIter) Scan(dest ...interface{}) bool { return false }
+
+func (it *errIter) Close() error { return it.err }
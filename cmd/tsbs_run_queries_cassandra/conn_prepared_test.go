@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPreparedStatementCachePreparesOnce(t *testing.T) {
+	csi := newTestClientSideIndex(10, 2, "usage_user")
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(36*time.Hour), time.Hour)
+	qp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mqe := &mockQueryExecutor{respond: serverAggregationRows}
+	p := &mockPreparer{qe: mqe}
+	cache := newPreparedStatementCache(p)
+	qp.MaxConcurrency = 8
+	if _, err := qp.Execute(context.Background(), cache); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	n := mqe.Calls()
+	if n < 2 {
+		t.Fatalf("too few queries executed: got %d", n)
+	}
+	if got := p.Prepares(); got != 1 {
+		t.Errorf("incorrect number of prepares for %d queries: got %d want %d", n, got, 1)
+	}
+	hits, misses := cache.Stats()
+	if hits != uint64(n-1) || misses != 1 {
+		t.Errorf("incorrect stats: got %d hits, %d misses want %d hits, %d misses", hits, misses, n-1, 1)
+	}
+}
+
+func TestPreparedStatementCachePrepareError(t *testing.T) {
+	wantErr := errors.New("mock failure")
+	p := &mockPreparer{qe: &mockQueryExecutor{respond: serverAggregationRows}, err: wantErr}
+	cache := newPreparedStatementCache(p)
+
+	for i := 0; i < 2; i++ {
+		iter := cache.Query(context.Background(), "SELECT 1")
+		if iter.Scan() {
+			t.Errorf("scan of a failed statement returned a row")
+		}
+		if err := iter.Close(); err != wantErr {
+			t.Errorf("incorrect error: got %v want %v", err, wantErr)
+		}
+	}
+	// failed statements are not cached:
+	if got := p.Prepares(); got != 2 {
+		t.Errorf("incorrect number of prepares: got %d want %d", got, 2)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// probeStatement is the trivial CQL query probing new sessions, and
+// prewarming their connection pool.
+const probeStatement = "SELECT now() FROM system.local"
+
+// peersStatement lists the other nodes of the cluster of the node queried,
+// which gocql discovers and connects to besides the hosts given.
+const peersStatement = "SELECT peer FROM system.peers"
+
+// clusterHosts returns the number of nodes of the cluster that qe queries:
+// the node queried and its peers.
+func clusterHosts(ctx context.Context, qe QueryExecutor) (int, error) {
+	iter := qe.Query(ctx, peersStatement)
+	n := 1
+	var peer string
+	for iter.Scan(&peer) {
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// poolSize returns the number of connections of the pool of the sessions
+// made by NewCassandraSession with the given options to a cluster of hosts
+// nodes (see clusterHosts): the connections per host times the hosts.
+func poolSize(daemonURL string, opts SessionOptions, hosts int) int {
+	cluster := newClusterConfig(daemonURL, "", 0, opts)
+	return cluster.NumConns * hosts
+}
+
+// prewarmPool issues n trivial queries at once through qe (set by
+// -prewarm-pool), so that gocql, which otherwise dials the connections of its
+// pool lazily, has them established before the benchmark clock starts,
+// rather than the first queries paying their setup. It returns the first
+// error of the queries.
+//
+// This is a best effort: gocql picks the host and connection of each query,
+// so that n queries at once are not guaranteed to land on n connections.
+func prewarmPool(ctx context.Context, qe QueryExecutor, n int) error {
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			iter := qe.Query(ctx, probeStatement)
+			for iter.Scan() {
+			}
+			errs <- iter.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
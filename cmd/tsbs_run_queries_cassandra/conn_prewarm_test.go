@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrewarmPool(t *testing.T) {
+	opts := SessionOptions{ConnsPerHost: 3}
+	// a single contact point of a cluster of two nodes:
+	peers := &mockQueryExecutor{respond: func(stmt string, args []interface{}) ([][]interface{}, error) {
+		if stmt != peersStatement {
+			t.Errorf("incorrect statement: got %s want %s", stmt, peersStatement)
+		}
+		return [][]interface{}{{"10.0.0.2"}}, nil
+	}}
+	hosts, err := clusterHosts(context.Background(), peers)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	n := poolSize("host0", opts, hosts)
+	if n != 6 {
+		t.Errorf("incorrect pool size: got %d want 6", n)
+	}
+
+	// each query waits for all of the others, which are thus in flight at
+	// once, as needed to open all the connections:
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	qe := &mockQueryExecutor{respond: func(stmt string, args []interface{}) ([][]interface{}, error) {
+		if stmt != probeStatement {
+			t.Errorf("incorrect statement: got %s want %s", stmt, probeStatement)
+		}
+		arrived.Done()
+		done := make(chan struct{})
+		go func() {
+			arrived.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("queries not in flight at once")
+		}
+		return [][]interface{}{{int64(0)}}, nil
+	}}
+	if err := prewarmPool(context.Background(), qe, n); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := qe.Calls(); got < opts.ConnsPerHost*2 {
+		t.Errorf("incorrect number of queries: got %d want at least %d", got, opts.ConnsPerHost*2)
+	}
+
+	failing := &mockQueryExecutor{respond: func(string, []interface{}) ([][]interface{}, error) {
+		return nil, errors.New("unavailable")
+	}}
+	if err := prewarmPool(context.Background(), failing, n); err == nil || err.Error() != "unavailable" {
+		t.Errorf("incorrect error: got %v want unavailable", err)
+	}
+}
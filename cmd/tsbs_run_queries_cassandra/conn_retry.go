@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// retryingQueryExecutor is a QueryExecutor that retries statements failing
+// with transient errors (see isRetriableError), with exponential backoff
+// and jitter between attempts. Other errors are returned immediately.
+type retryingQueryExecutor struct {
+	qe          QueryExecutor
+	maxRetries  int
+	backoffBase time.Duration
+	sleep       func(context.Context, time.Duration) error // replaced in tests
+
+	retries uint64 // accessed atomically
+}
+
+// newRetryingQueryExecutor wraps a QueryExecutor so that each statement is
+// retried up to maxRetries times.
+func newRetryingQueryExecutor(qe QueryExecutor, maxRetries int, backoffBase time.Duration) *retryingQueryExecutor {
+	return &retryingQueryExecutor{
+		qe:          qe,
+		maxRetries:  maxRetries,
+		backoffBase: backoffBase,
+		sleep:       sleepContext,
+	}
+}
+
+// sleepContext pauses for the given duration, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Query executes a CQL statement and returns an iterator over its rows that
+// transparently retries the statement.
+func (e *retryingQueryExecutor) Query(ctx context.Context, stmt string, args ...interface{}) ResultIter {
+	return &retryingIter{
+		e:    e,
+		ctx:  ctx,
+		stmt: stmt,
+		args: args,
+		iter: e.qe.Query(ctx, stmt, args...),
+	}
+}
+
+// Retries returns the total number of retries made so far.
+func (e *retryingQueryExecutor) Retries() uint64 {
+	return atomic.LoadUint64(&e.retries)
+}
+
+// backoff returns the delay before the given retry (starting at 0): the
+// base delay doubled for each previous attempt, half of which is jitter.
+func (e *retryingQueryExecutor) backoff(attempt int) time.Duration {
+	d := e.backoffBase << uint(attempt)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// isRetriableError reports whether an error is transient, i.e. the same
+// statement may succeed if it is executed again.
+func isRetriableError(err error) bool {
+	switch err.(type) {
+	case *gocql.RequestErrUnavailable, *gocql.RequestErrReadTimeout:
+		return true
+	}
+	return err == gocql.ErrTimeoutNoResponse || err == gocql.ErrConnectionClosed || err == gocql.ErrNoConnections
+}
+
+// retryingIter is the ResultIter of a retryingQueryExecutor.
+//
+// A failed statement is only retried if none of its rows have been scanned
+// yet, since callers consume rows as they go; a failure after that point is
+// returned as is. Retries stop once the context of the statement is done.
+type retryingIter struct {
+	e       *retryingQueryExecutor
+	ctx     context.Context
+	stmt    string
+	args    []interface{}
+	iter    ResultIter
+	attempt int
+	rows    int
+
+	closed bool
+	err    error
+}
+
+// Scan copies the columns of the next row into dest, retrying the statement
+// if it failed before returning any rows.
+func (it *retryingIter) Scan(dest ...interface{}) bool {
+	if it.closed {
+		return false
+	}
+	for {
+		if it.iter.Scan(dest...) {
+			it.rows++
+			return true
+		}
+		err := it.iter.Close()
+		if err == nil || it.rows > 0 || it.attempt >= it.e.maxRetries || !isRetriableError(err) {
+			it.closed = true
+			it.err = err
+			return false
+		}
+		if err := it.e.sleep(it.ctx, it.e.backoff(it.attempt)); err != nil {
+			it.closed = true
+			it.err = err
+			return false
+		}
+		it.attempt++
+		atomic.AddUint64(&it.e.retries, 1)
+		if logs.Enabled(LogLevelWarn) {
+			fields := append(queryLogFields(it.ctx), "attempt", it.attempt, "err", err, "stmt", it.stmt)
+			logs.Log(LogLevelWarn, "retrying CQL query", fields...)
+		}
+		it.iter = it.e.qe.Query(it.ctx, it.stmt, it.args...)
+	}
+}
+
+// Close returns the error of the last attempt, if any.
+func (it *retryingIter) Close() error {
+	if it.closed {
+		return it.err
+	}
+	it.closed = true
+	it.err = it.iter.Close()
+	return it.err
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// failingRows returns a respond function for a mockQueryExecutor that fails
+// with err for the first n calls, and then returns rows.
+func failingRows(n int, err error, rows [][]interface{}) func(string, []interface{}) ([][]interface{}, error) {
+	var mu sync.Mutex
+	calls := 0
+	return func(string, []interface{}) ([][]interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls <= n {
+			return nil, err
+		}
+		return rows, nil
+	}
+}
+
+func scanAll(iter ResultIter) ([]float64, error) {
+	values := []float64{}
+	var x float64
+	for iter.Scan(&x) {
+		values = append(values, x)
+	}
+	return values, iter.Close()
+}
+
+func TestRetryingQueryExecutor(t *testing.T) {
+	rows := [][]interface{}{{1.0}, {2.0}}
+	errSyntax := errors.New("line 1:0 no viable alternative at input")
+	cases := []struct {
+		desc        string
+		failures    int
+		err         error
+		maxRetries  int
+		wantErr     error
+		wantCalls   int
+		wantRetries uint64
+	}{
+		{
+			desc:      "no failures",
+			wantCalls: 1,
+		},
+		{
+			desc:        "timeouts then success",
+			failures:    3,
+			err:         gocql.ErrTimeoutNoResponse,
+			maxRetries:  3,
+			wantCalls:   4,
+			wantRetries: 3,
+		},
+		{
+			desc:        "unavailable then success",
+			failures:    1,
+			err:         &gocql.RequestErrUnavailable{},
+			maxRetries:  3,
+			wantCalls:   2,
+			wantRetries: 1,
+		},
+		{
+			desc:        "too many timeouts",
+			failures:    5,
+			err:         gocql.ErrTimeoutNoResponse,
+			maxRetries:  2,
+			wantErr:     gocql.ErrTimeoutNoResponse,
+			wantCalls:   3,
+			wantRetries: 2,
+		},
+		{
+			desc:       "not retriable",
+			failures:   1,
+			err:        errSyntax,
+			maxRetries: 3,
+			wantErr:    errSyntax,
+			wantCalls:  1,
+		},
+	}
+	for _, c := range cases {
+		mock := &mockQueryExecutor{respond: failingRows(c.failures, c.err, rows)}
+		qe := newRetryingQueryExecutor(mock, c.maxRetries, time.Millisecond)
+		sleeps := []time.Duration{}
+		qe.sleep = func(_ context.Context, d time.Duration) error {
+			sleeps = append(sleeps, d)
+			return nil
+		}
+
+		values, err := scanAll(qe.Query(context.Background(), "SELECT value FROM t", "id"))
+		if err != c.wantErr {
+			t.Errorf("%s: incorrect error: got %v want %v", c.desc, err, c.wantErr)
+		}
+		if err == nil && len(values) != len(rows) {
+			t.Errorf("%s: incorrect number of rows: got %d want %d", c.desc, len(values), len(rows))
+		}
+		if got := mock.Calls(); got != c.wantCalls {
+			t.Errorf("%s: incorrect number of calls: got %d want %d", c.desc, got, c.wantCalls)
+		}
+		if got := qe.Retries(); got != c.wantRetries {
+			t.Errorf("%s: incorrect number of retries: got %d want %d", c.desc, got, c.wantRetries)
+		}
+
+		// each backoff is in [base * 2^n / 2, base * 2^n]
+		for i, d := range sleeps {
+			max := time.Millisecond << uint(i)
+			if d < max/2 || d > max {
+				t.Errorf("%s: backoff %d out of range: got %v want [%v, %v]", c.desc, i, d, max/2, max)
+			}
+		}
+	}
+}
+
+func TestRetryingQueryExecutorAfterRows(t *testing.T) {
+	// a failure after some rows have been consumed must not be retried, as
+	// the rows would be seen twice
+	mock := &mockQueryExecutor{respond: func(string, []interface{}) ([][]interface{}, error) {
+		return [][]interface{}{{1.0}}, gocql.ErrTimeoutNoResponse
+	}}
+	qe := newRetryingQueryExecutor(mock, 3, time.Millisecond)
+	qe.sleep = func(context.Context, time.Duration) error { return nil }
+
+	values, err := scanAll(qe.Query(context.Background(), "SELECT value FROM t", "id"))
+	if err != gocql.ErrTimeoutNoResponse {
+		t.Errorf("incorrect error: got %v want %v", err, gocql.ErrTimeoutNoResponse)
+	}
+	if len(values) != 1 {
+		t.Errorf("incorrect number of rows: got %d want %d", len(values), 1)
+	}
+	if got := mock.Calls(); got != 1 {
+		t.Errorf("incorrect number of calls: got %d want %d", got, 1)
+	}
+}
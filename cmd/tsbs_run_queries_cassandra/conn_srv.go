@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// srvResolver looks up DNS SRV records, as *net.Resolver does.
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// resolveSRVHosts resolves a DNS SRV record, e.g.
+// "_cql._tcp.cassandra.example.com", to a comma-separated list of the
+// host:port of its targets, as taken by NewCassandraSession. Targets are in
+// order of priority, then of weight, as returned by the resolver. It fails
+// if the record has no targets.
+func resolveSRVHosts(ctx context.Context, r srvResolver, record string) (string, error) {
+	_, addrs, err := r.LookupSRV(ctx, "", "", record)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve SRV record %s: %v", record, err)
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		if addrs[i].Priority != addrs[j].Priority {
+			return addrs[i].Priority < addrs[j].Priority
+		}
+		return addrs[i].Weight > addrs[j].Weight
+	})
+	hosts := []string{}
+	for _, a := range addrs {
+		target := strings.TrimSuffix(a.Target, ".")
+		// a target of "." means the service is not available at the name:
+		if len(target) == 0 {
+			continue
+		}
+		hosts = append(hosts, net.JoinHostPort(target, strconv.Itoa(int(a.Port))))
+	}
+	if len(hosts) == 0 {
+		return "", fmt.Errorf("SRV record %s has no targets", record)
+	}
+	return strings.Join(hosts, ","), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// stubSRVResolver is an srvResolver returning fixed targets for one name.
+type stubSRVResolver struct {
+	name  string
+	addrs []*net.SRV
+}
+
+func (r *stubSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if name != r.name {
+		return "", nil, errors.New("no such host")
+	}
+	return name, r.addrs, nil
+}
+
+func TestResolveSRVHosts(t *testing.T) {
+	const record = "_cql._tcp.cassandra.example.com"
+	cases := []struct {
+		desc    string
+		record  string
+		addrs   []*net.SRV
+		want    string
+		wantErr bool
+	}{
+		{
+			desc:   "two targets",
+			record: record,
+			addrs: []*net.SRV{
+				{Target: "node1.example.com.", Port: 9042, Priority: 10, Weight: 5},
+				{Target: "node2.example.com.", Port: 9142, Priority: 10, Weight: 5},
+			},
+			want: "node1.example.com:9042,node2.example.com:9142",
+		},
+		{
+			desc:   "ordered by priority then weight",
+			record: record,
+			addrs: []*net.SRV{
+				{Target: "backup.example.com.", Port: 9042, Priority: 20, Weight: 100},
+				{Target: "light.example.com.", Port: 9042, Priority: 10, Weight: 1},
+				{Target: "heavy.example.com.", Port: 9042, Priority: 10, Weight: 10},
+			},
+			want: "heavy.example.com:9042,light.example.com:9042,backup.example.com:9042",
+		},
+		{
+			desc:    "no targets",
+			record:  record,
+			addrs:   []*net.SRV{},
+			wantErr: true,
+		},
+		{
+			desc:    "service not available",
+			record:  record,
+			addrs:   []*net.SRV{{Target: ".", Port: 0}},
+			wantErr: true,
+		},
+		{
+			desc:    "lookup error",
+			record:  "_cql._tcp.unknown.example.com",
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		r := &stubSRVResolver{name: record, addrs: c.addrs}
+		got, err := resolveSRVHosts(context.Background(), r, c.record)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got hosts %q", c.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.desc, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: incorrect hosts: got %q want %q", c.desc, got, c.want)
+		}
+	}
+}
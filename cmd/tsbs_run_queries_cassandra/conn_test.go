@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+func TestParseReadConsistency(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    gocql.Consistency
+		wantErr bool
+	}{
+		{in: "ONE", want: gocql.One},
+		{in: "quorum", want: gocql.Quorum},
+		{in: "LOCAL_QUORUM", want: gocql.LocalQuorum},
+		{in: "LOCAL_ONE", want: gocql.LocalOne},
+		{in: "ALL", want: gocql.All},
+		{in: "ANY", wantErr: true},
+		{in: "EACH_QUORUM", wantErr: true},
+		{in: "MOST", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseReadConsistency(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error but did not get one", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.in, err)
+		}
+		if got != c.want {
+			t.Errorf("%s: incorrect consistency: got %v want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestNewClusterConfig(t *testing.T) {
+	opts := SessionOptions{Consistency: gocql.LocalQuorum}
+	cluster := newClusterConfig("localhost:9042", "benchmark", time.Second, opts)
+	if got := cluster.Consistency; got != gocql.LocalQuorum {
+		t.Errorf("incorrect consistency: got %v want %v", got, gocql.LocalQuorum)
+	}
+	if got := cluster.Keyspace; got != "benchmark" {
+		t.Errorf("incorrect keyspace: got %s want %s", got, "benchmark")
+	}
+	if cluster.PoolConfig.HostSelectionPolicy != nil {
+		t.Errorf("host selection policy set without DC-aware routing")
+	}
+
+	opts.DCAwareRouting = true
+	opts.LocalDC = "dc1"
+	cluster = newClusterConfig("localhost:9042", "benchmark", time.Second, opts)
+	if cluster.PoolConfig.HostSelectionPolicy == nil {
+		t.Errorf("host selection policy not set with DC-aware routing")
+	}
+}
+
+func TestNewClusterConfigConnsPerHost(t *testing.T) {
+	cases := []struct {
+		connsPerHost int
+		want         int
+	}{
+		{connsPerHost: 0, want: gocql.NewCluster().NumConns}, // driver default
+		{connsPerHost: 1, want: 1},
+		{connsPerHost: 8, want: 8},
+	}
+	for _, c := range cases {
+		opts := SessionOptions{ConnsPerHost: c.connsPerHost}
+		cluster := newClusterConfig("localhost:9042", "benchmark", time.Second, opts)
+		if got := cluster.NumConns; got != c.want {
+			t.Errorf("%d: incorrect connections per host: got %d want %d", c.connsPerHost, got, c.want)
+		}
+	}
+
+	want := "CQL connection pool: 8 connections per host (2 hosts given), shared by 16 workers"
+	if got := describePool("host0,host1", SessionOptions{ConnsPerHost: 8}, 16); got != want {
+		t.Errorf("incorrect pool description: got %q want %q", got, want)
+	}
+}
+
+func TestNewClusterConfigTokenAware(t *testing.T) {
+	cases := []struct {
+		desc string
+		opts SessionOptions
+		want string
+	}{
+		{
+			desc: "token aware",
+			opts: SessionOptions{TokenAware: true},
+			want: "*gocql.tokenAwareHostPolicy",
+		},
+		{
+			desc: "token and DC aware",
+			opts: SessionOptions{TokenAware: true, DCAwareRouting: true, LocalDC: "dc1"},
+			want: "*gocql.tokenAwareHostPolicy",
+		},
+		{
+			desc: "DC aware only",
+			opts: SessionOptions{DCAwareRouting: true, LocalDC: "dc1"},
+			want: "*gocql.dcAwareRR",
+		},
+	}
+	for _, c := range cases {
+		cluster := newClusterConfig("localhost:9042", "benchmark", time.Second, c.opts)
+		if got := fmt.Sprintf("%T", cluster.PoolConfig.HostSelectionPolicy); got != c.want {
+			t.Errorf("%s: incorrect host selection policy: got %s want %s", c.desc, got, c.want)
+		}
+	}
+}
+
+func TestNewProbedSessionUnreachable(t *testing.T) {
+	// nothing listens on these ports, so connections are refused:
+	hosts := "127.0.0.1:1,127.0.0.1:2"
+	opts := SessionOptions{Consistency: gocql.One, ConnectTimeout: 500 * time.Millisecond}
+	start := time.Now()
+	session, err := newProbedSession(hosts, "benchmark", time.Second, opts)
+	if err == nil {
+		session.Close()
+		t.Fatalf("unexpected session to unreachable hosts")
+	}
+	if took := time.Since(start); took > 10*time.Second {
+		t.Errorf("did not fail fast: took %v", took)
+	}
+	cerr, ok := err.(*ConnectError)
+	if !ok {
+		t.Fatalf("incorrect error type: got %T want *ConnectError", err)
+	}
+	want := []string{"127.0.0.1:1", "127.0.0.1:2"}
+	if !reflect.DeepEqual(cerr.Unreachable, want) {
+		t.Errorf("incorrect unreachable hosts: got %v want %v", cerr.Unreachable, want)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "unreachable hosts: 127.0.0.1:1, 127.0.0.1:2") || !strings.Contains(msg, `keyspace "benchmark"`) {
+		t.Errorf("incorrect error message: %s", msg)
+	}
+}
+
+func TestUnreachableHosts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p, _ := strconv.Atoi(port)
+
+	hosts := []string{l.Addr().String(), "127.0.0.1", "127.0.0.1:1"}
+	// the host without a port is dialled on the default port:
+	got := unreachableHosts(hosts, p, time.Second)
+	if want := []string{"127.0.0.1:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect unreachable hosts: got %v want %v", got, want)
+	}
+}
+
+func TestCheckKeyspace(t *testing.T) {
+	qe := &mockQueryExecutor{respond: func(stmt string, args []interface{}) ([][]interface{}, error) {
+		switch args[0].(string) {
+		case "snapshot_1":
+			return [][]interface{}{{"snapshot_1"}}, nil
+		case "unavailable":
+			return nil, fmt.Errorf("unavailable")
+		}
+		return nil, nil
+	}}
+	if err := checkKeyspace(context.Background(), qe, "snapshot_1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := checkKeyspace(context.Background(), qe, "snapshot_2"); err == nil || err.Error() != `keyspace "snapshot_2" does not exist` {
+		t.Errorf("incorrect error: got %v", err)
+	}
+	if err := checkKeyspace(context.Background(), qe, "unavailable"); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Errorf("incorrect error: got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/gocql/gocql"
+)
+
+// newSslOptions returns the TLS options of the sessions made by
+// NewCassandraSession: the CA certificates verifying the nodes (the system
+// ones if caPath is empty), and the client certificate and key presented to
+// them, if any. The files are loaded by gocql when it connects, so they are
+// checked here first, to fail at startup. It returns nil, i.e.
+// unencrypted connections, if no option is set.
+func newSslOptions(caPath, certPath, keyPath string, insecureSkipVerify bool) (*gocql.SslOptions, error) {
+	if len(caPath) == 0 && len(certPath) == 0 && len(keyPath) == 0 && !insecureSkipVerify {
+		return nil, nil
+	}
+	if len(caPath) > 0 {
+		pem, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA certificates: %v", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates in %s", caPath)
+		}
+	}
+	if (len(certPath) > 0) != (len(keyPath) > 0) {
+		return nil, fmt.Errorf("a client certificate needs both a certificate and a key")
+	}
+	if len(certPath) > 0 {
+		if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %v", err)
+		}
+	}
+	return &gocql.SslOptions{
+		CaPath:   caPath,
+		CertPath: certPath,
+		KeyPath:  keyPath,
+		// gocql skips the verification of certificates and host names
+		// unless it is enabled:
+		EnableHostVerification: !insecureSkipVerify,
+	}, nil
+}
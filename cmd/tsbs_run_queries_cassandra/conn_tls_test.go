@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key as PEM
+// files in dir, returning their paths.
+func writeTestCertificate(t *testing.T, dir string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return certPath, keyPath
+}
+
+func TestNewSslOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsbs_run_queries_cassandra")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeTestCertificate(t, dir)
+
+	opts, err := newSslOptions("", "", "", false)
+	if err != nil || opts != nil {
+		t.Errorf("no TLS options: got %v (%v) want nil", opts, err)
+	}
+
+	opts, err = newSslOptions(certPath, certPath, keyPath, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.CaPath != certPath || opts.CertPath != certPath || opts.KeyPath != keyPath {
+		t.Errorf("incorrect paths: got %s, %s, %s want %s, %s, %s", opts.CaPath, opts.CertPath, opts.KeyPath, certPath, certPath, keyPath)
+	}
+	if !opts.EnableHostVerification {
+		t.Errorf("host verification not enabled")
+	}
+	cluster := newClusterConfig("localhost:9042", "benchmark", time.Second, SessionOptions{TLS: opts})
+	if cluster.SslOpts != opts {
+		t.Errorf("TLS options not set on the cluster")
+	}
+
+	opts, err = newSslOptions("", "", "", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts == nil || opts.EnableHostVerification {
+		t.Errorf("insecure skip verify: got %+v want TLS without host verification", opts)
+	}
+
+	cases := []struct {
+		desc          string
+		ca, cert, key string
+	}{
+		{desc: "missing CA", ca: filepath.Join(dir, "missing.pem")},
+		{desc: "CA without certificates", ca: filepath.Join(dir, "key.pem")},
+		{desc: "certificate without key", cert: certPath},
+		{desc: "key not matching", cert: certPath, key: certPath},
+	}
+	for _, c := range cases {
+		if _, err := newSslOptions(c.ca, c.cert, c.key, false); err == nil {
+			t.Errorf("%s: expected an error", c.desc)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gocql/gocql"
+)
+
+// queryTracing turns on the tracing of the statements executed with a
+// context (see withQueryTracing), and counts the rows Cassandra read to
+// execute them, from their trace events. Like queryPaging, it is carried by
+// the context so that it passes through QueryExecutor wrappers unchanged.
+//
+// Tracing costs extra writes on the cluster, and an extra query per
+// statement (or page) on the client. Trace events are written
+// asynchronously, so the rows of events not written yet when the trace is
+// read are missed.
+type queryTracing struct {
+	rows int64 // accessed atomically
+}
+
+type queryTracingKey struct{}
+
+// withQueryTracing returns a context whose statements are traced by t.
+func withQueryTracing(ctx context.Context, t *queryTracing) context.Context {
+	return context.WithValue(ctx, queryTracingKey{}, t)
+}
+
+// queryTracingFrom returns the queryTracing of a context, or nil if it has
+// none.
+func queryTracingFrom(ctx context.Context) *queryTracing {
+	t, _ := ctx.Value(queryTracingKey{}).(*queryTracing)
+	return t
+}
+
+// Rows returns the number of rows scanned so far.
+func (t *queryTracing) Rows() int {
+	return int(atomic.LoadInt64(&t.rows))
+}
+
+func (t *queryTracing) addRows(n int) {
+	atomic.AddInt64(&t.rows, int64(n))
+}
+
+// scannedRowsRegexp matches the trace events of replicas reading rows,
+// e.g. "Read 3 live rows and 0 tombstone cells" (or, before Cassandra 3,
+// "Read 3 live and 0 tombstone cells").
+var scannedRowsRegexp = regexp.MustCompile(`^Read (\d+) live (?:rows )?and \d+ tombstone`)
+
+// scannedRows returns the number of rows read according to the activity of
+// a trace event, or 0 if it does not read rows.
+func scannedRows(activity string) int {
+	m := scannedRowsRegexp.FindStringSubmatch(activity)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+// rowsTracer is a gocql.Tracer adding the rows scanned by each traced
+// statement to a queryTracing. Traces that cannot be read are not counted.
+type rowsTracer struct {
+	session *gocql.Session
+	tracing *queryTracing
+}
+
+// Trace reads the events of a trace, once its statement has executed.
+func (t *rowsTracer) Trace(traceID []byte) {
+	iter := t.session.Query("SELECT activity FROM system_traces.events WHERE session_id = ?", traceID).Consistency(gocql.One).Iter()
+	var activity string
+	for iter.Scan(&activity) {
+		t.tracing.addRows(scannedRows(activity))
+	}
+	iter.Close()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScannedRows(t *testing.T) {
+	cases := []struct {
+		activity string
+		want     int
+	}{
+		{activity: "Read 3 live rows and 0 tombstone cells", want: 3},
+		{activity: "Read 120 live rows and 4 tombstone cells for query SELECT * FROM benchmark.series_double", want: 120},
+		{activity: "Read 7 live and 1 tombstone cells", want: 7},
+		{activity: "Executing single-partition query on series_double", want: 0},
+		{activity: "Read-repair DC_LOCAL", want: 0},
+	}
+	for _, c := range cases {
+		if got := scannedRows(c.activity); got != c.want {
+			t.Errorf("%q: incorrect rows: got %d want %d", c.activity, got, c.want)
+		}
+	}
+}
+
+func TestHLQueryExecutorTracing(t *testing.T) {
+	// 2 series, each aggregated over 3 buckets on the server:
+	csi := newTestClientSideIndex(2, 1, "usage_user")
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(3*time.Hour), time.Hour)
+	for _, tracing := range []bool{false, true} {
+		qe := &mockQueryExecutor{respond: serverAggregationRows, scanned: 60}
+		hlqe := NewHLQueryExecutor(qe, csi, 0)
+		_, _, info, err := hlqe.Do(q, HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithServerAggregation, Tracing: tracing})
+		if err != nil {
+			t.Fatalf("tracing %v: unexpected error: %v", tracing, err)
+		}
+		want := 0
+		if tracing {
+			want = 6 * 60
+		}
+		if info.RowsScanned != want {
+			t.Errorf("tracing %v: incorrect rows scanned: got %d want %d", tracing, info.RowsScanned, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// cqlTemplate is the template of the statements built by NewCQLQuery (set
+// by -cql-template), if any.
+var cqlTemplate *template.Template
+
+// Positions of the Args of the CQLQueries built by NewCQLQuery.
+const (
+	cqlArgSeriesID = iota
+	cqlArgTimeStart
+	cqlArgTimeEnd
+)
+
+// cqlTemplateData is the data of a -cql-template. The SeriesID, TimeStart
+// and TimeEnd methods are the named arguments of the statement: each of them
+// renders a bind marker, and binds the argument at its place, e.g.
+//
+//	SELECT {{.Aggregation}} FROM {{.Table}} WHERE series_id = {{.SeriesID}} AND timestamp_ns >= {{.TimeStart}} AND timestamp_ns < {{.TimeEnd}} ALLOW FILTERING
+type cqlTemplateData struct {
+	// Aggregation is the selected expression, e.g. "max(value)", "value" for
+	// client-side aggregations, or "timestamp_ns, value" for raw points.
+	Aggregation string
+	Table       string
+	// OrderBy is the ORDER BY clause of raw points, if any.
+	OrderBy string
+
+	args []int // positions in the Args of NewCQLQuery, in statement order
+}
+
+// SeriesID binds the series id of the query.
+func (d *cqlTemplateData) SeriesID() string { return d.bind(cqlArgSeriesID) }
+
+// TimeStart binds the start of the time range of the query, in nanoseconds.
+func (d *cqlTemplateData) TimeStart() string { return d.bind(cqlArgTimeStart) }
+
+// TimeEnd binds the end of the time range of the query, in nanoseconds.
+func (d *cqlTemplateData) TimeEnd() string { return d.bind(cqlArgTimeEnd) }
+
+func (d *cqlTemplateData) bind(arg int) string {
+	d.args = append(d.args, arg)
+	return "?"
+}
+
+// render executes a template of CQL statements, returning the statement and
+// the positions of the arguments of its bind markers.
+func (d *cqlTemplateData) render(t *template.Template) (string, []int, error) {
+	d.args = nil
+	var b strings.Builder
+	if err := t.Execute(&b, d); err != nil {
+		return "", nil, err
+	}
+	stmt := b.String()
+	if n := strings.Count(stmt, "?"); n != len(d.args) {
+		return "", nil, fmt.Errorf("%d bind markers but %d named arguments (use {{.SeriesID}}, {{.TimeStart}} and {{.TimeEnd}} rather than ?): %s", n, len(d.args), stmt)
+	}
+	return stmt, d.args, nil
+}
+
+// parseCQLTemplate parses a -cql-template, and checks that it renders a
+// statement whose bind markers all are named arguments.
+func parseCQLTemplate(text string) (*template.Template, error) {
+	t, err := template.New("cql").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// catch errors once, rather than for every query:
+	d := &cqlTemplateData{Aggregation: "max(" + valueColumn + ")", Table: "series_double"}
+	if _, _, err := d.render(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// BoundArgs returns the arguments of the bind markers of the statement of a
+// CQLQuery, in statement order. They are its Args unless its statement was
+// built by a -cql-template.
+func (q CQLQuery) BoundArgs() []interface{} {
+	if q.ArgOrder == nil {
+		return q.Args
+	}
+	args := make([]interface{}, len(q.ArgOrder))
+	for i, pos := range q.ArgOrder {
+		args[i] = q.Args[pos]
+	}
+	return args
+}
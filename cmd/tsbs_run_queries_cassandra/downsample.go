@@ -0,0 +1,188 @@
+package main
+
+import (
+	"math"
+
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+const (
+	DownsampleAvg  = 1 // average the buckets of each group of consecutive buckets
+	DownsampleMax  = 2 // keep the maximum of each group of consecutive buckets
+	DownsampleLTTB = 3 // keep the buckets selected by largest-triangle-three-buckets
+)
+
+// downsampleResults reduces time-ordered (ascending or descending)
+// CQLResults to at most maxPoints results, for clients rendering a bounded
+// number of points whatever the resolution of the query. DownsampleAvg and
+// DownsampleMax merge groups of consecutive results of about the same size
+// into one over their time intervals, whose values are the mean or maximum
+// of their known values, and absent if none is. DownsampleLTTB keeps the
+// results selected by largest-triangle-three-buckets, which best preserve
+// the visual shape of the values, as they are. Both keep the first and last
+// results, or the time range they start and end. Raw results, and a
+// maxPoints below 1, leave the results as they are.
+func downsampleResults(results []CQLResult, maxPoints, reducer int) []CQLResult {
+	if maxPoints < 1 || len(results) <= maxPoints || len(results[0].Series) > 0 {
+		return results
+	}
+	order := ascendingOrder(results)
+	sorted := make([]CQLResult, len(order))
+	for pos, i := range order {
+		sorted[pos] = results[i]
+	}
+
+	var out []CQLResult
+	if reducer == DownsampleLTTB {
+		out = lttbResults(sorted, maxPoints)
+	} else {
+		out = make([]CQLResult, maxPoints)
+		for g := range out {
+			// the groups of results [g*n/maxPoints, (g+1)*n/maxPoints):
+			out[g] = mergeResults(sorted[g*len(sorted)/maxPoints:(g+1)*len(sorted)/maxPoints], reducer)
+		}
+	}
+	if order[0] != 0 {
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+	}
+	return out
+}
+
+// downsampleResultsPerMeasurement downsamples the results of each
+// measurement, and group of tags, of a query separately, as
+// fillResultsPerMeasurement fills them.
+func downsampleResultsPerMeasurement(results []CQLResult, maxPoints, reducer int) []CQLResult {
+	return perResultGroup(results, func(group []CQLResult) []CQLResult {
+		return downsampleResults(group, maxPoints, reducer)
+	})
+}
+
+// mergeResults merges ascending results into one over their time range,
+// with the mean or maximum of the known values of each, per reducer.
+func mergeResults(group []CQLResult, reducer int) CQLResult {
+	first, last := group[0], group[len(group)-1]
+	ti, err := utils.NewTimeInterval(first.Start(), last.End())
+	if err != nil {
+		// the results are ascending, so they cannot end before they start:
+		panic("logic error: " + err.Error())
+	}
+	res := CQLResult{
+		TimeInterval: ti,
+		Values:       make([]float64, len(first.Values)),
+		Measurement:  first.Measurement,
+		Tags:         first.Tags,
+		ValueSeries:  first.ValueSeries,
+		ZeroFilled:   true,
+	}
+	var traced seriesIDSet
+	for _, r := range group {
+		res.ZeroFilled = res.ZeroFilled && r.ZeroFilled
+		if r.SeriesIds != nil {
+			if traced == nil {
+				traced = seriesIDSet{}
+			}
+			for _, id := range r.SeriesIds {
+				traced[id] = struct{}{}
+			}
+		}
+	}
+	if traced != nil {
+		res.SeriesIds = traced.sorted()
+	}
+	for v := range res.Values {
+		n := 0 // known values
+		acc := math.Inf(-1)
+		if reducer == DownsampleAvg {
+			acc = 0
+		}
+		for _, r := range group {
+			if r.IsAbsent(v) {
+				continue
+			}
+			if reducer == DownsampleAvg {
+				acc += r.Values[v]
+			} else {
+				acc = math.Max(acc, r.Values[v])
+			}
+			n++
+		}
+		switch {
+		case n == 0:
+			if res.Absent == nil {
+				res.Absent = make([]bool, len(res.Values))
+			}
+			res.Absent[v] = true
+		case reducer == DownsampleAvg:
+			res.Values[v] = acc / float64(n)
+		default:
+			res.Values[v] = acc
+		}
+	}
+	return res
+}
+
+// lttbResults selects maxPoints of ascending results by
+// largest-triangle-three-buckets: the first and last results, and of each of
+// maxPoints-2 groups of the results between them, the one forming the
+// largest triangle with the result selected before it and the mean of the
+// next group, in time and value. Results of several values are selected on
+// the sum of the areas of their known values.
+func lttbResults(results []CQLResult, maxPoints int) []CQLResult {
+	switch maxPoints {
+	case 1:
+		return results[:1]
+	case 2:
+		return []CQLResult{results[0], results[len(results)-1]}
+	}
+	out := make([]CQLResult, 0, maxPoints)
+	out = append(out, results[0])
+	x := func(r *CQLResult) float64 { return float64(r.Start().UnixNano()) }
+
+	prev := 0 // index of the last selected result
+	inner := results[1 : len(results)-1]
+	groups := maxPoints - 2
+	for g := 0; g < groups; g++ {
+		group := inner[g*len(inner)/groups : (g+1)*len(inner)/groups]
+		next := results[len(results)-1:]
+		if g+1 < groups {
+			next = inner[(g+1)*len(inner)/groups : (g+2)*len(inner)/groups]
+		}
+
+		// the mean of the next group, in time and of each value:
+		var nextX float64
+		nextY := make([]float64, len(results[0].Values))
+		nextN := make([]int, len(nextY))
+		for i := range next {
+			nextX += x(&next[i])
+			for v := range nextY {
+				if !next[i].IsAbsent(v) {
+					nextY[v] += next[i].Values[v]
+					nextN[v]++
+				}
+			}
+		}
+		nextX /= float64(len(next))
+
+		a := &results[prev]
+		best, bestArea := 0, -1.0
+		for i := range group {
+			b := &group[i]
+			area := 0.0
+			for v := range nextY {
+				if nextN[v] == 0 || a.IsAbsent(v) || b.IsAbsent(v) {
+					continue
+				}
+				ny := nextY[v] / float64(nextN[v])
+				area += math.Abs((x(a)-nextX)*(b.Values[v]-a.Values[v])-(x(a)-x(b))*(ny-a.Values[v])) / 2
+			}
+			if area > bestArea {
+				best, bestArea = i, area
+			}
+		}
+		out = append(out, group[best])
+		prev = 1 + g*len(inner)/groups + best
+	}
+	return append(out, results[len(results)-1])
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDownsampleResults(t *testing.T) {
+	n := func() *float64 { return nil }
+	v := float64Ptr
+	cases := []struct {
+		desc      string
+		reducer   int
+		maxPoints int
+		in        []*float64
+		want      []*float64
+	}{
+		{desc: "avg", reducer: DownsampleAvg, maxPoints: 3, in: []*float64{v(1), v(3), v(5), v(7), v(9), v(11)}, want: []*float64{v(2), v(6), v(10)}},
+		{desc: "avg uneven", reducer: DownsampleAvg, maxPoints: 2, in: []*float64{v(1), v(2), v(3), v(4), v(5)}, want: []*float64{v(1.5), v(4)}},
+		{desc: "avg absent", reducer: DownsampleAvg, maxPoints: 2, in: []*float64{n(), n(), v(2), n()}, want: []*float64{n(), v(2)}},
+		{desc: "max", reducer: DownsampleMax, maxPoints: 2, in: []*float64{v(1), v(-3), v(-5), v(-2)}, want: []*float64{v(1), v(-2)}},
+		{desc: "lttb spike", reducer: DownsampleLTTB, maxPoints: 3, in: []*float64{v(0), v(1), v(9), v(1), v(0)}, want: []*float64{v(0), v(9), v(0)}},
+		{desc: "lttb first and last", reducer: DownsampleLTTB, maxPoints: 2, in: []*float64{v(1), v(9), v(3)}, want: []*float64{v(1), v(3)}},
+		{desc: "under max points", reducer: DownsampleLTTB, maxPoints: 4, in: []*float64{v(1), v(2)}, want: []*float64{v(1), v(2)}},
+	}
+	for _, c := range cases {
+		values := make([][]*float64, len(c.in))
+		for i, x := range c.in {
+			values[i] = []*float64{x}
+		}
+		got := resultValues(downsampleResults(newTestCQLResults(t, values...), c.maxPoints, c.reducer))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: incorrect values: got %v want %v", c.desc, derefs(got), derefs(c.want))
+		}
+	}
+}
+
+func TestDownsampleResultsEndpoints(t *testing.T) {
+	values := make([][]*float64, 1000)
+	for i := range values {
+		values[i] = []*float64{float64Ptr(math.Sin(float64(i) / 50))}
+	}
+	for _, reducer := range []int{DownsampleAvg, DownsampleMax, DownsampleLTTB} {
+		for _, descending := range []bool{false, true} {
+			results := newTestCQLResults(t, values...)
+			if descending {
+				for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+					results[i], results[j] = results[j], results[i]
+				}
+			}
+			first, last := results[0], results[len(results)-1]
+			got := downsampleResults(results, 100, reducer)
+			if len(got) != 100 {
+				t.Errorf("reducer %d: incorrect number of results: got %d want 100", reducer, len(got))
+				continue
+			}
+			// the first and last results start and end the same time range:
+			if descending {
+				first, last = last, first
+				got[0], got[len(got)-1] = got[len(got)-1], got[0]
+			}
+			if !got[0].Start().Equal(first.Start()) || !got[len(got)-1].End().Equal(last.End()) {
+				t.Errorf("reducer %d: endpoints not preserved: got %v to %v want %v to %v", reducer,
+					got[0].Start(), got[len(got)-1].End(), first.Start(), last.End())
+			}
+			if reducer == DownsampleLTTB && (got[0].Values[0] != first.Values[0] || got[len(got)-1].Values[0] != last.Values[0]) {
+				t.Errorf("lttb: endpoint values not preserved: got %v and %v want %v and %v",
+					got[0].Values[0], got[len(got)-1].Values[0], first.Values[0], last.Values[0])
+			}
+		}
+	}
+}
+
+func TestDownsampleResultsPerMeasurement(t *testing.T) {
+	results := newTestCQLResults(t,
+		[]*float64{float64Ptr(1)}, []*float64{float64Ptr(3)}, []*float64{float64Ptr(5)}, []*float64{float64Ptr(7)},
+	)
+	for i := range results {
+		results[i].Measurement = []string{"cpu", "cpu", "mem", "mem"}[i]
+	}
+	downsampled := downsampleResultsPerMeasurement(results, 1, DownsampleAvg)
+	got := make([]string, len(downsampled))
+	for i, r := range downsampled {
+		got[i] = r.Measurement + " " + r.valuesString()
+	}
+	want := []string{"cpu [2]", "mem [6]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect downsampling: got %v want %v", got, want)
+	}
+}
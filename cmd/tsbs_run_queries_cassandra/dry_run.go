@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeDryRun writes the CQLQueries of a query plan as CQL statements that
+// can be pasted into cqlsh, i.e. with their arguments substituted. Queries
+// are grouped by the time interval they cover, each group starting with a
+// comment giving its bounds both in nanoseconds and in RFC3339.
+func writeDryRun(w io.Writer, q *HLQuery, queries []CQLQuery) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "-- ID %d: %s (%d CQL queries)\n", q.GetID(), q.HumanLabel, len(queries))
+	var lastStart, lastEnd int64
+	for i, cq := range queries {
+		start, end := cqlQueryTimeRange(cq)
+		if i == 0 || start != lastStart || end != lastEnd {
+			fmt.Fprintf(&buf, "-- [%d, %d) = [%s, %s)\n", start, end,
+				time.Unix(0, start).UTC().Format(time.RFC3339Nano),
+				time.Unix(0, end).UTC().Format(time.RFC3339Nano))
+			lastStart, lastEnd = start, end
+		}
+		buf.WriteString(cqlStatementWithArgs(cq.PreparableQueryString, cq.BoundArgs()))
+		buf.WriteString(";\n")
+	}
+	// a single write keeps the output of concurrent workers intact
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// cqlQueryTimeRange returns the bounds (in nanoseconds) of the time range
+// argument of a CQLQuery (see NewCQLQuery).
+func cqlQueryTimeRange(cq CQLQuery) (start, end int64) {
+	if len(cq.Args) < 3 {
+		return 0, 0
+	}
+	start, _ = cq.Args[1].(int64)
+	end, _ = cq.Args[2].(int64)
+	return start, end
+}
+
+// cqlStatementWithArgs replaces the placeholders of a prepared statement
+// with its arguments, as CQL literals.
+func cqlStatementWithArgs(stmt string, args []interface{}) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range stmt {
+		if r != '?' || n >= len(args) {
+			b.WriteRune(r)
+			continue
+		}
+		b.WriteString(cqlLiteral(args[n]))
+		n++
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// cqlLiteral formats a value as a CQL literal.
+func cqlLiteral(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return "'" + strings.Replace(v, "'", "''", -1) + "'"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case []string:
+		parts := make([]string, len(v))
+		for i, s := range v {
+			parts[i] = cqlLiteral(s)
+		}
+		return "(" + strings.Join(parts, ", ") + ")"
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
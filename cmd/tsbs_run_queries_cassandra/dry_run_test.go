@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWriteDryRun(t *testing.T) {
+	csi := newTestClientSideIndex(2, 1, "usage_user")
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Hour), time.Hour)
+	q.SetID(7)
+	qp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeDryRun(&buf, q, qp.AllCQLQueries()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `-- ID 7: test (2 CQL queries)
+-- [1451606400000000000, 1451610000000000000) = [2016-01-01T00:00:00Z, 2016-01-01T01:00:00Z)
+SELECT max(value) FROM series_double WHERE series_id = 'cpu,hostname=host_0#usage_user#2016-01-01' AND timestamp_ns >= 1451606400000000000 AND timestamp_ns < 1451610000000000000;
+SELECT max(value) FROM series_double WHERE series_id = 'cpu,hostname=host_1#usage_user#2016-01-01' AND timestamp_ns >= 1451606400000000000 AND timestamp_ns < 1451610000000000000;
+`
+	if got := buf.String(); got != want {
+		t.Errorf("incorrect output:\ngot\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCQLLiteral(t *testing.T) {
+	cases := []struct {
+		in   interface{}
+		want string
+	}{
+		{in: "host_0", want: "'host_0'"},
+		{in: "it's", want: "'it''s'"},
+		{in: int64(-42), want: "-42"},
+		{in: 1.5, want: "1.5"},
+		{in: []string{"host_0", "host_1"}, want: "('host_0', 'host_1')"},
+	}
+	for _, c := range cases {
+		if got := cqlLiteral(c.in); got != c.want {
+			t.Errorf("%v: incorrect literal: got %s want %s", c.in, got, c.want)
+		}
+	}
+}
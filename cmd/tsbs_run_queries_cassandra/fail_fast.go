@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// A failFast aborts the run on the first query failing to execute or
+// invalid (set by -fail-fast), e.g. for correctness gates in CI: it stops
+// the runner from starting more queries, and cancels those in flight, whose
+// cancellations are then not failures. It is safe for concurrent use.
+type failFast struct {
+	stop   func()             // of the runner, see query.BenchmarkRunner.Stop
+	cancel context.CancelFunc // of the queries in flight, if set
+
+	mu    sync.Mutex
+	err   error // of the first failed query, nil if none failed
+	id    uint64
+	query string // as HLQuery.String
+}
+
+// fail records the failure of a query, aborting the run if it is the first.
+func (f *failFast) fail(id uint64, q *HLQuery, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return
+	}
+	f.err, f.id, f.query = err, id, q.String()
+	f.stop()
+	if f.cancel != nil {
+		f.cancel()
+	}
+}
+
+// Err returns an error describing the first failed query, nil if none
+// failed.
+func (f *failFast) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		return nil
+	}
+	return fmt.Errorf("aborted by -fail-fast: query %d failed: %v\nquery: %s", f.id, f.err, f.query)
+}
+
+// exitOnFailure exits with a non-zero status, printing the first failed
+// query, if the run was aborted.
+func (f *failFast) exitOnFailure() {
+	if err := f.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
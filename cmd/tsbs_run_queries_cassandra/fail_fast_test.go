@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/timescale/tsbs/query"
+)
+
+// runFailFast runs the queries of a file of numQueries with -fail-fast and
+// workers, the tenth of them failing to execute, and returns the executor
+// of their CQL queries.
+func runFailFast(t *testing.T, numQueries int, workers uint) *mockQueryExecutor {
+	dir, err := ioutil.TempDir("", "tsbs_run_queries_cassandra")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := writeTestQueryFile(t, dir, numQueries)
+
+	failing := testStart.Add(9 * time.Minute).UnixNano()
+	mock := &mockQueryExecutor{delay: time.Millisecond, respond: func(stmt string, args []interface{}) ([][]interface{}, error) {
+		if args[1].(int64) == failing {
+			return nil, errors.New("unavailable")
+		}
+		return serverAggregationRows(stmt, args)
+	}}
+	runner = query.NewBenchmarkRunner(query.BenchmarkRunnerConfig{Workers: workers, FileName: fileName})
+	csi = newTestClientSideIndex(1, 1, "usage_user")
+	qe = mock
+	aggrPlan = AggrPlanTypeWithServerAggregation
+	var cancel context.CancelFunc
+	shutdownCtx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	abort = &failFast{stop: runner.Stop, cancel: cancel}
+
+	runner.Run(&query.CassandraPool, newProcessor)
+	return mock
+}
+
+func TestRunnerFailFast(t *testing.T) {
+	const numQueries, workers = 1000, 4
+	oldRunner, oldCSI, oldQE, oldAggrPlan := runner, csi, qe, aggrPlan
+	oldShutdownCtx, oldAbort := shutdownCtx, abort
+	defer func() {
+		runner, csi, qe, aggrPlan = oldRunner, oldCSI, oldQE, oldAggrPlan
+		shutdownCtx, abort = oldShutdownCtx, oldAbort
+		atomic.StoreUint64(&failed, 0)
+		atomic.StoreUint64(&cancelled, 0)
+	}()
+
+	goroutines := runtime.NumGoroutine()
+	mock := runFailFast(t, numQueries, workers)
+
+	// the queries started before the failure finish or are cancelled, but
+	// no more are started:
+	if calls := mock.Calls(); calls < 10 || calls > 10+2*workers {
+		t.Errorf("incorrect number of CQL queries: got %d want from 10 to %d", calls, 10+2*workers)
+	}
+	err := abort.Err()
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	for _, want := range []string{"unavailable", "TimeStart: " + testStart.Add(9*time.Minute).String()} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("incorrect error: got %q want one containing %q", err, want)
+		}
+	}
+	if got := atomic.LoadUint64(&failed); got != 1 {
+		t.Errorf("incorrect number of failed queries: got %d want 1", got)
+	}
+
+	// the workers and stats processor are all done:
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > goroutines {
+		t.Errorf("leaked goroutines: got %d want at most %d", got, goroutines)
+	}
+}
+
+func TestRunnerFailFastExitStatus(t *testing.T) {
+	if os.Getenv("TSBS_FAIL_FAST_EXIT") == "1" {
+		runFailFast(t, 100, 2)
+		abort.exitOnFailure()
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRunnerFailFastExitStatus$")
+	cmd.Env = append(os.Environ(), "TSBS_FAIL_FAST_EXIT=1")
+	out, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.Success() {
+		t.Fatalf("incorrect exit: got %v want a non-zero status\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "aborted by -fail-fast: query 9 failed: unavailable") {
+		t.Errorf("incorrect output: got %q", out)
+	}
+}
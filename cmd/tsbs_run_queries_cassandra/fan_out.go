@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A fanOutHistogram counts the executed HLQueries by the number of CQL
+// queries their plan expanded into, in buckets of 1-10, 11-100, 101-1000,
+// etc., along with the series rows they touched. It reveals the queries
+// whose fan-out dominates a run. It is safe for concurrent use.
+type fanOutHistogram struct {
+	mu      sync.Mutex
+	buckets []fanOutBucket // i holds fan-outs in (10^i, 10^(i+1)]
+	empty   uint64         // queries without any CQL query
+	maxID   uint64         // of the query with the largest fan-out
+	max     int
+}
+
+// A fanOutBucket holds the queries of a fanOutHistogram bucket.
+type fanOutBucket struct {
+	queries   uint64
+	series    uint64 // touched by all of the queries
+	maxSeries int
+}
+
+// observe records a query with the given id, whose plan ran cqlQueries CQL
+// queries touching series rows.
+func (h *fanOutHistogram) observe(id uint64, cqlQueries, series int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if cqlQueries > h.max {
+		h.max = cqlQueries
+		h.maxID = id
+	}
+	if cqlQueries <= 0 {
+		h.empty++
+		return
+	}
+	i := 0
+	for upper := 10; cqlQueries > upper; upper *= 10 {
+		i++
+	}
+	for len(h.buckets) <= i {
+		h.buckets = append(h.buckets, fanOutBucket{})
+	}
+	b := &h.buckets[i]
+	b.queries++
+	b.series += uint64(series)
+	if series > b.maxSeries {
+		b.maxSeries = series
+	}
+}
+
+// writeTo writes the non-empty buckets, one per line, followed by the query
+// with the largest fan-out. Nothing is written if no query was observed.
+func (h *fanOutHistogram) writeTo(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.empty == 0 && len(h.buckets) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintln(w, "CQL fan-out per query:"); err != nil {
+		return err
+	}
+	if h.empty > 0 {
+		if _, err := fmt.Fprintf(w, "%15s: %d queries\n", "0", h.empty); err != nil {
+			return err
+		}
+	}
+	lower, upper := 1, 10
+	for _, b := range h.buckets {
+		if b.queries > 0 {
+			_, err := fmt.Fprintf(w, "%15s: %d queries, series touched: mean %.1f, max %d\n",
+				fmt.Sprintf("%d-%d", lower, upper), b.queries, float64(b.series)/float64(b.queries), b.maxSeries)
+			if err != nil {
+				return err
+			}
+		}
+		lower, upper = upper+1, upper*10
+	}
+	_, err := fmt.Fprintf(w, "largest fan-out: %d CQL queries (query %d)\n", h.max, h.maxID)
+	return err
+}
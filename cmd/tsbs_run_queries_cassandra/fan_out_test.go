@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestHLQueryExecutorFanOut(t *testing.T) {
+	// 2 hosts over 2 days, with 3 hourly buckets on each day:
+	csi := newTestClientSideIndex(2, 2, "usage_user")
+	q := newTestHLQuery("max", "usage_user", testStart.Add(21*time.Hour), testStart.Add(27*time.Hour), time.Hour)
+	cases := []struct {
+		desc           string
+		plan           int
+		respond        func(string, []interface{}) ([][]interface{}, error)
+		wantCQLQueries int
+	}{
+		{desc: "server", plan: AggrPlanTypeWithServerAggregation, respond: serverAggregationRows, wantCQLQueries: 12},
+		{desc: "client", plan: AggrPlanTypeWithoutServerAggregation, respond: countRows, wantCQLQueries: 4},
+	}
+	for _, c := range cases {
+		hlqe := NewHLQueryExecutor(&mockQueryExecutor{respond: c.respond}, csi, 0)
+		_, _, info, err := hlqe.Do(q, HLQueryExecutorDoOptions{AggregationPlan: c.plan})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if info.CQLQueries != c.wantCQLQueries {
+			t.Errorf("%s: incorrect fan-out: got %d want %d", c.desc, info.CQLQueries, c.wantCQLQueries)
+		}
+		if info.Series != 4 {
+			t.Errorf("%s: incorrect number of series: got %d want %d", c.desc, info.Series, 4)
+		}
+	}
+}
+
+func TestFanOutHistogram(t *testing.T) {
+	var h fanOutHistogram
+	var buf bytes.Buffer
+	if err := h.writeTo(&buf); err != nil || buf.Len() > 0 {
+		t.Errorf("no queries: got %q (%v) want nothing", buf.String(), err)
+	}
+
+	h.observe(1, 1, 1)
+	h.observe(2, 10, 4)
+	h.observe(3, 11, 2)
+	h.observe(4, 1000, 50)
+	h.observe(5, 0, 0)
+	if err := h.writeTo(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `CQL fan-out per query:
+              0: 1 queries
+           1-10: 2 queries, series touched: mean 2.5, max 4
+         11-100: 1 queries, series touched: mean 2.0, max 2
+       101-1000: 1 queries, series touched: mean 50.0, max 50
+largest fan-out: 1000 CQL queries (query 4)
+`
+	if got := buf.String(); got != want {
+		t.Errorf("incorrect histogram:\ngot\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSelectivityStats(t *testing.T) {
+	// 4 hosts over 2 days, i.e. 8 series rows of usage_user:
+	csi := newTestClientSideIndex(4, 2, "usage_user")
+	queries := []*HLQuery{
+		newTestHLQuery("max", "usage_user", testStart, testStart.Add(2*day), time.Hour),                  // 8 rows
+		newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Hour), time.Hour),              // 2 rows, see below
+		newTestHLQuery("cardinality", "usage_user", testStart.Add(day), testStart.Add(2*day), 0),         // 4 rows
+		newTestHLQuery("max", "usage_user", testStart.Add(23*time.Hour), testStart.Add(25*time.Hour), 0), // 8 rows
+		newTestHLQuery("count_all", "usage_user", testStart, testStart.Add(day), time.Hour),              // 4 rows
+	}
+	queries[1].TagSets = [][]string{{"hostname=host_0", "hostname=host_1"}}
+
+	hlqe := NewHLQueryExecutor(&mockQueryExecutor{respond: serverAggregationRows}, csi, 0)
+	var s selectivityStats
+	for i, q := range queries {
+		_, _, info, err := hlqe.Do(q, HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithServerAggregation, SlotInterval: 10 * time.Second})
+		if err != nil {
+			t.Fatalf("query %d: unexpected error: %v", i, err)
+		}
+		s.observe(uint64(i), info.Matched)
+	}
+	if got, want := s.mean(), 5.2; got != want {
+		t.Errorf("incorrect mean matched series: got %v want %v", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := s.writeTo(&buf, len(csi.seriesIds)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Series matched per query: mean 5.2 (65.00% of 8 in the client-side index), max 8 (query 0)\n"
+	if got := buf.String(); got != want {
+		t.Errorf("incorrect summary: got %q want %q", got, want)
+	}
+
+	var empty selectivityStats
+	buf.Reset()
+	if err := empty.writeTo(&buf, 8); err != nil || buf.Len() > 0 {
+		t.Errorf("no queries: got %q (%v) want nothing", buf.String(), err)
+	}
+}
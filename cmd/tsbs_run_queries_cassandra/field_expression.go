@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A fieldExpression is an arithmetic expression of the fields of a
+// measurement, e.g. "usage_user + usage_system" or "(a - b) / 2", which
+// Cassandra cannot compute: the client evaluates it on the points of the
+// series of its fields at each timestamp, before aggregating its values
+// like those of a field (see HLQuery.FieldExpression).
+//
+// It supports numbers (e.g. 2, 0.5 or 1e-5), fields, the binary operators
+// +, -, * and /, unary minus and parentheses, with the usual precedence. Divisions by zero yield
+// infinite or NaN values, as handled by -nan-policy.
+type fieldExpression struct {
+	source string
+	fields []string // referenced, in order of first appearance
+	root   exprNode
+}
+
+// An exprNode is a node of the syntax tree of a fieldExpression, evaluated
+// from the values of its fields, in the order of fieldExpression.fields.
+type exprNode interface {
+	eval(values []float64) float64
+}
+
+type (
+	exprNumber float64
+	exprField  int // index into fieldExpression.fields
+	exprNeg    struct{ x exprNode }
+	exprBinary struct {
+		op   byte
+		x, y exprNode
+	}
+)
+
+func (n exprNumber) eval(_ []float64) float64     { return float64(n) }
+func (n exprField) eval(values []float64) float64 { return values[n] }
+func (n *exprNeg) eval(values []float64) float64  { return -n.x.eval(values) }
+func (n *exprBinary) eval(values []float64) float64 {
+	x, y := n.x.eval(values), n.y.eval(values)
+	switch n.op {
+	case '+':
+		return x + y
+	case '-':
+		return x - y
+	case '*':
+		return x * y
+	default:
+		return x / y
+	}
+}
+
+// parseFieldExpression parses the FieldExpression of an HLQuery, which must
+// reference at least one field.
+func parseFieldExpression(s string) (*fieldExpression, error) {
+	p := &exprParser{expr: &fieldExpression{source: s}, src: s}
+	p.next()
+	root, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "" {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.tok, p.off)
+	}
+	if len(p.expr.fields) == 0 {
+		return nil, fmt.Errorf("no field in %q", s)
+	}
+	p.expr.root = root
+	return p.expr, nil
+}
+
+// eval returns the value of the expression for the values of its fields.
+func (e *fieldExpression) eval(values []float64) float64 {
+	return e.root.eval(values)
+}
+
+// exprParser is a recursive descent parser of fieldExpressions, with one
+// token of lookahead: tok, at offset off of src ("" at the end).
+type exprParser struct {
+	expr     *fieldExpression
+	src      string
+	pos, off int
+	tok      string
+}
+
+// next scans the next token: a number, a field, or an operator or
+// parenthesis.
+func (p *exprParser) next() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+	p.off = p.pos
+	if p.pos == len(p.src) {
+		p.tok = ""
+		return
+	}
+	end := p.pos + 1
+	if c := rune(p.src[p.pos]); isExprIdent(c) || c == '.' {
+		number := unicode.IsDigit(c) || c == '.'
+		for end < len(p.src) && (isExprIdent(rune(p.src[end])) || p.src[end] == '.' ||
+			// the sign of the exponent of a number, e.g. 1e-5:
+			number && (p.src[end] == '-' || p.src[end] == '+') && (p.src[end-1] == 'e' || p.src[end-1] == 'E')) {
+			end++
+		}
+	}
+	p.tok = p.src[p.pos:end]
+	p.pos = end
+}
+
+func isExprIdent(c rune) bool {
+	return c == '_' || c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c))
+}
+
+// parseSum parses terms separated by + or -.
+func (p *exprParser) parseSum() (exprNode, error) {
+	x, err := p.parseProduct()
+	for err == nil && (p.tok == "+" || p.tok == "-") {
+		op := p.tok[0]
+		p.next()
+		var y exprNode
+		if y, err = p.parseProduct(); err == nil {
+			x = &exprBinary{op: op, x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+// parseProduct parses factors separated by * or /.
+func (p *exprParser) parseProduct() (exprNode, error) {
+	x, err := p.parseFactor()
+	for err == nil && (p.tok == "*" || p.tok == "/") {
+		op := p.tok[0]
+		p.next()
+		var y exprNode
+		if y, err = p.parseFactor(); err == nil {
+			x = &exprBinary{op: op, x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+// parseFactor parses a number, a field, a negated factor or a
+// parenthesized expression.
+func (p *exprParser) parseFactor() (exprNode, error) {
+	tok, off := p.tok, p.off
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end of %q", p.src)
+	case tok == "-":
+		p.next()
+		x, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNeg{x: x}, nil
+	case tok == "(":
+		p.next()
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != ")" {
+			return nil, fmt.Errorf("missing ) at offset %d", p.off)
+		}
+		p.next()
+		return x, nil
+	case unicode.IsDigit(rune(tok[0])) || tok[0] == '.':
+		v, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", tok, off)
+		}
+		p.next()
+		return exprNumber(v), nil
+	case isExprIdent(rune(tok[0])) && !strings.Contains(tok, "."):
+		p.next()
+		for i, f := range p.expr.fields {
+			if f == tok {
+				return exprField(i), nil
+			}
+		}
+		p.expr.fields = append(p.expr.fields, tok)
+		return exprField(len(p.expr.fields) - 1), nil
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", tok, off)
+}
+
+// fieldExpression returns the parsed FieldExpression of the query, or nil if
+// it has none.
+func (q *HLQuery) fieldExpression() (*fieldExpression, error) {
+	if len(q.FieldExpression) == 0 {
+		return nil, nil
+	}
+	expr, err := parseFieldExpression(string(q.FieldExpression))
+	if err != nil {
+		return nil, &InvalidQueryError{fmt.Sprintf("invalid field expression: %v", err)}
+	}
+	return expr, nil
+}
+
+// validateFieldExpression checks the FieldExpression of a query, if any: it
+// must parse, and be aggregated by a single aggregation of the values of
+// points, which is not a share.
+func (q *HLQuery) validateFieldExpression() error {
+	if len(q.FieldExpression) == 0 {
+		return nil
+	}
+	if _, err := q.fieldExpression(); err != nil {
+		return err
+	}
+	aggr := string(q.AggregationType)
+	_, shares := parseShareAggregation(aggr)
+	if len(aggr) == 0 || q.IsRaw() || q.IsLastPoint() || q.IsCardinality() || q.IsCountAll() || shares || len(q.Aggregations()) > 0 {
+		return &InvalidQueryError{fmt.Sprintf("field expression %q cannot be aggregated by %q", q.FieldExpression, aggr)}
+	}
+	return nil
+}
+
+// queriedFields returns the fields whose series the query reads: those
+// referenced by its FieldExpression, if it has a valid one, otherwise those
+// of its FieldName.
+func (q *HLQuery) queriedFields() []string {
+	if expr, err := q.fieldExpression(); err == nil && expr != nil {
+		return expr.fields
+	}
+	return strings.Split(string(q.FieldName), ",")
+}
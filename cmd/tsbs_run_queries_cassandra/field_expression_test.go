@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFieldExpression(t *testing.T) {
+	cases := []struct {
+		expr       string
+		values     []float64 // of the fields, in order of appearance
+		wantFields string
+		want       float64
+	}{
+		{expr: "usage_user + usage_system", values: []float64{1, 2}, wantFields: "usage_user,usage_system", want: 3},
+		{expr: "a+b*c", values: []float64{1, 2, 3}, wantFields: "a,b,c", want: 7},
+		{expr: "(a + b) * c", values: []float64{1, 2, 3}, wantFields: "a,b,c", want: 9},
+		{expr: "a - b - c", values: []float64{10, 2, 3}, wantFields: "a,b,c", want: 5},
+		{expr: "a / b / 2", values: []float64{12, 3}, wantFields: "a,b", want: 2},
+		{expr: "-a * -2.5 + a", values: []float64{2}, wantFields: "a", want: 7},
+		{expr: "100 - usage_idle", values: []float64{40}, wantFields: "usage_idle", want: 60},
+		{expr: "a / a", values: []float64{0}, wantFields: "a", want: math.NaN()},
+		{expr: "a * 1e-5 + 2.5E+1 - 1e2", values: []float64{1e5}, wantFields: "a", want: -74},
+		{expr: "e - 1e-1", values: []float64{1}, wantFields: "e", want: 0.9},
+	}
+	for _, c := range cases {
+		expr, err := parseFieldExpression(c.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.expr, err)
+			continue
+		}
+		if got := strings.Join(expr.fields, ","); got != c.wantFields {
+			t.Errorf("%s: incorrect fields: got %s want %s", c.expr, got, c.wantFields)
+		}
+		if got := expr.eval(c.values); got != c.want && !(math.IsNaN(got) && math.IsNaN(c.want)) {
+			t.Errorf("%s: incorrect value: got %v want %v", c.expr, got, c.want)
+		}
+	}
+
+	for _, expr := range []string{"", "a +", "(a + b", "a b", "a % b", "2 * 3", "1.2.3 + a", "a.b", "1e + a", "a + 1e-"} {
+		if _, err := parseFieldExpression(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+// expressionRows mocks the points of series at 1h, 2h and 3h into each of
+// their days: the hour for usage_user, and ten times the hour plus the host
+// for usage_system, whose series of host_1 has no point at 3h.
+func expressionRows(stmt string, args []interface{}) ([][]interface{}, error) {
+	rows, err := countRows(stmt, args)
+	if err != nil {
+		return nil, err
+	}
+	series := args[0].(string)
+	kept := rows[:0]
+	for _, row := range rows {
+		v := expressionValue(series, time.Unix(0, row[0].(int64)).UTC().Hour())
+		if math.IsNaN(v) {
+			continue
+		}
+		row[1] = v
+		kept = append(kept, row)
+	}
+	return kept, nil
+}
+
+// expressionValue returns the value mocked by expressionRows at an hour,
+// NaN if there is no point.
+func expressionValue(series string, hour int) float64 {
+	host := 0.0
+	if strings.HasPrefix(series, "cpu,hostname=host_1#") {
+		host = 1
+	}
+	switch {
+	case strings.Contains(series, "#usage_user#"):
+		return float64(hour)
+	case host == 1 && hour == 3:
+		return math.NaN()
+	}
+	return 10*float64(hour) + host
+}
+
+func TestFieldExpressionAggregation(t *testing.T) {
+	csi := newTestClientSideIndex(2, 1, "usage_user", "usage_system", "usage_idle")
+	q := newTestHLQuery("avg", "", testStart, testStart.Add(4*time.Hour), 2*time.Hour)
+	q.FieldExpression = []byte("usage_user + usage_system")
+
+	// the server aggregation plan cannot compute it:
+	qe := &mockQueryExecutor{respond: expressionRows}
+	qp, err := NewHLQueryExecutor(qe, csi, 0).plan(q, HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithServerAggregation})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := qp.(*QueryPlanWithoutServerAggregation); !ok {
+		t.Errorf("incorrect plan: got %T want %T", qp, &QueryPlanWithoutServerAggregation{})
+	}
+	results, err := qp.Execute(context.Background(), qe)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the series of both fields of both hosts, but not usage_idle:
+	if got := qe.Calls(); got != 4 {
+		t.Errorf("incorrect number of CQL queries: got %d want 4", got)
+	}
+
+	// the average of the sums of the points of both fields at each
+	// timestamp, skipping host_1 at 3h, where usage_system has no point:
+	want := make([]float64, 2)
+	for b, hours := range [][]int{{1}, {2, 3}} {
+		sum, n := 0.0, 0
+		for _, host := range []string{"host_0", "host_1"} {
+			for _, h := range hours {
+				user := expressionValue("cpu,hostname="+host+"#usage_user#", h)
+				system := expressionValue("cpu,hostname="+host+"#usage_system#", h)
+				if math.IsNaN(user) || math.IsNaN(system) {
+					continue
+				}
+				sum += user + system
+				n++
+			}
+		}
+		want[b] = sum / float64(n)
+	}
+	if len(results) != 2 {
+		t.Fatalf("incorrect number of results: got %d want 2", len(results))
+	}
+	for i, r := range results {
+		if len(r.Values) != 1 || math.Abs(r.Values[0]-want[i]) > 1e-9 {
+			t.Errorf("bucket %d: incorrect values: got %v want [%v]", i, r.Values, want[i])
+		}
+	}
+}
+
+func TestFieldExpressionInvalid(t *testing.T) {
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	cases := []struct {
+		aggr string
+		expr string
+	}{
+		{aggr: "avg", expr: "usage_user +"},
+		{aggr: "", expr: "usage_user * 2"},
+		{aggr: "share_sum", expr: "usage_user * 2"},
+		{aggr: "avg,max", expr: "usage_user * 2"},
+		{aggr: "count_all", expr: "usage_user * 2"},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery(c.aggr, "", testStart, testStart.Add(time.Hour), 0)
+		q.FieldExpression = []byte(c.expr)
+		if _, err := q.ToQueryPlanWithoutServerAggregation(csi); err == nil {
+			t.Errorf("%s of %s: expected an error", c.aggr, c.expr)
+		} else if _, ok := err.(*InvalidQueryError); !ok {
+			t.Errorf("%s of %s: incorrect error: got %v", c.aggr, c.expr, err)
+		}
+	}
+}
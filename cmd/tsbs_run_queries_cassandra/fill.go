@@ -0,0 +1,121 @@
+package main
+
+import "strings"
+
+const (
+	FillModeNull     = 1 // leave empty buckets absent
+	FillModePrevious = 2
+	FillModeLinear   = 3
+	FillModeNone     = 4
+)
+
+// fillResults replaces the absent values of time-ordered (ascending or
+// descending) CQLResults according to a fill mode, like InfluxDB's fill():
+//
+// - FillModePrevious carries the last known value forward in time,
+// - FillModeLinear interpolates between the nearest known values, by time,
+// - FillModeNone drops the results without any value at all,
+// - FillModeNull leaves the results as they are.
+//
+// Absent values without a known value before (or, for FillModeLinear, after)
+// them in time stay absent. Values are filled in place.
+func fillResults(results []CQLResult, mode int) []CQLResult {
+	switch mode {
+	case FillModePrevious, FillModeLinear:
+		if len(results) == 0 {
+			return results
+		}
+		order := ascendingOrder(results)
+		for v := range results[0].Values {
+			fillValue(results, order, v, mode)
+		}
+		for i := range results {
+			results[i].compactAbsent()
+		}
+		return results
+	case FillModeNone:
+		filtered := results[:0]
+		for _, r := range results {
+			if !r.allAbsent() {
+				filtered = append(filtered, r)
+			}
+		}
+		return filtered
+	default:
+		return results
+	}
+}
+
+// fillResultsPerMeasurement fills the results of each measurement of a
+// query of several measurements (see QueryPlanPerMeasurement) separately,
+// so that values are not carried across measurements, and likewise for each
+// tag group (see QueryPlanPerTagGroup).
+func fillResultsPerMeasurement(results []CQLResult, mode int) []CQLResult {
+	return perResultGroup(results, func(group []CQLResult) []CQLResult {
+		return fillResults(group, mode)
+	})
+}
+
+// perResultGroup applies f to the consecutive results of each measurement
+// and group of tags, and concatenates what it returns in place.
+func perResultGroup(results []CQLResult, f func([]CQLResult) []CQLResult) []CQLResult {
+	out := results[:0]
+	for start := 0; start < len(results); {
+		end := start + 1
+		for end < len(results) && results[end].Measurement == results[start].Measurement &&
+			strings.Join(results[end].Tags, ",") == strings.Join(results[start].Tags, ",") {
+			end++
+		}
+		out = append(out, f(results[start:end])...)
+		start = end
+	}
+	return out
+}
+
+// ascendingOrder returns the indexes of time-ordered (ascending or
+// descending) results in ascending time order.
+func ascendingOrder(results []CQLResult) []int {
+	order := make([]int, len(results))
+	descending := len(results) > 0 && results[len(results)-1].Start().Before(results[0].Start())
+	for i := range order {
+		if descending {
+			order[i] = len(results) - 1 - i
+		} else {
+			order[i] = i
+		}
+	}
+	return order
+}
+
+// fillValue fills the absent v-th values of results, visited in order.
+func fillValue(results []CQLResult, order []int, v int, mode int) {
+	prev := -1 // position in order of the last known value
+	for pos, i := range order {
+		if !results[i].IsAbsent(v) {
+			if mode == FillModeLinear && prev >= 0 {
+				interpolate(results, order[prev:pos+1], v)
+			}
+			prev = pos
+			continue
+		}
+		if mode == FillModePrevious && prev >= 0 {
+			results[i].Values[v] = results[order[prev]].Values[v]
+			results[i].Absent[v] = false
+		}
+	}
+}
+
+// interpolate fills the absent v-th values of the results between the first
+// and last of span, which are known, linearly by the start time of each.
+func interpolate(results []CQLResult, span []int, v int) {
+	first, last := &results[span[0]], &results[span[len(span)-1]]
+	x0 := float64(first.Start().UnixNano())
+	x1 := float64(last.Start().UnixNano())
+	y0, y1 := first.Values[v], last.Values[v]
+	for _, i := range span[1 : len(span)-1] {
+		r := &results[i]
+		x := float64(r.Start().UnixNano())
+		r.Values[v] = y0 + (x-x0)/(x1-x0)*(y1-y0)
+		r.Absent[v] = false
+	}
+}
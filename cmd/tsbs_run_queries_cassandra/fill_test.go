@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// resultValues returns the first value of each result, with nil for absent.
+func resultValues(results []CQLResult) []*float64 {
+	values := make([]*float64, len(results))
+	for i, r := range results {
+		if !r.IsAbsent(0) {
+			values[i] = float64Ptr(r.Values[0])
+		}
+	}
+	return values
+}
+
+func TestFillResults(t *testing.T) {
+	n := func() *float64 { return nil }
+	v := float64Ptr
+	cases := []struct {
+		desc string
+		mode int
+		in   []*float64
+		want []*float64
+	}{
+		{desc: "null", mode: FillModeNull, in: []*float64{n(), v(1), n(), v(3), n()}, want: []*float64{n(), v(1), n(), v(3), n()}},
+		{desc: "previous interior", mode: FillModePrevious, in: []*float64{v(1), n(), n(), v(4)}, want: []*float64{v(1), v(1), v(1), v(4)}},
+		{desc: "previous edges", mode: FillModePrevious, in: []*float64{n(), v(2), n()}, want: []*float64{n(), v(2), v(2)}},
+		{desc: "linear interior", mode: FillModeLinear, in: []*float64{v(1), n(), n(), v(4), n(), v(0)}, want: []*float64{v(1), v(2), v(3), v(4), v(2), v(0)}},
+		{desc: "linear edges", mode: FillModeLinear, in: []*float64{n(), v(2), n(), v(6), n()}, want: []*float64{n(), v(2), v(4), v(6), n()}},
+		{desc: "none interior", mode: FillModeNone, in: []*float64{v(1), n(), v(3)}, want: []*float64{v(1), v(3)}},
+		{desc: "none edges", mode: FillModeNone, in: []*float64{n(), v(2), n()}, want: []*float64{v(2)}},
+		{desc: "all absent", mode: FillModeLinear, in: []*float64{n(), n()}, want: []*float64{n(), n()}},
+	}
+	for _, c := range cases {
+		values := make([][]*float64, len(c.in))
+		for i, x := range c.in {
+			values[i] = []*float64{x}
+		}
+		got := resultValues(fillResults(newTestCQLResults(t, values...), c.mode))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: incorrect values: got %v want %v", c.desc, derefs(got), derefs(c.want))
+		}
+	}
+}
+
+func TestFillResultsDescending(t *testing.T) {
+	results := newTestCQLResults(t, []*float64{float64Ptr(1)}, []*float64{nil}, []*float64{float64Ptr(5)}, []*float64{nil})
+	for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+		results[i], results[j] = results[j], results[i]
+	}
+	// previous in time is the next result of a descending slice:
+	got := resultValues(fillResults(results, FillModePrevious))
+	want := []*float64{float64Ptr(5), float64Ptr(5), float64Ptr(1), float64Ptr(1)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect values: got %v want %v", derefs(got), derefs(want))
+	}
+	if results[0].Absent != nil {
+		t.Errorf("Absent not reset for a fully filled result")
+	}
+}
+
+// derefs formats values for error messages.
+func derefs(values []*float64) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		if v == nil {
+			out[i] = "null"
+		} else {
+			out[i] = *v
+		}
+	}
+	return out
+}
+
+func TestFillResultsPerMeasurement(t *testing.T) {
+	results := newTestCQLResults(t,
+		[]*float64{float64Ptr(1)},
+		[]*float64{nil},
+		[]*float64{nil},
+		[]*float64{float64Ptr(2)},
+	)
+	for i := range results {
+		results[i].Measurement = []string{"cpu", "cpu", "mem", "mem"}[i]
+	}
+	filled := fillResultsPerMeasurement(results, FillModePrevious)
+	got := make([]string, len(filled))
+	for i, r := range filled {
+		got[i] = r.Measurement + " " + r.valuesString()
+	}
+	// the first mem bucket has no previous value of its own measurement
+	want := []string{"cpu [1]", "cpu [1]", "mem [null]", "mem [2]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect fill: got %v want %v", got, want)
+	}
+
+	filled = fillResultsPerMeasurement(filled, FillModeNone)
+	if got := len(filled); got != 3 {
+		t.Errorf("incorrect number of results with fill none: got %d want %d", got, 3)
+	}
+}
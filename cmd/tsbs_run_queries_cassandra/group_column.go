@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+// A GroupColumn is a clustering column of a series table, preceding
+// timestamp_ns, holding the start (in nanoseconds) of the interval of its
+// Resolution that each point is in, e.g. hour_ns with the primary key
+// (series_id, hour_ns, timestamp_ns). The server can then aggregate the
+// points of every interval of a series at once, with a GROUP BY on it.
+type GroupColumn struct {
+	Column     string        // e.g. "hour_ns"
+	Resolution time.Duration // e.g. one hour
+}
+
+// parseGroupColumns parses a comma-separated list of group columns (from
+// -group-columns) of the form "series_table:column=resolution", e.g.
+// "series_double:hour_ns=1h", into the GroupColumn of each series table.
+func parseGroupColumns(s string) (map[string]GroupColumn, error) {
+	columns := map[string]GroupColumn{}
+	if len(s) == 0 {
+		return columns, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.FieldsFunc(entry, func(r rune) bool { return r == ':' || r == '=' })
+		if len(parts) != 3 || strings.Count(entry, ":") != 1 || strings.Count(entry, "=") != 1 {
+			return nil, fmt.Errorf("invalid group column %q: want series_table:column=resolution", entry)
+		}
+		for _, name := range parts[:2] {
+			if err := validateCQLIdentifier(name); err != nil {
+				return nil, fmt.Errorf("invalid group column %q: %v", entry, err)
+			}
+		}
+		resolution, err := time.ParseDuration(parts[2])
+		if err != nil || resolution <= 0 {
+			return nil, fmt.Errorf("invalid group column %q: bad resolution %q", entry, parts[2])
+		}
+		if _, ok := columns[parts[0]]; ok {
+			return nil, fmt.Errorf("invalid group column %q: table %s already has one", entry, parts[0])
+		}
+		columns[parts[0]] = GroupColumn{Column: parts[1], Resolution: resolution}
+	}
+	return columns, nil
+}
+
+// withGroupColumns sets the GroupColumn of each series to that of its
+// table, if any.
+func withGroupColumns(series []Series, columns map[string]GroupColumn) []Series {
+	for i := range series {
+		if gc, ok := columns[series[i].Table]; ok {
+			series[i].GroupColumn = &gc
+		} else {
+			series[i].GroupColumn = nil
+		}
+	}
+	return series
+}
+
+// isGroupableAggregation reports whether the server computes an aggregation
+// itself, so that it can aggregate the intervals of a GroupColumn: the
+// others are computed by the client from the raw values.
+func isGroupableAggregation(label string) bool {
+	switch label {
+	case "min", "max", "sum", "count", "avg":
+		return true
+	}
+	return false
+}
+
+// canGroupOnServer reports whether the server aggregation plan of the query
+// can aggregate the time buckets tis (in time order) of any series with a
+// GroupColumn by one CQL query each (see groupedRange), rather than by one
+// per time bucket. Calendar and explicit buckets, -inclusive-end, whose end
+// point is in no interval of its own, -time-weighted-avg and -cql-template
+// always use one per time bucket.
+func (q *HLQuery) canGroupOnServer(tis []*utils.TimeInterval) bool {
+	return len(tis) > 0 && q.GroupByDuration > 0 && len(q.GroupByCalendar) == 0 && len(q.TimeBuckets) == 0 &&
+		isGroupableAggregation(string(q.AggregationType)) && !inclusiveEnd && !timeWeightedAvg && cqlTemplate == nil
+}
+
+// groupedRange returns the time range of the points of the series in the
+// time buckets tis (in time order) of the query, and whether a GROUP BY on
+// its GroupColumn aggregates them into those buckets exactly: i.e. the range
+// and the buckets within it are aligned to its resolution, and the
+// GroupByDuration is a multiple of it, the resolution itself for averages,
+// as the mean of the averages of the intervals of a bucket is not the
+// average of the bucket.
+func (q *HLQuery) groupedRange(s *Series, tis []*utils.TimeInterval) (start, end time.Time, ok bool) {
+	gc := s.GroupColumn
+	if gc == nil || q.GroupByDuration%gc.Resolution != 0 || (string(q.AggregationType) == "avg" && q.GroupByDuration != gc.Resolution) {
+		return start, end, false
+	}
+	start, end = q.TimeStart, q.TimeEnd
+	if first := tis[0].Start(); first.After(start) {
+		start = first
+	}
+	if last := tis[len(tis)-1].End(); last.Before(end) {
+		end = last
+	}
+	if s.TimeInterval.Start().After(start) {
+		start = s.TimeInterval.Start()
+	}
+	if s.TimeInterval.End().Before(end) {
+		end = s.TimeInterval.End()
+	}
+	if !start.Before(end) {
+		return start, end, false
+	}
+	n := int64(gc.Resolution)
+	if start.UnixNano()%n != 0 || end.UnixNano()%n != 0 {
+		return start, end, false
+	}
+	for _, ti := range tis {
+		if ti.Start().After(start) && ti.Start().Before(end) && ti.Start().UnixNano()%n != 0 {
+			return start, end, false
+		}
+	}
+	return start, end, true
+}
+
+// NewGroupedCQLQuery builds a CQLQuery aggregating the points of a series
+// over each interval of its GroupColumn, using prepared CQL statements. Each
+// row holds the start of an interval and its aggregate; intervals without
+// points have no row. The time range must be aligned to the resolution of
+// the column, as it selects whole intervals (see groupedRange).
+func NewGroupedCQLQuery(aggrLabel, tableName, rowName string, gc *GroupColumn, timeStartNanos, timeEndNanos int64) CQLQuery {
+	rowParts := strings.Split(rowName, "#")
+	return CQLQuery{
+		PreparableQueryString: fmt.Sprintf("SELECT %s, %s(%s) FROM %s WHERE series_id = ? AND %s >= ? AND %s < ? GROUP BY %s", gc.Column, aggrLabel, valueColumn, tableName, gc.Column, gc.Column, gc.Column),
+		Args:                  []interface{}{rowName, timeStartNanos, timeEndNanos},
+		Field:                 rowParts[len(rowParts)-2],
+	}
+}
+
+// A groupedRow is the aggregate of an interval of a GroupColumn, read by one
+// of the GroupedCQLQueries of a QueryPlanWithServerAggregation.
+type groupedRow struct {
+	q     *CQLQuery
+	value float64
+}
+
+// executeGrouped executes the GroupedCQLQueries of the plan, returning their
+// rows by the time bucket, of buckets (in time order), that their interval
+// is in.
+func (qp *QueryPlanWithServerAggregation) executeGrouped(ctx context.Context, qe QueryExecutor, buckets []*utils.TimeInterval) (map[*utils.TimeInterval][]groupedRow, error) {
+	if len(qp.GroupedCQLQueries) == 0 {
+		return nil, nil
+	}
+	// Like time buckets, the queries are executed on up to MaxConcurrency
+	// goroutines, each storing its rows at its own position; they are then
+	// gathered in query order:
+	queryRows := make([]map[*utils.TimeInterval][]groupedRow, len(qp.GroupedCQLQueries))
+	err := executeConcurrently(ctx, len(qp.GroupedCQLQueries), qp.MaxConcurrency, func(ctx context.Context, i int) error {
+		var err error
+		queryRows[i], err = qp.executeGroupedQuery(ctx, qe, &qp.GroupedCQLQueries[i], buckets)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	rows := map[*utils.TimeInterval][]groupedRow{}
+	for _, qr := range queryRows {
+		for b, r := range qr {
+			rows[b] = append(rows[b], r...)
+		}
+	}
+	return rows, nil
+}
+
+// executeGroupedQuery runs one of the GroupedCQLQueries, and returns its rows
+// by the time bucket of their interval.
+func (qp *QueryPlanWithServerAggregation) executeGroupedQuery(ctx context.Context, qe QueryExecutor, q *CQLQuery, buckets []*utils.TimeInterval) (map[*utils.TimeInterval][]groupedRow, error) {
+	rows := map[*utils.TimeInterval][]groupedRow{}
+	var intervalNs int64
+	put := func(v float64) {
+		ts := time.Unix(0, intervalNs)
+		// the first bucket ending after the start of the interval:
+		j := sort.Search(len(buckets), func(j int) bool { return buckets[j].End().After(ts) })
+		if j < len(buckets) && !ts.Before(buckets[j].Start()) {
+			rows[buckets[j]] = append(rows[buckets[j]], groupedRow{q: q, value: v})
+		}
+	}
+
+	// as in executeBucket, aggregates over no rows are NULL, and counts are
+	// bigints:
+	iter := qe.Query(ctx, q.PreparableQueryString, q.BoundArgs()...)
+	if qp.AggregatorLabel == "count" {
+		var n int64
+		for iter.Scan(&intervalNs, &n) {
+			put(float64(n))
+		}
+	} else {
+		var x *float64
+		for iter.Scan(&intervalNs, &x) {
+			if x != nil {
+				put(*x)
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
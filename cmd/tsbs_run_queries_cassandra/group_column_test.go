@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGroupColumns(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    map[string]GroupColumn
+		wantErr bool
+	}{
+		{in: "", want: map[string]GroupColumn{}},
+		{
+			in: "series_double:hour_ns=1h,series_bigint:day_ns=24h",
+			want: map[string]GroupColumn{
+				"series_double": {Column: "hour_ns", Resolution: time.Hour},
+				"series_bigint": {Column: "day_ns", Resolution: day},
+			},
+		},
+		{in: "hour_ns=1h", wantErr: true},
+		{in: "series_double:hour_ns", wantErr: true},
+		{in: "series_double:hour-ns=1h", wantErr: true},
+		{in: "series_double:hour_ns=hourly", wantErr: true},
+		{in: "series_double:hour_ns=0s", wantErr: true},
+		{in: "series_double:hour_ns=1h,series_double:day_ns=24h", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseGroupColumns(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: incorrect group columns: got %v want %v", c.in, got, c.want)
+		}
+	}
+}
+
+// groupedRows mocks the GROUP BY hour_ns of a series whose aggregate over
+// each hour is the number of the hour in the day, with 2 points per hour.
+func groupedRows(stmt string, args []interface{}) ([][]interface{}, error) {
+	rows := [][]interface{}{}
+	for ns := args[1].(int64); ns < args[2].(int64); ns += int64(time.Hour) {
+		hour := float64(time.Unix(0, ns).UTC().Hour())
+		if strings.HasPrefix(stmt, "SELECT hour_ns, count(") {
+			rows = append(rows, []interface{}{ns, int64(2)})
+		} else {
+			rows = append(rows, []interface{}{ns, hour})
+		}
+	}
+	return rows, nil
+}
+
+func TestGroupedCQLQuery(t *testing.T) {
+	columns := map[string]GroupColumn{testTable: {Column: "hour_ns", Resolution: time.Hour}}
+	csi := NewClientSideIndex(withGroupColumns(newTestClientSideIndex(2, 1, "usage_user").CopyOfSeriesCollection(), columns))
+
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(4*time.Hour), 2*time.Hour)
+	qp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// one query per series, rather than one per series and time bucket:
+	cqs := qp.AllCQLQueries()
+	if len(cqs) != 2 || len(qp.GroupedCQLQueries) != 2 {
+		t.Fatalf("incorrect number of CQL queries: got %d (%d grouped) want 2", len(cqs), len(qp.GroupedCQLQueries))
+	}
+	wantStmt := "SELECT hour_ns, max(value) FROM " + testTable + " WHERE series_id = ? AND hour_ns >= ? AND hour_ns < ? GROUP BY hour_ns"
+	if got := cqs[0].PreparableQueryString; got != wantStmt {
+		t.Errorf("incorrect CQL: got %s want %s", got, wantStmt)
+	}
+	if got, want := cqs[0].Args[1:], []interface{}{testStart.UnixNano(), testStart.Add(4 * time.Hour).UnixNano()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect time range: got %v want %v", got, want)
+	}
+
+	cases := []struct {
+		aggr    string
+		groupBy time.Duration
+		want    []float64
+	}{
+		{aggr: "max", groupBy: 2 * time.Hour, want: []float64{1, 3}},
+		{aggr: "min", groupBy: 2 * time.Hour, want: []float64{0, 2}},
+		{aggr: "sum", groupBy: 2 * time.Hour, want: []float64{2, 10}},
+		{aggr: "count", groupBy: 2 * time.Hour, want: []float64{8, 8}},
+		{aggr: "avg", groupBy: time.Hour, want: []float64{0, 1, 2, 3}},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery(c.aggr, "usage_user", testStart, testStart.Add(4*time.Hour), c.groupBy)
+		qp, err := q.ToQueryPlanWithServerAggregation(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.aggr, err)
+		}
+		for _, concurrency := range []int{1, 2} {
+			qp.MaxConcurrency = concurrency
+			qe := &mockQueryExecutor{respond: groupedRows}
+			results, err := qp.Execute(context.Background(), qe)
+			if err != nil {
+				t.Fatalf("%s: concurrency %d: unexpected error: %v", c.aggr, concurrency, err)
+			}
+			if qe.Calls() != 2 {
+				t.Errorf("%s: concurrency %d: incorrect number of round-trips: got %d want 2", c.aggr, concurrency, qe.Calls())
+			}
+			got := make([]float64, len(results))
+			for i, r := range results {
+				got[i] = r.Values[0]
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%s: concurrency %d: incorrect values: got %v want %v", c.aggr, concurrency, got, c.want)
+			}
+		}
+	}
+
+	// the grouped queries of both series are executed at once:
+	qp.MaxConcurrency = 2
+	qe := &mockQueryExecutor{respond: groupedRows, delay: 50 * time.Millisecond}
+	start := time.Now()
+	if _, err := qp.Execute(context.Background(), qe); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("grouped queries not executed concurrently: took %v", elapsed)
+	}
+}
+
+func TestGroupedCQLQueryFallback(t *testing.T) {
+	columns := map[string]GroupColumn{testTable: {Column: "hour_ns", Resolution: time.Hour}}
+	csi := NewClientSideIndex(withGroupColumns(newTestClientSideIndex(1, 1, "usage_user").CopyOfSeriesCollection(), columns))
+	cases := []struct {
+		desc    string
+		aggr    string
+		start   time.Time
+		groupBy time.Duration
+		grouped bool
+	}{
+		{desc: "aligned", aggr: "sum", start: testStart, groupBy: 2 * time.Hour, grouped: true},
+		{desc: "unaligned start", aggr: "sum", start: testStart.Add(30 * time.Minute), groupBy: 2 * time.Hour},
+		{desc: "finer than the column", aggr: "sum", start: testStart, groupBy: 30 * time.Minute},
+		{desc: "average of several intervals", aggr: "avg", start: testStart, groupBy: 2 * time.Hour},
+		{desc: "client-side aggregation", aggr: "stddev", start: testStart, groupBy: time.Hour},
+		{desc: "whole range", aggr: "max", start: testStart, groupBy: 0},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery(c.aggr, "usage_user", c.start, testStart.Add(4*time.Hour), c.groupBy)
+		qp, err := q.ToQueryPlanWithServerAggregation(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if got := len(qp.GroupedCQLQueries) > 0; got != c.grouped {
+			t.Errorf("%s: incorrect grouping on the server: got %v want %v", c.desc, got, c.grouped)
+		}
+	}
+
+	// without group columns, each bucket has its queries:
+	q := newTestHLQuery("sum", "usage_user", testStart, testStart.Add(4*time.Hour), 2*time.Hour)
+	qp, err := q.ToQueryPlanWithServerAggregation(newTestClientSideIndex(1, 1, "usage_user"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(qp.GroupedCQLQueries) != 0 || len(qp.AllCQLQueries()) != 2 {
+		t.Errorf("no group columns: incorrect CQL queries: %v", qp.AllCQLQueries())
+	}
+}
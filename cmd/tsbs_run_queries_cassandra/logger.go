@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Levels of the messages of a leveledLogger, from the most verbose.
+const (
+	LogLevelDebug = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// A leveledLogger writes the messages of at least its level as logfmt lines
+// of structured fields, e.g.
+//
+//	time=2016-01-01T00:00:00Z level=debug msg="query planned" query_id=3 label="cpu-max-all-1"
+//
+// Callers building fields on a hot path check Enabled first, so that
+// nothing is allocated for messages that are not written. It is safe for
+// concurrent use.
+type leveledLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level int
+	now   func() time.Time
+}
+
+// logs is the logger of the benchmarker (set by -log-level).
+var logs = newLeveledLogger(os.Stderr, LogLevelInfo)
+
+// newLeveledLogger returns a leveledLogger writing the messages of at least
+// level to w.
+func newLeveledLogger(w io.Writer, level int) *leveledLogger {
+	return &leveledLogger{w: w, level: level, now: time.Now}
+}
+
+// Enabled reports whether messages of the given level are written.
+func (l *leveledLogger) Enabled(level int) bool {
+	return level >= l.level
+}
+
+// Log writes a message of the given level, if enabled, with fields given as
+// alternating keys and values.
+func (l *leveledLogger) Log(level int, msg string, keyvals ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("time=")
+	b.WriteString(l.now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(" level=")
+	b.WriteString(logLevelNames[level])
+	b.WriteString(" msg=")
+	b.WriteString(logfmtValue(msg))
+	for i := 0; i < len(keyvals); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(keyvals[i]))
+		b.WriteByte('=')
+		if i+1 < len(keyvals) {
+			b.WriteString(logfmtValue(fmt.Sprint(keyvals[i+1])))
+		}
+	}
+	b.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, b.String())
+}
+
+// logfmtValue quotes a value if it is empty or has spaces, quotes or an
+// equals sign.
+func logfmtValue(s string) string {
+	if len(s) == 0 || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// parseLogLevel parses the name of a log level, e.g. "warn".
+func parseLogLevel(s string) (int, error) {
+	for level, name := range logLevelNames {
+		if s == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (choices: %s)", s, strings.Join(logLevelNames, ", "))
+}
+
+// queryLogKey is the key of the HLQuery whose statements a context executes,
+// so that messages about them (e.g. their retries) can name it.
+type queryLogKey struct{}
+
+// withQueryLog returns a context whose statements are logged as those of q.
+func withQueryLog(ctx context.Context, q *HLQuery) context.Context {
+	return context.WithValue(ctx, queryLogKey{}, q)
+}
+
+// queryLogFields returns the fields naming the HLQuery of a context, if any.
+func queryLogFields(ctx context.Context) []interface{} {
+	q, ok := ctx.Value(queryLogKey{}).(*HLQuery)
+	if !ok {
+		return nil
+	}
+	return []interface{}{"query_id", q.GetID(), "label", string(q.HumanLabel)}
+}
+
+// loggingQueryExecutor is a QueryExecutor logging each statement it
+// executes at debug level. It is only installed at that level, so that it
+// costs nothing otherwise.
+type loggingQueryExecutor struct {
+	qe QueryExecutor
+}
+
+// Query logs the statement, then executes it.
+func (e *loggingQueryExecutor) Query(ctx context.Context, stmt string, args ...interface{}) ResultIter {
+	fields := append(queryLogFields(ctx), "stmt", stmt, "args", fmt.Sprintf("%v", args))
+	logs.Log(LogLevelDebug, "CQL query", fields...)
+	return e.qe.Query(ctx, stmt, args...)
+}
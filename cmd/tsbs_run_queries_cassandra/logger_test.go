@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeveledLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLeveledLogger(&buf, LogLevelWarn)
+	l.now = func() time.Time { return testStart }
+
+	l.Log(LogLevelInfo, "not written", "a", 1)
+	l.Log(LogLevelWarn, "query timed out", "query_id", 3, "label", "cpu max", "empty", "", "odd")
+	want := `time=2016-01-01T00:00:00Z level=warn msg="query timed out" query_id=3 label="cpu max" empty="" odd=` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("incorrect log:\ngot  %q\nwant %q", got, want)
+	}
+	if l.Enabled(LogLevelDebug) || !l.Enabled(LogLevelError) {
+		t.Errorf("incorrect enabled levels for warn")
+	}
+
+	for _, name := range []string{"debug", "info", "warn", "error"} {
+		level, err := parseLogLevel(name)
+		if err != nil || logLevelNames[level] != name {
+			t.Errorf("%s: incorrect level: got %d (%v)", name, level, err)
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Errorf("expected an error for an unknown level")
+	}
+}
+
+func TestDebugLogsQueryID(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l *leveledLogger) { logs = l }(logs)
+	logs = newLeveledLogger(&buf, LogLevelDebug)
+
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(2*time.Hour), time.Hour)
+	q.SetID(7)
+	q.HumanLabel = []byte("cpu-max")
+	hlqe := NewHLQueryExecutor(&loggingQueryExecutor{qe: &mockQueryExecutor{respond: serverAggregationRows}}, csi, 0)
+	if _, _, _, err := hlqe.Do(q, HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithServerAggregation}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msgs := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if !strings.Contains(line, " query_id=7 label=cpu-max ") {
+			t.Errorf("log without the query ID: %s", line)
+		}
+		msg := strings.SplitN(strings.SplitN(line, ` msg="`, 2)[1], `"`, 2)[0]
+		msgs[msg]++
+	}
+	want := map[string]int{"query planned": 1, "CQL query": 2, "query executed": 1}
+	for msg, n := range want {
+		if msgs[msg] != n {
+			t.Errorf("incorrect number of %q logs: got %d want %d", msg, msgs[msg], n)
+		}
+	}
+
+	// nothing is logged at info level:
+	buf.Reset()
+	logs = newLeveledLogger(&buf, LogLevelInfo)
+	if _, _, _, err := hlqe.Do(q, HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithServerAggregation}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("unexpected logs at info level: %s", buf.String())
+	}
+}
@@ -8,8 +8,14 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gocql/gocql"
@@ -39,8 +45,56 @@ var (
 var (
 	daemonURL      string
 	aggrPlanLabel  string
+	subQueryPar    int
+	queryTimeout   time.Duration
+	dryRun         bool
+	noExecute      bool
+	timezone       *time.Location
 	requestTimeout time.Duration
 	csiTimeout     time.Duration
+	csiFile        string
+	respFmtLabel   string
+	responsesFile  string
+	fillModeLabel  string
+	skipEmpty      bool
+	movingAvg      int
+	movingAvgLabel string
+	maxPoints      int
+	reducerLabel   string
+	maxBuckets     int
+	overflowLabel  string
+	nanPolicyLabel string
+	maxRetries     int
+	retryBackoff   time.Duration
+	maxInFlight    int
+	prewarm        bool
+	verifyRepeat   int
+	verifyTol      float64
+	sessionOpts    SessionOptions
+	pushgatewayURL string
+	pushInterval   time.Duration
+	pushJob        string
+	pushInstance   string
+	metricsListen  string
+	metricsFile    string
+	timingsFile    string
+	batchReads     bool
+	varianceLabel  string
+	sharesLabel    string
+	dedupCache     bool
+	pageSize       int
+	trace          bool
+	tracing        bool
+	shutdownGrace  time.Duration
+	seriesIds      []string            // read by all queries, if set
+	valuePreds     []ValuePredicate    // of raw and last point queries
+	tableName      TableNameResolver   // nil for the table of each series
+	keyspaces      []string            // of the series, if not only -db-name
+	readKeyspace   string              // of all CQL queries, if set
+	slotInterval   time.Duration       // between the expected points of a series
+	rollups        map[string][]Rollup // of each series table, by -rollup-tables
+	// of each series table, by -group-columns:
+	groupColumns map[string]GroupColumn
 )
 
 // Helpers for choice-like flags:
@@ -49,14 +103,86 @@ var (
 		"server": AggrPlanTypeWithServerAggregation,
 		"client": AggrPlanTypeWithoutServerAggregation,
 	}
+	responseFormatChoices = map[string]int{
+		"text":   ResponseFormatText,
+		"json":   ResponseFormatJSON,
+		"line":   ResponseFormatLine,
+		"binary": ResponseFormatBinary,
+	}
+	varianceModeChoices = map[string]int{
+		"population": VarianceModePopulation,
+		"sample":     VarianceModeSample,
+	}
+	zeroTotalSharesChoices = map[string]int{
+		"null": ZeroTotalSharesNull,
+		"zero": ZeroTotalSharesZero,
+	}
+	fillModeChoices = map[string]int{
+		"null":     FillModeNull,
+		"previous": FillModePrevious,
+		"linear":   FillModeLinear,
+		"none":     FillModeNone,
+	}
+	bucketOverflowChoices = map[string]int{
+		"error":   BucketOverflowError,
+		"coarsen": BucketOverflowCoarsen,
+	}
+	nanPolicyChoices = map[string]int{
+		"keep":  NaNPolicyKeep,
+		"drop":  NaNPolicyDrop,
+		"zero":  NaNPolicyZero,
+		"error": NaNPolicyError,
+	}
+	movingAvgStartChoices = map[string]int{
+		"null":    MovingAverageStartNull,
+		"partial": MovingAverageStartPartial,
+	}
+	downsampleChoices = map[string]int{
+		"avg":  DownsampleAvg,
+		"max":  DownsampleMax,
+		"lttb": DownsampleLTTB,
+	}
 )
 
 // Global vars:
 var (
-	runner   *query.BenchmarkRunner
-	aggrPlan int
-	csi      *ClientSideIndex
-	session  *gocql.Session
+	runner         *query.BenchmarkRunner
+	aggrPlan       int
+	respFmt        int
+	fillMode       int
+	movingAvgStart int
+	downsample     int
+	bucketOverflow int
+	nanPolicy      int
+	csi            *ClientSideIndex
+	session        *gocql.Session
+	qe             QueryExecutor
+	stmtCache      *preparedStatementCache
+	retrier        *retryingQueryExecutor
+	limiter        *inFlightLimiter // nil unless -max-in-flight is set
+	breaker        *circuitBreaker  // nil unless -breaker-threshold is set
+	phases         *phaseStats      // nil unless -phase-timings is set
+	valStats       *valueStats      // nil unless -value-stats is set
+	abort          *failFast        // nil unless -fail-fast is set
+	timedOut       uint64           // accessed atomically
+	failed         uint64           // accessed atomically
+	invalid        uint64           // accessed atomically
+	cancelled      uint64           // accessed atomically
+	noData         uint64           // accessed atomically
+	overBuckets    uint64           // accessed atomically
+	nonFinite      uint64           // accessed atomically
+	metrics        *queryMetrics    // nil unless -prometheus-pushgateway, -metrics-listen or -metrics-file is set
+	fanOut         fanOutHistogram
+	selected       selectivityStats
+	repeats        repeatStats
+	validated      validationStats
+	timings        *timingsWriter      // nil unless -timings-csv is set
+	respDump       *responseDumpWriter // nil unless -print-responses-format=binary
+	resCache       *resultCache        // nil unless -dedup-cache is set
+
+	// shutdownCtx is cancelled once the -shutdown-grace after an interrupt
+	// has elapsed, cancelling the queries still in flight.
+	shutdownCtx context.Context
 )
 
 // Parse args:
@@ -64,10 +190,84 @@ func init() {
 	var config query.BenchmarkRunnerConfig
 	config.AddToFlagSet(pflag.CommandLine)
 
-	pflag.String("host", "localhost:9042", "Cassandra hostname and port combination.")
+	pflag.String("host", "localhost:9042", "Cassandra hostname and port combination, or comma-separated list of them.")
+	pflag.String("hosts-srv", "", "DNS SRV record resolved at startup to the Cassandra hosts, instead of -host.")
+	pflag.String("username", "", "Username of the Cassandra clusters with authentication (or set "+usernameEnv+").")
+	pflag.String("password", "", "Password of -username (or set "+passwordEnv+", so that it does not show in process listings).")
+	pflag.String("auth-provider", "password", "Authenticator of the credentials (choices: password).")
+	pflag.String("ssl-ca", "", "PEM file of the CA certificates verifying the Cassandra nodes, enabling TLS (defaults to the system ones).")
+	pflag.String("ssl-cert", "", "PEM file of the client certificate presented to the Cassandra nodes, enabling TLS (with -ssl-key).")
+	pflag.String("ssl-key", "", "PEM file of the key of -ssl-cert.")
+	pflag.Bool("ssl-insecure-skip-verify", false, "Enable TLS without verifying the certificates and host names of the Cassandra nodes.")
+	pflag.Duration("connect-timeout", 600*time.Millisecond, "Maximum time to connect to each host, and to run a probe query at startup (the gocql default).")
 	pflag.String("aggregation-plan", "", "Aggregation plan (choices: server, client)")
+	pflag.String("fill", "null", "How to fill empty time buckets (choices: null, previous, linear, none).")
+	pflag.Int("max-buckets", 0, "Maximum number of time buckets of a query (0 for no limit); see -bucket-overflow-policy.")
+	pflag.String("bucket-overflow-policy", "error", "What to do with queries over -max-buckets (choices: error, coarsen).")
+	pflag.Int("moving-average", 0, "Replace the values of the time buckets of results by their trailing moving average over that many buckets, if above 1.")
+	pflag.String("moving-average-start", "null", "Values of the first buckets, before a full -moving-average window (choices: null, partial).")
+	pflag.Int("max-points", 0, "Downsample the time buckets of results to at most that many points, per measurement and group of tags (0 for no limit); see -max-points-reducer.")
+	pflag.String("max-points-reducer", "lttb", "How to downsample results over -max-points (choices: avg, max, lttb).")
+	pflag.String("nan-policy", "keep", "What to do with the NaN and infinite values of results (choices: keep, drop, zero, error); drop makes them absent, error fails their query.")
+	pflag.Bool("skip-empty", false, "Omit time buckets without any data from the results, even for counts and sums (which are otherwise zero-filled).")
+	pflag.Duration("slot-interval", 10*time.Second, "Interval between the points of each series, from which count_all aggregations compute the number of points expected in each time bucket.")
+	pflag.String("variance", "population", "Variance computed by the variance and stddev aggregations (choices: population, sample).")
+	pflag.String("zero-total-shares", "null", "Shares of the series of time buckets whose total is zero, for the share_ aggregations (choices: null, zero).")
+	pflag.Bool("dedup-cache", false, "Execute identical queries only once, serving the results of repeats from a cache (reported under their own <label>-cached statistics).")
+	pflag.Bool("trace", false, "Record the series_ids that fed each result, printed with -print-responses (for debugging tag matching).")
+	pflag.Bool("phase-timings", false, "Print the mean time of the plan build and of the execution of queries, and their shares of the total, in the summary.")
+	pflag.Bool("value-stats", false, "Print the minimum, mean and maximum of the result values of each query type in the summary, to sanity check their range.")
+	pflag.Bool("enable-tracing", false, "Trace every CQL query to count the rows Cassandra scans for each query, written to -timings-csv (at the cost of extra load on the cluster).")
+	pflag.String("log-level", "info", "Level of the messages logged to stderr (choices: debug, info, warn, error); debug logs the planning and execution of each query, and each CQL query.")
+	pflag.Bool("dry-run", false, "Print the CQL queries of each query instead of executing them.")
+	pflag.Bool("no-execute", false, "Only build the plan of each query, then print those that are invalid and the number of valid and invalid queries.")
+	pflag.Duration("shutdown-grace", 30*time.Second, "On SIGINT or SIGTERM, how long to wait for the queries in flight before cancelling them and printing the stats so far.")
+	pflag.Duration("query-timeout", 0, "Maximum execution time of each query, after which it is cancelled and recorded as timed out (0 for no limit).")
+	pflag.Float64("breaker-threshold", 0, "Error rate, from 0 to 1, of the last -breaker-window queries above which all workers pause for -breaker-cooldown, then resume once a probe query succeeds; failed queries are then recorded rather than ending the run (0 to disable).")
+	pflag.Duration("breaker-cooldown", 10*time.Second, "Duration of the pause of the circuit breaker of -breaker-threshold, before its probe query.")
+	pflag.Bool("fail-fast", false, "Abort the run on the first query failing to execute (or timing out) or invalid, exiting with a non-zero status and the failed query, after the stats of the queries processed so far.")
+	pflag.Int("breaker-window", 100, "Number of the last queries whose error rate the circuit breaker of -breaker-threshold watches.")
+	pflag.String("timezone", "UTC", "Timezone (IANA name, e.g. America/New_York) whose midnights delimit time buckets of whole days.")
+	pflag.Bool("batch-reads", false, "Merge the CQL queries of each time bucket into one per field, with series_id IN (only used by the server aggregation plan, for min, max, sum and count).")
+	pflag.Int("page-size", 0, "Number of rows per page fetched by raw queries (0 for the driver default of 5000).")
+	pflag.Int("subquery-parallelism", 1, "Number of time buckets of a query to execute concurrently (only used by the server aggregation plan).")
+	pflag.String("consistency", "ONE", "Consistency level of reads (choices: ONE, TWO, THREE, QUORUM, ALL, LOCAL_QUORUM, LOCAL_ONE).")
+	pflag.Bool("dc-aware-routing", false, "Route queries to hosts in the local datacenter (see -local-dc).")
+	pflag.String("local-dc", "", "Name of the local datacenter, used with -dc-aware-routing.")
+	pflag.Int("conns-per-host", 0, "Number of connections opened to each host, shared by all workers (0 for the driver default of 2).")
+	pflag.Bool("prewarm-pool", false, "Establish all the connections of the pool, with -conns-per-host trivial queries per host at once, before the benchmark clock starts (reporting how long it took).")
+	pflag.Bool("token-aware", true, "Route each CQL query to a replica of its series (falling back to -dc-aware-routing or round robin).")
+	pflag.Bool("inclusive-end", false, "Select the points at the end time of queries, with <= rather than < (the last time bucket then includes its end).")
+	pflag.Bool("time-weighted-avg", false, "Weight the average of each series row by the duration of the time bucket it covers, e.g. in buckets clamped to the query time range (server aggregation plan only).")
+	pflag.String("value-column", "value", "Column of the series tables holding the values of points.")
+	pflag.String("timestamp-column", "timestamp_ns", "Column of the series tables holding the timestamps of points, in nanoseconds (their clustering column).")
+	pflag.String("cql-template", "", "Go text/template of the CQL statements of queries, e.g. 'SELECT {{.Aggregation}} FROM {{.Table}} WHERE series_id = {{.SeriesID}} AND timestamp_ns >= {{.TimeStart}} AND timestamp_ns < {{.TimeEnd}} ALLOW FILTERING' (fields: Aggregation, Table, OrderBy; arguments: SeriesID, TimeStart, TimeEnd).")
+	pflag.String("table-name-template", "", "Go text/template of the table to read each series from, for schemas partitioning their tables, e.g. '{{.Table}}_{{.Start.Format \"20060102\"}}' (fields: Table, Measurement, Field, Start, End; defaults to the table of the series).")
+	pflag.String("series-ids", "", "Space-separated list of series ids (which hold commas), of rows (e.g. cpu,hostname=host_0#usage_user#2016-01-01) or of series across days (e.g. cpu,hostname=host_0#usage_user), that are the only series read by queries, instead of those matching their tags.")
+	pflag.String("value-predicates", "", "Comma-separated list of predicates on the values of points (e.g. '> 90' or '>=10,<20') filtering them on the server in raw and last point queries, which needs a secondary index on the value column or -allow-filtering.")
+	pflag.Bool("allow-filtering", false, "End the raw queries with -value-predicates with ALLOW FILTERING, for tables without a secondary index on their value column (Cassandra then reads all the points of the time range of each series to filter them).")
+	pflag.String("keyspaces", "", "Comma-separated list of keyspaces sharing the schema (e.g. one per tenant) whose series are all queried, with keyspace-qualified tables (defaults to -db-name only).")
+	pflag.String("read-keyspace", "", "Keyspace read by all the CQL queries, e.g. a snapshot of -db-name, whatever the keyspace the client-side index was read from (which selects the series).")
+	pflag.String("rollup-tables", "", "Comma-separated list of rollup tables pre-aggregating series tables, as series_table:rollup_table=resolution (e.g. series_double:series_double_1h=1h), read by the server aggregation plan for the time buckets aligned to their resolution.")
+	pflag.String("group-columns", "", "Comma-separated list of clustering columns of series tables holding the start of an interval of each point, as series_table:column=resolution (e.g. series_double:hour_ns=1h), which the server aggregation plan groups by to aggregate all the aligned time buckets of a series with one CQL query.")
+	pflag.String("client-side-index-file", "", "File caching the client side index: loaded if it exists, otherwise written after reading the index from the cluster.")
 	pflag.Duration("read-timeout", 1*time.Second, "Maximum request timeout.")
+	pflag.String("timings-csv", "", "File to write the timing of each query to, as CSV (for offline analysis).")
+	pflag.String("print-responses-format", "text", "Format of responses printed with -print-responses (choices: text, json, line, binary); binary responses are written to -responses-file.")
+	pflag.String("responses-file", "", "File to write the responses of -print-responses-format=binary to.")
+	pflag.String("decode-responses", "", "Print the responses of a file written with -print-responses-format=binary as JSON to stdout, then exit.")
+	pflag.Int("max-retries", 0, "Maximum number of times to retry a CQL query failing with a transient error (timeout, unavailable).")
+	pflag.Duration("retry-backoff-base", 10*time.Millisecond, "Delay before the first retry of a CQL query, doubled for each further retry.")
+	pflag.Int("max-in-flight", 0, "Maximum number of CQL queries in flight at once across all workers (0 for no limit).")
+	pflag.Int("verify-repeat", 1, "Number of times to execute each query, flagging the queries whose results differ across repetitions (only the first is timed).")
+	pflag.Float64("verify-tolerance", 1e-9, "Maximum difference between the values of repetitions considered equal, relative to their magnitude when above 1 (see -verify-repeat).")
 	pflag.Duration("client-side-index-timeout", 10*time.Second, "Maximum client-side index timeout (only used at initialization).")
+	pflag.String("prometheus-pushgateway", "", "URL of a Prometheus pushgateway to periodically push query metrics to (e.g. http://localhost:9091).")
+	pflag.Duration("prometheus-push-interval", 10*time.Second, "Interval between pushes of metrics to the Prometheus pushgateway.")
+	pflag.String("prometheus-job", "tsbs_run_queries_cassandra", "Job label of the metrics pushed to the Prometheus pushgateway.")
+	pflag.String("prometheus-instance", "", "Instance label of the metrics pushed to the Prometheus pushgateway (defaults to the hostname).")
+	pflag.String("metrics-listen", "", "Address to serve query metrics on at /metrics while the benchmark runs, in the OpenMetrics or Prometheus text format (e.g. :8080).")
+	pflag.String("metrics-file", "", "File to write the query metrics to at the end of the run, in the OpenMetrics format.")
 
 	pflag.Parse()
 
@@ -83,33 +283,543 @@ func init() {
 
 	daemonURL = viper.GetString("host")
 	aggrPlanLabel = viper.GetString("aggregation-plan")
+	subQueryPar = viper.GetInt("subquery-parallelism")
+	batchReads = viper.GetBool("batch-reads")
+	pageSize = viper.GetInt("page-size")
+	queryTimeout = viper.GetDuration("query-timeout")
+	breakerThreshold := viper.GetFloat64("breaker-threshold")
+	breakerCooldown := viper.GetDuration("breaker-cooldown")
+	breakerWindow := viper.GetInt("breaker-window")
+	if viper.GetBool("phase-timings") {
+		phases = &phaseStats{}
+	}
+	if viper.GetBool("value-stats") {
+		valStats = &valueStats{}
+	}
+	shutdownGrace = viper.GetDuration("shutdown-grace")
+	dryRun = viper.GetBool("dry-run")
+	noExecute = viper.GetBool("no-execute")
+	dedupCache = viper.GetBool("dedup-cache")
+	trace = viper.GetBool("trace")
+	tracing = viper.GetBool("enable-tracing")
 	requestTimeout = viper.GetDuration("read-timeout")
 	csiTimeout = viper.GetDuration("client-side-index-timeout")
+	csiFile = viper.GetString("client-side-index-file")
+	respFmtLabel = viper.GetString("print-responses-format")
+	responsesFile = viper.GetString("responses-file")
+	fillModeLabel = viper.GetString("fill")
+	skipEmpty = viper.GetBool("skip-empty")
+	movingAvg = viper.GetInt("moving-average")
+	maxBuckets = viper.GetInt("max-buckets")
+	overflowLabel = viper.GetString("bucket-overflow-policy")
+	nanPolicyLabel = viper.GetString("nan-policy")
+	movingAvgLabel = viper.GetString("moving-average-start")
+	maxPoints = viper.GetInt("max-points")
+	reducerLabel = viper.GetString("max-points-reducer")
+	varianceLabel = viper.GetString("variance")
+	sharesLabel = viper.GetString("zero-total-shares")
+	slotInterval = viper.GetDuration("slot-interval")
+	maxRetries = viper.GetInt("max-retries")
+	retryBackoff = viper.GetDuration("retry-backoff-base")
+	maxInFlight = viper.GetInt("max-in-flight")
+	prewarm = viper.GetBool("prewarm-pool")
+	verifyRepeat = viper.GetInt("verify-repeat")
+	verifyTol = viper.GetFloat64("verify-tolerance")
+	sessionOpts.DCAwareRouting = viper.GetBool("dc-aware-routing")
+	sessionOpts.LocalDC = viper.GetString("local-dc")
+	sessionOpts.TokenAware = viper.GetBool("token-aware")
+	sessionOpts.ConnectTimeout = viper.GetDuration("connect-timeout")
+	sessionOpts.ConnsPerHost = viper.GetInt("conns-per-host")
+	sessionOpts.Authenticator, err = newAuthenticator(viper.GetString("auth-provider"), credential("username", usernameEnv), credential("password", passwordEnv))
+	if err != nil {
+		log.Fatalf("invalid authentication: %v", err)
+	}
+	sessionOpts.TLS, err = newSslOptions(viper.GetString("ssl-ca"), viper.GetString("ssl-cert"), viper.GetString("ssl-key"), viper.GetBool("ssl-insecure-skip-verify"))
+	if err != nil {
+		log.Fatalf("invalid TLS options: %v", err)
+	}
+	pushgatewayURL = viper.GetString("prometheus-pushgateway")
+	pushInterval = viper.GetDuration("prometheus-push-interval")
+	pushJob = viper.GetString("prometheus-job")
+	pushInstance = viper.GetString("prometheus-instance")
+	metricsListen = viper.GetString("metrics-listen")
+	metricsFile = viper.GetString("metrics-file")
+	if len(pushgatewayURL) > 0 || len(metricsListen) > 0 || len(metricsFile) > 0 {
+		metrics = &queryMetrics{}
+	}
+	timingsFile = viper.GetString("timings-csv")
 
-	if _, ok := aggrPlanChoices[aggrPlanLabel]; !ok {
-		log.Fatal("invalid aggregation plan")
+	logLevel, err := parseLogLevel(viper.GetString("log-level"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	logs = newLeveledLogger(os.Stderr, logLevel)
+
+	if record := viper.GetString("hosts-srv"); len(record) > 0 {
+		ctx, cancel := context.Background(), func() {}
+		if sessionOpts.ConnectTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, sessionOpts.ConnectTimeout)
+		}
+		daemonURL, err = resolveSRVHosts(ctx, net.DefaultResolver, record)
+		cancel()
+		if err != nil {
+			log.Fatal(err)
+		}
+		logs.Log(LogLevelInfo, "resolved hosts", "srv", record, "hosts", daemonURL)
+	}
+
+	if _, ok := responseFormatChoices[respFmtLabel]; !ok {
+		log.Fatal("invalid print responses format")
+	}
+	respFmt = responseFormatChoices[respFmtLabel]
+	if respFmt == ResponseFormatBinary && config.PrintResponses && len(responsesFile) == 0 {
+		log.Fatal("-print-responses-format=binary needs a -responses-file")
+	}
+
+	if _, ok := fillModeChoices[fillModeLabel]; !ok {
+		log.Fatal("invalid fill mode")
+	}
+	fillMode = fillModeChoices[fillModeLabel]
+
+	if maxBuckets < 0 {
+		log.Fatal("invalid maximum of time buckets")
+	}
+	if _, ok := bucketOverflowChoices[overflowLabel]; !ok {
+		log.Fatal("invalid bucket overflow policy")
+	}
+	bucketOverflow = bucketOverflowChoices[overflowLabel]
+
+	if _, ok := nanPolicyChoices[nanPolicyLabel]; !ok {
+		log.Fatal("invalid NaN policy")
+	}
+	nanPolicy = nanPolicyChoices[nanPolicyLabel]
+
+	if movingAvg < 0 {
+		log.Fatal("invalid moving average window")
+	}
+	if _, ok := movingAvgStartChoices[movingAvgLabel]; !ok {
+		log.Fatal("invalid moving average start")
+	}
+	movingAvgStart = movingAvgStartChoices[movingAvgLabel]
+
+	if maxPoints < 0 {
+		log.Fatal("invalid max points")
+	}
+	if _, ok := downsampleChoices[reducerLabel]; !ok {
+		log.Fatal("invalid max points reducer")
+	}
+	downsample = downsampleChoices[reducerLabel]
+
+	if _, ok := varianceModeChoices[varianceLabel]; !ok {
+		log.Fatal("invalid variance")
+	}
+	varianceMode = varianceModeChoices[varianceLabel]
+
+	if _, ok := zeroTotalSharesChoices[sharesLabel]; !ok {
+		log.Fatal("invalid zero total shares")
+	}
+	zeroTotalShares = zeroTotalSharesChoices[sharesLabel]
+
+	timezone, err = time.LoadLocation(viper.GetString("timezone"))
+	if err != nil {
+		log.Fatalf("invalid timezone: %v", err)
+	}
+
+	inclusiveEnd = viper.GetBool("inclusive-end")
+	timeWeightedAvg = viper.GetBool("time-weighted-avg")
+	valueColumn = viper.GetString("value-column")
+	if err := validateCQLIdentifier(valueColumn); err != nil {
+		log.Fatalf("invalid value column: %v", err)
+	}
+	timestampColumn = viper.GetString("timestamp-column")
+	if err := validateCQLIdentifier(timestampColumn); err != nil {
+		log.Fatalf("invalid timestamp column: %v", err)
+	}
+
+	seriesIds = strings.Fields(viper.GetString("series-ids"))
+	valuePreds, err = parseValuePredicates(viper.GetString("value-predicates"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	allowFiltering = viper.GetBool("allow-filtering")
+	if len(valuePreds) > 0 && !allowFiltering {
+		logs.Log(LogLevelWarn, "value predicates need a secondary index on the value column, otherwise Cassandra rejects the queries without -allow-filtering", "column", valueColumn)
+	} else if len(valuePreds) > 0 {
+		logs.Log(LogLevelWarn, "value predicates with ALLOW FILTERING read all the points of the time range of each series", "column", valueColumn)
+	}
+
+	if ks := viper.GetString("keyspaces"); len(ks) > 0 {
+		keyspaces = strings.Split(ks, ",")
+		for _, k := range keyspaces {
+			if err := validateCQLIdentifier(k); err != nil {
+				log.Fatalf("invalid keyspace: %v", err)
+			}
+		}
+	}
+	readKeyspace = viper.GetString("read-keyspace")
+	if len(readKeyspace) > 0 {
+		if err := validateCQLIdentifier(readKeyspace); err != nil {
+			log.Fatalf("invalid read keyspace: %v", err)
+		}
+		if len(keyspaces) > 1 {
+			log.Fatal("-read-keyspace cannot be combined with several -keyspaces")
+		}
+	}
+
+	if tmpl := viper.GetString("table-name-template"); len(tmpl) > 0 {
+		tableName, err = newTemplateTableNameResolver(tmpl)
+		if err != nil {
+			log.Fatalf("invalid table name template: %v", err)
+		}
+	}
+
+	if tmpl := viper.GetString("cql-template"); len(tmpl) > 0 {
+		if batchReads {
+			log.Fatal("-batch-reads cannot be used with -cql-template")
+		}
+		cqlTemplate, err = parseCQLTemplate(tmpl)
+		if err != nil {
+			log.Fatalf("invalid CQL template: %v", err)
+		}
+	}
+
+	rollups, err = parseRollupTables(viper.GetString("rollup-tables"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	groupColumns, err = parseGroupColumns(viper.GetString("group-columns"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sessionOpts.Consistency, err = parseReadConsistency(viper.GetString("consistency"))
+	if err != nil {
+		log.Fatalf("invalid consistency: %v", err)
+	}
+	if sessionOpts.ConnsPerHost < 0 {
+		log.Fatal("invalid connections per host")
+	}
+	if maxInFlight < 0 {
+		log.Fatal("invalid maximum of queries in flight")
+	}
+	if breakerThreshold < 0 || breakerThreshold >= 1 {
+		log.Fatal("invalid circuit breaker threshold")
+	}
+	if breakerThreshold > 0 {
+		if breakerCooldown <= 0 || breakerWindow < 1 {
+			log.Fatal("invalid circuit breaker cooldown or window")
+		}
+		breaker = newCircuitBreaker(breakerThreshold, breakerCooldown, breakerWindow)
+	}
+	if breaker != nil && viper.GetBool("fail-fast") {
+		log.Fatal("-fail-fast cannot be combined with -breaker-threshold")
+	}
+	if verifyRepeat < 1 {
+		log.Fatal("invalid number of repetitions")
+	}
+	if sessionOpts.DCAwareRouting && len(sessionOpts.LocalDC) == 0 {
+		log.Fatal("-dc-aware-routing requires -local-dc")
+	}
+	if len(pushgatewayURL) > 0 && pushInterval <= 0 {
+		log.Fatal("invalid prometheus push interval")
+	}
+	if len(pushInstance) == 0 {
+		pushInstance, _ = os.Hostname()
 	}
-	aggrPlan = aggrPlanChoices[aggrPlanLabel]
 
 	runner = query.NewBenchmarkRunner(config)
+	if viper.GetBool("fail-fast") {
+		abort = &failFast{stop: runner.Stop}
+	}
 }
 
 func main() {
+	// deferred first, to exit once the others have run:
+	defer func() {
+		if abort != nil {
+			abort.exitOnFailure()
+		}
+		if n := runner.Regressions(); n > 0 {
+			log.Fatalf("%d regressions from the baseline", n)
+		}
+	}()
+	if name := viper.GetString("decode-responses"); len(name) > 0 {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out := bufio.NewWriter(os.Stdout)
+		if err := decodeResponseDump(f, out); err != nil {
+			log.Fatalf("cannot decode responses from %s: %v", name, err)
+		}
+		if err := out.Flush(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// there is no default plan, which must be chosen for each run (and is
+	// not needed to decode responses):
+	if _, ok := aggrPlanChoices[aggrPlanLabel]; !ok {
+		log.Fatal("invalid aggregation plan")
+	}
+	aggrPlan = aggrPlanChoices[aggrPlanLabel]
+
 	// Make client-side index:
-	session = NewCassandraSession(daemonURL, runner.DatabaseName(), csiTimeout)
-	csi = NewClientSideIndex(FetchSeriesCollection(session))
-	session.Close()
+	csi = newClientSideIndex()
+	csi.TableName = tableName
+	csi.ReadKeyspace = readKeyspace
+	for _, id := range csi.unknownSeriesIds(seriesIds) {
+		logs.Log(LogLevelWarn, "unknown series id", "series_id", id)
+	}
+
+	if len(timingsFile) > 0 {
+		f, err := os.Create(timingsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		timings = newTimingsWriter(f, time.Second)
+		defer func() {
+			if err := timings.Close(); err != nil {
+				log.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if respFmt == ResponseFormatBinary && runner.DoPrintResponses() {
+		f, err := os.Create(responsesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		respDump, err = newResponseDumpWriter(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func() {
+			if err := respDump.Flush(); err != nil {
+				log.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if noExecute {
+		runner.Run(&query.CassandraPool, newProcessor)
+		if err := validated.writeTo(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if dryRun {
+		runner.Run(&query.CassandraPool, newProcessor)
+		if err := fanOut.writeTo(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		if err := selected.writeTo(os.Stdout, len(csi.seriesIds)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	// Make database connection pool:
-	session = NewCassandraSession(daemonURL, runner.DatabaseName(), requestTimeout)
+	session = NewCassandraSession(daemonURL, runner.DatabaseName(), requestTimeout, sessionOpts)
 	defer session.Close()
+	fmt.Println(describePool(daemonURL, sessionOpts, runner.Workers))
+	if len(readKeyspace) > 0 {
+		if err := checkKeyspace(context.Background(), NewGocqlQueryExecutor(session), readKeyspace); err != nil {
+			log.Fatalf("invalid -read-keyspace: %v", err)
+		}
+	}
+	if prewarm {
+		hosts, err := clusterHosts(context.Background(), NewGocqlQueryExecutor(session))
+		if err != nil {
+			log.Fatalf("cannot list the nodes of the cluster: %v", err)
+		}
+		n := poolSize(daemonURL, sessionOpts, hosts)
+		start := time.Now()
+		if err := prewarmPool(context.Background(), NewGocqlQueryExecutor(session), n); err != nil {
+			log.Fatalf("cannot prewarm the CQL connection pool: %v", err)
+		}
+		fmt.Printf("CQL connection pool prewarmed with %d queries in %v\n", n, time.Since(start))
+	}
+	stmtCache = newPreparedStatementCache(NewGocqlPreparer(session))
+	if dedupCache {
+		resCache = newResultCache()
+	}
+	qe = stmtCache
+	if logs.Enabled(LogLevelDebug) {
+		qe = &loggingQueryExecutor{qe: qe}
+	}
+	if maxInFlight > 0 {
+		// below the retrier, so that the backoff between attempts
+		// does not hold a slot:
+		limiter = newInFlightLimiter(qe, maxInFlight)
+		qe = limiter
+	}
+	if maxRetries > 0 {
+		retrier = newRetryingQueryExecutor(qe, maxRetries, retryBackoff)
+		qe = retrier
+	}
+
+	if len(pushgatewayURL) > 0 {
+		pusher := newPushgatewayPusher(pushgatewayURL, pushJob, pushInstance, metrics, queryRetries)
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			pusher.Run(pushInterval, done)
+			close(stopped)
+		}()
+		defer func() {
+			close(done)
+			<-stopped
+		}()
+	}
+
+	if len(metricsListen) > 0 {
+		addr, err := serveMetrics(metricsListen, metrics, queryRetries)
+		if err != nil {
+			log.Fatalf("cannot serve metrics: %v", err)
+		}
+		logs.Log(LogLevelInfo, "serving metrics", "addr", addr.String())
+	}
 
+	var cancel context.CancelFunc
+	shutdownCtx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if abort != nil {
+		abort.cancel = cancel
+	}
+	stopSignals := handleShutdownSignals(runner, shutdownGrace, cancel)
 	runner.Run(&query.CassandraPool, newProcessor)
+	stopSignals()
+
+	hits, misses := stmtCache.Stats()
+	fmt.Printf("CQL prepared statement cache: %d hits, %d misses\n", hits, misses)
+	if resCache != nil {
+		hits, misses := resCache.Stats()
+		fmt.Printf("Query result cache: %d hits, %d misses\n", hits, misses)
+	}
+	if retrier != nil {
+		fmt.Printf("CQL query retries: %d\n", retrier.Retries())
+	}
+	if limiter != nil {
+		fmt.Printf("CQL queries in flight: max %d (limit %d)\n", limiter.MaxInFlight(), maxInFlight)
+	}
+	if queryTimeout > 0 {
+		fmt.Printf("Queries timed out: %d\n", atomic.LoadUint64(&timedOut))
+	}
+	if breaker != nil || abort != nil {
+		fmt.Printf("Queries failed: %d\n", atomic.LoadUint64(&failed))
+	}
+	if breaker != nil {
+		fmt.Printf("Circuit breaker trips: %d\n", breaker.Trips())
+	}
+	if n := atomic.LoadUint64(&invalid); n > 0 {
+		fmt.Printf("Queries invalid: %d\n", n)
+	}
+	if n := atomic.LoadUint64(&cancelled); n > 0 {
+		fmt.Printf("Queries cancelled at shutdown: %d\n", n)
+	}
+	fmt.Printf("Queries without data: %d\n", atomic.LoadUint64(&noData))
+	if maxBuckets > 0 {
+		fmt.Printf("Queries over %d time buckets (%s): %d\n", maxBuckets, overflowLabel, atomic.LoadUint64(&overBuckets))
+	}
+	if n := atomic.LoadUint64(&nonFinite); n > 0 {
+		fmt.Printf("Queries with non-finite values (%s): %d\n", nanPolicyLabel, n)
+	}
+	if phases != nil {
+		if err := phases.writeTo(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if valStats != nil {
+		if err := valStats.writeTo(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := fanOut.writeTo(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+	if err := selected.writeTo(os.Stdout, len(csi.seriesIds)); err != nil {
+		log.Fatal(err)
+	}
+	if err := repeats.writeTo(os.Stdout, verifyRepeat); err != nil {
+		log.Fatal(err)
+	}
+	if len(metricsFile) > 0 {
+		if err := writeMetricsFile(metricsFile, metrics, queryRetries()); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// queryRetries returns the number of retries of CQL queries so far.
+func queryRetries() uint64 {
+	if retrier == nil {
+		return 0
+	}
+	return retrier.Retries()
+}
+
+// newClientSideIndex loads the client-side index from csiFile, if it
+// exists; otherwise it is fetched from the cluster, then written to csiFile.
+func newClientSideIndex() *ClientSideIndex {
+	if len(csiFile) > 0 {
+		f, err := os.Open(csiFile)
+		if err == nil {
+			defer f.Close()
+			csi, err := LoadClientSideIndex(bufio.NewReader(f))
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(rollups) == 0 && len(groupColumns) == 0 {
+				return csi
+			}
+			// rollups and group columns are not part of the file, which
+			// only holds the data:
+			return NewClientSideIndex(withGroupColumns(withRollups(csi.CopyOfSeriesCollection(), rollups), groupColumns))
+		} else if !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+	}
+
+	s := NewCassandraSession(daemonURL, runner.DatabaseName(), csiTimeout, sessionOpts)
+	series, err := FetchSeriesCollection(context.Background(), NewGocqlQueryExecutor(s), keyspaces...)
+	s.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	csi := NewClientSideIndex(withGroupColumns(withRollups(series, rollups), groupColumns))
+
+	if len(csiFile) > 0 {
+		f, err := os.Create(csiFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := bufio.NewWriter(f)
+		if err := csi.SerializeTo(w); err != nil {
+			log.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			log.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return csi
 }
 
 type processor struct {
-	qe   *HLQueryExecutor
-	opts *HLQueryExecutorDoOptions
+	qe      *HLQueryExecutor
+	opts    *HLQueryExecutorDoOptions
+	metrics *workerMetrics // nil unless metrics is set
 }
 
 func newProcessor() query.Processor { return &processor{} }
@@ -117,29 +827,179 @@ func newProcessor() query.Processor { return &processor{} }
 func (p *processor) Init(workerNumber int) {
 	p.opts = &HLQueryExecutorDoOptions{
 		AggregationPlan:      aggrPlan,
+		SubQueryParallelism:  subQueryPar,
 		Debug:                runner.DebugLevel(),
 		PrettyPrintResponses: runner.DoPrintResponses(),
+		ResponseFormat:       respFmt,
+		ResponseDump:         respDump,
+		Timeout:              queryTimeout,
+		DryRun:               dryRun,
+		NoExecute:            noExecute,
+		FillMode:             fillMode,
+		SkipEmpty:            skipEmpty,
+		MovingAverage:        movingAvg,
+		MovingAverageStart:   movingAvgStart,
+		MaxPoints:            maxPoints,
+		Downsample:           downsample,
+		MaxBuckets:           maxBuckets,
+		BucketOverflow:       bucketOverflow,
+		NaNPolicy:            nanPolicy,
+		BatchReads:           batchReads,
+		ResultCache:          resCache,
+		PageSize:             pageSize,
+		Trace:                trace,
+		Tracing:              tracing,
+		SlotInterval:         slotInterval,
+		VerifyRepeat:         verifyRepeat,
+		VerifyTolerance:      verifyTol,
+		ValueStats:           valStats != nil,
+		Context:              shutdownCtx,
+	}
+	p.qe = NewHLQueryExecutor(qe, csi, runner.DebugLevel())
+	if metrics != nil {
+		p.metrics = metrics.newWorker()
 	}
-	p.qe = NewHLQueryExecutor(session, csi, runner.DebugLevel())
+}
+
+// statLabel returns label followed by suffix, in a new slice: appending to
+// label itself could write into the spare capacity it shares with the query
+// or with other labels.
+func statLabel(label []byte, suffix string) []byte {
+	l := make([]byte, 0, len(label)+len(suffix))
+	l = append(l, label...)
+	return append(l, suffix...)
+}
+
+// labelledStats returns the stats of a query reported under its own label,
+// the query label with a suffix such as "-timeout", and left out of the
+// overall latencies, so that timed out, cancelled, failed, invalid or cached
+// queries do not skew those of the others. The time to build the plan of a
+// planned query is still reported under its "-qp" label.
+func labelledStats(labels [][]byte, suffix string, planned bool, qpLagMs, lagMs float64) []*query.Stat {
+	var stats []*query.Stat
+	if planned {
+		stats = append(stats, query.GetPartialStat().Init(labels[1], qpLagMs))
+	}
+	return append(stats, query.GetPartialStat().Init(statLabel(labels[0], suffix), lagMs))
 }
 
 func (p *processor) ProcessQuery(q query.Query, isWarm bool) ([]*query.Stat, error) {
 	cq := q.(*query.Cassandra)
-	hlq := &HLQuery{*cq}
-	hlq.ForceUTC()
+	hlq := &HLQuery{Cassandra: *cq, SeriesIds: seriesIds, TimeBuckets: timeIntervals(cq.TimeBuckets)}
+	if hlq.IsRaw() || hlq.IsLastPoint() {
+		hlq.ValuePredicates = valuePreds
+	}
+	hlq.ForceLocation(timezone)
 	labels := [][]byte{
 		q.HumanLabelName(),
-		append(q.HumanLabelName(), "-qp"...),
-		append(q.HumanLabelName(), "-req"...),
+		statLabel(q.HumanLabelName(), "-qp"),
+		statLabel(q.HumanLabelName(), "-req"),
 	}
 	if isWarm {
 		for i, l := range labels {
-			labels[i] = append(l, " (warm)"...)
+			labels[i] = statLabel(l, " (warm)")
+		}
+	}
+	probe := false
+	if breaker != nil && !noExecute {
+		ctx := p.opts.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		var err error
+		if probe, err = breaker.wait(ctx); err != nil {
+			// cancelled at shutdown while the breaker was open:
+			atomic.AddUint64(&cancelled, 1)
+			return nil, nil
+		}
+	}
+	qpLagMs, reqLagMs, info, err := p.qe.Do(hlq, *p.opts)
+	if breaker != nil && !noExecute {
+		_, isInvalid := err.(*InvalidQueryError)
+		queryFailed := err != nil && err != context.Canceled && !isInvalid
+		if breaker.observe(probe, queryFailed) {
+			logs.Log(LogLevelWarn, "circuit breaker open", "query_id", q.GetID(), "cooldown", breaker.cooldown.String())
+		} else if probe && !queryFailed {
+			logs.Log(LogLevelInfo, "circuit breaker closed", "query_id", q.GetID())
 		}
 	}
-	qpLagMs, reqLagMs, err := p.qe.Do(hlq, *p.opts)
+	if abort != nil && err != nil && err != context.Canceled {
+		abort.fail(q.GetID(), hlq, err)
+	}
+	if noExecute {
+		// all plan errors make the query invalid, without failing the
+		// run, so that they are all reported:
+		validated.observe(q.GetID(), string(q.HumanLabelName()), err)
+		return []*query.Stat{query.GetPartialStat().Init(labels[1], qpLagMs)}, nil
+	}
+	if p.metrics != nil {
+		p.metrics.observe(qpLagMs+reqLagMs, err)
+	}
+	if info.OverBuckets && !isWarm {
+		atomic.AddUint64(&overBuckets, 1)
+	}
+	if info.NonFinite > 0 && !isWarm {
+		atomic.AddUint64(&nonFinite, 1)
+	}
+	if _, ok := err.(*InvalidQueryError); !ok && !info.Cached && !isWarm {
+		// only planned queries have a fan-out, counted once per query:
+		fanOut.observe(q.GetID(), info.CQLQueries, info.Series)
+		selected.observe(q.GetID(), info.Matched)
+	}
+	if timings != nil {
+		timings.Write(queryTiming{
+			ID:         q.GetID(),
+			HumanLabel: string(q.HumanLabelName()),
+			PlanBuild:  time.Duration(qpLagMs * 1e6),
+			Execute:    time.Duration(reqLagMs * 1e6),
+			Info:       info,
+			Err:        err,
+		})
+	}
+	if err == context.DeadlineExceeded {
+		atomic.AddUint64(&timedOut, 1)
+		logs.Log(LogLevelWarn, "query timed out", "query_id", q.GetID(), "label", string(q.HumanLabelName()), "elapsed_ms", qpLagMs+reqLagMs)
+		return labelledStats(labels, "-timeout", true, qpLagMs, qpLagMs+reqLagMs), nil
+	}
+	if err == context.Canceled {
+		// cancelled at shutdown:
+		atomic.AddUint64(&cancelled, 1)
+		return labelledStats(labels, "-cancelled", true, qpLagMs, qpLagMs+reqLagMs), nil
+	}
+	if _, ok := err.(*InvalidQueryError); ok {
+		// invalid queries are not executed, nor do they fail the run:
+		atomic.AddUint64(&invalid, 1)
+		logs.Log(LogLevelWarn, "invalid query", "query_id", q.GetID(), "label", string(q.HumanLabelName()), "err", err)
+		return labelledStats(labels, "-invalid", false, qpLagMs, qpLagMs), nil
+	}
 	if err != nil {
-		return nil, err
+		logs.Log(LogLevelError, "query failed", "query_id", q.GetID(), "label", string(q.HumanLabelName()), "err", err)
+		if breaker == nil && abort == nil {
+			return nil, err
+		}
+		// With the circuit breaker, or -fail-fast aborting the run,
+		// failed queries are counted rather than panicking:
+		atomic.AddUint64(&failed, 1)
+		return labelledStats(labels, "-failed", true, qpLagMs, qpLagMs+reqLagMs), nil
+	}
+	if info.Cached {
+		// repeats served from the cache:
+		return labelledStats(labels, "-cached", false, qpLagMs, qpLagMs+reqLagMs), nil
+	}
+	if info.NoData && !isWarm {
+		// empty results may come from time ranges outside of the data,
+		// rather than from slow queries:
+		atomic.AddUint64(&noData, 1)
+		logs.Log(LogLevelDebug, "query without data", "query_id", q.GetID(), "label", string(q.HumanLabelName()))
+	}
+	if verifyRepeat > 1 {
+		repeats.observe(q.GetID(), string(q.HumanLabelName()), info.Differing)
+	}
+	if phases != nil && !isWarm {
+		phases.observe(time.Duration(qpLagMs*1e6), time.Duration(reqLagMs*1e6))
+	}
+	if valStats != nil && !isWarm {
+		valStats.observe(string(q.HumanLabelName()), info.Values)
 	}
 	// total stat
 	totalMs := qpLagMs + reqLagMs
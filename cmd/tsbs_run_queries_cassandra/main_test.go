@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/timescale/tsbs/query"
+)
+
+// writeTestQueryFile writes a file of numQueries encoded queries in dir.
+// Each query covers its own minute, so that its CQL queries identify it.
+func writeTestQueryFile(t *testing.T, dir string, numQueries int) string {
+	fileName := filepath.Join(dir, "queries.gob")
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	enc := gob.NewEncoder(f)
+	for i := 0; i < numQueries; i++ {
+		start := testStart.Add(time.Duration(i) * time.Minute)
+		q := newTestHLQuery("max", "usage_user", start, start.Add(time.Minute), time.Minute)
+		if err := enc.Encode(&q.Cassandra); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return fileName
+}
+
+func TestRunnerWorkersProcessEachQueryOnce(t *testing.T) {
+	const numQueries = 200
+	dir, err := ioutil.TempDir("", "tsbs_run_queries_cassandra")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := writeTestQueryFile(t, dir, numQueries)
+
+	var mu sync.Mutex
+	seen := map[int64]int{}
+	mock := &mockQueryExecutor{respond: func(stmt string, args []interface{}) ([][]interface{}, error) {
+		mu.Lock()
+		seen[args[1].(int64)]++
+		mu.Unlock()
+		return serverAggregationRows(stmt, args)
+	}}
+
+	oldRunner, oldCSI, oldQE, oldAggrPlan := runner, csi, qe, aggrPlan
+	defer func() { runner, csi, qe, aggrPlan = oldRunner, oldCSI, oldQE, oldAggrPlan }()
+	runner = query.NewBenchmarkRunner(query.BenchmarkRunnerConfig{Workers: 8, FileName: fileName})
+	csi = newTestClientSideIndex(1, 1, "usage_user")
+	qe = mock
+	aggrPlan = AggrPlanTypeWithServerAggregation
+
+	runner.Run(&query.CassandraPool, newProcessor)
+
+	if got := mock.Calls(); got != numQueries {
+		t.Errorf("incorrect number of CQL queries: got %d want %d", got, numQueries)
+	}
+	for i := 0; i < numQueries; i++ {
+		start := testStart.Add(time.Duration(i) * time.Minute).UnixNano()
+		if got := seen[start]; got != 1 {
+			t.Errorf("query %d processed %d times, want once", i, got)
+		}
+	}
+}
+
+func TestRunnerMaxQueries(t *testing.T) {
+	const numQueries, limit = 100, 10
+	dir, err := ioutil.TempDir("", "tsbs_run_queries_cassandra")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := writeTestQueryFile(t, dir, numQueries)
+
+	mock := &mockQueryExecutor{respond: serverAggregationRows}
+	oldRunner, oldCSI, oldQE, oldAggrPlan := runner, csi, qe, aggrPlan
+	defer func() { runner, csi, qe, aggrPlan = oldRunner, oldCSI, oldQE, oldAggrPlan }()
+	// -max-queries limits the number of queries read, whatever the workers:
+	runner = query.NewBenchmarkRunner(query.BenchmarkRunnerConfig{Workers: 8, FileName: fileName, Limit: limit})
+	csi = newTestClientSideIndex(1, 1, "usage_user")
+	qe = mock
+	aggrPlan = AggrPlanTypeWithServerAggregation
+
+	runner.Run(&query.CassandraPool, newProcessor)
+
+	if got := mock.Calls(); got != limit {
+		t.Errorf("incorrect number of CQL queries: got %d want %d", got, limit)
+	}
+}
+
+func TestRunnerShutdownSignal(t *testing.T) {
+	const numQueries, workers = 1000, 2
+	dir, err := ioutil.TempDir("", "tsbs_run_queries_cassandra")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := writeTestQueryFile(t, dir, numQueries)
+
+	oldRunner, oldCSI, oldQE, oldAggrPlan := runner, csi, qe, aggrPlan
+	oldTimings, oldShutdownCtx := timings, shutdownCtx
+	defer func() {
+		runner, csi, qe, aggrPlan = oldRunner, oldCSI, oldQE, oldAggrPlan
+		timings, shutdownCtx = oldTimings, oldShutdownCtx
+		atomic.StoreUint64(&cancelled, 0)
+	}()
+	csi = newTestClientSideIndex(1, 1, "usage_user")
+	aggrPlan = AggrPlanTypeWithServerAggregation
+
+	cases := []struct {
+		desc          string
+		delay         time.Duration
+		grace         time.Duration
+		wantCancelled uint64
+	}{
+		{desc: "queries in flight finish", delay: 10 * time.Millisecond, grace: time.Minute},
+		{desc: "queries in flight cancelled", delay: time.Minute, grace: 10 * time.Millisecond, wantCancelled: workers},
+	}
+	for _, c := range cases {
+		atomic.StoreUint64(&cancelled, 0)
+		mock := &mockQueryExecutor{respond: serverAggregationRows, delay: c.delay}
+		qe = mock
+		runner = query.NewBenchmarkRunner(query.BenchmarkRunnerConfig{Workers: workers, FileName: fileName})
+		var buf bytes.Buffer
+		timings = newTimingsWriter(&buf, time.Hour)
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithCancel(context.Background())
+		stop := handleShutdownSignals(runner, c.grace, cancel)
+
+		// interrupt once a few queries are in flight:
+		go func() {
+			for mock.Calls() < workers {
+				time.Sleep(time.Millisecond)
+			}
+			syscall.Kill(os.Getpid(), syscall.SIGINT)
+		}()
+		runner.Run(&query.CassandraPool, newProcessor)
+		stop()
+		cancel()
+		if err := timings.Close(); err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+
+		calls := mock.Calls()
+		if calls < workers || calls >= numQueries {
+			t.Errorf("%s: incorrect number of CQL queries: got %d want from %d to %d", c.desc, calls, workers, numQueries)
+		}
+		if got := atomic.LoadUint64(&cancelled); got != c.wantCancelled {
+			t.Errorf("%s: incorrect number of cancelled queries: got %d want %d", c.desc, got, c.wantCancelled)
+		}
+		// the timings of all queries started were written:
+		rows, err := csv.NewReader(&buf).ReadAll()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if got := len(rows) - 1; got != calls {
+			t.Errorf("%s: incorrect number of timings: got %d want %d", c.desc, got, calls)
+		}
+	}
+}
+
+// recordingProcessor is a query.Processor recording the fields of the
+// queries it is given, as decoded by the runner.
+type recordingProcessor struct {
+	queries [][]interface{}
+}
+
+func (p *recordingProcessor) Init(workerNumber int) {}
+
+func (p *recordingProcessor) ProcessQuery(q query.Query, isWarm bool) ([]*query.Stat, error) {
+	p.queries = append(p.queries, queryFields(q.(*query.Cassandra)))
+	return nil, nil
+}
+
+// queryFields returns copies of the fields of a query, as queries are
+// reused once processed. Empty and nil fields are the same.
+func queryFields(q *query.Cassandra) []interface{} {
+	tagsets := ""
+	for _, tagset := range q.TagSets {
+		tagsets += strings.Join(tagset, ",") + ";"
+	}
+	return []interface{}{
+		q.GetID(), string(q.HumanLabel), string(q.HumanDescription),
+		string(q.MeasurementName), string(q.FieldName), string(q.AggregationType),
+		q.TimeStart, q.TimeEnd, q.GroupByDuration, string(q.GroupByCalendar),
+		string(q.ForEveryN), string(q.WhereClause), string(q.OrderBy), q.Limit, tagsets,
+	}
+}
+
+func TestRunnerReadsQueriesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsbs_run_queries_cassandra")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := []*HLQuery{
+		newTestHLQuery("max", "usage_user,usage_system", testStart, testStart.Add(12*time.Hour), time.Hour),
+		newTestHLQuery("", "usage_user", testStart, testStart.Add(time.Hour), 0),
+	}
+	want[0].HumanDescription = []byte("max cpu over 12 hours")
+	want[0].TagSets = [][]string{{"hostname=host_0", "hostname=host_1"}, {"region=eu-west-1"}}
+	want[1].MeasurementName = []byte("cpu,mem")
+	want[1].GroupByCalendar = []byte("1w")
+	want[1].ForEveryN = []byte("hostname,1")
+	want[1].WhereClause = []byte("usage_user,>,90.0")
+	want[1].OrderBy = []byte("timestamp_ns DESC")
+	want[1].Limit = 5
+
+	fileName := filepath.Join(dir, "queries.gob")
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	enc := gob.NewEncoder(f)
+	for _, q := range want {
+		if err := enc.Encode(&q.Cassandra); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// -file reads the queries from the file rather than stdin:
+	r := query.NewBenchmarkRunner(query.BenchmarkRunnerConfig{Workers: 1, FileName: fileName})
+	p := &recordingProcessor{}
+	r.Run(&query.CassandraPool, func() query.Processor { return p })
+
+	if len(p.queries) != len(want) {
+		t.Fatalf("incorrect number of queries: got %d want %d", len(p.queries), len(want))
+	}
+	for i, got := range p.queries {
+		want[i].SetID(uint64(i))
+		if w := queryFields(&want[i].Cassandra); !reflect.DeepEqual(got, w) {
+			t.Errorf("query %d: incorrect decoded query:\ngot\n%v\nwant\n%v", i, got, w)
+		}
+	}
+}
+
+func TestStatLabel(t *testing.T) {
+	// a label with spare capacity must not be written by its suffixes:
+	label := append(make([]byte, 0, 64), "query"...)
+	timeout := statLabel(label, "-timeout")
+	failed := statLabel(label, "-failed")
+	if got := string(label); got != "query" {
+		t.Errorf("incorrect label: got %q want %q", got, "query")
+	}
+	if got := string(timeout); got != "query-timeout" {
+		t.Errorf("incorrect label: got %q want %q", got, "query-timeout")
+	}
+	if got := string(failed); got != "query-failed" {
+		t.Errorf("incorrect label: got %q want %q", got, "query-failed")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Content types of the exposition formats of queryMetrics.
+const (
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// newMetricsHandler returns the handler of the metrics served by
+// -metrics-listen at /metrics, for a sidecar to scrape while the benchmark
+// runs: in the OpenMetrics format if the scraper accepts it, otherwise in
+// the Prometheus text format. Metrics are only read when scraped, so that
+// the workers do no more than update their counters.
+func newMetricsHandler(m *queryMetrics, retries func() uint64) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		openMetrics := strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text")
+		if openMetrics {
+			w.Header().Set("Content-Type", openMetricsContentType)
+		} else {
+			w.Header().Set("Content-Type", prometheusContentType)
+		}
+		m.writeTo(w, retries(), openMetrics)
+	})
+	return mux
+}
+
+// serveMetrics serves the metrics of newMetricsHandler on addr (e.g.
+// ":8080") in the background, returning the address listened on.
+func serveMetrics(addr string, m *queryMetrics, retries func() uint64) (net.Addr, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(ln, newMetricsHandler(m, retries))
+	return ln.Addr(), nil
+}
+
+// writeMetricsFile writes the metrics to the file at path, in the
+// OpenMetrics format.
+func writeMetricsFile(path string, m *queryMetrics, retries uint64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := m.writeTo(f, retries, true); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var (
+	expositionType   = regexp.MustCompile(`^# TYPE ([a-zA-Z_:][a-zA-Z0-9_:]*) (counter|gauge|summary|histogram|untyped)$`)
+	expositionSample = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="[^"]*"(,[a-zA-Z_][a-zA-Z0-9_]*="[^"]*")*\})? (\S+)$`)
+)
+
+// parseExposition checks that an exposition of metrics is well-formed, in
+// the OpenMetrics format or in the Prometheus text one, and returns its
+// samples by name and labels. Every sample must be of the family of the
+// last TYPE line.
+func parseExposition(t *testing.T, text string, openMetrics bool) map[string]float64 {
+	samples := map[string]float64{}
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if openMetrics {
+		if lines[len(lines)-1] != "# EOF" {
+			t.Fatalf("exposition does not end with # EOF:\n%s", text)
+		}
+		lines = lines[:len(lines)-1]
+	}
+	family, typ := "", ""
+	for _, line := range lines {
+		if m := expositionType.FindStringSubmatch(line); m != nil {
+			family, typ = m[1], m[2]
+			if openMetrics && typ == "counter" && strings.HasSuffix(family, "_total") {
+				t.Errorf("counter family with a _total suffix: %s", line)
+			}
+			continue
+		}
+		m := expositionSample.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("invalid line: %q", line)
+			continue
+		}
+		name := m[1]
+		suffixes := []string{""}
+		switch {
+		case typ == "summary":
+			suffixes = []string{"", "_sum", "_count"}
+		case typ == "counter" && openMetrics:
+			suffixes = []string{"_total"}
+		}
+		ok := false
+		for _, s := range suffixes {
+			ok = ok || name == family+s
+		}
+		if !ok {
+			t.Errorf("sample %s not of the %s %s", name, typ, family)
+		}
+		v, err := strconv.ParseFloat(m[4], 64)
+		if err != nil {
+			t.Errorf("invalid value: %q", line)
+		}
+		samples[name+m[2]] = v
+	}
+	return samples
+}
+
+func TestMetricsHandler(t *testing.T) {
+	var m queryMetrics
+	ts := httptest.NewServer(newMetricsHandler(&m, func() uint64 { return 2 }))
+	defer ts.Close()
+
+	get := func(accept string) (string, string) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp.Header.Get("Content-Type"), string(body)
+	}
+
+	// before the first query, quantiles are unknown:
+	_, body := get("")
+	if got := parseExposition(t, body, false)[`query_duration_seconds{quantile="0.5"}`]; !math.IsNaN(got) {
+		t.Errorf("incorrect median before any query: got %v want NaN", got)
+	}
+
+	// from two workers, merged:
+	workers := []*workerMetrics{m.newWorker(), m.newWorker()}
+	for i := 1; i <= 100; i++ {
+		var err error
+		if i%10 == 0 {
+			err = errors.New("failed")
+		}
+		workers[i%2].observe(float64(i), err)
+	}
+	for _, c := range []struct {
+		desc        string
+		accept      string
+		contentType string
+		openMetrics bool
+	}{
+		{desc: "prometheus", contentType: prometheusContentType},
+		{desc: "openmetrics", accept: "application/openmetrics-text; version=1.0.0,text/plain;q=0.5", contentType: openMetricsContentType, openMetrics: true},
+	} {
+		contentType, body := get(c.accept)
+		if contentType != c.contentType {
+			t.Errorf("%s: incorrect content type: got %s want %s", c.desc, contentType, c.contentType)
+		}
+		samples := parseExposition(t, body, c.openMetrics)
+		want := map[string]float64{
+			"queries_total":                           100,
+			"query_errors_total":                      10,
+			"gocql_retries_total":                     2,
+			"query_duration_seconds_count":            100,
+			"query_duration_seconds_sum":              5.05,
+			`query_duration_seconds{quantile="0.5"}`:  0.05,
+			`query_duration_seconds{quantile="0.99"}`: 0.099,
+		}
+		for name, v := range want {
+			if got, ok := samples[name]; !ok || math.Abs(got-v) > 1e-3*v {
+				t.Errorf("%s: incorrect %s: got %v want %v", c.desc, name, got, v)
+			}
+		}
+	}
+}
+
+func TestWriteMetricsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsbs_run_queries_cassandra")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.txt")
+
+	var m queryMetrics
+	m.newWorker().observe(1000, nil)
+	if err := writeMetricsFile(path, &m, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := parseExposition(t, string(b), true)["queries_total"]; got != 1 {
+		t.Errorf("incorrect queries_total: got %v want 1", got)
+	}
+}
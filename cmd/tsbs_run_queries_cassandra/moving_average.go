@@ -0,0 +1,65 @@
+package main
+
+const (
+	MovingAverageStartNull    = 1 // leave the buckets before a full window absent
+	MovingAverageStartPartial = 2 // average the buckets of their partial window
+)
+
+// movingAverageResults replaces the values of time-ordered (ascending or
+// descending) CQLResults by their trailing moving average over window
+// buckets: the mean of the known values of each bucket and of the window-1
+// buckets before it in time. The first window-1 buckets are left absent,
+// or averaged over the buckets before them, according to start. A bucket
+// whose window has no known value stays absent. Values are replaced in
+// place; a window below 2 leaves them as they are.
+func movingAverageResults(results []CQLResult, window, start int) []CQLResult {
+	if window < 2 || len(results) == 0 {
+		return results
+	}
+	order := ascendingOrder(results)
+	for v := range results[0].Values {
+		// the original values, as the results are replaced in place:
+		values := make([]float64, len(order))
+		known := make([]bool, len(order))
+		for pos, i := range order {
+			values[pos], known[pos] = results[i].Values[v], !results[i].IsAbsent(v)
+		}
+
+		for pos, i := range order {
+			var sum float64
+			n := 0 // known values in the window
+			for w := pos; w >= 0 && w > pos-window; w-- {
+				if known[w] {
+					sum += values[w]
+					n++
+				}
+			}
+			r := &results[i]
+			if n == 0 || (pos < window-1 && start == MovingAverageStartNull) {
+				if r.Absent == nil {
+					r.Absent = make([]bool, len(r.Values))
+				}
+				r.Absent[v] = true
+				r.Values[v] = 0
+				continue
+			}
+			r.Values[v] = sum / float64(n)
+			if r.Absent != nil {
+				r.Absent[v] = false
+			}
+		}
+	}
+	for i := range results {
+		results[i].compactAbsent()
+	}
+	return results
+}
+
+// movingAverageResultsPerMeasurement averages the results of each
+// measurement, and group of tags, of a query separately, as
+// fillResultsPerMeasurement fills them.
+func movingAverageResultsPerMeasurement(results []CQLResult, window, start int) []CQLResult {
+	return perResultGroup(results, func(group []CQLResult) []CQLResult {
+		return movingAverageResults(group, window, start)
+	})
+}
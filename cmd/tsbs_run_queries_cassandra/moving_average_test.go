@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMovingAverageResults(t *testing.T) {
+	n := func() *float64 { return nil }
+	v := float64Ptr
+	seq := []*float64{v(1), v(2), v(3), v(4), v(5), v(6)}
+	cases := []struct {
+		desc   string
+		window int
+		start  int
+		in     []*float64
+		want   []*float64
+	}{
+		{desc: "null start", window: 3, start: MovingAverageStartNull, in: seq, want: []*float64{n(), n(), v(2), v(3), v(4), v(5)}},
+		{desc: "partial start", window: 3, start: MovingAverageStartPartial, in: seq, want: []*float64{v(1), v(1.5), v(2), v(3), v(4), v(5)}},
+		{desc: "window of one", window: 1, start: MovingAverageStartNull, in: []*float64{v(1), v(2)}, want: []*float64{v(1), v(2)}},
+		{desc: "window above results", window: 4, start: MovingAverageStartPartial, in: []*float64{v(2), v(4)}, want: []*float64{v(2), v(3)}},
+		{desc: "absent values", window: 2, start: MovingAverageStartPartial, in: []*float64{v(2), n(), v(4), v(6)}, want: []*float64{v(2), v(2), v(4), v(5)}},
+		{desc: "absent window", window: 2, start: MovingAverageStartPartial, in: []*float64{n(), n(), v(3)}, want: []*float64{n(), n(), v(3)}},
+	}
+	for _, c := range cases {
+		values := make([][]*float64, len(c.in))
+		for i, x := range c.in {
+			values[i] = []*float64{x}
+		}
+		got := resultValues(movingAverageResults(newTestCQLResults(t, values...), c.window, c.start))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: incorrect values: got %v want %v", c.desc, derefs(got), derefs(c.want))
+		}
+	}
+}
+
+func TestMovingAverageResultsDescending(t *testing.T) {
+	results := newTestCQLResults(t, []*float64{float64Ptr(1)}, []*float64{float64Ptr(3)}, []*float64{float64Ptr(5)})
+	for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+		results[i], results[j] = results[j], results[i]
+	}
+	// the window of a descending slice is made of the next results:
+	got := resultValues(movingAverageResults(results, 2, MovingAverageStartNull))
+	want := []*float64{float64Ptr(4), float64Ptr(2), nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect values: got %v want %v", derefs(got), derefs(want))
+	}
+}
+
+func TestMovingAverageResultsPerMeasurement(t *testing.T) {
+	results := newTestCQLResults(t,
+		[]*float64{float64Ptr(1), float64Ptr(10)},
+		[]*float64{float64Ptr(3), float64Ptr(20)},
+		[]*float64{float64Ptr(5), float64Ptr(30)},
+		[]*float64{float64Ptr(7), float64Ptr(40)},
+	)
+	for i := range results {
+		results[i].Measurement = []string{"cpu", "cpu", "mem", "mem"}[i]
+	}
+	averaged := movingAverageResultsPerMeasurement(results, 2, MovingAverageStartPartial)
+	got := make([]string, len(averaged))
+	for i, r := range averaged {
+		got[i] = r.Measurement + " " + r.valuesString()
+	}
+	// the first mem bucket is not averaged with the last cpu bucket
+	want := []string{"cpu [1 10]", "cpu [2 15]", "mem [5 30]", "mem [6 35]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect moving average: got %v want %v", got, want)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+// Aggregations returns the aggregations of a query of several of them,
+// whose AggregationType is a comma-separated list such as "avg,min,max", in
+// order; it is nil for a query of a single aggregation.
+func (q *HLQuery) Aggregations() []string {
+	if !strings.Contains(string(q.AggregationType), ",") {
+		return nil
+	}
+	return strings.Split(string(q.AggregationType), ",")
+}
+
+// validateAggregations checks the aggregations of a query of several of
+// them: each is computed by Cassandra (see isGroupableAggregation) or from
+// the values of the series by the client (see isClientSideAggregation), and
+// appears once.
+func (q *HLQuery) validateAggregations() error {
+	seen := map[string]bool{}
+	for _, a := range q.Aggregations() {
+		if !isGroupableAggregation(a) && !isClientSideAggregation(a) {
+			return &InvalidQueryError{fmt.Sprintf("aggregation %q cannot be combined with others in %q", a, q.AggregationType)}
+		}
+		if seen[a] {
+			return &InvalidQueryError{fmt.Sprintf("aggregation %q repeated in %q", a, q.AggregationType)}
+		}
+		seen[a] = true
+	}
+	return nil
+}
+
+// hasClientSideAggregation reports whether any of the aggregations needs
+// the values of the series, so that the client computes all of them.
+func hasClientSideAggregation(labels []string) bool {
+	for _, l := range labels {
+		if isClientSideAggregation(l) {
+			return true
+		}
+	}
+	return false
+}
+
+// cqlAggregations returns the columns selected by the CQL queries of several
+// aggregations: one per aggregation, e.g. "avg(value), min(value)", or only
+// the values if any is computed by the client, which then computes all of
+// them from the values read in the same round-trip.
+func cqlAggregations(labels []string) string {
+	if hasClientSideAggregation(labels) {
+		return valueColumn
+	}
+	selected := make([]string, len(labels))
+	for i, l := range labels {
+		selected[i] = fmt.Sprintf("%s(%s)", l, valueColumn)
+	}
+	return strings.Join(selected, ", ")
+}
+
+// newAggregationsAggregator returns the Aggregator of one of several
+// aggregations of a series, merging the aggregates of the series computed by
+// Cassandra, or aggregating their values when the client computes them.
+func newAggregationsAggregator(label string, labels []string) (Aggregator, error) {
+	if hasClientSideAggregation(labels) {
+		return GetAggregator(label)
+	}
+	return getMergeAggregator(label)
+}
+
+// scanAggregations puts the rows of a CQL query of several aggregations
+// into their Aggregators, one per aggregation, reporting whether any row fed
+// them. Rows hold either one column per aggregation, NULL over no points
+// except for counts, or the values of the series, which feed all of them.
+func scanAggregations(iter ResultIter, labels []string, aggrs []Aggregator) bool {
+	fed := false
+	if hasClientSideAggregation(labels) {
+		var x *float64
+		for iter.Scan(&x) {
+			if x == nil {
+				continue
+			}
+			for _, agg := range aggrs {
+				agg.Put(*x)
+			}
+			fed = true
+		}
+		return fed
+	}
+
+	values := make([]*float64, len(labels))
+	counts := make([]int64, len(labels))
+	dest := make([]interface{}, len(labels))
+	for i, l := range labels {
+		if l == "count" {
+			dest[i] = &counts[i]
+		} else {
+			dest[i] = &values[i]
+		}
+	}
+	for iter.Scan(dest...) {
+		for i, l := range labels {
+			switch {
+			case l == "count":
+				aggrs[i].Put(float64(counts[i]))
+				fed = fed || counts[i] > 0
+			case values[i] != nil:
+				aggrs[i].Put(*values[i])
+				fed = true
+			}
+		}
+	}
+	return fed
+}
+
+// newAggregationsCQLResult builds the CQLResult for one time bucket of a
+// query of several aggregations from their Aggregators, by field then by
+// aggregation. Empty aggregators yield absent values, except for additive
+// aggregations, which yield 0 (see isAdditiveAggregation): the result is
+// ZeroFilled if all of them are, without data.
+func newAggregationsCQLResult(ti *utils.TimeInterval, aggrs []Aggregator, labels []string) CQLResult {
+	res := CQLResult{TimeInterval: ti, Values: make([]float64, len(aggrs)), Aggregations: make([]string, len(aggrs)), ZeroFilled: true}
+	for i, aggr := range aggrs {
+		label := labels[i%len(labels)]
+		res.Aggregations[i] = label
+		if !aggr.Empty() {
+			res.Values[i] = aggr.Get()
+			res.ZeroFilled = false
+			continue
+		}
+		res.ZeroFilled = res.ZeroFilled && isAdditiveAggregation(label)
+		if !isAdditiveAggregation(label) {
+			if res.Absent == nil {
+				res.Absent = make([]bool, len(aggrs))
+			}
+			res.Absent[i] = true
+		}
+	}
+	return res
+}
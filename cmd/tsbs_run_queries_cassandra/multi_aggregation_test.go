@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// multiAggregationRows mocks the rows of the series host_0 and host_1, whose
+// points in the first hour of each day are 1, 2, 3 and 4, 5, 6: the avg,
+// min, max or count selected, or the points themselves.
+func multiAggregationRows(stmt string, args []interface{}) ([][]interface{}, error) {
+	points := []float64{1, 2, 3}
+	if strings.Contains(args[0].(string), "host_1#") {
+		points = []float64{4, 5, 6}
+	}
+	day, err := time.Parse(BucketTimeLayout, strings.Split(args[0].(string), "#")[2])
+	if err != nil {
+		return nil, err
+	}
+	if start := day.UnixNano(); args[1].(int64) >= start+int64(time.Hour) {
+		// no point after the first hour:
+		points = nil
+	}
+	if strings.HasPrefix(stmt, "SELECT value ") {
+		rows := [][]interface{}{}
+		for _, p := range points {
+			rows = append(rows, []interface{}{p})
+		}
+		return rows, nil
+	}
+	columns := strings.Split(strings.TrimPrefix(strings.Split(stmt, " FROM ")[0], "SELECT "), ", ")
+	row := make([]interface{}, len(columns))
+	for i, c := range columns {
+		switch {
+		case c == "count(value)":
+			row[i] = int64(len(points))
+		case len(points) == 0:
+		case c == "avg(value)":
+			row[i] = points[1]
+		case c == "min(value)":
+			row[i] = points[0]
+		case c == "max(value)":
+			row[i] = points[2]
+		}
+	}
+	return [][]interface{}{row}, nil
+}
+
+func TestMultiAggregation(t *testing.T) {
+	csi := newTestClientSideIndex(2, 1, "usage_user")
+	q := newTestHLQuery("avg,min,max,count", "usage_user", testStart, testStart.Add(2*time.Hour), time.Hour)
+	qp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// one CQL query per series and time bucket, for all of the aggregations:
+	cqs := qp.AllCQLQueries()
+	if len(cqs) != 4 {
+		t.Errorf("incorrect number of CQL queries: got %d want 4", len(cqs))
+	}
+	wantStmt := "SELECT avg(value), min(value), max(value), count(value) FROM series_double WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ?"
+	if got := cqs[0].PreparableQueryString; got != wantStmt {
+		t.Errorf("incorrect CQL: got %s want %s", got, wantStmt)
+	}
+
+	results, err := qp.Execute(context.Background(), &mockQueryExecutor{respond: multiAggregationRows})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("incorrect number of results: got %d want 2", len(results))
+	}
+	wantAggrs := []string{"avg", "min", "max", "count"}
+	for i, r := range results {
+		if !reflect.DeepEqual(r.Aggregations, wantAggrs) {
+			t.Errorf("bucket %d: incorrect aggregations: got %v want %v", i, r.Aggregations, wantAggrs)
+		}
+	}
+	// averages are merged as the mean of those of each series:
+	if got, want := results[0].valuesString(), "[3.5 1 6 6]"; got != want {
+		t.Errorf("incorrect values: got %s want %s", got, want)
+	}
+	// the bucket without points has a count, but no other aggregate:
+	if got, want := results[1].valuesString(), "[null null null 0]"; got != want {
+		t.Errorf("empty bucket: incorrect values: got %s want %s", got, want)
+	}
+}
+
+func TestMultiAggregationWithClientSideAggregation(t *testing.T) {
+	csi := newTestClientSideIndex(2, 1, "usage_user", "usage_system")
+	q := newTestHLQuery("count,avg,variance", "usage_user,usage_system", testStart, testStart.Add(time.Hour), 0)
+	qp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the values are read once, for the client to compute all of them:
+	wantStmt := "SELECT value FROM series_double WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ?"
+	for _, cq := range qp.AllCQLQueries() {
+		if cq.PreparableQueryString != wantStmt {
+			t.Errorf("incorrect CQL: got %s want %s", cq.PreparableQueryString, wantStmt)
+		}
+	}
+	results, err := qp.Execute(context.Background(), &mockQueryExecutor{respond: multiAggregationRows})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("incorrect number of results: got %d want 1", len(results))
+	}
+	// by field, then by aggregation, over the points of both series:
+	r := results[0]
+	want := []float64{6, 3.5, 35.0 / 12, 6, 3.5, 35.0 / 12}
+	wantAggrs := []string{"count", "avg", "variance", "count", "avg", "variance"}
+	if !reflect.DeepEqual(r.Aggregations, wantAggrs) {
+		t.Errorf("incorrect aggregations: got %v want %v", r.Aggregations, wantAggrs)
+	}
+	for i, v := range r.Values {
+		if math.Abs(v-want[i]) > 1e-9 {
+			t.Errorf("incorrect value %d (%s): got %v want %v", i, r.Aggregations[i], v, want[i])
+		}
+	}
+}
+
+func TestMultiAggregationPlan(t *testing.T) {
+	csi := newTestClientSideIndex(2, 1, "usage_user")
+
+	// the client aggregation plan is overridden, as for shares:
+	hlqe := NewHLQueryExecutor(&mockQueryExecutor{respond: multiAggregationRows}, csi, 0)
+	q := newTestHLQuery("min,count_nonnull", "usage_user", testStart, testStart.Add(time.Hour), 0)
+	_, _, info, err := hlqe.Do(q, HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithoutServerAggregation, ValueStats: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.CQLQueries != 2 || info.Values.min != 1 || info.Values.max != 6 {
+		t.Errorf("incorrect execution: got %d CQL queries, values from %v to %v want 2, from 1 to 6", info.CQLQueries, info.Values.min, info.Values.max)
+	}
+
+	for _, aggr := range []string{"avg,rate", "avg,avg", "share_sum,avg", "max,last", "min,"} {
+		q := newTestHLQuery(aggr, "usage_user", testStart, testStart.Add(time.Hour), 0)
+		if _, err := q.ToQueryPlanWithServerAggregation(csi); err == nil {
+			t.Errorf("%s: expected an error", aggr)
+		} else if _, ok := err.(*InvalidQueryError); !ok {
+			t.Errorf("%s: incorrect error: got %v", aggr, err)
+		}
+	}
+}
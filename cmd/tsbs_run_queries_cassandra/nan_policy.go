@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	NaNPolicyKeep  = 1 // leave non-finite values as they are
+	NaNPolicyDrop  = 2 // make non-finite values absent
+	NaNPolicyZero  = 3 // replace non-finite values by zero
+	NaNPolicyError = 4 // fail the query on a non-finite value
+)
+
+// A NonFiniteResultError reports a NaN or infinite value in the results of
+// a query, with NaNPolicyError.
+type NonFiniteResultError struct {
+	Start, End time.Time // of the time bucket
+	Value      float64
+}
+
+func (e *NonFiniteResultError) Error() string {
+	return fmt.Sprintf("non-finite value %v in the time bucket [%s, %s)", e.Value, e.Start.Format(time.RFC3339Nano), e.End.Format(time.RFC3339Nano))
+}
+
+// applyNaNPolicy replaces, according to policy, the NaN and infinite values
+// of results, which aggregations produce from NaN points or from sums
+// overflowing, so that they do not end in printed responses (where JSON has
+// no representation of them), returning how many there were. Absent values
+// and the points of raw results are left as they are. Values are replaced
+// in place.
+func applyNaNPolicy(results []CQLResult, policy int) (int, error) {
+	n := 0
+	for i := range results {
+		r := &results[i]
+		for j, v := range r.Values {
+			if r.IsAbsent(j) || !(math.IsNaN(v) || math.IsInf(v, 0)) {
+				continue
+			}
+			n++
+			switch policy {
+			case NaNPolicyKeep:
+			case NaNPolicyError:
+				return n, &NonFiniteResultError{Start: r.Start(), End: r.End(), Value: v}
+			case NaNPolicyZero:
+				r.Values[j] = 0
+			default:
+				if r.Absent == nil {
+					r.Absent = make([]bool, len(r.Values))
+				}
+				r.Absent[j] = true
+				r.Values[j] = 0
+			}
+		}
+	}
+	return n, nil
+}
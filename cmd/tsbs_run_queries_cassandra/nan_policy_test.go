@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+// nanBucketRows mocks a server-side aggregate that is NaN in the second
+// hour of the day (e.g. from NaN points), and 1 otherwise.
+func nanBucketRows(_ string, args []interface{}) ([][]interface{}, error) {
+	if args[1].(int64) == testStart.Add(time.Hour).UnixNano() {
+		return [][]interface{}{{math.NaN()}}, nil
+	}
+	return [][]interface{}{{1.0}}, nil
+}
+
+func TestApplyNaNPolicy(t *testing.T) {
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(3*time.Hour), time.Hour)
+	cases := []struct {
+		desc    string
+		policy  int
+		want    []*float64
+		wantErr bool
+	}{
+		{desc: "drop", policy: NaNPolicyDrop, want: []*float64{float64Ptr(1), nil, float64Ptr(1)}},
+		{desc: "zero", policy: NaNPolicyZero, want: []*float64{float64Ptr(1), float64Ptr(0), float64Ptr(1)}},
+		{desc: "error", policy: NaNPolicyError, wantErr: true},
+	}
+	for _, c := range cases {
+		qp, err := q.ToQueryPlanWithServerAggregation(csi)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		results, err := qp.Execute(context.Background(), &mockQueryExecutor{respond: nanBucketRows})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		n, err := applyNaNPolicy(results, c.policy)
+		if n != 1 {
+			t.Errorf("%s: incorrect number of non-finite values: got %d want 1", c.desc, n)
+		}
+		if c.wantErr {
+			if e, ok := err.(*NonFiniteResultError); !ok || !e.Start.Equal(testStart.Add(time.Hour)) {
+				t.Errorf("%s: incorrect error: got %v", c.desc, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		got := resultValues(results)
+		if len(got) != len(c.want) {
+			t.Fatalf("%s: incorrect number of results: got %d want %d", c.desc, len(got), len(c.want))
+		}
+		for i := range got {
+			if (got[i] == nil) != (c.want[i] == nil) || (got[i] != nil && *got[i] != *c.want[i]) {
+				t.Errorf("%s: incorrect bucket %d: got %v want %v", c.desc, i, derefs(got), derefs(c.want))
+				break
+			}
+		}
+	}
+
+	// the keep policy only counts them:
+	results := newTestCQLResults(t, []*float64{float64Ptr(math.Inf(-1))}, []*float64{nil})
+	if n, err := applyNaNPolicy(results, NaNPolicyKeep); n != 1 || err != nil || !math.IsInf(results[0].Values[0], -1) {
+		t.Errorf("keep: got %d non-finite values (%v), values %v", n, err, results[0].Values)
+	}
+}
+
+func TestHLQueryExecutorNaNPolicy(t *testing.T) {
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(3*time.Hour), time.Hour)
+	hlqe := NewHLQueryExecutor(&mockQueryExecutor{respond: nanBucketRows}, csi, 0)
+	opts := HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithServerAggregation}
+
+	if _, _, info, err := hlqe.Do(q, opts); err != nil || info.NonFinite != 1 {
+		t.Errorf("default policy: got %d non-finite values (%v) want 1", info.NonFinite, err)
+	}
+	opts.NaNPolicy = NaNPolicyError
+	if _, _, _, err := hlqe.Do(q, opts); err == nil {
+		t.Errorf("error policy: expected an error")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// phaseStats sums the time of both phases of the executed queries: the
+// build of their plan on the client, from the client-side index, and its
+// execution by Cassandra, so that the summary tells which of the index or
+// the cluster is the bottleneck. It only adds atomic additions to queries,
+// and is safe for concurrent use.
+type phaseStats struct {
+	queries   uint64 // accessed atomically
+	planNs    uint64 // accessed atomically
+	executeNs uint64 // accessed atomically
+}
+
+// observe records the phases of an executed query.
+func (s *phaseStats) observe(plan, execute time.Duration) {
+	if plan < 0 {
+		plan = 0
+	}
+	if execute < 0 {
+		execute = 0
+	}
+	atomic.AddUint64(&s.queries, 1)
+	atomic.AddUint64(&s.planNs, uint64(plan))
+	atomic.AddUint64(&s.executeNs, uint64(execute))
+}
+
+// means returns the mean time of both phases of the queries, zero if none
+// was observed.
+func (s *phaseStats) means() (plan, execute time.Duration) {
+	n := atomic.LoadUint64(&s.queries)
+	if n == 0 {
+		return 0, 0
+	}
+	return time.Duration(atomic.LoadUint64(&s.planNs) / n), time.Duration(atomic.LoadUint64(&s.executeNs) / n)
+}
+
+// writeTo writes the mean time of both phases, in milliseconds, and their
+// share of the total. Nothing is written if no query was observed.
+func (s *phaseStats) writeTo(w io.Writer) error {
+	n := atomic.LoadUint64(&s.queries)
+	if n == 0 {
+		return nil
+	}
+	planNs, executeNs := atomic.LoadUint64(&s.planNs), atomic.LoadUint64(&s.executeNs)
+	share := func(ns uint64) float64 {
+		if planNs+executeNs == 0 {
+			return 0
+		}
+		return 100 * float64(ns) / float64(planNs+executeNs)
+	}
+	plan, execute := s.means()
+	_, err := fmt.Fprintf(w, "Query phases (%d queries): plan build mean %.3fms (%.1f%%), execute mean %.3fms (%.1f%%)\n",
+		n, float64(plan)/1e6, share(planNs), float64(execute)/1e6, share(executeNs))
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/timescale/tsbs/query"
+)
+
+func TestPhaseStats(t *testing.T) {
+	var s phaseStats
+	var buf bytes.Buffer
+	if err := s.writeTo(&buf); err != nil || buf.Len() > 0 {
+		t.Errorf("no query: incorrect summary: got %q (%v) want nothing", buf.String(), err)
+	}
+	s.observe(time.Millisecond, 3*time.Millisecond)
+	s.observe(3*time.Millisecond, 5*time.Millisecond)
+	s.observe(-time.Millisecond, 4*time.Millisecond) // clock adjustments
+	if plan, execute := s.means(); plan != 4*time.Millisecond/3 || execute != 4*time.Millisecond {
+		t.Errorf("incorrect means: got %v and %v want %v and %v", plan, execute, 4*time.Millisecond/3, 4*time.Millisecond)
+	}
+	if err := s.writeTo(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Query phases (3 queries): plan build mean 1.333ms (25.0%), execute mean 4.000ms (75.0%)\n"
+	if buf.String() != want {
+		t.Errorf("incorrect summary: got %q want %q", buf.String(), want)
+	}
+}
+
+func TestRunnerPhaseTimings(t *testing.T) {
+	const numQueries = 10
+	dir, err := ioutil.TempDir("", "tsbs_run_queries_cassandra")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := writeTestQueryFile(t, dir, numQueries)
+
+	oldRunner, oldCSI, oldQE, oldAggrPlan, oldPhases := runner, csi, qe, aggrPlan, phases
+	defer func() {
+		runner, csi, qe, aggrPlan, phases = oldRunner, oldCSI, oldQE, oldAggrPlan, oldPhases
+	}()
+	runner = query.NewBenchmarkRunner(query.BenchmarkRunnerConfig{Workers: 2, FileName: fileName})
+	csi = newTestClientSideIndex(10, 1, "usage_user")
+	qe = &mockQueryExecutor{respond: serverAggregationRows, delay: time.Millisecond}
+	aggrPlan = AggrPlanTypeWithServerAggregation
+	phases = &phaseStats{}
+
+	runner.Run(&query.CassandraPool, newProcessor)
+
+	if phases.queries != numQueries {
+		t.Errorf("incorrect number of queries: got %d want %d", phases.queries, numQueries)
+	}
+	// both phases are timed, each CQL query taking at least the delay:
+	plan, execute := phases.means()
+	if plan < 0 || execute < time.Millisecond {
+		t.Errorf("incorrect phase timings: got plan %v and execute %v", plan, execute)
+	}
+	if phases.planNs == 0 {
+		t.Errorf("plan build not timed")
+	}
+}
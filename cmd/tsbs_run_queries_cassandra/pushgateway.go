@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/filipecosta90/hdrhistogram"
+)
+
+// metricsQuantiles are the quantiles of the latency summary of queryMetrics.
+var metricsQuantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+// queryMetrics holds the counters of a benchmark run that are exported to a
+// Prometheus pushgateway, served by -metrics-listen or written to
+// -metrics-file. Its counters are accessed atomically. The latencies are
+// recorded by each worker in its own histogram (see newWorker), so that
+// workers do not contend, and merged when the metrics are written.
+type queryMetrics struct {
+	queries     uint64
+	errors      uint64 // including timed out queries
+	latencyNsec uint64 // sum of the latencies of all queries
+	outOfRange  uint64 // latencies outside of the histograms, see workerMetrics.observe
+
+	mu      sync.Mutex
+	workers []*workerMetrics
+}
+
+// newLatencyHistogram returns a histogram of latencies in microseconds,
+// from 1us to an hour, with 3 significant digits.
+func newLatencyHistogram() *hdrhistogram.Histogram {
+	return hdrhistogram.New(1, 3600e6, 3)
+}
+
+// workerMetrics records the queries of one worker into queryMetrics. Its
+// histogram is only contended while the metrics are written.
+type workerMetrics struct {
+	m *queryMetrics
+
+	mu        sync.Mutex
+	latencies *hdrhistogram.Histogram
+}
+
+// newWorker returns the workerMetrics recording the queries of a worker.
+func (m *queryMetrics) newWorker() *workerMetrics {
+	w := &workerMetrics{m: m, latencies: newLatencyHistogram()}
+	m.mu.Lock()
+	m.workers = append(m.workers, w)
+	m.mu.Unlock()
+	return w
+}
+
+// observe records a query that took the given time, and failed if err is
+// not nil. Latencies outside of the histogram, e.g. over an hour, are
+// counted and recorded at its nearest bound.
+func (w *workerMetrics) observe(latencyMs float64, err error) {
+	m := w.m
+	atomic.AddUint64(&m.queries, 1)
+	if err != nil {
+		atomic.AddUint64(&m.errors, 1)
+	}
+	atomic.AddUint64(&m.latencyNsec, uint64(latencyMs*1e6))
+
+	us := int64(latencyMs * 1e3)
+	w.mu.Lock()
+	if max := w.latencies.HighestTrackableValue(); us < 0 || us > max {
+		atomic.AddUint64(&m.outOfRange, 1)
+		if us < 0 {
+			us = 0
+		} else {
+			us = max
+		}
+	}
+	if err := w.latencies.RecordValue(us); err != nil {
+		atomic.AddUint64(&m.outOfRange, 1)
+	}
+	w.mu.Unlock()
+}
+
+// quantiles returns the latencies of metricsQuantiles, in seconds, or NaNs
+// before the first query, from the histograms of all workers.
+func (m *queryMetrics) quantiles() []float64 {
+	merged := newLatencyHistogram()
+	m.mu.Lock()
+	for _, w := range m.workers {
+		w.mu.Lock()
+		merged.Merge(w.latencies)
+		w.mu.Unlock()
+	}
+	m.mu.Unlock()
+
+	values := make([]float64, len(metricsQuantiles))
+	for i, q := range metricsQuantiles {
+		if merged.TotalCount() == 0 {
+			values[i] = math.NaN()
+			continue
+		}
+		values[i] = float64(merged.ValueAtQuantile(q*100)) / 1e6
+	}
+	return values
+}
+
+// writeTo writes the metrics in the Prometheus text exposition format,
+// along with the given number of gocql retries, or in the OpenMetrics one,
+// which names the families of counters without their _total suffix and
+// ends with an EOF marker.
+func (m *queryMetrics) writeTo(w io.Writer, retries uint64, openMetrics bool) error {
+	queries := atomic.LoadUint64(&m.queries)
+	latency := float64(atomic.LoadUint64(&m.latencyNsec)) / 1e9
+	counter := func(name string) string {
+		if openMetrics {
+			return strings.TrimSuffix(name, "_total")
+		}
+		return name
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# TYPE %s counter\nqueries_total %d\n", counter("queries_total"), queries)
+	fmt.Fprintf(&b, "# TYPE %s counter\nquery_errors_total %d\n", counter("query_errors_total"), atomic.LoadUint64(&m.errors))
+	fmt.Fprintf(&b, "# TYPE %s counter\ngocql_retries_total %d\n", counter("gocql_retries_total"), retries)
+	fmt.Fprintf(&b, "# TYPE %s counter\nquery_duration_out_of_range_total %d\n", counter("query_duration_out_of_range_total"), atomic.LoadUint64(&m.outOfRange))
+	b.WriteString("# TYPE query_duration_seconds summary\n")
+	for i, v := range m.quantiles() {
+		fmt.Fprintf(&b, "query_duration_seconds{quantile=\"%g\"} %g\n", metricsQuantiles[i], v)
+	}
+	fmt.Fprintf(&b, "query_duration_seconds_sum %g\nquery_duration_seconds_count %d\n", latency, queries)
+	if openMetrics {
+		b.WriteString("# EOF\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// A pushgatewayPusher periodically pushes queryMetrics to a Prometheus
+// pushgateway, under a job and instance grouping key.
+type pushgatewayPusher struct {
+	url     string
+	client  *http.Client
+	metrics *queryMetrics
+	retries func() uint64 // of gocql queries so far
+}
+
+// newPushgatewayPusher creates a pushgatewayPusher for the pushgateway at
+// baseURL (e.g. http://localhost:9091). An empty instance is left out of
+// the grouping key.
+func newPushgatewayPusher(baseURL, job, instance string, metrics *queryMetrics, retries func() uint64) *pushgatewayPusher {
+	u := strings.TrimSuffix(baseURL, "/") + "/metrics/job/" + url.PathEscape(job)
+	if len(instance) > 0 {
+		u += "/instance/" + url.PathEscape(instance)
+	}
+	return &pushgatewayPusher{
+		url:     u,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		metrics: metrics,
+		retries: retries,
+	}
+}
+
+// Push replaces the metrics of the grouping key with the current ones.
+func (p *pushgatewayPusher) Push() error {
+	var buf bytes.Buffer
+	if err := p.metrics.writeTo(&buf, p.retries(), false); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, p.url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("pushgateway %s: unexpected status %s: %s", p.url, resp.Status, body)
+	}
+	return nil
+}
+
+// Run pushes the metrics every interval until done is closed, then pushes
+// them one last time so that the final interval is not lost. Failed pushes
+// are reported on stderr.
+func (p *pushgatewayPusher) Run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.pushOrWarn()
+		case <-done:
+			p.pushOrWarn()
+			return
+		}
+	}
+}
+
+func (p *pushgatewayPusher) pushOrWarn() {
+	if err := p.Push(); err != nil {
+		fmt.Fprintf(os.Stderr, "could not push metrics: %v\n", err)
+	}
+}
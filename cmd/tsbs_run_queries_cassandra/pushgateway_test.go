@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pushRecorder records the pushes received by an httptest server.
+type pushRecorder struct {
+	pushes chan *http.Request
+	bodies chan string
+}
+
+func newPushRecorder() (*pushRecorder, *httptest.Server) {
+	r := &pushRecorder{pushes: make(chan *http.Request, 10), bodies: make(chan string, 10)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.pushes <- req
+		r.bodies <- string(body)
+	}))
+	return r, ts
+}
+
+func TestPushgatewayPusherPush(t *testing.T) {
+	rec, ts := newPushRecorder()
+	defer ts.Close()
+
+	var m queryMetrics
+	w := m.newWorker()
+	w.observe(1500, nil)
+	w.observe(500, errors.New("failed"))
+	w.observe(1000, nil)
+	p := newPushgatewayPusher(ts.URL+"/", "tsbs", "host a", &m, func() uint64 { return 7 })
+	if err := p.Push(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req, body := <-rec.pushes, <-rec.bodies
+	if got, want := req.Method, http.MethodPut; got != want {
+		t.Errorf("incorrect method: got %s want %s", got, want)
+	}
+	if got, want := req.URL.EscapedPath(), "/metrics/job/tsbs/instance/host%20a"; got != want {
+		t.Errorf("incorrect path: got %s want %s", got, want)
+	}
+	if got := req.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("incorrect content type: got %s", got)
+	}
+	for _, want := range []string{
+		"# TYPE queries_total counter\nqueries_total 3\n",
+		"# TYPE query_errors_total counter\nquery_errors_total 1\n",
+		"# TYPE gocql_retries_total counter\ngocql_retries_total 7\n",
+		"# TYPE query_duration_seconds summary\nquery_duration_seconds{quantile=\"0.5\"} 1.00",
+		"query_duration_seconds_sum 3\nquery_duration_seconds_count 3\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("payload does not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestQueryMetricsOutOfRange(t *testing.T) {
+	var m queryMetrics
+	w := m.newWorker()
+	w.observe(2*3600e3, nil) // two hours, over the histogram
+	w.observe(-1, nil)       // e.g. a clock adjustment
+	w.observe(10, nil)
+	if got := atomic.LoadUint64(&m.outOfRange); got != 2 {
+		t.Errorf("incorrect number of latencies out of range: got %d want 2", got)
+	}
+	// recorded at the bounds of the histogram:
+	if got := m.quantiles()[len(metricsQuantiles)-1]; got < 3599 {
+		t.Errorf("incorrect 0.99 quantile: got %vs want an hour", got)
+	}
+}
+
+func TestPushgatewayPusherPushError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "bad metrics", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	p := newPushgatewayPusher(ts.URL, "tsbs", "", &queryMetrics{}, func() uint64 { return 0 })
+	err := p.Push()
+	if err == nil || !strings.Contains(err.Error(), "bad metrics") {
+		t.Errorf("incorrect error: got %v", err)
+	}
+}
+
+func TestPushgatewayPusherRunFinalPush(t *testing.T) {
+	rec, ts := newPushRecorder()
+	defer ts.Close()
+
+	var m queryMetrics
+	p := newPushgatewayPusher(ts.URL, "tsbs", "", &m, func() uint64 { return 0 })
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		p.Run(time.Hour, done)
+		close(stopped)
+	}()
+	m.newWorker().observe(1, nil)
+	close(done)
+	<-stopped
+
+	req, body := <-rec.pushes, <-rec.bodies
+	if got, want := req.URL.Path, "/metrics/job/tsbs"; got != want {
+		t.Errorf("incorrect path: got %s want %s", got, want)
+	}
+	if !strings.Contains(body, "queries_total 1\n") {
+		t.Errorf("final push does not have the last query:\n%s", body)
+	}
+}
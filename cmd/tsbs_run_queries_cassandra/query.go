@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/timescale/tsbs/internal/utils"
 	"github.com/timescale/tsbs/query"
@@ -16,6 +19,40 @@ import (
 // construct a QueryPlan.
 type HLQuery struct {
 	query.Cassandra
+
+	SeriesMatcher SeriesMatcher // nil for the DefaultSeriesMatcher
+
+	// SeriesIds are, if set, the only series read, whatever the TagSets and
+	// SeriesMatcher (see seriesIdsMatchFunc).
+	SeriesIds []string
+
+	// TimeBuckets are, if set, the time buckets of the query, e.g. business
+	// hours, instead of those of its GroupByDuration or GroupByCalendar (see
+	// timeIntervals). They must be sorted, not overlap and lie within the
+	// time range of the query, but may leave gaps between them.
+	TimeBuckets []*utils.TimeInterval
+
+	// ValuePredicates filter, if set, the points of raw and last point
+	// queries on their value, on the server.
+	ValuePredicates []ValuePredicate
+}
+
+// timeIntervals returns the TimeIntervals of the TimeBuckets of a
+// query.Cassandra. A bucket that ends before it starts is made empty, for
+// Validate to reject.
+func timeIntervals(buckets [][2]time.Time) []*utils.TimeInterval {
+	if len(buckets) == 0 {
+		return nil
+	}
+	tis := make([]*utils.TimeInterval, len(buckets))
+	for i, b := range buckets {
+		ti, err := utils.NewTimeInterval(b[0], b[1])
+		if err != nil {
+			ti, _ = utils.NewTimeInterval(b[0], b[0])
+		}
+		tis[i] = ti
+	}
+	return tis
 }
 
 // String produces a debug-ready description of a Query.
@@ -25,42 +62,355 @@ func (q *HLQuery) String() string {
 
 // ForceUTC rewrites timestamps in UTC, which is helpful for pretty-printing.
 func (q *HLQuery) ForceUTC() {
-	q.TimeStart = q.TimeStart.UTC()
-	q.TimeEnd = q.TimeEnd.UTC()
+	q.ForceLocation(time.UTC)
+}
+
+// ForceLocation rewrites timestamps in the given location. Time buckets of
+// whole days are aligned to midnight in that location (see
+// bucketTimeIntervals).
+func (q *HLQuery) ForceLocation(loc *time.Location) {
+	q.TimeStart = q.TimeStart.In(loc)
+	q.TimeEnd = q.TimeEnd.In(loc)
+}
+
+// An InvalidQueryError reports an HLQuery that cannot be planned, typically
+// because the query generator emitted a malformed query.
+type InvalidQueryError struct {
+	Reason string
+}
+
+func (e *InvalidQueryError) Error() string {
+	return "invalid query: " + e.Reason
+}
+
+// Validate returns an InvalidQueryError if the time range of the HLQuery is
+// empty, its GroupByDuration or GroupLimit is negative, its OrderBy is not
+// supported (see rawOrderBy), its TimeBuckets are not in order, its "none"
+// aggregation is combined with ForEveryN or WhereClause, its
+// FieldExpression does not parse or its ValuePredicates are not those of a
+// raw query. Validate is called by each of the ToQueryPlan methods.
+func (q *HLQuery) Validate() error {
+	if !q.TimeStart.Before(q.TimeEnd) {
+		return &InvalidQueryError{fmt.Sprintf("TimeStart %s is not before TimeEnd %s", q.TimeStart.Format(time.RFC3339Nano), q.TimeEnd.Format(time.RFC3339Nano))}
+	}
+	if q.GroupByDuration < 0 {
+		return &InvalidQueryError{fmt.Sprintf("negative GroupByDuration %s", q.GroupByDuration)}
+	}
+	if q.GroupLimit < 0 {
+		return &InvalidQueryError{fmt.Sprintf("negative GroupLimit %d", q.GroupLimit)}
+	}
+	if _, ok := rawOrderBy(string(q.OrderBy)); !ok {
+		return &InvalidQueryError{fmt.Sprintf("unsupported ORDER BY %q: points can only be ordered by timestamp_ns, ASC or DESC", q.OrderBy)}
+	}
+	for i, ti := range q.TimeBuckets {
+		switch {
+		case !ti.Start().Before(ti.End()):
+			return &InvalidQueryError{fmt.Sprintf("empty time bucket %d [%s, %s)", i, ti.StartString(), ti.EndString())}
+		case ti.Start().Before(q.TimeStart) || ti.End().After(q.TimeEnd):
+			return &InvalidQueryError{fmt.Sprintf("time bucket %d [%s, %s) outside of the time range of the query", i, ti.StartString(), ti.EndString())}
+		case i > 0 && ti.Start().Before(q.TimeBuckets[i-1].End()):
+			return &InvalidQueryError{fmt.Sprintf("time bucket %d [%s, %s) overlaps or precedes the one before it", i, ti.StartString(), ti.EndString())}
+		}
+	}
+	if err := q.validateAggregations(); err != nil {
+		return err
+	}
+	if string(q.AggregationType) == "none" && (len(q.ForEveryN) > 0 || len(q.WhereClause) > 0) {
+		// "none" selects raw points, which IsRaw does not plan for these:
+		return &InvalidQueryError{"aggregation \"none\" cannot be combined with ForEveryN or WhereClause"}
+	}
+	if err := q.validateFieldExpression(); err != nil {
+		return err
+	}
+	if len(q.ValuePredicates) > 0 && !q.IsRaw() && !q.IsLastPoint() {
+		return &InvalidQueryError{"value predicates are only supported by raw and last point queries"}
+	}
+	for _, p := range q.ValuePredicates {
+		ok := false
+		for _, op := range valuePredicateOps {
+			ok = ok || p.Op == op
+		}
+		if !ok {
+			return &InvalidQueryError{fmt.Sprintf("unsupported value predicate operator %q", p.Op)}
+		}
+	}
+	return nil
+}
+
+// rawOrderBy returns the ORDER BY clause selecting raw points in the order
+// given by an HLQuery OrderBy, with timestamp_ns ascending by default. Points
+// are clustered by timestamp_ns within a row, so that is the only column they
+// can be ordered by; ok is false for any other order.
+func rawOrderBy(orderBy string) (clause string, ok bool) {
+	parts := strings.Fields(orderBy)
+	switch {
+	case len(parts) == 0:
+		return "timestamp_ns", true
+	case parts[0] != "timestamp_ns" || len(parts) > 2:
+		return "", false
+	case len(parts) == 1:
+		return "timestamp_ns", true
+	case strings.EqualFold(parts[1], "ASC"), strings.EqualFold(parts[1], "DESC"):
+		return "timestamp_ns " + strings.ToUpper(parts[1]), true
+	}
+	return "", false
+}
+
+// isDescending reports whether the OrderBy of the query orders points by
+// descending timestamp_ns, in any case or spacing (see rawOrderBy).
+func (q *HLQuery) isDescending() bool {
+	orderBy, _ := rawOrderBy(string(q.OrderBy))
+	return strings.HasSuffix(orderBy, " DESC")
+}
+
+// Measurements returns the measurements of the query: its MeasurementName
+// may be a comma-separated list, e.g. "cpu,mem".
+func (q *HLQuery) Measurements() []string {
+	return strings.Split(string(q.MeasurementName), ",")
+}
+
+// ForMeasurement returns a copy of the query reading only the given
+// measurement.
+func (q *HLQuery) ForMeasurement(m string) *HLQuery {
+	qm := *q
+	qm.MeasurementName = []byte(m)
+	return &qm
+}
+
+// GroupByTags returns the tag keys whose values group the results of the
+// query, if any.
+func (q *HLQuery) GroupByTags() []string {
+	if len(q.GroupByTagKeys) == 0 {
+		return nil
+	}
+	return strings.Split(string(q.GroupByTagKeys), ",")
+}
+
+// ForTagGroup returns a copy of the query reading only the series with the
+// given tags (e.g. "hostname=host_0"), and no longer grouped by tag.
+func (q *HLQuery) ForTagGroup(tags []string) *HLQuery {
+	qg := *q
+	qg.GroupByTagKeys = nil
+	qg.TagSets = append([][]string{}, q.TagSets...)
+	for _, tag := range tags {
+		qg.TagSets = append(qg.TagSets, []string{tag})
+	}
+	return &qg
+}
+
+// tagGroups partitions the series of the index matching an HLQuery (of a
+// single measurement) by their values of the tag keys, and returns the tags
+// of each group, in the order of the keys (e.g. ["hostname=host_0"]), and
+// its series. The groups are sorted by their tags. Series without a value
+// for each of the keys are left out.
+func (csi *ClientSideIndex) tagGroups(q *HLQuery, keys []string) ([][]string, [][]Series, error) {
+	match, err := q.seriesMatchFunc()
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := q.queriedFields()
+	groups := map[string][]string{}
+	members := map[string][]Series{}
+	for _, s := range csi.getSeriesChoicesForFieldsAndMeasurement(fields, string(q.MeasurementName)) {
+		if !match(&s) {
+			continue
+		}
+		if tags, ok := s.tagGroup(keys); ok {
+			id := strings.Join(tags, ",")
+			groups[id] = tags
+			members[id] = append(members[id], s)
+		}
+	}
+	ids := make([]string, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	sorted := make([][]string, len(ids))
+	series := make([][]Series, len(ids))
+	for i, id := range ids {
+		sorted[i], series[i] = groups[id], members[id]
+	}
+	return sorted, series, nil
+}
+
+// aggregationAliases maps the aliases of aggregations to the aggregation
+// they are planned as. Cassandra's count(value) only counts the cells that
+// are stored, so "count_nonnull" is spelled out for contrast with
+// "count_all" (see IsCountAll).
+var aggregationAliases = map[string]string{
+	"count_nonnull": "count",
+}
+
+// withCanonicalAggregation returns the query, or a copy of it whose
+// AggregationType is an alias (see aggregationAliases) replaced by the
+// aggregation it stands for, or is a list of aggregations with some.
+func (q *HLQuery) withCanonicalAggregation() *HLQuery {
+	labels := strings.Split(string(q.AggregationType), ",")
+	aliased := false
+	for i, l := range labels {
+		if label, ok := aggregationAliases[l]; ok {
+			labels[i] = label
+			aliased = true
+		}
+	}
+	if !aliased {
+		return q
+	}
+	qa := *q
+	qa.AggregationType = []byte(strings.Join(labels, ","))
+	return &qa
+}
+
+// timeBuckets returns the time buckets of the query, in time order: its
+// TimeBuckets if set, those of its GroupByCalendar if set (see
+// bucketCalendarIntervals), otherwise those of its GroupByDuration (see
+// bucketTimeIntervals).
+//
+// With a positive GroupLimit, only the first GroupLimit buckets are
+// returned, or the last ones for OrderBy "timestamp_ns DESC", so that the
+// others are not executed at all.
+func (q *HLQuery) timeBuckets() ([]*utils.TimeInterval, error) {
+	var tis []*utils.TimeInterval
+	if len(q.TimeBuckets) > 0 {
+		// a copy, as plans may reorder them:
+		tis = append(tis, q.TimeBuckets...)
+	} else if len(q.GroupByCalendar) > 0 {
+		var err error
+		if tis, err = bucketCalendarIntervals(q.TimeStart, q.TimeEnd, string(q.GroupByCalendar)); err != nil {
+			return nil, err
+		}
+	} else {
+		tis = bucketTimeIntervals(q.TimeStart, q.TimeEnd, q.GroupByDuration)
+	}
+	if q.GroupLimit <= 0 || len(tis) <= q.GroupLimit {
+		return tis, nil
+	}
+	if q.isDescending() {
+		return tis[len(tis)-q.GroupLimit:], nil
+	}
+	return tis[:q.GroupLimit], nil
+}
+
+// bucketsTimeRange returns the time range of the query that its time buckets
+// tis (in time order) cover, e.g. those kept by a GroupLimit, so that CQL
+// queries read no point outside of them. The end is that of the query only
+// if the last bucket reaches it, so that -inclusive-end never selects the
+// first point of a bucket left out.
+func (q *HLQuery) bucketsTimeRange(tis []*utils.TimeInterval) (start, end time.Time) {
+	start, end = q.TimeStart, q.TimeEnd
+	if len(tis) == 0 {
+		return start, end
+	}
+	if first := tis[0].Start(); first.After(start) {
+		start = first
+	}
+	if last := tis[len(tis)-1].End(); last.Before(end) {
+		end = last
+		if inclusiveEnd {
+			end = end.Add(-time.Nanosecond)
+		}
+	}
+	return start, end
+}
+
+// Policies of queries with more time buckets than -max-buckets.
+const (
+	BucketOverflowError   = 1 // the query is invalid
+	BucketOverflowCoarsen = 2 // its GroupByDuration is coarsened to fit
+)
+
+// limitBuckets caps the number of time buckets of the GroupByDuration of a
+// query to maxBuckets, so that a tiny duration over a long time range cannot
+// exhaust memory. A query over the cap is returned with the policy applied:
+// an InvalidQueryError, or a copy of the query whose GroupByDuration is the
+// smallest multiple of its own within the cap. over reports whether the
+// query was over the cap.
+func (q *HLQuery) limitBuckets(maxBuckets int, policy int) (limited *HLQuery, over bool, err error) {
+	if maxBuckets <= 0 || len(q.TimeBuckets) > 0 || len(q.GroupByCalendar) > 0 || q.GroupByDuration <= 0 {
+		return q, false, nil
+	}
+	n := bucketCount(q.TimeStart, q.TimeEnd, q.GroupByDuration)
+	if n <= int64(maxBuckets) {
+		return q, false, nil
+	}
+	if policy == BucketOverflowError {
+		return q, true, &InvalidQueryError{fmt.Sprintf("%d time buckets of %s exceed the maximum of %d", n, q.GroupByDuration, maxBuckets)}
+	}
+	k := (n + int64(maxBuckets) - 1) / int64(maxBuckets)
+	// alignment may add a bucket to the estimate:
+	for bucketCount(q.TimeStart, q.TimeEnd, time.Duration(k)*q.GroupByDuration) > int64(maxBuckets) {
+		k++
+	}
+	qc := *q
+	qc.GroupByDuration = time.Duration(k) * q.GroupByDuration
+	return &qc, true, nil
 }
 
 // ToQueryPlanWithServerAggregation combines an HLQuery with a
 // ClientSideIndex to make a QueryPlanWithServerAggregation.
+//
+// FieldName may be a comma-separated list of fields, in which case each
+// result holds one value per field, in the same order. Since each field is
+// stored in its own series, every field is aggregated by separate CQLQueries.
+//
+// AggregationType may be a comma-separated list of aggregations (see
+// HLQuery.Aggregations), all computed by each CQLQuery, in which case each
+// result holds one value per field and aggregation, by field then by
+// aggregation.
 func (q *HLQuery) ToQueryPlanWithServerAggregation(csi *ClientSideIndex) (qp *QueryPlanWithServerAggregation, err error) {
-	seriesChoices := csi.SeriesForMeasurementAndField(string(q.MeasurementName), string(q.FieldName))
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if len(q.FieldExpression) > 0 {
+		return nil, &InvalidQueryError{"field expressions are only computed by the client aggregation plan"}
+	}
+	match, err := q.seriesMatchFunc()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(string(q.FieldName), ",")
+	seriesChoices := csi.getSeriesChoicesForFieldsAndMeasurement(fields, string(q.MeasurementName))
 
 	// Build the time buckets used for 'group by time'-type queries.
 	//
 	// It is important to populate these even if they end up being empty,
 	// so that we get correct results for empty 'time buckets'.
-	tis := bucketTimeIntervals(q.TimeStart, q.TimeEnd, q.GroupByDuration)
+	tis, err := q.timeBuckets()
+	if err != nil {
+		return nil, err
+	}
 	bucketedSeries := map[*utils.TimeInterval][]Series{}
 	for _, ti := range tis {
 		bucketedSeries[ti] = []Series{}
 	}
 
 	// For each known db series, associate it to its applicable time
-	// buckets, if any:
+	// buckets, if any, unless its GroupColumn aggregates all of them:
+	groupOnServer := q.canGroupOnServer(tis)
+	grouped := []CQLQuery{}
 	for _, s := range seriesChoices {
 		// quick skip if the series doesn't match at all:
-		if !s.MatchesMeasurementName(string(q.MeasurementName)) {
+		if !match(&s) {
 			continue
 		}
-		if !s.MatchesFieldName(string(q.FieldName)) {
-			continue
-		}
-		if !s.MatchesTagSets(q.TagSets) {
-			continue
+		if groupOnServer {
+			if start, end, ok := q.groupedRange(&s, tis); ok {
+				ti, err := utils.NewTimeInterval(start, end)
+				if err != nil {
+					return nil, err
+				}
+				grouped = append(grouped, NewGroupedCQLQuery(string(q.AggregationType), csi.tableName(s, ti), s.Id, s.GroupColumn, start.UnixNano(), end.UnixNano()))
+				continue
+			}
 		}
 
 		// check each group-by interval to see if it applies:
 		for _, ti := range tis {
-			if !s.MatchesTimeInterval(ti) {
+			// with -inclusive-end, the points at the end are in the rows
+			// starting there:
+			atEnd := inclusiveEnd && !ti.End().Before(q.TimeEnd) && s.TimeInterval.Start().Equal(q.TimeEnd)
+			if !s.MatchesTimeInterval(ti) && !atEnd {
 				continue
 			}
 			bucketedSeries[ti] = append(bucketedSeries[ti], s)
@@ -68,6 +418,7 @@ func (q *HLQuery) ToQueryPlanWithServerAggregation(csi *ClientSideIndex) (qp *Qu
 	}
 
 	// For each group-by time bucket, convert its series into CQLQueries:
+	timeWeighted := timeWeightedAvg && string(q.AggregationType) == "avg"
 	cqlBuckets := make(map[*utils.TimeInterval][]CQLQuery, len(bucketedSeries))
 	for ti, seriesSlice := range bucketedSeries {
 		cqlQueries := make([]CQLQuery, len(seriesSlice))
@@ -83,20 +434,52 @@ func (q *HLQuery) ToQueryPlanWithServerAggregation(csi *ClientSideIndex) (qp *Qu
 			if end.After(q.TimeEnd) {
 				end = q.TimeEnd
 			}
+			endNanos := end.UnixNano()
+			if inclusiveEnd && end.Before(q.TimeEnd) {
+				// the end of the bucket is the start of the next one:
+				endNanos--
+			}
 
-			cqlQueries[i] = NewCQLQuery(string(q.AggregationType), ser.Table, ser.Id, string(q.OrderBy), start.UnixNano(), end.UnixNano())
+			// buckets aligned to a rollup read its pre-aggregated rows:
+			if r := chooseRollup(ser.Rollups, string(q.AggregationType), start, end); r != nil {
+				rollupSer := ser
+				rollupSer.Table = r.Table
+				cqlQueries[i] = NewRollupCQLQuery(string(q.AggregationType), csi.tableName(rollupSer, ti), ser.Id, start.UnixNano(), endNanos)
+			} else {
+				cqlQueries[i] = NewCQLQuery(string(q.AggregationType), csi.tableName(ser, ti), ser.Id, string(q.OrderBy), start.UnixNano(), endNanos)
+			}
+			if timeWeighted {
+				cqlQueries[i].Covered = ser.coveredDuration(start, end)
+			}
 		}
 		cqlBuckets[ti] = cqlQueries
 	}
 
-	qp, err = NewQueryPlanWithServerAggregation(string(q.AggregationType), cqlBuckets)
+	qp, err = NewQueryPlanWithServerAggregation(string(q.AggregationType), fields, cqlBuckets)
+	if err != nil {
+		return nil, err
+	}
+	if len(grouped) > 0 {
+		qp.GroupedCQLQueries = grouped
+	}
+	qp.Aggregations = q.Aggregations()
+
+	// Buckets without any series still produce a result: zero for additive
+	// aggregations, absent for all others (matching InfluxDB).
+	qp.ZeroFillEmpty = isAdditiveAggregation(string(q.AggregationType))
+	qp.TimeWeighted = timeWeighted
 	return
 }
 
+// getSeriesChoicesForFieldsAndMeasurement returns the series of the fields
+// of the measurement, which, as the MeasurementName of an HLQuery, may be a
+// comma-separated list of measurements.
 func (csi *ClientSideIndex) getSeriesChoicesForFieldsAndMeasurement(fields []string, measurement string) []Series {
 	seriesChoices := make([]Series, 0)
-	for _, f := range fields {
-		seriesChoices = append(seriesChoices, csi.SeriesForMeasurementAndField(measurement, f)...)
+	for _, m := range strings.Split(measurement, ",") {
+		for _, f := range fields {
+			seriesChoices = append(seriesChoices, csi.SeriesForMeasurementAndField(m, f)...)
+		}
 	}
 
 	return seriesChoices
@@ -105,26 +488,51 @@ func (csi *ClientSideIndex) getSeriesChoicesForFieldsAndMeasurement(fields []str
 // ToQueryPlanWithoutServerAggregation combines an HLQuery with a
 // ClientSideIndex to make a QueryPlanWithoutServerAggregation.
 //
-// It executes at most one CQLQuery per series.
+// It executes at most one CQLQuery per series. With a FieldExpression, the
+// series of the fields it references are read instead of those of FieldName,
+// and the results hold the aggregate of the values of the expression.
 func (q *HLQuery) ToQueryPlanWithoutServerAggregation(csi *ClientSideIndex) (qp *QueryPlanWithoutServerAggregation, err error) {
-	hlQueryInterval, err := utils.NewTimeInterval(q.TimeStart, q.TimeEnd)
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	match, err := q.seriesMatchFunc()
+	if err != nil {
+		return nil, err
+	}
+	fields := q.queriedFields()
+	expr, err := q.fieldExpression()
 	if err != nil {
 		return nil, err
 	}
-	fields := strings.Split(string(q.FieldName), ",")
 	seriesChoices := csi.getSeriesChoicesForFieldsAndMeasurement(fields, string(q.MeasurementName))
 	orderBy := string(q.OrderBy)
+	if len(orderBy) > 0 {
+		orderBy, _ = rawOrderBy(orderBy)
+	}
 
 	// Build the time buckets used for 'group by time'-type queries.
 	//
 	// It is important to populate these even if they end up being empty,
 	// so that we get correct results for empty 'time buckets'.
-	timeBuckets := bucketTimeIntervals(q.TimeStart, q.TimeEnd, q.GroupByDuration)
+	timeBuckets, err := q.timeBuckets()
+	if err != nil {
+		return nil, err
+	}
+	start, end := q.bucketsTimeRange(timeBuckets)
+	rangeEnd := end
+	if inclusiveEnd {
+		// the rows starting at the end hold its points:
+		rangeEnd = rangeEnd.Add(time.Nanosecond)
+	}
+	bucketsRange, err := utils.NewTimeInterval(start, rangeEnd)
+	if err != nil {
+		return nil, err
+	}
 
 	// TODO more generalized?
 	// Sort time buckets in reverse order if time descending for more
 	// efficient query planning
-	if orderBy == "timestamp_ns DESC" {
+	if q.isDescending() {
 		for i, j := 0, len(timeBuckets)-1; i < j; i, j = i+1, j-1 {
 			timeBuckets[i], timeBuckets[j] = timeBuckets[j], timeBuckets[i]
 		}
@@ -133,50 +541,53 @@ func (q *HLQuery) ToQueryPlanWithoutServerAggregation(csi *ClientSideIndex) (qp
 	// For each known db series, use it for querying only if it matches
 	// this HLQuery:
 	applicableSeries := []Series{}
-
-outer:
 	for _, s := range seriesChoices {
-		if !s.MatchesMeasurementName(string(q.MeasurementName)) {
+		// (and the time buckets it keeps):
+		if !match(&s) || !s.MatchesTimeInterval(bucketsRange) {
 			continue
 		}
+		applicableSeries = append(applicableSeries, s)
+	}
 
-		// Supports multiple fields separated by commas
-		fieldFound := false
-		for _, f := range fields {
-			if !s.MatchesFieldName(f) {
-				continue
+	// Rates need the points of each series in time order (or reverse time
+	// order), so its rows are queried one day after the other:
+	if _, ok := parseRateAggregation(string(q.AggregationType)); ok {
+		sort.Slice(applicableSeries, func(i, j int) bool {
+			if q.isDescending() {
+				return applicableSeries[j].Id < applicableSeries[i].Id
 			}
-			fieldFound = true
-			break
-		}
-		if !fieldFound {
-			continue outer
-		}
-
-		if !s.MatchesTagSets(q.TagSets) {
-			continue
-		}
-		if !s.MatchesTimeInterval(hlQueryInterval) {
-			continue
-		}
-
-		applicableSeries = append(applicableSeries, s)
+			return applicableSeries[i].Id < applicableSeries[j].Id
+		})
 	}
 
 	// Build CQLQuery objects that will be used to fulfill this HLQuery:
 	cqlQueries := []CQLQuery{}
 	for _, ser := range applicableSeries {
-		cqlQueries = append(cqlQueries, NewCQLQuery("", ser.Table, ser.Id, orderBy, q.TimeStart.UnixNano(), q.TimeEnd.UnixNano()))
+		cqlQueries = append(cqlQueries, NewCQLQuery("", csi.tableName(ser, ser.TimeInterval), ser.Id, orderBy, start.UnixNano(), end.UnixNano()))
 	}
 
-	qp, err = NewQueryPlanWithoutServerAggregation(string(q.AggregationType), q.GroupByDuration, fields, timeBuckets, q.Limit, cqlQueries)
+	aggregated := fields
+	if expr != nil {
+		aggregated = []string{expr.source}
+	}
+	qp, err = NewQueryPlanWithoutServerAggregation(string(q.AggregationType), q.GroupByDuration, aggregated, timeBuckets, q.Limit, cqlQueries)
+	if err != nil {
+		return nil, err
+	}
+	qp.Expression = expr
+	qp.ZeroFillEmpty = isAdditiveAggregation(string(q.AggregationType))
+	qp.explicitBuckets = len(q.TimeBuckets) > 0
+	qp.descending = q.isDescending()
 	return
 }
 
 // ToQueryPlanNoAggregation combines an HLQuery with a
 // ClientSideIndex to make a QueryPlanNoAggregation.
 func (q *HLQuery) ToQueryPlanNoAggregation(csi *ClientSideIndex) (*QueryPlanNoAggregation, error) {
-	hlQueryInterval, err := utils.NewTimeInterval(q.TimeStart, q.TimeEnd)
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	match, err := q.seriesMatchFunc()
 	if err != nil {
 		return nil, err
 	}
@@ -187,14 +598,7 @@ func (q *HLQuery) ToQueryPlanNoAggregation(csi *ClientSideIndex) (*QueryPlanNoAg
 	// this HLQuery (its tagsets and time interval):
 	applicableSeries := []Series{}
 	for _, s := range seriesChoices {
-		// If no tagsets given, return all that match time
-		if len(q.TagSets) > 0 {
-			if !s.MatchesTagSets(q.TagSets) {
-				continue
-			}
-		}
-
-		if !s.MatchesTimeInterval(hlQueryInterval) {
+		if !match(&s) {
 			continue
 		}
 
@@ -205,7 +609,7 @@ func (q *HLQuery) ToQueryPlanNoAggregation(csi *ClientSideIndex) (*QueryPlanNoAg
 	cqlQueries := []CQLQuery{}
 	whereClause := string(q.WhereClause)
 	for _, ser := range applicableSeries {
-		cqlQueries = append(cqlQueries, NewCQLQuery("", ser.Table, ser.Id, string(q.OrderBy), q.TimeStart.UnixNano(), q.TimeEnd.UnixNano()))
+		cqlQueries = append(cqlQueries, NewCQLQuery("", csi.tableName(ser, ser.TimeInterval), ser.Id, string(q.OrderBy), q.TimeStart.UnixNano(), q.TimeEnd.UnixNano()))
 	}
 
 	return NewQueryPlanNoAggregation(fields, whereClause, cqlQueries)
@@ -214,6 +618,9 @@ func (q *HLQuery) ToQueryPlanNoAggregation(csi *ClientSideIndex) (*QueryPlanNoAg
 // ToQueryPlanForEvery combines an HLQuery with a
 // ClientSideIndex to make a QueryPlanForEvery.
 func (q *HLQuery) ToQueryPlanForEvery(csi *ClientSideIndex) (*QueryPlanForEvery, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
 	forEveryArgs := strings.Split(string(q.ForEveryN), ",")
 	forEveryTag := forEveryArgs[0]
 	forEveryNum, err := strconv.ParseInt(forEveryArgs[1], 10, 0)
@@ -221,7 +628,7 @@ func (q *HLQuery) ToQueryPlanForEvery(csi *ClientSideIndex) (*QueryPlanForEvery,
 		panic("unparseable ForEveryN field: " + string(q.ForEveryN))
 	}
 
-	hlQueryInterval, err := utils.NewTimeInterval(q.TimeStart, q.TimeEnd)
+	match, err := q.seriesMatchFunc()
 	if err != nil {
 		return nil, err
 	}
@@ -233,14 +640,7 @@ func (q *HLQuery) ToQueryPlanForEvery(csi *ClientSideIndex) (*QueryPlanForEvery,
 	applicableSeries := []Series{}
 	for _, s := range seriesChoices {
 
-		// If no tagsets given, return all that match time
-		if len(q.TagSets) > 0 {
-			if !s.MatchesTagSets(q.TagSets) {
-				continue
-			}
-		}
-
-		if !s.MatchesTimeInterval(hlQueryInterval) {
+		if !match(&s) {
 			continue
 		}
 
@@ -250,7 +650,7 @@ func (q *HLQuery) ToQueryPlanForEvery(csi *ClientSideIndex) (*QueryPlanForEvery,
 	// Build CQLQuery objects that will be used to fulfill this HLQuery:
 	cqlQueries := []CQLQuery{}
 	for _, ser := range applicableSeries {
-		cqlQ := NewCQLQuery("", ser.Table, ser.Id, "timestamp_ns DESC", q.TimeStart.UnixNano(), q.TimeEnd.UnixNano())
+		cqlQ := NewCQLQuery("", csi.tableName(ser, ser.TimeInterval), ser.Id, "timestamp_ns DESC", q.TimeStart.UnixNano(), q.TimeEnd.UnixNano())
 		cqlQ.PreparableQueryString += " LIMIT 1"
 		cqlQueries = append(cqlQueries, cqlQ)
 	}
@@ -258,30 +658,348 @@ func (q *HLQuery) ToQueryPlanForEvery(csi *ClientSideIndex) (*QueryPlanForEvery,
 	return NewQueryPlanForEvery(fields, forEveryTag, forEveryNum, cqlQueries)
 }
 
+// IsRaw reports whether the HLQuery selects raw points, i.e. it has no
+// aggregation (or "none"), ForEveryN or WhereClause.
+func (q *HLQuery) IsRaw() bool {
+	aggr := string(q.AggregationType)
+	return (len(aggr) == 0 || aggr == "none") && len(q.ForEveryN) == 0 && len(q.WhereClause) == 0
+}
+
+// IsLastPoint reports whether the HLQuery selects the last point of each
+// series, i.e. it is a "last" aggregation with no GroupByDuration.
+func (q *HLQuery) IsLastPoint() bool {
+	return string(q.AggregationType) == "last" && q.GroupByDuration == 0 && len(q.ForEveryN) == 0 && len(q.WhereClause) == 0
+}
+
+// IsCardinality reports whether the HLQuery counts the series matching its
+// tagsets and time range, i.e. it is a "cardinality" aggregation.
+func (q *HLQuery) IsCardinality() bool {
+	return string(q.AggregationType) == "cardinality"
+}
+
+// ToQueryPlanCardinality combines an HLQuery with a ClientSideIndex to make
+// a QueryPlanCardinality, counting the distinct series (i.e. by their id
+// without the day) that have a row matching the HLQuery.
+func (q *HLQuery) ToQueryPlanCardinality(csi *ClientSideIndex) (*QueryPlanCardinality, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	hlQueryInterval, err := utils.NewTimeInterval(q.TimeStart, q.TimeEnd)
+	if err != nil {
+		return nil, err
+	}
+	match, err := q.seriesMatchFunc()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(string(q.FieldName), ",")
+	seriesChoices := csi.getSeriesChoicesForFieldsAndMeasurement(fields, string(q.MeasurementName))
+
+	// the series across days, of each keyspace (see -keyspaces):
+	series := map[[2]string]struct{}{}
+	matched := 0
+	for _, s := range seriesChoices {
+		if match(&s) {
+			series[[2]string{s.Keyspace, seriesKey(s.Id)}] = struct{}{}
+			matched++
+		}
+	}
+	qp, err := NewQueryPlanCardinality(hlQueryInterval, len(series))
+	if err == nil {
+		qp.Matched = matched
+	}
+	return qp, err
+}
+
+// IsCountAll reports whether the HLQuery counts the points its series would
+// have, one per slot, were none missing, i.e. it is a "count_all"
+// aggregation.
+func (q *HLQuery) IsCountAll() bool {
+	return string(q.AggregationType) == "count_all"
+}
+
+// ToQueryPlanCountAll combines an HLQuery with a ClientSideIndex to make a
+// QueryPlanCountAll, counting in each time bucket and for each field the
+// slots of the given interval covered by the matching series rows.
+func (q *HLQuery) ToQueryPlanCountAll(csi *ClientSideIndex, slot time.Duration) (*QueryPlanCountAll, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if slot <= 0 {
+		return nil, &InvalidQueryError{fmt.Sprintf("non-positive slot interval %s", slot)}
+	}
+	match, err := q.seriesMatchFunc()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(string(q.FieldName), ",")
+	seriesChoices := csi.getSeriesChoicesForFieldsAndMeasurement(fields, string(q.MeasurementName))
+	tis, err := q.timeBuckets()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]CQLResult, len(tis))
+	matched := 0
+	for i, ti := range tis {
+		start, end := ti.StartUnixNano(), ti.EndUnixNano()
+		if qs := q.TimeStart.UnixNano(); start < qs {
+			start = qs
+		}
+		if qe := q.TimeEnd.UnixNano(); end > qe {
+			end = qe
+		}
+		values := make([]float64, len(fields))
+		for _, s := range seriesChoices {
+			if !match(&s) {
+				continue
+			}
+			if i == 0 {
+				matched++
+			}
+			for j, f := range fields {
+				if s.Field == f {
+					values[j] += float64(countSlots(start, end, s.TimeInterval, slot))
+				}
+			}
+		}
+		results[i] = CQLResult{TimeInterval: ti, Values: values}
+	}
+	qp, err := NewQueryPlanCountAll(slot, results)
+	if err == nil {
+		qp.Matched = matched
+	}
+	return qp, err
+}
+
+// countSlots returns the number of slots, i.e. epoch-aligned multiples of
+// slot, in [start, end) that a series row covers.
+func countSlots(start, end int64, ti *utils.TimeInterval, slot time.Duration) int64 {
+	if s := ti.StartUnixNano(); start < s {
+		start = s
+	}
+	if e := ti.EndUnixNano(); end > e {
+		end = e
+	}
+	if start >= end {
+		return 0
+	}
+	n := int64(slot)
+	ceil := func(t int64) int64 { return (t + n - 1) / n }
+	return ceil(end) - ceil(start)
+}
+
+// ToQueryPlanRaw combines an HLQuery with a ClientSideIndex to make a
+// QueryPlanRaw.
+//
+// Each series is stored in one row per day, so the rows of each series are
+// queried in turn, in the order of its points (ascending unless OrderBy is
+// "timestamp_ns DESC"), until Limit points (if positive) have been read.
+func (q *HLQuery) ToQueryPlanRaw(csi *ClientSideIndex) (*QueryPlanRaw, error) {
+	orderBy, ok := rawOrderBy(string(q.OrderBy))
+	if !ok {
+		return nil, q.Validate()
+	}
+	return q.toQueryPlanRaw(csi, orderBy, q.Limit)
+}
+
+// ToQueryPlanLastPoint combines an HLQuery with a ClientSideIndex to make a
+// QueryPlanRaw selecting the last point of each series (see IsLastPoint).
+//
+// Rather than scanning the whole time range, the rows of each series are
+// queried latest first with a LIMIT of 1, which usually takes one query per
+// series.
+func (q *HLQuery) ToQueryPlanLastPoint(csi *ClientSideIndex) (*QueryPlanRaw, error) {
+	return q.toQueryPlanRaw(csi, "timestamp_ns DESC", 1)
+}
+
+func (q *HLQuery) toQueryPlanRaw(csi *ClientSideIndex, orderBy string, limit int) (*QueryPlanRaw, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	hlQueryInterval, err := utils.NewTimeInterval(q.TimeStart, q.TimeEnd)
+	if err != nil {
+		return nil, err
+	}
+	match, err := q.seriesMatchFunc()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(string(q.FieldName), ",")
+	seriesChoices := csi.getSeriesChoicesForFieldsAndMeasurement(fields, string(q.MeasurementName))
+	descending := strings.HasSuffix(orderBy, " DESC")
+
+	// Group the applicable rows by series, i.e. by their id without the day:
+	rows := map[string][]Series{}
+	for _, s := range seriesChoices {
+		if !match(&s) {
+			continue
+		}
+		key := s.Id[:strings.LastIndex(s.Id, "#")]
+		rows[key] = append(rows[key], s)
+	}
+	keys := make([]string, 0, len(rows))
+	for k := range rows {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	cqlQueries := make([][]CQLQuery, len(keys))
+	for i, k := range keys {
+		seriesRows := rows[k]
+		sort.Slice(seriesRows, func(a, b int) bool {
+			if descending {
+				return seriesRows[b].TimeInterval.Start().Before(seriesRows[a].TimeInterval.Start())
+			}
+			return seriesRows[a].TimeInterval.Start().Before(seriesRows[b].TimeInterval.Start())
+		})
+		for _, ser := range seriesRows {
+			cqlQueries[i] = append(cqlQueries[i], NewRawCQLQuery(csi.tableName(ser, ser.TimeInterval), ser.Id, orderBy, q.TimeStart.UnixNano(), q.TimeEnd.UnixNano(), limit, q.ValuePredicates...))
+		}
+	}
+
+	return NewQueryPlanRaw(hlQueryInterval, keys, cqlQueries, limit)
+}
+
 // CQLQuery wraps data needed to execute a gocql.Query.
 type CQLQuery struct {
 	PreparableQueryString string
 	Args                  []interface{}
 	Field                 string
+	SumAndCount           bool          // selects the sum and count of a rollup, for an average
+	Covered               time.Duration // of its time range by its series row, for time-weighted averages
+	ArgOrder              []int         // positions in Args of its bind markers, if not in order (see BoundArgs)
+}
+
+// valueColumn and timestampColumn are the columns of the series tables
+// holding the values of points and their timestamps in nanoseconds (set by
+// -value-column and -timestamp-column).
+var (
+	valueColumn     = "value"
+	timestampColumn = "timestamp_ns"
+)
+
+// inclusiveEnd makes CQL queries select the points at the end of their
+// time range (set by -inclusive-end), rather than the half-open range of
+// InfluxDB. Time buckets other than the last one still end before the start
+// of the next, so that no point is aggregated twice.
+var inclusiveEnd bool
+
+// timeWeightedAvg makes the server aggregation plan weight the average of
+// each series row by the duration of the time bucket it covers (set by
+// -time-weighted-avg), rather than averaging the rows equally. Rows only
+// cover part of a bucket across days, or in the buckets clamped to the
+// start or end of the query.
+var timeWeightedAvg bool
+
+// cqlTimeRange returns the condition of CQL queries selecting the points
+// from their start to their end, which are their second and third Args.
+func cqlTimeRange() string {
+	if inclusiveEnd {
+		return timestampColumn + " >= ? AND " + timestampColumn + " <= ?"
+	}
+	return timestampColumn + " >= ? AND " + timestampColumn + " < ?"
+}
+
+// cqlIdentifierRegexp matches the unquoted CQL identifiers.
+var cqlIdentifierRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,47}$`)
+
+// validateCQLIdentifier returns an error unless s is a valid unquoted CQL
+// identifier, so that it can safely be formatted into a CQL statement.
+func validateCQLIdentifier(s string) error {
+	if !cqlIdentifierRegexp.MatchString(s) {
+		return fmt.Errorf("%q is not a CQL identifier (a letter followed by at most 47 letters, digits or underscores)", s)
+	}
+	return nil
+}
+
+// cqlOrderBy returns an ORDER BY of an HLQuery or a query plan, which always
+// names the timestamps timestamp_ns, for the timestampColumn.
+func cqlOrderBy(orderBy string) string {
+	if strings.HasPrefix(orderBy, "timestamp_ns") {
+		return timestampColumn + strings.TrimPrefix(orderBy, "timestamp_ns")
+	}
+	return orderBy
 }
 
-// NewCQLQuery builds a CQLQuery, using prepared CQL statements.
+// NewCQLQuery builds a CQLQuery, using prepared CQL statements. Its Args
+// are the series id and time range (see cqlArgSeriesID), also with a
+// -cql-template.
 func NewCQLQuery(aggrLabel, tableName, rowName, orderBy string, timeStartNanos, timeEndNanos int64) CQLQuery {
-	var preparableQueryString string
+	var selected, orderByClause string
 
 	if len(aggrLabel) == 0 {
-		orderByClause := ""
 		if len(orderBy) > 0 {
-			orderByClause = "ORDER BY " + orderBy
+			orderByClause = "ORDER BY " + cqlOrderBy(orderBy)
 		}
-
-		preparableQueryString = fmt.Sprintf("SELECT timestamp_ns, value FROM %s WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ? %s", tableName, orderByClause)
+		selected = timestampColumn + ", " + valueColumn
+	} else if isClientSideAggregation(aggrLabel) {
+		// Cassandra cannot compute percentiles (or variances), so the raw
+		// values are fetched and aggregated by the client:
+		selected = valueColumn
+	} else if strings.Contains(aggrLabel, ",") {
+		selected = cqlAggregations(strings.Split(aggrLabel, ","))
 	} else {
-		preparableQueryString = fmt.Sprintf("SELECT %s(value) FROM %s WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ?", aggrLabel, tableName)
+		selected = fmt.Sprintf("%s(%s)", aggrLabel, valueColumn)
+	}
+	args := []interface{}{rowName, timeStartNanos, timeEndNanos}
+	rowParts := strings.Split(rowName, "#")
+	q := CQLQuery{Args: args, Field: rowParts[len(rowParts)-2]}
+
+	if cqlTemplate != nil {
+		d := &cqlTemplateData{Aggregation: selected, Table: tableName, OrderBy: orderByClause}
+		stmt, argOrder, err := d.render(cqlTemplate)
+		if err != nil {
+			panic(templateError{fmt.Errorf("cannot render CQL template: %v", err)})
+		}
+		q.PreparableQueryString, q.ArgOrder = stmt, argOrder
+		return q
+	}
+	q.PreparableQueryString = fmt.Sprintf("SELECT %s FROM %s WHERE series_id = ? AND %s", selected, tableName, cqlTimeRange())
+	if len(orderByClause) > 0 {
+		q.PreparableQueryString += " " + orderByClause
+	}
+	return q
+}
+
+// NewBatchedCQLQuery merges CQLQueries that only differ by their series id
+// (i.e. they have the same statement, field and time range) into a single
+// CQLQuery reading all of their series, with "series_id IN ?". Its first
+// arg is the list of series ids.
+func NewBatchedCQLQuery(queries []CQLQuery) CQLQuery {
+	ids := make([]string, len(queries))
+	for i, q := range queries {
+		ids[i] = q.Args[0].(string)
 	}
+	first := queries[0]
+	return CQLQuery{
+		PreparableQueryString: strings.Replace(first.PreparableQueryString, "series_id = ?", "series_id IN ?", 1),
+		Args:                  append([]interface{}{ids}, first.Args[1:]...),
+		Field:                 first.Field,
+		SumAndCount:           first.SumAndCount,
+	}
+}
+
+// NewRawCQLQuery builds a CQLQuery selecting the raw points of a series, in
+// the given order, using prepared CQL statements. With a positive limit, at
+// most that many points are selected; the limit is the last of the Args.
+// Only the points matching all of the value predicates are selected, whose
+// values follow the time range in the Args.
+func NewRawCQLQuery(tableName, rowName, orderBy string, timeStartNanos, timeEndNanos int64, limit int, preds ...ValuePredicate) CQLQuery {
+	preparableQueryString := fmt.Sprintf("SELECT %s, %s FROM %s WHERE series_id = ? AND %s%s ORDER BY %s", timestampColumn, valueColumn, tableName, cqlTimeRange(), cqlValuePredicates(preds), cqlOrderBy(orderBy))
 	args := []interface{}{rowName, timeStartNanos, timeEndNanos}
+	for _, p := range preds {
+		args = append(args, p.Value)
+	}
+	if limit > 0 {
+		preparableQueryString += " LIMIT ?"
+		args = append(args, limit)
+	}
+	if len(preds) > 0 && allowFiltering {
+		preparableQueryString += " ALLOW FILTERING"
+	}
 	rowParts := strings.Split(rowName, "#")
-	return CQLQuery{preparableQueryString, args, rowParts[len(rowParts)-2]}
+	return CQLQuery{PreparableQueryString: preparableQueryString, Args: args, Field: rowParts[len(rowParts)-2]}
 }
 
 // CQLResult holds a result from a set of CQL aggregation queries.
@@ -289,4 +1007,165 @@ func NewCQLQuery(aggrLabel, tableName, rowName, orderBy string, timeStartNanos,
 type CQLResult struct {
 	*utils.TimeInterval
 	Values []float64
+
+	// Absent marks the Values that no data contributed to, e.g. the
+	// maximum of an empty time bucket. A nil Absent means all are present.
+	Absent []bool
+
+	// Series and Points hold the raw points of one series instead of
+	// Values, for raw queries (see QueryPlanRaw).
+	Series string
+	Points []CQLPoint
+
+	// Measurement is set for queries of several measurements (see
+	// QueryPlanPerMeasurement).
+	Measurement string
+
+	// SeriesIds are the sorted series_ids of the rows that fed the result,
+	// set only by plans that trace them (see HLQueryExecutorDoOptions.Trace).
+	SeriesIds []string
+
+	// Tags are set for queries grouped by tag (see QueryPlanPerTagGroup),
+	// e.g. ["hostname=host_0"].
+	Tags []string
+
+	// ValueSeries are the series (without their day) of each of the
+	// Values, for the shares of series (see newSharesCQLResult).
+	ValueSeries []string
+
+	// Aggregations are the aggregations of each of the Values, for queries
+	// of several aggregations (see HLQuery.Aggregations).
+	Aggregations []string
+
+	// ZeroFilled is set when no data contributed to any of the Values,
+	// which are all zero-filled (see newAggregatedCQLResult).
+	ZeroFilled bool
+}
+
+// A CQLPoint is a raw point of a series.
+type CQLPoint struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// newAggregatedCQLResult builds the CQLResult for one time bucket from its
+// Aggregators. Empty aggregators yield absent values, unless zeroFillEmpty
+// is set (as it is for additive aggregations), in which case they yield 0.
+func newAggregatedCQLResult(ti *utils.TimeInterval, aggrs []Aggregator, zeroFillEmpty bool) CQLResult {
+	res := CQLResult{TimeInterval: ti, Values: make([]float64, len(aggrs)), ZeroFilled: zeroFillEmpty}
+	for i, aggr := range aggrs {
+		res.ZeroFilled = res.ZeroFilled && aggr.Empty()
+		if aggr.Empty() && !zeroFillEmpty {
+			if res.Absent == nil {
+				res.Absent = make([]bool, len(aggrs))
+			}
+			res.Absent[i] = true
+			continue
+		}
+		res.Values[i] = aggr.Get()
+	}
+	return res
+}
+
+// newSharesCQLResult builds the CQLResult for one time bucket from the
+// Aggregators of each of its series, by series id without their day: the
+// share of each series with data in their total, in series order. The
+// shares of a bucket whose total is zero are absent or zero, as set by
+// zeroTotalShares.
+func newSharesCQLResult(ti *utils.TimeInterval, aggrs map[string]Aggregator) CQLResult {
+	res := CQLResult{TimeInterval: ti, Values: []float64{}, ValueSeries: []string{}}
+	for series, aggr := range aggrs {
+		if !aggr.Empty() {
+			res.ValueSeries = append(res.ValueSeries, series)
+		}
+	}
+	sort.Strings(res.ValueSeries)
+	total := 0.0
+	for _, series := range res.ValueSeries {
+		v := aggrs[series].Get()
+		res.Values = append(res.Values, v)
+		total += v
+	}
+	if total == 0 {
+		if zeroTotalShares == ZeroTotalSharesNull && len(res.Values) > 0 {
+			res.Absent = make([]bool, len(res.Values))
+			for i := range res.Absent {
+				res.Absent[i] = true
+			}
+		}
+		for i := range res.Values {
+			res.Values[i] = 0
+		}
+		return res
+	}
+	for i := range res.Values {
+		res.Values[i] /= total
+	}
+	return res
+}
+
+// IsAbsent reports whether the i-th value has no data.
+func (r *CQLResult) IsAbsent(i int) bool {
+	return r.Absent != nil && r.Absent[i]
+}
+
+// allAbsent reports whether all values have no data.
+func (r *CQLResult) allAbsent() bool {
+	for i := range r.Values {
+		if !r.IsAbsent(i) {
+			return false
+		}
+	}
+	return len(r.Values) > 0
+}
+
+// hasData reports whether any data contributed to the result: to any of
+// its Values, or its Points for raw results.
+func (r *CQLResult) hasData() bool {
+	if len(r.Series) > 0 {
+		return len(r.Points) > 0
+	}
+	return len(r.Values) > 0 && !r.ZeroFilled && !r.allAbsent()
+}
+
+// resultsHaveData reports whether any of the results has data, i.e. its
+// query matched some data.
+func resultsHaveData(results []CQLResult) bool {
+	for i := range results {
+		if results[i].hasData() {
+			return true
+		}
+	}
+	return false
+}
+
+// compactAbsent resets Absent to nil if no value is absent.
+func (r *CQLResult) compactAbsent() {
+	for i := range r.Values {
+		if r.IsAbsent(i) {
+			return
+		}
+	}
+	r.Absent = nil
+}
+
+// valuesString formats the Values for printing, with absent values as null.
+// The Points of raw results are formatted with their series instead.
+func (r *CQLResult) valuesString() string {
+	if len(r.Series) > 0 {
+		parts := make([]string, len(r.Points))
+		for i, p := range r.Points {
+			parts[i] = p.Timestamp.Format(time.RFC3339Nano) + "=" + strconv.FormatFloat(p.Value, 'g', -1, 64)
+		}
+		return r.Series + " [" + strings.Join(parts, " ") + "]"
+	}
+	parts := make([]string, len(r.Values))
+	for i, v := range r.Values {
+		if r.IsAbsent(i) {
+			parts[i] = "null"
+		} else {
+			parts[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	}
+	return "[" + strings.Join(parts, " ") + "]"
 }
@@ -1,11 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"strings"
 	"time"
-
-	"github.com/gocql/gocql"
 )
 
 const (
@@ -13,17 +13,25 @@ const (
 	AggrPlanTypeWithoutServerAggregation = 2
 )
 
+const (
+	ResponseFormatText = 1
+	ResponseFormatJSON = 2
+	ResponseFormatLine = 3
+	// ResponseFormatBinary writes the responses to a responseDumpWriter.
+	ResponseFormatBinary = 4
+)
+
 // An HLQueryExecutor is responsible for executing HLQuery objects in the
 // context of a particular Cassandra session and data set.
 type HLQueryExecutor struct {
-	session *gocql.Session
+	session QueryExecutor
 	csi     *ClientSideIndex
 	debug   int
 }
 
 // NewHLQueryExecutor creates an HLQueryExecutor from a ClientSideIndex and
-// Cassandra session.
-func NewHLQueryExecutor(session *gocql.Session, csi *ClientSideIndex, debug int) *HLQueryExecutor {
+// Cassandra session (typically from NewGocqlQueryExecutor).
+func NewHLQueryExecutor(session QueryExecutor, csi *ClientSideIndex, debug int) *HLQueryExecutor {
 	return &HLQueryExecutor{
 		session: session,
 		csi:     csi,
@@ -34,35 +42,90 @@ func NewHLQueryExecutor(session *gocql.Session, csi *ClientSideIndex, debug int)
 // HLQueryExecutorDoOptions contains options used by HLQueryExecutor.
 type HLQueryExecutorDoOptions struct {
 	AggregationPlan      int
-	SubQueryParallelism  int // unused
+	SubQueryParallelism  int // time buckets executed at once by server aggregation
 	Debug                int
 	PrettyPrintResponses bool
+	ResponseFormat       int
+	ResponseDump         *responseDumpWriter
+	Timeout              time.Duration   // of the plan execution, if positive
+	Context              context.Context // cancels the plan execution when done, if set
+	DryRun               bool            // print the CQL of the plan instead of executing it
+	NoExecute            bool            // only build the plan, to validate the query
+	FillMode             int             // of empty time buckets, see fillResults
+	SkipEmpty            bool            // omit empty time buckets, even zero-filled ones
+	MovingAverage        int             // buckets of the trailing moving average of the results, if above 1
+	MovingAverageStart   int             // of the buckets before a full window, see movingAverageResults
+	MaxPoints            int             // results of each measurement and group of tags, if positive, see downsampleResults
+	Downsample           int             // reducer of the results over MaxPoints
+	MaxBuckets           int             // time buckets of a query, if positive, see limitBuckets
+	BucketOverflow       int             // policy of queries over MaxBuckets
+	NaNPolicy            int             // of non-finite result values, NaNPolicyKeep if unset
+	BatchReads           bool            // merge the CQL queries of server aggregation buckets
+	ResultCache          *resultCache    // of the results of identical queries, if set
+	PageSize             int             // rows per page of raw queries, if positive
+	Trace                bool            // set the SeriesIds of aggregated and raw results
+	Tracing              bool            // trace the CQL queries to count the rows they scan
+	SlotInterval         time.Duration   // between the expected points of a series, for count_all
+	VerifyRepeat         int             // executions of the plan whose results are compared, if above 1
+	VerifyTolerance      float64         // between the values of repetitions considered equal
+	ValueStats           bool            // summarize the result values in HLQueryExecutorDoInfo.Values
+}
+
+// HLQueryExecutorDoInfo describes the query plan executed by Do.
+type HLQueryExecutorDoInfo struct {
+	Buckets     int  // results, i.e. time buckets (or series of raw queries)
+	CQLQueries  int  // of the plan, i.e. its fan-out
+	Series      int  // distinct series rows queried
+	Matched     int  // series rows matched by the query (see matchedSeries)
+	Cached      bool // the results were served by the ResultCache
+	NoData      bool // no time bucket (or series of raw queries) has data
+	OverBuckets bool // the query had more time buckets than MaxBuckets
+	NonFinite   int  // NaN or infinite result values, see applyNaNPolicy
+	Pages       int  // fetched by all CQL queries
+	RowsScanned int  // read by Cassandra for all CQL queries, if Tracing
+
+	// Values summarizes the known result values, with ValueStats.
+	Values valueSummary
+
+	// Differing are the values whose results differ across the
+	// repetitions of the query, with VerifyRepeat.
+	Differing []bucketSpread
 }
 
 // Do takes a high-level query, constructs a query plan using the client-side
 // index contained within the query executor, executes that query plan, then
 // aggregates the results.
-func (qe *HLQueryExecutor) Do(q *HLQuery, opts HLQueryExecutorDoOptions) (qpLagMs, requestLagMs float64, err error) {
+//
+// If the execution takes longer than opts.Timeout, it is cancelled and Do
+// returns context.DeadlineExceeded along with the elapsed time.
+func (qe *HLQueryExecutor) Do(q *HLQuery, opts HLQueryExecutorDoOptions) (qpLagMs, requestLagMs float64, info HLQueryExecutorDoInfo, err error) {
 	if opts.Debug >= 1 {
 		fmt.Printf("[hlqe] Do: %s\n", q)
 	}
 
+	// serve the results of identical queries from the cache, if any:
+	var cacheKey string
+	if opts.ResultCache != nil && !opts.DryRun {
+		cacheKey = q.cacheKey()
+		lookupStart := time.Now()
+		if results, ok := opts.ResultCache.get(cacheKey); ok {
+			requestLagMs = float64(time.Now().Sub(lookupStart).Nanoseconds()) / 1e6
+			info = HLQueryExecutorDoInfo{Buckets: len(results), Cached: true}
+			err = printResponses(q, results, opts)
+			return
+		}
+	}
+
 	// build the query plan:
 	var qp QueryPlan
 	qpStart := time.Now()
-	if len(string(q.AggregationType)) == 0 && len(string(q.ForEveryN)) == 0 {
-		qp, err = q.ToQueryPlanNoAggregation(qe.csi)
-	} else if len(string(q.AggregationType)) == 0 {
-		qp, err = q.ToQueryPlanForEvery(qe.csi)
-	} else {
-		switch opts.AggregationPlan {
-		case AggrPlanTypeWithServerAggregation:
-			qp, err = q.ToQueryPlanWithServerAggregation(qe.csi)
-		case AggrPlanTypeWithoutServerAggregation:
-			qp, err = q.ToQueryPlanWithoutServerAggregation(qe.csi)
-		default:
-			panic("logic error: invalid aggregation plan option")
+	groupBy := q.GroupByDuration
+	if q, info.OverBuckets, err = q.limitBuckets(opts.MaxBuckets, opts.BucketOverflow); err == nil {
+		if info.OverBuckets && logs.Enabled(LogLevelWarn) {
+			logs.Log(LogLevelWarn, "time buckets coarsened", "query_id", q.GetID(), "label", string(q.HumanLabel),
+				"group_by", groupBy, "coarsened", q.GroupByDuration)
 		}
+		qp, err = qe.queryPlan(q, opts)
 	}
 	qpLagMs = float64(time.Now().Sub(qpStart).Nanoseconds()) / 1e6
 
@@ -71,27 +134,276 @@ func (qe *HLQueryExecutor) Do(q *HLQuery, opts HLQueryExecutorDoOptions) (qpLagM
 		// FYI: query planning takes about 0.5ms for 1000 series.
 		fmt.Printf("[hlqe] query planning took %fms\n", qpLagMs)
 
-		qp.DebugQueries(opts.Debug)
+		if err == nil {
+			qp.DebugQueries(opts.Debug)
+		}
 	}
 
 	if err != nil {
 		return
 	}
+	cqlQueries := qp.AllCQLQueries()
+	info.CQLQueries = len(cqlQueries)
+	info.Series = countSeries(cqlQueries)
+	info.Matched = matchedSeries(qp, info.Series)
+	if logs.Enabled(LogLevelDebug) {
+		logs.Log(LogLevelDebug, "query planned", "query_id", q.GetID(), "label", string(q.HumanLabel),
+			"plan", fmt.Sprintf("%T", qp), "cql_queries", info.CQLQueries, "series", info.Series, "plan_ms", qpLagMs)
+	}
+
+	if opts.NoExecute {
+		return
+	}
+	if opts.DryRun {
+		err = writeDryRun(os.Stdout, q, cqlQueries)
+		return
+	}
 
 	// execute the query plan:
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	paging := &queryPaging{}
+	if q.IsRaw() {
+		paging.pageSize = opts.PageSize
+	}
+	ctx = withQueryPaging(ctx, paging)
+	if logs.Enabled(LogLevelWarn) {
+		ctx = withQueryLog(ctx, q)
+	}
+	var tracing *queryTracing
+	if opts.Tracing {
+		tracing = &queryTracing{}
+		ctx = withQueryTracing(ctx, tracing)
+	}
 	var results []CQLResult
 	execStart := time.Now()
-	results, err = qp.Execute(qe.session)
+	results, err = qp.Execute(ctx, qe.session)
 	requestLagMs = float64(time.Now().Sub(execStart).Nanoseconds()) / 1e6
+	info.Pages = paging.Pages()
+	if tracing != nil {
+		info.RowsScanned = tracing.Rows()
+	}
 	if err != nil {
 		return
 	}
+	info.NoData = !resultsHaveData(results)
+	if results, info.NonFinite, err = postProcessResults(results, opts); err != nil {
+		return
+	}
+	if info.NonFinite > 0 && logs.Enabled(LogLevelWarn) {
+		logs.Log(LogLevelWarn, "non-finite values", "query_id", q.GetID(), "label", string(q.HumanLabel), "values", info.NonFinite)
+	}
+	info.Buckets = len(results)
+	if opts.ValueStats {
+		info.Values = summarizeValues(results)
+	}
+	if logs.Enabled(LogLevelDebug) {
+		logs.Log(LogLevelDebug, "query executed", "query_id", q.GetID(), "label", string(q.HumanLabel),
+			"buckets", info.Buckets, "pages", info.Pages, "exec_ms", requestLagMs)
+	}
+
+	// repetitions are not timed, only compared with the first results:
+	if opts.VerifyRepeat > 1 {
+		if info.Differing, err = qe.repeatResults(q, qp, results, opts); err != nil {
+			return
+		}
+	}
+	if opts.ResultCache != nil {
+		opts.ResultCache.put(cacheKey, results)
+	}
+
+	err = printResponses(q, results, opts)
+	return
+}
 
-	// optionally, print reponses for query validation:
-	if opts.PrettyPrintResponses {
+// postProcessResults fills the empty time buckets of executed results,
+// averages them over a moving window and downsamples them, if enabled, then
+// applies the NaN policy to them, returning the number of their non-finite
+// values.
+func postProcessResults(results []CQLResult, opts HLQueryExecutorDoOptions) ([]CQLResult, int, error) {
+	results = fillResultsPerMeasurement(results, opts.FillMode)
+	if opts.MovingAverage > 1 {
+		results = movingAverageResultsPerMeasurement(results, opts.MovingAverage, opts.MovingAverageStart)
+	}
+	if opts.MaxPoints > 0 {
+		results = downsampleResultsPerMeasurement(results, opts.MaxPoints, opts.Downsample)
+	}
+	policy := opts.NaNPolicy
+	if policy == 0 {
+		policy = NaNPolicyKeep
+	}
+	n, err := applyNaNPolicy(results, policy)
+	return results, n, err
+}
+
+// printResponses optionally prints the results of a query, for query
+// validation.
+func printResponses(q *HLQuery, results []CQLResult, opts HLQueryExecutorDoOptions) error {
+	if !opts.PrettyPrintResponses {
+		return nil
+	}
+	switch opts.ResponseFormat {
+	case ResponseFormatJSON:
+		return writeJSONResponse(os.Stderr, NewQueryResponse(q, results))
+	case ResponseFormatLine:
+		return writeLineProtocolResponse(os.Stderr, q, results)
+	case ResponseFormatBinary:
+		return opts.ResponseDump.Write(NewQueryResponse(q, results))
+	default:
 		for _, r := range results {
-			fmt.Fprintf(os.Stderr, "ID %d: [%s, %s] -> %v\n", q.GetID(), r.TimeInterval.Start(), r.TimeInterval.End(), r.Values)
+			measurement := ""
+			if len(r.Measurement) > 0 {
+				measurement = r.Measurement + ": "
+			}
+			if len(r.Tags) > 0 {
+				measurement += strings.Join(r.Tags, ",") + ": "
+			}
+			trace := ""
+			if r.ValueSeries != nil {
+				trace = " of " + strings.Join(r.ValueSeries, " ")
+			}
+			if r.SeriesIds != nil {
+				trace += " <- " + strings.Join(r.SeriesIds, " ")
+			}
+			fmt.Fprintf(os.Stderr, "ID %d: %s[%s, %s] -> %s%s\n", q.GetID(), measurement, r.TimeInterval.Start(), r.TimeInterval.End(), r.valuesString(), trace)
+		}
+	}
+	return nil
+}
+
+// queryPlan builds the QueryPlan of a query: a QueryPlanPerMeasurement if
+// it has several measurements. It fails if a template fails to render for
+// the query (see templateError).
+func (qe *HLQueryExecutor) queryPlan(q *HLQuery, opts HLQueryExecutorDoOptions) (_ QueryPlan, err error) {
+	defer recoverTemplateError(&err)
+	ms := q.Measurements()
+	if len(ms) == 1 {
+		return qe.plan(q, opts)
+	}
+	plans := make([]QueryPlan, len(ms))
+	for i, m := range ms {
+		var err error
+		if plans[i], err = qe.plan(q.ForMeasurement(m), opts); err != nil {
+			return nil, err
+		}
+	}
+	return NewQueryPlanPerMeasurement(ms, plans)
+}
+
+// plan builds the QueryPlan of a query of a single measurement: a
+// QueryPlanPerTagGroup if it is grouped by tag.
+func (qe *HLQueryExecutor) plan(q *HLQuery, opts HLQueryExecutorDoOptions) (qp QueryPlan, err error) {
+	if keys := q.GroupByTags(); len(keys) > 0 {
+		groups, series, err := qe.csi.tagGroups(q, keys)
+		if err != nil {
+			return nil, err
+		}
+		// each group is planned from an index of its own series, rather
+		// than matching the series of the whole index again:
+		plans := make([]QueryPlan, len(groups))
+		for i, tags := range groups {
+			gqe := *qe
+			gqe.csi = qe.csi.subIndex(series[i])
+			if plans[i], err = gqe.plan(q.ForTagGroup(tags), opts); err != nil {
+				return nil, err
+			}
+		}
+		return NewQueryPlanPerTagGroup(groups, plans)
+	}
+	q = q.withCanonicalAggregation()
+	if q.IsCardinality() {
+		qp, err = q.ToQueryPlanCardinality(qe.csi)
+	} else if q.IsCountAll() {
+		qp, err = q.ToQueryPlanCountAll(qe.csi, opts.SlotInterval)
+	} else if q.IsRaw() || q.IsLastPoint() {
+		var rqp *QueryPlanRaw
+		if q.IsRaw() {
+			rqp, err = q.ToQueryPlanRaw(qe.csi)
+		} else {
+			rqp, err = q.ToQueryPlanLastPoint(qe.csi)
+		}
+		if err == nil {
+			rqp.Trace = opts.Trace
+		}
+		qp = rqp
+	} else if len(string(q.AggregationType)) == 0 && len(string(q.ForEveryN)) == 0 {
+		qp, err = q.ToQueryPlanNoAggregation(qe.csi)
+	} else if len(string(q.AggregationType)) == 0 {
+		qp, err = q.ToQueryPlanForEvery(qe.csi)
+	} else {
+		// rates are computed from the points of each series, which only
+		// the client aggregation plan fetches:
+		if _, ok := parseRateAggregation(string(q.AggregationType)); ok {
+			opts.AggregationPlan = AggrPlanTypeWithoutServerAggregation
+		}
+		// field expressions are evaluated on the points of the series of
+		// their fields, which only the client aggregation plan fetches:
+		if len(q.FieldExpression) > 0 {
+			opts.AggregationPlan = AggrPlanTypeWithoutServerAggregation
+		}
+		// several aggregations are computed by each CQL query of the
+		// server aggregation plan:
+		if len(q.Aggregations()) > 0 {
+			opts.AggregationPlan = AggrPlanTypeWithServerAggregation
+		}
+		// shares are computed from the aggregate of each series, which
+		// the server aggregation plan queries:
+		aggr, shares := parseShareAggregation(string(q.AggregationType))
+		if shares {
+			opts.AggregationPlan = AggrPlanTypeWithServerAggregation
+			qs := *q
+			qs.AggregationType = []byte(aggr)
+			q = &qs
+		}
+		switch opts.AggregationPlan {
+		case AggrPlanTypeWithServerAggregation:
+			var sqp *QueryPlanWithServerAggregation
+			sqp, err = q.ToQueryPlanWithServerAggregation(qe.csi)
+			if err == nil {
+				sqp.MaxConcurrency = opts.SubQueryParallelism
+				sqp.SkipEmpty = opts.SkipEmpty
+				sqp.Trace = opts.Trace
+				sqp.Shares = shares
+				if opts.BatchReads {
+					sqp.BatchReads()
+				}
+			}
+			qp = sqp
+		case AggrPlanTypeWithoutServerAggregation:
+			var cqp *QueryPlanWithoutServerAggregation
+			cqp, err = q.ToQueryPlanWithoutServerAggregation(qe.csi)
+			if err == nil {
+				cqp.SkipEmpty = opts.SkipEmpty
+				cqp.Trace = opts.Trace
+			}
+			qp = cqp
+		default:
+			panic("logic error: invalid aggregation plan option")
 		}
 	}
 	return
 }
+
+// countSeries returns the number of distinct series rows queried by a set of
+// CQLQueries.
+func countSeries(queries []CQLQuery) int {
+	seen := make(map[string]struct{}, len(queries))
+	for _, q := range queries {
+		switch id := q.Args[0].(type) {
+		case string:
+			seen[id] = struct{}{}
+		case []string: // batched
+			for _, id := range id {
+				seen[id] = struct{}{}
+			}
+		}
+	}
+	return len(seen)
+}
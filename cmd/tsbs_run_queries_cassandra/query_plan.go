@@ -1,40 +1,62 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/gocql/gocql"
 	"github.com/timescale/tsbs/internal/utils"
 )
 
 // A QueryPlan is a strategy used to fulfill an HLQuery.
 type QueryPlan interface {
-	Execute(*gocql.Session) ([]CQLResult, error)
+	Execute(context.Context, QueryExecutor) ([]CQLResult, error)
 	DebugQueries(int)
+	AllCQLQueries() []CQLQuery // in execution order
 }
 
 // A QueryPlanWithServerAggregation fulfills an HLQuery by performing
 // aggregation on both the server and the client. This results in more
 // round-trip requests, but uses the server to aggregate over large datasets.
 //
-// It has 1) an Aggregator, which merges data on the client, and 2) a map of
-// time interval buckets to CQL queries, which are used to retrieve data
-// relevant to each bucket.
+// It has 1) an Aggregator label, used to merge data of each field on the
+// client, 2) the Fields, in the order of the values of each result, and 3) a
+// map of time interval buckets to CQL queries, which are used to retrieve
+// data relevant to each bucket. Buckets are independent of each other, so
+// they may be executed in parallel. The series with a GroupColumn may
+// instead be read by 4) GroupedCQLQueries, one per series aggregating all
+// of its buckets, whose rows are merged into the bucket of their interval.
+//
+// With several Aggregations, the label is their comma-separated list, and
+// the rows of each query hold all of them (see scanAggregations).
 type QueryPlanWithServerAggregation struct {
 	AggregatorLabel    string
+	Fields             []string
 	BucketedCQLQueries map[*utils.TimeInterval][]CQLQuery
+	GroupedCQLQueries  []CQLQuery
+	ZeroFillEmpty      bool // report 0 rather than absent for empty buckets
+	SkipEmpty          bool // omit the results of empty buckets instead
+	MaxConcurrency     int  // number of buckets to execute at once
+	Trace              bool // set the SeriesIds of results
+	TimeWeighted       bool // weight averages by the Covered duration of their queries
+	Shares             bool // aggregate each series, into their shares of the total
+
+	// Aggregations are those of a query of several of them, in the order
+	// of the values of each field.
+	Aggregations []string
 }
 
 // NewQueryPlanWithServerAggregation builds a QueryPlanWithServerAggregation.
 // It is typically called via (*HLQuery).ToQueryPlanWithServerAggregation.
-func NewQueryPlanWithServerAggregation(aggrLabel string, bucketedCQLQueries map[*utils.TimeInterval][]CQLQuery) (*QueryPlanWithServerAggregation, error) {
+func NewQueryPlanWithServerAggregation(aggrLabel string, fields []string, bucketedCQLQueries map[*utils.TimeInterval][]CQLQuery) (*QueryPlanWithServerAggregation, error) {
 	qp := &QueryPlanWithServerAggregation{
 		AggregatorLabel:    aggrLabel,
+		Fields:             fields,
 		BucketedCQLQueries: bucketedCQLQueries,
 	}
 	return qp, nil
@@ -42,8 +64,10 @@ func NewQueryPlanWithServerAggregation(aggrLabel string, bucketedCQLQueries map[
 
 // Execute runs all CQLQueries in the QueryPlan and collects the results.
 //
-// TODO(rw): support parallel execution.
-func (qp *QueryPlanWithServerAggregation) Execute(session *gocql.Session) ([]CQLResult, error) {
+// Time buckets are executed on up to MaxConcurrency goroutines. Results are
+// always returned in time bucket order, regardless of completion order. On
+// the first error, or once ctx is done, the remaining buckets are cancelled.
+func (qp *QueryPlanWithServerAggregation) Execute(ctx context.Context, qe QueryExecutor) ([]CQLResult, error) {
 	// sort the time interval buckets we'll use:
 	sortedKeys := make([]*utils.TimeInterval, 0, len(qp.BucketedCQLQueries))
 	for k := range qp.BucketedCQLQueries {
@@ -51,40 +75,359 @@ func (qp *QueryPlanWithServerAggregation) Execute(session *gocql.Session) ([]CQL
 	}
 	sort.Sort(TimeIntervals(sortedKeys))
 
-	// for each bucket, execute its queries while aggregating its results
-	// in constant space, then append them to the result set:
-	results := make([]CQLResult, 0, len(qp.BucketedCQLQueries))
-	for _, k := range sortedKeys {
-		agg, err := GetAggregator(qp.AggregatorLabel)
+	// the grouped queries feed any of the buckets, so they are executed
+	// first:
+	grouped, err := qp.executeGrouped(ctx, qe, sortedKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	// buckets without any series cannot be fed, so they are not executed:
+	if qp.SkipEmpty {
+		nonEmpty := sortedKeys[:0]
+		for _, k := range sortedKeys {
+			if len(qp.BucketedCQLQueries[k]) > 0 || len(grouped[k]) > 0 {
+				nonEmpty = append(nonEmpty, k)
+			}
+		}
+		sortedKeys = nonEmpty
+	}
+
+	// Each bucket stores its results at its sorted position, so no further
+	// synchronization is needed on the results slice:
+	results := make([]CQLResult, len(sortedKeys))
+	fed := make([]bool, len(sortedKeys))
+	err = executeConcurrently(ctx, len(sortedKeys), qp.MaxConcurrency, func(ctx context.Context, i int) error {
+		res, ok, err := qp.executeBucket(ctx, qe, sortedKeys[i], grouped[sortedKeys[i]])
+		results[i], fed[i] = res, ok
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return qp.skipEmpty(results, fed), nil
+}
+
+// executeConcurrently calls execute with each index from 0 to n-1 on up to
+// workers goroutines, or in order on the calling goroutine for a single
+// worker. On the first error, or once ctx is done, the remaining indexes are
+// cancelled, and the error returned.
+func executeConcurrently(ctx context.Context, n, workers int, execute func(ctx context.Context, i int) error) error {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := execute(ctx, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	indexes := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := execute(workCtx, i); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for i := 0; i < n; i++ {
+		select {
+		case indexes <- i:
+		case <-workCtx.Done():
+			break dispatch
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// skipEmpty drops the results of the buckets that no row fed, if SkipEmpty
+// is set.
+func (qp *QueryPlanWithServerAggregation) skipEmpty(results []CQLResult, fed []bool) []CQLResult {
+	if !qp.SkipEmpty {
+		return results
+	}
+	kept := results[:0]
+	for i, r := range results {
+		if fed[i] {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// BatchReads merges the CQLQueries of each time bucket that read the same
+// field over the same time range into one CQLQuery (see NewBatchedCQLQuery),
+// saving a round-trip per series. It reports whether the queries were
+// merged: only aggregations for which the aggregate over several series
+// equals the merge of their separate aggregates are (see
+// isBatchableAggregation).
+func (qp *QueryPlanWithServerAggregation) BatchReads() bool {
+	if qp.Shares || !isBatchableAggregation(qp.AggregatorLabel) {
+		return false
+	}
+	type batchKey struct {
+		stmt, field string
+		start, end  interface{}
+	}
+	for ti, queries := range qp.BucketedCQLQueries {
+		keys := []batchKey{}
+		batches := map[batchKey][]CQLQuery{}
+		for _, q := range queries {
+			k := batchKey{q.PreparableQueryString, q.Field, q.Args[1], q.Args[2]}
+			if _, ok := batches[k]; !ok {
+				keys = append(keys, k)
+			}
+			batches[k] = append(batches[k], q)
+		}
+		batched := make([]CQLQuery, len(keys))
+		for i, k := range keys {
+			batched[i] = NewBatchedCQLQuery(batches[k])
+		}
+		qp.BucketedCQLQueries[ti] = batched
+	}
+	return true
+}
+
+// isBatchableAggregation reports whether the aggregation of the rows of
+// several series by one CQL query gives the same result as the merge of
+// their separate aggregates. It does not for avg, whose merge is the mean
+// of the per-series means.
+func isBatchableAggregation(label string) bool {
+	switch label {
+	case "min", "max", "sum", "count":
+		return true
+	}
+	return false
+}
+
+// executeBucket executes the queries of one time bucket while aggregating
+// their results in constant space, with the rows of grouped queries in the
+// bucket. It reports whether any row fed the result: counts of zero do not.
+func (qp *QueryPlanWithServerAggregation) executeBucket(ctx context.Context, qe QueryExecutor, ti *utils.TimeInterval, grouped []groupedRow) (CQLResult, bool, error) {
+	// one Aggregator per field, and per aggregation with several
+	// Aggregations; a plan without Fields has a single field:
+	perField := 1
+	if len(qp.Aggregations) > 0 {
+		perField = len(qp.Aggregations)
+	}
+	aggrs := make([]Aggregator, perField*len(qp.Fields))
+	if len(aggrs) == 0 {
+		aggrs = make([]Aggregator, perField)
+	}
+	for i := range aggrs {
+		if qp.TimeWeighted {
+			aggrs[i] = &AggregatorWeightedAvg{}
+			continue
+		}
+		var agg Aggregator
+		var err error
+		if len(qp.Aggregations) > 0 {
+			agg, err = newAggregationsAggregator(qp.Aggregations[i%perField], qp.Aggregations)
+		} else {
+			agg, err = getMergeAggregator(qp.AggregatorLabel)
+		}
 		if err != nil {
-			return nil, err
+			return CQLResult{}, false, err
 		}
+		aggrs[i] = agg
+	}
 
-		for _, q := range qp.BucketedCQLQueries[k] {
-			// Execute one CQLQuery and collect its result
-			//
-			// For server-side aggregation, this will return only
-			// one row; for exclusive client-side aggregation this
-			// will return a sequence.
-			iter := session.Query(q.PreparableQueryString, q.Args...).Iter()
-			var x float64
-			for iter.Scan(&x) {
-				agg.Put(x)
+	var traced seriesIDSet
+	if qp.Trace {
+		traced = seriesIDSet{}
+	}
+	var shares map[string]Aggregator
+	if qp.Shares {
+		shares = map[string]Aggregator{}
+	}
+
+	// fieldAggrs returns the Aggregators of the field of a query:
+	fieldAggrs := func(q *CQLQuery) []Aggregator {
+		for i, f := range qp.Fields {
+			if q.Field == f {
+				return aggrs[i*perField : (i+1)*perField]
 			}
-			if err := iter.Close(); err != nil {
-				return nil, err
+		}
+		return aggrs[:perField]
+	}
+	// aggFor returns the Aggregator of the rows of a query:
+	aggFor := func(q *CQLQuery) (Aggregator, error) {
+		agg := fieldAggrs(q)[0]
+		if shares != nil {
+			// the series of the row, whichever day it is stored in:
+			series := q.Args[0].(string)
+			series = series[:strings.LastIndex(series, "#")]
+			if agg = shares[series]; agg == nil {
+				var err error
+				if agg, err = getMergeAggregator(qp.AggregatorLabel); err != nil {
+					return nil, err
+				}
+				shares[series] = agg
 			}
 		}
-		results = append(results, CQLResult{TimeInterval: k, Values: []float64{agg.Get()}})
+		return agg, nil
 	}
 
-	return results, nil
+	bucketFed := false
+	for _, r := range grouped {
+		agg, err := aggFor(r.q)
+		if err != nil {
+			return CQLResult{}, false, err
+		}
+		agg.Put(r.value)
+		fed := qp.AggregatorLabel != "count" || r.value > 0
+		if fed && traced != nil {
+			traced.add(*r.q)
+		}
+		bucketFed = bucketFed || fed
+	}
+	for _, q := range qp.BucketedCQLQueries[ti] {
+		agg, err := aggFor(&q)
+		if err != nil {
+			return CQLResult{}, false, err
+		}
+		put := agg.Put
+		if w, ok := agg.(*AggregatorWeightedAvg); ok {
+			weight := q.Covered.Seconds()
+			put = func(v float64) { w.PutWeighted(v, weight) }
+		}
+
+		// Execute one CQLQuery and collect its result
+		//
+		// For server-side aggregation, this will return only
+		// one row; for exclusive client-side aggregation this
+		// will return a sequence.
+		//
+		// Aggregates over no rows are NULL, so they are skipped;
+		// counts are never NULL, but are bigints. Averages of rollups
+		// are made of their sum and count.
+		iter := qe.Query(ctx, q.PreparableQueryString, q.BoundArgs()...)
+		fed := false
+		if len(qp.Aggregations) > 0 {
+			fed = scanAggregations(iter, qp.Aggregations, fieldAggrs(&q))
+		} else if q.SumAndCount {
+			var sum *float64
+			var n int64
+			for iter.Scan(&sum, &n) {
+				if sum != nil && n > 0 {
+					put(*sum / float64(n))
+					fed = true
+				}
+			}
+		} else if qp.AggregatorLabel == "count" {
+			var n int64
+			for iter.Scan(&n) {
+				agg.Put(float64(n))
+				fed = fed || n > 0
+			}
+		} else {
+			var x *float64
+			for iter.Scan(&x) {
+				if x != nil {
+					put(*x)
+					fed = true
+				}
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return CQLResult{}, false, err
+		}
+		if fed && traced != nil {
+			traced.add(q)
+		}
+		bucketFed = bucketFed || fed
+	}
+	res := newAggregatedCQLResult(ti, aggrs, qp.ZeroFillEmpty)
+	zeroFilled := qp.ZeroFillEmpty
+	if len(qp.Aggregations) > 0 {
+		res = newAggregationsCQLResult(ti, aggrs, qp.Aggregations)
+		zeroFilled = true
+	}
+	// counts of no rows are zeros put into their aggregators, rather than
+	// data:
+	res.ZeroFilled = res.ZeroFilled || zeroFilled && !bucketFed
+	if shares != nil {
+		res = newSharesCQLResult(ti, shares)
+	}
+	if traced != nil {
+		res.SeriesIds = traced.sorted()
+	}
+	return res, bucketFed, nil
+}
+
+// A seriesIDSet collects the series_ids of the rows that fed a CQLResult,
+// for tracing.
+type seriesIDSet map[string]struct{}
+
+// add adds the series_ids read by a CQLQuery: all of them for a batched
+// query (see NewBatchedCQLQuery), as its rows do not tell them apart.
+func (s seriesIDSet) add(q CQLQuery) {
+	switch id := q.Args[0].(type) {
+	case string:
+		s[id] = struct{}{}
+	case []string:
+		for _, id := range id {
+			s[id] = struct{}{}
+		}
+	}
+}
+
+// sorted returns the series_ids of the set in order.
+func (s seriesIDSet) sorted() []string {
+	ids := make([]string, 0, len(s))
+	for id := range s {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// AllCQLQueries returns the grouped CQLQueries, then those of all time
+// buckets, in time order.
+func (qp *QueryPlanWithServerAggregation) AllCQLQueries() []CQLQuery {
+	sortedKeys := make([]*utils.TimeInterval, 0, len(qp.BucketedCQLQueries))
+	for k := range qp.BucketedCQLQueries {
+		sortedKeys = append(sortedKeys, k)
+	}
+	sort.Sort(TimeIntervals(sortedKeys))
+
+	queries := append([]CQLQuery{}, qp.GroupedCQLQueries...)
+	for _, k := range sortedKeys {
+		queries = append(queries, qp.BucketedCQLQueries[k]...)
+	}
+	return queries
 }
 
 // DebugQueries prints debugging information.
 func (qp *QueryPlanWithServerAggregation) DebugQueries(level int) {
 	if level >= 1 {
-		n := 0
+		n := len(qp.GroupedCQLQueries)
 		for _, qq := range qp.BucketedCQLQueries {
 			n += len(qq)
 		}
@@ -92,9 +435,12 @@ func (qp *QueryPlanWithServerAggregation) DebugQueries(level int) {
 	}
 
 	if level >= 2 {
+		for i, q := range qp.GroupedCQLQueries {
+			fmt.Printf("[qpsa] CQL: grouped, %d, %v\n", i, q)
+		}
 		for k, qq := range qp.BucketedCQLQueries {
 			for i, q := range qq {
-				fmt.Printf("[qpsa] CQL: %v, %d, %s\n", k, i, q)
+				fmt.Printf("[qpsa] CQL: %v, %d, %v\n", k, i, q)
 			}
 		}
 	}
@@ -114,8 +460,20 @@ type QueryPlanWithoutServerAggregation struct {
 	GroupByDuration time.Duration
 	Fields          []string
 	TimeBuckets     []*utils.TimeInterval
+	ZeroFillEmpty   bool // report 0 rather than absent for empty buckets
+	SkipEmpty       bool // omit the results of empty buckets instead
+	Trace           bool // set the SeriesIds of results
 	limit           int
 	CQLQueries      []CQLQuery
+
+	// Expression is, if set, the field expression whose values are
+	// aggregated, as the only one of Fields, from the points of the
+	// CQLQueries of its fields (see executeExpression).
+	Expression *fieldExpression
+
+	sortedBuckets   []*utils.TimeInterval // TimeBuckets in time order
+	explicitBuckets bool                  // the TimeBuckets of the HLQuery, which may have gaps
+	descending      bool                  // the CQLQueries read the latest points first
 }
 
 // NewQueryPlanWithoutServerAggregation builds a QueryPlanWithoutServerAggregation.
@@ -137,6 +495,10 @@ func NewQueryPlanWithoutServerAggregation(aggrLabel string, groupByDuration time
 		}
 	}
 
+	sortedBuckets := make([]*utils.TimeInterval, len(timeBuckets))
+	copy(sortedBuckets, timeBuckets)
+	sort.Sort(TimeIntervals(sortedBuckets))
+
 	qp := &QueryPlanWithoutServerAggregation{
 		Aggregators:     aggrs,
 		GroupByDuration: groupByDuration,
@@ -144,10 +506,67 @@ func NewQueryPlanWithoutServerAggregation(aggrLabel string, groupByDuration time
 		TimeBuckets:     timeBuckets,
 		limit:           limit,
 		CQLQueries:      cqlQueries,
+		sortedBuckets:   sortedBuckets,
 	}
 	return qp, nil
 }
 
+// bucketFor returns the time bucket of a timestamp, or nil if there is none.
+// Buckets are searched rather than computed from GroupByDuration, as they
+// may have different lengths (see bucketTimeIntervals).
+func (qp *QueryPlanWithoutServerAggregation) bucketFor(ts time.Time) *utils.TimeInterval {
+	// the first bucket ending after ts:
+	i := sort.Search(len(qp.sortedBuckets), func(i int) bool {
+		return qp.sortedBuckets[i].End().After(ts)
+	})
+	if i == len(qp.sortedBuckets) {
+		// with -inclusive-end, the last bucket holds the points at its end:
+		if last := len(qp.sortedBuckets) - 1; inclusiveEnd && last >= 0 && ts.Equal(qp.sortedBuckets[last].End()) {
+			return qp.sortedBuckets[last]
+		}
+		return nil
+	}
+	if ts.Before(qp.sortedBuckets[i].Start()) {
+		return nil
+	}
+	return qp.sortedBuckets[i]
+}
+
+// bucketsAhead reports whether the points read after one of timestamp ts,
+// which is in no bucket, may still be in explicit TimeBuckets: ts is in a gap
+// between them, or before the first of them (after the last, for descending
+// reads). Otherwise the points of the buckets, in time order, are over.
+func (qp *QueryPlanWithoutServerAggregation) bucketsAhead(ts time.Time) bool {
+	n := len(qp.sortedBuckets)
+	if !qp.explicitBuckets || n == 0 {
+		return false
+	}
+	if qp.descending {
+		return !ts.Before(qp.sortedBuckets[0].Start())
+	}
+	return ts.Before(qp.sortedBuckets[n-1].End())
+}
+
+// sortCQLResults sorts results by the start of their TimeInterval, keeping
+// the order of those starting at the same time, so that the results of a
+// query do not depend on the iteration order of the maps they were built
+// from.
+func sortCQLResults(results []CQLResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Start().Before(results[j].Start())
+	})
+}
+
+// sortedKeys returns the keys of the rows of a result, in order.
+func sortedKeys(m map[string][]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func csiDebugQueries(cqlQueries []CQLQuery, label string, level int) {
 	if level >= 1 {
 		fmt.Printf("[%s] query with client aggregation plan has %d CQLQuery objects\n", label, len(cqlQueries))
@@ -155,7 +574,7 @@ func csiDebugQueries(cqlQueries []CQLQuery, label string, level int) {
 
 	if level >= 2 {
 		for i, q := range cqlQueries {
-			fmt.Printf("[%s] CQL: %d, %s\n", label, i, q)
+			fmt.Printf("[%s] CQL: %d, %v\n", label, i, q)
 		}
 	}
 }
@@ -163,29 +582,57 @@ func csiDebugQueries(cqlQueries []CQLQuery, label string, level int) {
 // Execute runs all CQLQueries in the QueryPlan and collects the results.
 //
 // TODO(rw): support parallel execution.
-func (qp *QueryPlanWithoutServerAggregation) Execute(session *gocql.Session) ([]CQLResult, error) {
+func (qp *QueryPlanWithoutServerAggregation) Execute(ctx context.Context, qe QueryExecutor) ([]CQLResult, error) {
+	var traced map[*utils.TimeInterval]seriesIDSet
+	if qp.Trace {
+		traced = make(map[*utils.TimeInterval]seriesIDSet, len(qp.Aggregators))
+		for ti := range qp.Aggregators {
+			traced[ti] = seriesIDSet{}
+		}
+	}
+
+	queries := qp.CQLQueries
+	if qp.Expression != nil {
+		if err := qp.executeExpression(ctx, qe, traced); err != nil {
+			return nil, err
+		}
+		queries = nil
+	}
+
 	// for each query, execute it, then put each result row into the
 	// client-side aggregator that matches its time bucket:
-	for _, q := range qp.CQLQueries {
-		iter := session.Query(q.PreparableQueryString, q.Args...).Iter()
+	for _, q := range queries {
+		iter := qe.Query(ctx, q.PreparableQueryString, q.BoundArgs()...)
+
+		// the series of the points, whichever day they are stored in:
+		series := q.Args[0].(string)
+		series = series[:strings.LastIndex(series, "#")]
 
 		var timestampNs int64
 		var value float64
 
 		for iter.Scan(&timestampNs, &value) {
-			ts := time.Unix(0, timestampNs).UTC()
-			tsTruncated := ts.Truncate(qp.GroupByDuration)
-			bucketKey, err := utils.NewTimeInterval(tsTruncated, tsTruncated.Add(qp.GroupByDuration))
-			if err != nil {
-				return nil, err
-			}
+			ts := time.Unix(0, timestampNs)
+			bucketKey := qp.bucketFor(ts)
 
 			// Due to limits, bucket is not needed, skip
 			if _, ok := qp.Aggregators[bucketKey]; !ok {
+				// but go on to the first of the explicit TimeBuckets, and
+				// past a gap between them:
+				if bucketKey == nil && qp.bucketsAhead(ts) {
+					continue
+				}
 				break
 			}
 
-			qp.Aggregators[bucketKey][q.Field].Put(value)
+			if agg, ok := qp.Aggregators[bucketKey][q.Field].(pointAggregator); ok {
+				agg.PutPoint(series, timestampNs, value)
+			} else {
+				qp.Aggregators[bucketKey][q.Field].Put(value)
+			}
+			if traced != nil {
+				traced[bucketKey].add(q)
+			}
 		}
 		if err := iter.Close(); err != nil {
 			return nil, err
@@ -199,16 +646,121 @@ func (qp *QueryPlanWithoutServerAggregation) Execute(session *gocql.Session) ([]
 			continue
 		}
 
-		res := CQLResult{TimeInterval: ti, Values: make([]float64, len(qp.Fields))}
+		aggrs := make([]Aggregator, len(qp.Fields))
+		empty := true
 		for i, f := range qp.Fields {
-			res.Values[i] = qp.Aggregators[ti][f].Get()
+			aggrs[i] = qp.Aggregators[ti][f]
+			empty = empty && aggrs[i].Empty()
+		}
+		if empty && qp.SkipEmpty {
+			continue
+		}
+		res := newAggregatedCQLResult(ti, aggrs, qp.ZeroFillEmpty)
+		if traced != nil {
+			res.SeriesIds = traced[ti].sorted()
 		}
 		results = append(results, res)
 	}
 
+	// buckets are executed latest first for "timestamp_ns DESC", but
+	// returned in time order like those of the server aggregation plan:
+	sortCQLResults(results)
 	return results, nil
 }
 
+// executeExpression executes the CQLQueries of a plan of a field expression,
+// joining the points of the series of its fields by measurement and tags,
+// then timestamp. The value of the expression at each timestamp with a point
+// of every field is put into the aggregator of its time bucket, in time
+// order for each series; timestamps missing any of the fields are skipped.
+func (qp *QueryPlanWithoutServerAggregation) executeExpression(ctx context.Context, qe QueryExecutor, traced map[*utils.TimeInterval]seriesIDSet) error {
+	type exprPoint struct {
+		values  []float64
+		queries []int // of the value of each field, by index into CQLQueries plus one
+		fields  int   // with a value
+	}
+	fields := qp.Expression.fields
+	fieldPos := make(map[string]int, len(fields))
+	for i, f := range fields {
+		fieldPos[f] = i
+	}
+
+	points := map[string]map[int64]*exprPoint{}
+	for i, q := range qp.CQLQueries {
+		iter := qe.Query(ctx, q.PreparableQueryString, q.BoundArgs()...)
+
+		// the measurement and tags of the series, without day and field:
+		series := seriesKey(seriesKey(q.Args[0].(string)))
+		if _, ok := points[series]; !ok {
+			points[series] = map[int64]*exprPoint{}
+		}
+		pos := fieldPos[q.Field]
+
+		var timestampNs int64
+		var value float64
+
+		for iter.Scan(&timestampNs, &value) {
+			p, ok := points[series][timestampNs]
+			if !ok {
+				p = &exprPoint{values: make([]float64, len(fields)), queries: make([]int, len(fields))}
+				points[series][timestampNs] = p
+			}
+			if p.queries[pos] == 0 {
+				p.fields++
+			}
+			p.values[pos] = value
+			p.queries[pos] = i + 1
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+
+	seriesKeys := make([]string, 0, len(points))
+	for series := range points {
+		seriesKeys = append(seriesKeys, series)
+	}
+	sort.Strings(seriesKeys)
+
+	label := qp.Fields[0]
+	for _, series := range seriesKeys {
+		timestamps := make(int64arr, 0, len(points[series]))
+		for ts := range points[series] {
+			timestamps = append(timestamps, ts)
+		}
+		sort.Sort(timestamps)
+		for _, ts := range timestamps {
+			p := points[series][ts]
+			if p.fields < len(fields) {
+				continue
+			}
+			ti := qp.bucketFor(time.Unix(0, ts))
+			aggrs, ok := qp.Aggregators[ti]
+			if !ok {
+				// outside of the buckets, or of those within the limit
+				continue
+			}
+			value := qp.Expression.eval(p.values)
+			if agg, ok := aggrs[label].(pointAggregator); ok {
+				agg.PutPoint(series, ts, value)
+			} else {
+				aggrs[label].Put(value)
+			}
+			if traced != nil {
+				for _, q := range p.queries {
+					traced[ti].add(qp.CQLQueries[q-1])
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// AllCQLQueries returns the CQLQueries of the plan.
+func (qp *QueryPlanWithoutServerAggregation) AllCQLQueries() []CQLQuery {
+	return qp.CQLQueries
+}
+
 // DebugQueries prints debugging information.
 func (qp *QueryPlanWithoutServerAggregation) DebugQueries(level int) {
 	csiDebugQueries(qp.CQLQueries, "qpca", level)
@@ -241,7 +793,7 @@ func (a int64arr) Less(i, j int) bool { return a[i] < a[j] }
 // Execute runs all CQLQueries in the QueryPlan and collects the results.
 //
 // TODO(rw): support parallel execution.
-func (qp *QueryPlanNoAggregation) Execute(session *gocql.Session) ([]CQLResult, error) {
+func (qp *QueryPlanNoAggregation) Execute(ctx context.Context, qe QueryExecutor) ([]CQLResult, error) {
 	res := make(map[int64]map[string][]float64)
 	// Useful index for placing values in a row correctly
 	fieldPos := make(map[string]int)
@@ -266,7 +818,7 @@ func (qp *QueryPlanNoAggregation) Execute(session *gocql.Session) ([]CQLResult,
 		// First pass of all queries
 		for _, q := range qp.cqlQueries {
 			if q.Field == whereParts[0] { // only handle queries for where clause field
-				iter := session.Query(q.PreparableQueryString, q.Args...).Iter()
+				iter := qe.Query(ctx, q.PreparableQueryString, q.BoundArgs()...)
 
 				var timestampNs int64
 				var value float64
@@ -295,7 +847,7 @@ func (qp *QueryPlanNoAggregation) Execute(session *gocql.Session) ([]CQLResult,
 		// Second pass for non-where clause fields
 		for _, q := range qp.cqlQueries {
 			if q.Field != whereParts[0] {
-				iter := session.Query(q.PreparableQueryString, q.Args...).Iter()
+				iter := qe.Query(ctx, q.PreparableQueryString, q.BoundArgs()...)
 
 				var timestampNs int64
 				var value float64
@@ -331,7 +883,8 @@ func (qp *QueryPlanNoAggregation) Execute(session *gocql.Session) ([]CQLResult,
 	results := make([]CQLResult, 0, len(res))
 	for _, ts := range keys {
 		tst := time.Unix(0, ts)
-		for _, vals := range res[ts] {
+		for _, series := range sortedKeys(res[ts]) {
+			vals := res[ts][series]
 			ti, err := utils.NewTimeInterval(tst, tst)
 			if err != nil {
 				return nil, err
@@ -347,6 +900,11 @@ func (qp *QueryPlanNoAggregation) Execute(session *gocql.Session) ([]CQLResult,
 	return results, nil
 }
 
+// AllCQLQueries returns the CQLQueries of the plan.
+func (qp *QueryPlanNoAggregation) AllCQLQueries() []CQLQuery {
+	return qp.cqlQueries
+}
+
 // DebugQueries prints debugging information.
 func (qp *QueryPlanNoAggregation) DebugQueries(level int) {
 	csiDebugQueries(qp.cqlQueries, "qpna", level)
@@ -396,7 +954,7 @@ func NewQueryPlanForEvery(fields []string, forEveryTag string, forEveryNum int64
 // Execute runs all CQLQueries in the QueryPlan and collects the results.
 //
 // TODO(rw): support parallel execution.
-func (qp *QueryPlanForEvery) Execute(session *gocql.Session) ([]CQLResult, error) {
+func (qp *QueryPlanForEvery) Execute(ctx context.Context, qe QueryExecutor) ([]CQLResult, error) {
 	res := make(map[string]map[int64][]float64)
 	seriesTracker := make(map[string]int)
 
@@ -407,7 +965,7 @@ func (qp *QueryPlanForEvery) Execute(session *gocql.Session) ([]CQLResult, error
 	}
 
 	for _, q := range qp.cqlQueries {
-		iter := session.Query(q.PreparableQueryString, q.Args...).Iter()
+		iter := qe.Query(ctx, q.PreparableQueryString, q.BoundArgs()...)
 
 		rm := r.FindSubmatch([]byte(q.Args[0].(string)))
 		key := string(rm[1])
@@ -422,6 +980,7 @@ func (qp *QueryPlanForEvery) Execute(session *gocql.Session) ([]CQLResult, error
 		} else if seriesTracker[key] == len(qp.fields) {
 			// Collected values for each field in the row, no need to
 			// do more queries
+			iter.Close()
 			continue
 		}
 
@@ -454,8 +1013,20 @@ func (qp *QueryPlanForEvery) Execute(session *gocql.Session) ([]CQLResult, error
 
 	results := make([]CQLResult, 0, len(res))
 	// TODO should print out each host
-	for _, map2 := range res {
-		for ts, vals := range map2 {
+	tags := make([]string, 0, len(res))
+	for tag := range res {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		map2 := res[tag]
+		timestamps := make(int64arr, 0, len(map2))
+		for ts := range map2 {
+			timestamps = append(timestamps, ts)
+		}
+		sort.Sort(timestamps)
+		for _, ts := range timestamps {
+			vals := map2[ts]
 			tst := time.Unix(0, ts)
 			ti, err := utils.NewTimeInterval(tst, tst)
 			if err != nil {
@@ -469,10 +1040,309 @@ func (qp *QueryPlanForEvery) Execute(session *gocql.Session) ([]CQLResult, error
 		}
 	}
 
+	sortCQLResults(results)
 	return results, nil
 }
 
+// AllCQLQueries returns the CQLQueries of the plan.
+func (qp *QueryPlanForEvery) AllCQLQueries() []CQLQuery {
+	return qp.cqlQueries
+}
+
 // DebugQueries prints debugging information.
 func (qp *QueryPlanForEvery) DebugQueries(level int) {
 	csiDebugQueries(qp.cqlQueries, "qpfe", level)
 }
+
+// A QueryPlanRaw fulfills an HLQuery selecting raw points (see
+// HLQuery.IsRaw), producing one CQLResult holding the points of each series.
+type QueryPlanRaw struct {
+	TimeInterval *utils.TimeInterval
+	Series       []string     // series ids, without their day
+	CQLQueries   [][]CQLQuery // of each series, in the order of its points
+	Limit        int          // of points per series, if positive
+	Trace        bool         // set the SeriesIds of results
+}
+
+// NewQueryPlanRaw builds a QueryPlanRaw.
+// It is typically called via (*HLQuery).ToQueryPlanRaw.
+func NewQueryPlanRaw(ti *utils.TimeInterval, series []string, cqlQueries [][]CQLQuery, limit int) (*QueryPlanRaw, error) {
+	if len(series) != len(cqlQueries) {
+		return nil, fmt.Errorf("logic error: %d series with %d query lists", len(series), len(cqlQueries))
+	}
+	return &QueryPlanRaw{
+		TimeInterval: ti,
+		Series:       series,
+		CQLQueries:   cqlQueries,
+		Limit:        limit,
+	}, nil
+}
+
+// Execute runs the CQLQueries of each series in turn, until Limit points
+// have been read for it.
+func (qp *QueryPlanRaw) Execute(ctx context.Context, qe QueryExecutor) ([]CQLResult, error) {
+	results := make([]CQLResult, 0, len(qp.Series))
+	for i, series := range qp.Series {
+		points := []CQLPoint{}
+		var traced seriesIDSet
+		if qp.Trace {
+			traced = seriesIDSet{}
+		}
+		for _, q := range qp.CQLQueries[i] {
+			args := q.Args
+			if qp.Limit > 0 {
+				remaining := qp.Limit - len(points)
+				if remaining <= 0 {
+					break
+				}
+				args = append(append([]interface{}{}, q.Args[:len(q.Args)-1]...), remaining)
+			}
+
+			iter := qe.Query(ctx, q.PreparableQueryString, args...)
+			var timestampNs int64
+			var value float64
+			n := len(points)
+			for iter.Scan(&timestampNs, &value) {
+				points = append(points, CQLPoint{Timestamp: time.Unix(0, timestampNs).UTC(), Value: value})
+			}
+			if err := iter.Close(); err != nil {
+				if isOrderingError(err) {
+					return nil, &OrderingError{Stmt: q.PreparableQueryString, Err: err}
+				}
+				if isFilteringError(err) {
+					return nil, &FilteringError{Stmt: q.PreparableQueryString, Err: err}
+				}
+				return nil, err
+			}
+			if len(points) > n && traced != nil {
+				traced.add(q)
+			}
+		}
+		res := CQLResult{TimeInterval: qp.TimeInterval, Series: series, Points: points}
+		if traced != nil {
+			res.SeriesIds = traced.sorted()
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// cqlErrInvalid is the code of the errors of requests rejected as invalid by
+// Cassandra, ORDER BY violations included.
+const cqlErrInvalid = 0x2200
+
+// An OrderingError reports a raw query rejected by Cassandra because of its
+// ORDER BY, e.g. when the table is not clustered by timestamp_ns.
+type OrderingError struct {
+	Stmt string // the rejected CQL statement
+	Err  error  // as returned by Cassandra
+}
+
+func (e *OrderingError) Error() string {
+	return fmt.Sprintf("cannot order points as queried (the table must be clustered by %s): %s: %v", timestampColumn, e.Stmt, e.Err)
+}
+
+// isOrderingError reports whether err is a request error (such as a
+// gocql.RequestError) rejecting the ORDER BY of a query.
+func isOrderingError(err error) bool {
+	re, ok := err.(interface {
+		Code() int
+		Message() string
+	})
+	return ok && re.Code() == cqlErrInvalid && strings.Contains(strings.ToLower(re.Message()), "order by")
+}
+
+// AllCQLQueries returns the CQLQueries of all series.
+func (qp *QueryPlanRaw) AllCQLQueries() []CQLQuery {
+	queries := []CQLQuery{}
+	for _, qq := range qp.CQLQueries {
+		queries = append(queries, qq...)
+	}
+	return queries
+}
+
+// DebugQueries prints debugging information.
+func (qp *QueryPlanRaw) DebugQueries(level int) {
+	csiDebugQueries(qp.AllCQLQueries(), "qpr", level)
+}
+
+// A QueryPlanCardinality fulfills an HLQuery counting the distinct series
+// that match it (see HLQuery.IsCardinality) from the ClientSideIndex alone,
+// so that it measures the overhead of series selection in isolation.
+type QueryPlanCardinality struct {
+	TimeInterval *utils.TimeInterval
+	Count        int // of matching series
+	Matched      int // series rows, of all the days of the series
+}
+
+// NewQueryPlanCardinality builds a QueryPlanCardinality.
+// It is typically called via (*HLQuery).ToQueryPlanCardinality.
+func NewQueryPlanCardinality(ti *utils.TimeInterval, count int) (*QueryPlanCardinality, error) {
+	return &QueryPlanCardinality{TimeInterval: ti, Count: count}, nil
+}
+
+// Execute returns a single result over the whole time range, holding the
+// count of series, without executing any CQL query.
+func (qp *QueryPlanCardinality) Execute(_ context.Context, _ QueryExecutor) ([]CQLResult, error) {
+	return []CQLResult{{TimeInterval: qp.TimeInterval, Values: []float64{float64(qp.Count)}}}, nil
+}
+
+// AllCQLQueries returns no CQLQueries.
+func (qp *QueryPlanCardinality) AllCQLQueries() []CQLQuery {
+	return []CQLQuery{}
+}
+
+// DebugQueries prints debugging information.
+func (qp *QueryPlanCardinality) DebugQueries(level int) {
+	if level >= 1 {
+		fmt.Printf("[qpcard] query with cardinality plan matches %d series\n", qp.Count)
+	}
+}
+
+// A QueryPlanCountAll fulfills an HLQuery with a "count_all" aggregation
+// (see HLQuery.IsCountAll) from the ClientSideIndex alone: its results hold
+// the number of slots of each time bucket that the matching series cover,
+// i.e. the count of their points if none were missing. Compared with the
+// "count" (or "count_nonnull") of the same query, it exposes data gaps.
+type QueryPlanCountAll struct {
+	SlotInterval time.Duration // between the expected points of a series
+	Results      []CQLResult   // in time order
+	Matched      int           // series rows whose slots are counted
+}
+
+// NewQueryPlanCountAll builds a QueryPlanCountAll.
+// It is typically called via (*HLQuery).ToQueryPlanCountAll.
+func NewQueryPlanCountAll(slot time.Duration, results []CQLResult) (*QueryPlanCountAll, error) {
+	return &QueryPlanCountAll{SlotInterval: slot, Results: results}, nil
+}
+
+// Execute returns the expected counts of each time bucket, without
+// executing any CQL query.
+func (qp *QueryPlanCountAll) Execute(_ context.Context, _ QueryExecutor) ([]CQLResult, error) {
+	results := make([]CQLResult, len(qp.Results))
+	copy(results, qp.Results)
+	return results, nil
+}
+
+// AllCQLQueries returns no CQLQueries.
+func (qp *QueryPlanCountAll) AllCQLQueries() []CQLQuery {
+	return []CQLQuery{}
+}
+
+// DebugQueries prints debugging information.
+func (qp *QueryPlanCountAll) DebugQueries(level int) {
+	if level >= 1 {
+		fmt.Printf("[qpcountall] query with count_all plan has %d time buckets of %s slots\n", len(qp.Results), qp.SlotInterval)
+	}
+}
+
+// A QueryPlanPerMeasurement fulfills an HLQuery of several measurements
+// (UNION semantics) by a QueryPlan per measurement, so that the time
+// buckets of each measurement are aggregated separately. Its results are
+// those of each plan in turn, with their Measurement set.
+type QueryPlanPerMeasurement struct {
+	Measurements []string
+	Plans        []QueryPlan // of each measurement
+}
+
+// NewQueryPlanPerMeasurement builds a QueryPlanPerMeasurement.
+func NewQueryPlanPerMeasurement(measurements []string, plans []QueryPlan) (*QueryPlanPerMeasurement, error) {
+	if len(measurements) != len(plans) {
+		return nil, fmt.Errorf("logic error: %d measurements with %d query plans", len(measurements), len(plans))
+	}
+	return &QueryPlanPerMeasurement{
+		Measurements: measurements,
+		Plans:        plans,
+	}, nil
+}
+
+// Execute runs the plan of each measurement in turn.
+func (qp *QueryPlanPerMeasurement) Execute(ctx context.Context, qe QueryExecutor) ([]CQLResult, error) {
+	results := []CQLResult{}
+	for i, p := range qp.Plans {
+		res, err := p.Execute(ctx, qe)
+		if err != nil {
+			return nil, err
+		}
+		for j := range res {
+			res[j].Measurement = qp.Measurements[i]
+		}
+		results = append(results, res...)
+	}
+	return results, nil
+}
+
+// AllCQLQueries returns the CQLQueries of the plan of each measurement.
+func (qp *QueryPlanPerMeasurement) AllCQLQueries() []CQLQuery {
+	queries := []CQLQuery{}
+	for _, p := range qp.Plans {
+		queries = append(queries, p.AllCQLQueries()...)
+	}
+	return queries
+}
+
+// DebugQueries prints debugging information.
+func (qp *QueryPlanPerMeasurement) DebugQueries(level int) {
+	for i, p := range qp.Plans {
+		if level >= 1 {
+			fmt.Printf("[qppm] measurement %s:\n", qp.Measurements[i])
+		}
+		p.DebugQueries(level)
+	}
+}
+
+// A QueryPlanPerTagGroup fulfills an HLQuery grouped by tag (see
+// GroupByTagKeys) by a QueryPlan per group of the series it matches with
+// the same values of the tag keys, so that the time buckets of each group
+// are aggregated separately. Its results are those of each plan in turn,
+// with their Tags set.
+type QueryPlanPerTagGroup struct {
+	Groups [][]string  // tags of each group, e.g. ["hostname=host_0"]
+	Plans  []QueryPlan // of each group
+}
+
+// NewQueryPlanPerTagGroup builds a QueryPlanPerTagGroup.
+func NewQueryPlanPerTagGroup(groups [][]string, plans []QueryPlan) (*QueryPlanPerTagGroup, error) {
+	if len(groups) != len(plans) {
+		return nil, fmt.Errorf("logic error: %d tag groups with %d query plans", len(groups), len(plans))
+	}
+	return &QueryPlanPerTagGroup{
+		Groups: groups,
+		Plans:  plans,
+	}, nil
+}
+
+// Execute runs the plan of each group in turn.
+func (qp *QueryPlanPerTagGroup) Execute(ctx context.Context, qe QueryExecutor) ([]CQLResult, error) {
+	results := []CQLResult{}
+	for i, p := range qp.Plans {
+		res, err := p.Execute(ctx, qe)
+		if err != nil {
+			return nil, err
+		}
+		for j := range res {
+			res[j].Tags = qp.Groups[i]
+		}
+		results = append(results, res...)
+	}
+	return results, nil
+}
+
+// AllCQLQueries returns the CQLQueries of the plan of each group.
+func (qp *QueryPlanPerTagGroup) AllCQLQueries() []CQLQuery {
+	queries := []CQLQuery{}
+	for _, p := range qp.Plans {
+		queries = append(queries, p.AllCQLQueries()...)
+	}
+	return queries
+}
+
+// DebugQueries prints debugging information.
+func (qp *QueryPlanPerTagGroup) DebugQueries(level int) {
+	for i, p := range qp.Plans {
+		if level >= 1 {
+			fmt.Printf("[qpptg] tags %s:\n", strings.Join(qp.Groups[i], ","))
+		}
+		p.DebugQueries(level)
+	}
+}
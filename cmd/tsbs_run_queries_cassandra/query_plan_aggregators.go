@@ -1,6 +1,13 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
 
 // Type Aggregator merges QueryPlan results on the client in constant time.
 // This is intended to match the aggregation that a CQLQuery performs on a
@@ -10,6 +17,49 @@ import "fmt"
 type Aggregator interface {
 	Put(float64)
 	Get() float64
+	Empty() bool
+}
+
+const (
+	VarianceModePopulation = 1
+	VarianceModeSample     = 2
+)
+
+// varianceMode selects the variance computed by the "variance" and
+// "stddev" aggregations (set by -variance).
+var varianceMode = VarianceModePopulation
+
+const (
+	ZeroTotalSharesNull = 1
+	ZeroTotalSharesZero = 2
+)
+
+// zeroTotalShares selects the shares of the series of a time bucket whose
+// total is zero, for the "share_" aggregations (set by -zero-total-shares):
+// absent, or zero.
+var zeroTotalShares = ZeroTotalSharesNull
+
+// isClientSideAggregation reports whether an aggregation cannot be computed
+// by Cassandra, so that CQLQueries fetch the raw values, which are then
+// aggregated by the client (e.g. percentiles).
+func isClientSideAggregation(label string) bool {
+	if label == "variance" || label == "stddev" {
+		return true
+	}
+	_, ok := parsePercentile([]byte(label))
+	return ok
+}
+
+// isAdditiveAggregation reports whether an aggregation over no values has a
+// meaningful result of zero (e.g. sum, count). All other aggregations, such
+// as the extrema, have no value for an empty time bucket.
+func isAdditiveAggregation(label string) bool {
+	switch label {
+	case "sum", "count":
+		return true
+	default:
+		return false
+	}
 }
 
 // AggregatorMax aggregates the maximum of a stream of values.
@@ -34,6 +84,11 @@ func (a *AggregatorMax) Get() float64 {
 	return a.value
 }
 
+// Empty reports whether no values have been put.
+func (a *AggregatorMax) Empty() bool {
+	return a.count == 0
+}
+
 // AggregatorMax aggregates the minimum of a stream of values.
 type AggregatorMin struct {
 	value float64
@@ -53,6 +108,11 @@ func (a *AggregatorMin) Get() float64 {
 	return a.value
 }
 
+// Empty reports whether no values have been put.
+func (a *AggregatorMin) Empty() bool {
+	return a.count == 0
+}
+
 // AggregatorMax aggregates the average of a stream of values.
 type AggregatorAvg struct {
 	value float64
@@ -73,6 +133,337 @@ func (a *AggregatorAvg) Get() float64 {
 	return a.value / float64(a.count)
 }
 
+// Empty reports whether no values have been put.
+func (a *AggregatorAvg) Empty() bool {
+	return a.count == 0
+}
+
+// AggregatorWeightedAvg aggregates the weighted average of a stream of
+// values, e.g. of averages over durations of different lengths. Values put
+// without a weight weigh 1.
+type AggregatorWeightedAvg struct {
+	value  float64
+	weight float64
+	count  int64
+}
+
+// Put puts a value of weight 1 for averaging.
+func (a *AggregatorWeightedAvg) Put(n float64) {
+	a.PutWeighted(n, 1)
+}
+
+// PutWeighted puts a value of the given weight for averaging.
+func (a *AggregatorWeightedAvg) PutWeighted(n, weight float64) {
+	a.value += n * weight
+	a.weight += weight
+	a.count++
+}
+
+// Get computes the aggregated weighted average.
+func (a *AggregatorWeightedAvg) Get() float64 {
+	if a.weight == 0 {
+		return 0
+	}
+	return a.value / a.weight
+}
+
+// Empty reports whether no values have been put.
+func (a *AggregatorWeightedAvg) Empty() bool {
+	return a.count == 0
+}
+
+// AggregatorSum aggregates the sum of a stream of values.
+type AggregatorSum struct {
+	value float64
+	count int64
+}
+
+// Put puts a value for summing.
+func (a *AggregatorSum) Put(n float64) {
+	a.value += n
+	a.count++
+}
+
+// Get computes the aggregated sum.
+func (a *AggregatorSum) Get() float64 {
+	return a.value
+}
+
+// Empty reports whether no values have been put.
+func (a *AggregatorSum) Empty() bool {
+	return a.count == 0
+}
+
+// AggregatorCount aggregates the number of values in a stream.
+type AggregatorCount struct {
+	count int64
+}
+
+// Put counts a value.
+func (a *AggregatorCount) Put(_ float64) {
+	a.count++
+}
+
+// Get returns the number of values.
+func (a *AggregatorCount) Get() float64 {
+	return float64(a.count)
+}
+
+// Empty reports whether no values have been put.
+func (a *AggregatorCount) Empty() bool {
+	return a.count == 0
+}
+
+// AggregatorPercentile aggregates a percentile of a stream of values, using
+// linear interpolation between the closest ranks.
+//
+// Unlike the other Aggregators it does not run in constant space: every value
+// put into it is kept until Get is called, so its memory use grows with the
+// number of rows in a time bucket.
+type AggregatorPercentile struct {
+	level  float64 // in [0, 1]
+	values []float64
+}
+
+// Put puts a value for finding the percentile.
+func (a *AggregatorPercentile) Put(n float64) {
+	a.values = append(a.values, n)
+}
+
+// Get computes the aggregated percentile.
+func (a *AggregatorPercentile) Get() float64 {
+	if len(a.values) == 0 {
+		return 0
+	}
+	sort.Float64s(a.values)
+	pos := a.level * float64(len(a.values)-1)
+	lo := int(math.Floor(pos))
+	hi := int(math.Ceil(pos))
+	return a.values[lo] + (pos-float64(lo))*(a.values[hi]-a.values[lo])
+}
+
+// Empty reports whether no values have been put.
+func (a *AggregatorPercentile) Empty() bool {
+	return len(a.values) == 0
+}
+
+// AggregatorVariance aggregates the variance, or the standard deviation, of
+// a stream of values. It uses Welford's online algorithm, which is
+// numerically stable even for large numbers of values far from zero.
+type AggregatorVariance struct {
+	sample bool // the sample (rather than population) variance
+	stddev bool // the square root of the variance
+
+	count int64
+	mean  float64
+	m2    float64 // sum of the squared differences from the mean
+}
+
+// Put puts a value for finding the variance.
+func (a *AggregatorVariance) Put(n float64) {
+	a.count++
+	delta := n - a.mean
+	a.mean += delta / float64(a.count)
+	a.m2 += delta * (n - a.mean)
+}
+
+// Get computes the aggregated variance (or standard deviation). The sample
+// variance of a single value is 0.
+func (a *AggregatorVariance) Get() float64 {
+	n := a.count
+	if a.sample {
+		n--
+	}
+	if n <= 0 {
+		return 0
+	}
+	v := a.m2 / float64(n)
+	if a.stddev {
+		return math.Sqrt(v)
+	}
+	return v
+}
+
+// Empty reports whether no values have been put.
+func (a *AggregatorVariance) Empty() bool {
+	return a.count == 0
+}
+
+// A pointAggregator is an Aggregator of the points of several series, which
+// needs their timestamps and series (see AggregatorRate). Its points are put
+// with PutPoint rather than Put.
+type pointAggregator interface {
+	Aggregator
+	PutPoint(series string, timestampNs int64, value float64)
+}
+
+// AggregatorRate aggregates the per-second rates of increase of counters:
+// the rate of each series, over the time between its first and last points,
+// is computed first, then the rates of all series are merged by another
+// aggregation (e.g. summed, for "sum_rate"). Counters are reset to zero on
+// restarts, so decreases count as no increase. Series with fewer than two
+// points have no rate.
+//
+// It keeps one counterRate per series, so its memory use grows with the
+// number of series in a time bucket, but not with their points.
+type AggregatorRate struct {
+	merge  string // label of the aggregation of the series rates
+	series map[string]*counterRate
+}
+
+// A counterRate is the increase of a counter between its first and last points.
+type counterRate struct {
+	first, last           int64 // timestamps
+	firstValue, lastValue float64
+	increase              float64
+	points                int
+}
+
+// put puts a point of the counter, which must be after or before all of
+// those put so far (i.e. points are put in either time order); points
+// between them are ignored.
+func (c *counterRate) put(ts int64, v float64) {
+	switch {
+	case c.points == 0:
+		c.first, c.last, c.firstValue, c.lastValue = ts, ts, v, v
+	case ts > c.last:
+		c.increase += nonNegative(v - c.lastValue)
+		c.last, c.lastValue = ts, v
+	case ts < c.first:
+		c.increase += nonNegative(c.firstValue - v)
+		c.first, c.firstValue = ts, v
+	default:
+		return
+	}
+	c.points++
+}
+
+// rate returns the per-second rate of increase of the counter, or false if
+// it has fewer than two points.
+func (c *counterRate) rate() (float64, bool) {
+	if c.points < 2 {
+		return 0, false
+	}
+	return c.increase / (float64(c.last-c.first) / 1e9), true
+}
+
+func nonNegative(x float64) float64 {
+	if x < 0 {
+		return 0
+	}
+	return x
+}
+
+// Put cannot aggregate values without their series and timestamps, so it
+// panics: use PutPoint.
+func (a *AggregatorRate) Put(_ float64) {
+	panic("logic error: AggregatorRate needs the series and timestamps of values")
+}
+
+// PutPoint puts a point of a series, whose points must be put in time order
+// (or reverse time order).
+func (a *AggregatorRate) PutPoint(series string, timestampNs int64, value float64) {
+	if a.series == nil {
+		a.series = map[string]*counterRate{}
+	}
+	c, ok := a.series[series]
+	if !ok {
+		c = &counterRate{}
+		a.series[series] = c
+	}
+	c.put(timestampNs, value)
+}
+
+// Get merges the rates of the series.
+func (a *AggregatorRate) Get() float64 {
+	merged, err := GetAggregator(a.merge)
+	if err != nil {
+		panic(fmt.Sprintf("logic error: %v", err))
+	}
+	for _, c := range a.series {
+		if r, ok := c.rate(); ok {
+			merged.Put(r)
+		}
+	}
+	return merged.Get()
+}
+
+// Empty reports whether no series has a rate.
+func (a *AggregatorRate) Empty() bool {
+	for _, c := range a.series {
+		if c.points >= 2 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRateAggregation parses a composite aggregation of counter rates, of
+// the form "<aggregation>_rate" (e.g. "sum_rate"), into the aggregation of
+// the series rates: sum, avg, min or max.
+func parseRateAggregation(label string) (merge string, ok bool) {
+	if !strings.HasSuffix(label, "_rate") {
+		return "", false
+	}
+	switch merge = strings.TrimSuffix(label, "_rate"); merge {
+	case "sum", "avg", "min", "max":
+		return merge, true
+	}
+	return "", false
+}
+
+// parseShareAggregation parses a composite aggregation of the shares of the
+// series of each time bucket in their total, of the form
+// "share_<aggregation>" (e.g. "share_sum"), into the aggregation of each
+// series: sum, avg, min, max or count.
+func parseShareAggregation(label string) (aggr string, ok bool) {
+	if !strings.HasPrefix(label, "share_") {
+		return "", false
+	}
+	switch aggr = strings.TrimPrefix(label, "share_"); aggr {
+	case "sum", "avg", "min", "max", "count":
+		return aggr, true
+	}
+	return "", false
+}
+
+// percentileLevelRegexp matches the level of a percentile aggregation label.
+var percentileLevelRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// parsePercentile parses a percentile aggregation label of the form "p99" or
+// "percentile_99" into its level as a fraction, e.g. 0.99. The level is a
+// decimal number in (0,100], without a sign, an exponent or anything after
+// it.
+func parsePercentile(label []byte) (float64, bool) {
+	s := string(label)
+	switch {
+	case strings.HasPrefix(s, "percentile_"):
+		s = s[len("percentile_"):]
+	case strings.HasPrefix(s, "p"):
+		s = s[len("p"):]
+	default:
+		return 0, false
+	}
+	if !percentileLevelRegexp.MatchString(s) {
+		return 0, false
+	}
+	level, err := strconv.ParseFloat(s, 64)
+	if err != nil || level <= 0 || level > 100 {
+		return 0, false
+	}
+	return level / 100, true
+}
+
+// getMergeAggregator translates a label into a new Aggregator that merges
+// the per-series results of the same aggregation made by the server. Counts
+// are merged by summing them; all other aggregations merge into themselves.
+func getMergeAggregator(label string) (Aggregator, error) {
+	if label == "count" {
+		return &AggregatorSum{}, nil
+	}
+	return GetAggregator(label)
+}
+
 // GetConstantSpaceAggr translates a label into a new ConstantSpaceAggr.
 func GetAggregator(label string) (Aggregator, error) {
 	// TODO(rw): fewer heap allocations here.
@@ -83,7 +474,21 @@ func GetAggregator(label string) (Aggregator, error) {
 		return &AggregatorMax{}, nil
 	case "avg":
 		return &AggregatorAvg{}, nil
+	case "sum":
+		return &AggregatorSum{}, nil
+	case "count":
+		return &AggregatorCount{}, nil
+	case "variance":
+		return &AggregatorVariance{sample: varianceMode == VarianceModeSample}, nil
+	case "stddev":
+		return &AggregatorVariance{sample: varianceMode == VarianceModeSample, stddev: true}, nil
 	default:
+		if merge, ok := parseRateAggregation(label); ok {
+			return &AggregatorRate{merge: merge}, nil
+		}
+		if level, ok := parsePercentile([]byte(label)); ok {
+			return &AggregatorPercentile{level: level}, nil
+		}
 		return nil, fmt.Errorf("invalid aggregation specifier")
 	}
 }
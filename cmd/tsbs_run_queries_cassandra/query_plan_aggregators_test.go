@@ -0,0 +1,250 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParsePercentile(t *testing.T) {
+	cases := []struct {
+		label     string
+		wantLevel float64
+		wantOK    bool
+	}{
+		{label: "p50", wantLevel: 0.5, wantOK: true},
+		{label: "p99", wantLevel: 0.99, wantOK: true},
+		{label: "p12.5", wantLevel: 0.125, wantOK: true},
+		{label: "percentile_95", wantLevel: 0.95, wantOK: true},
+		{label: "p100", wantLevel: 1, wantOK: true},
+		{label: "p0", wantOK: false},
+		{label: "p0.0", wantOK: false},
+		{label: "p101", wantOK: false},
+		{label: "p100.5", wantOK: false},
+		{label: "p-1", wantOK: false},
+		{label: "p+50", wantOK: false},
+		{label: "pnan", wantOK: false},
+		{label: "pinf", wantOK: false},
+		{label: "p1e1", wantOK: false},
+		{label: "p0x10", wantOK: false},
+		{label: "p99x", wantOK: false},
+		{label: "p99 ", wantOK: false},
+		{label: "p99.", wantOK: false},
+		{label: "p", wantOK: false},
+		{label: "percentile_", wantOK: false},
+		{label: "max", wantOK: false},
+		{label: "", wantOK: false},
+	}
+	for _, c := range cases {
+		level, ok := parsePercentile([]byte(c.label))
+		if ok != c.wantOK {
+			t.Errorf("%s: incorrect ok: got %v want %v", c.label, ok, c.wantOK)
+		}
+		if ok && level != c.wantLevel {
+			t.Errorf("%s: incorrect level: got %v want %v", c.label, level, c.wantLevel)
+		}
+	}
+}
+
+func TestAggregatorPercentile(t *testing.T) {
+	cases := []struct {
+		desc   string
+		label  string
+		values []float64
+		want   float64
+	}{
+		{desc: "p50 odd", label: "p50", values: []float64{5, 1, 3}, want: 3},
+		{desc: "p50 even", label: "p50", values: []float64{4, 1, 3, 2}, want: 2.5},
+		{desc: "p50 single", label: "p50", values: []float64{7}, want: 7},
+		{desc: "p1", label: "p1", values: []float64{4, 1, 3, 2}, want: 1.03},
+		{desc: "p100", label: "p100", values: []float64{4, 1, 3, 2}, want: 4},
+		{desc: "p75 interpolated", label: "percentile_75", values: []float64{10, 20, 30}, want: 25},
+	}
+	for _, c := range cases {
+		aggr, err := GetAggregator(c.label)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if !aggr.Empty() {
+			t.Errorf("%s: new aggregator is not empty", c.desc)
+		}
+		for _, v := range c.values {
+			aggr.Put(v)
+		}
+		if got := aggr.Get(); got != c.want {
+			t.Errorf("%s: incorrect percentile: got %v want %v", c.desc, got, c.want)
+		}
+	}
+}
+
+// naiveVariance computes the variance of values in two passes.
+func naiveVariance(values []float64, sample bool) float64 {
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	ss := 0.0
+	for _, v := range values {
+		ss += (v - mean) * (v - mean)
+	}
+	n := len(values)
+	if sample {
+		n--
+	}
+	return ss / float64(n)
+}
+
+func TestAggregatorVariance(t *testing.T) {
+	large := make([]float64, 1000)
+	for i := range large {
+		large[i] = 1e9 + float64(i%10)/10
+	}
+	cases := []struct {
+		desc   string
+		values []float64
+	}{
+		{desc: "small", values: []float64{2, 4, 4, 4, 5, 5, 7, 9}},
+		{desc: "negative", values: []float64{-1.5, 0, 3.25, -7}},
+		{desc: "large offset", values: large},
+	}
+	for _, c := range cases {
+		for _, sample := range []bool{false, true} {
+			want := naiveVariance(c.values, sample)
+			for _, stddev := range []bool{false, true} {
+				a := &AggregatorVariance{sample: sample, stddev: stddev}
+				for _, v := range c.values {
+					a.Put(v)
+				}
+				w := want
+				if stddev {
+					w = math.Sqrt(want)
+				}
+				if got := a.Get(); math.Abs(got-w) > 1e-6*w {
+					t.Errorf("%s (sample %v, stddev %v): incorrect result: got %v want %v", c.desc, sample, stddev, got, w)
+				}
+			}
+		}
+	}
+
+	// the population variance of 2, 4, 4, 4, 5, 5, 7, 9 is exactly 4
+	a := &AggregatorVariance{stddev: true}
+	for _, v := range cases[0].values {
+		a.Put(v)
+	}
+	if got := a.Get(); got != 2 {
+		t.Errorf("incorrect standard deviation: got %v want %v", got, 2)
+	}
+
+	a = &AggregatorVariance{sample: true}
+	if !a.Empty() {
+		t.Errorf("new aggregator is not empty")
+	}
+	a.Put(3)
+	if a.Empty() {
+		t.Errorf("aggregator with a value is empty")
+	}
+	if got := a.Get(); got != 0 {
+		t.Errorf("incorrect sample variance of one value: got %v want %v", got, 0)
+	}
+}
+
+func TestGetAggregatorVarianceMode(t *testing.T) {
+	defer func(m int) { varianceMode = m }(varianceMode)
+	for _, c := range []struct {
+		mode int
+		want float64
+	}{
+		{mode: VarianceModePopulation, want: 1},
+		{mode: VarianceModeSample, want: 2},
+	} {
+		varianceMode = c.mode
+		a, err := GetAggregator("variance")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		a.Put(1)
+		a.Put(3)
+		if got := a.Get(); got != c.want {
+			t.Errorf("mode %d: incorrect variance: got %v want %v", c.mode, got, c.want)
+		}
+	}
+}
+
+func TestAggregatorRate(t *testing.T) {
+	type point struct {
+		series string
+		ts     int64 // seconds
+		value  float64
+	}
+	cases := []struct {
+		desc   string
+		label  string
+		points []point
+		want   float64
+		empty  bool
+	}{
+		{
+			desc:   "steady counter",
+			label:  "sum_rate",
+			points: []point{{"a", 0, 10}, {"a", 10, 30}, {"a", 20, 50}},
+			want:   2,
+		},
+		{
+			// the counter restarts from 0 at 20s: the drop counts as no
+			// increase, and its increase after the reset still counts
+			desc:   "counter reset",
+			label:  "sum_rate",
+			points: []point{{"a", 0, 10}, {"a", 10, 30}, {"a", 20, 5}, {"a", 40, 45}},
+			want:   1.5,
+		},
+		{
+			desc:   "reverse time order",
+			label:  "sum_rate",
+			points: []point{{"a", 40, 45}, {"a", 20, 5}, {"a", 10, 30}, {"a", 0, 10}},
+			want:   1.5,
+		},
+		{
+			desc:   "sum across series",
+			label:  "sum_rate",
+			points: []point{{"a", 0, 0}, {"b", 0, 100}, {"a", 10, 10}, {"b", 10, 150}},
+			want:   6,
+		},
+		{
+			desc:   "max across series",
+			label:  "max_rate",
+			points: []point{{"a", 0, 0}, {"b", 0, 100}, {"a", 10, 10}, {"b", 10, 150}},
+			want:   5,
+		},
+		{
+			desc:   "single point",
+			label:  "sum_rate",
+			points: []point{{"a", 0, 10}, {"b", 0, 10}},
+			empty:  true,
+		},
+	}
+	for _, c := range cases {
+		aggr, err := GetAggregator(c.label)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		a := aggr.(pointAggregator)
+		for _, p := range c.points {
+			a.PutPoint(p.series, p.ts*1e9, p.value)
+		}
+		if got := a.Empty(); got != c.empty {
+			t.Errorf("%s: incorrect emptiness: got %v want %v", c.desc, got, c.empty)
+		}
+		if c.empty {
+			continue
+		}
+		if got := a.Get(); got != c.want {
+			t.Errorf("%s: incorrect rate: got %v want %v", c.desc, got, c.want)
+		}
+	}
+
+	for _, label := range []string{"rate", "count_rate", "sum_rates"} {
+		if _, ok := parseRateAggregation(label); ok {
+			t.Errorf("%s: unexpected rate aggregation", label)
+		}
+	}
+}
@@ -0,0 +1,1503 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+var testStart = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestClientSideIndex builds a ClientSideIndex of cpu series for the
+// given number of hosts and days (starting at testStart) for each field.
+func newTestClientSideIndex(hosts, days int, fields ...string) *ClientSideIndex {
+	return NewSyntheticClientSideIndex(testStart, hosts, days, fields...)
+}
+
+// serverAggregationRows mocks a server-side aggregate, deterministically
+// derived from the series id and time range of the query.
+func serverAggregationRows(_ string, args []interface{}) ([][]interface{}, error) {
+	v := float64(len(args[0].(string))) + float64(args[1].(int64)%1e12)/1e9
+	return [][]interface{}{{v}}, nil
+}
+
+// countRows mocks the rows of series with a point at 1h, 2h and 3h into
+// each of their days: their count for server aggregation, or the points
+// themselves (with a value of 1) otherwise.
+func countRows(stmt string, args []interface{}) ([][]interface{}, error) {
+	day, err := time.Parse(BucketTimeLayout, strings.Split(args[0].(string), "#")[2])
+	if err != nil {
+		return nil, err
+	}
+	start, end := args[1].(int64), args[2].(int64)
+	rows := [][]interface{}{}
+	for h := 1; h <= 3; h++ {
+		ts := day.Add(time.Duration(h) * time.Hour).UnixNano()
+		if ts >= start && ts < end {
+			rows = append(rows, []interface{}{ts, 1.0})
+		}
+	}
+	if strings.HasPrefix(stmt, "SELECT count(value)") {
+		return [][]interface{}{{int64(len(rows))}}, nil
+	}
+	return rows, nil
+}
+
+func TestCountAggregation(t *testing.T) {
+	// host_0 has data on the 1st and 3rd, but not on the 2nd
+	csi := NewClientSideIndex([]Series{
+		NewSeries(testTable, "cpu,hostname=host_0#usage_user#2016-01-01"),
+		NewSeries(testTable, "cpu,hostname=host_0#usage_user#2016-01-03"),
+	})
+	day := 24 * time.Hour
+
+	cases := []struct {
+		desc    string
+		start   time.Time
+		end     time.Time
+		groupBy time.Duration
+		want    []float64
+	}{
+		{
+			desc:    "partially empty",
+			start:   testStart,
+			end:     testStart.Add(3 * day),
+			groupBy: day,
+			want:    []float64{3, 0, 3},
+		},
+		{
+			desc:    "partially empty hours",
+			start:   testStart,
+			end:     testStart.Add(4 * time.Hour),
+			groupBy: 2 * time.Hour,
+			want:    []float64{1, 2},
+		},
+		{
+			desc:    "fully empty",
+			start:   testStart.Add(3 * day),
+			end:     testStart.Add(5 * day),
+			groupBy: day,
+			want:    []float64{0, 0},
+		},
+		{
+			desc:  "no group by",
+			start: testStart.Add(2 * time.Hour),
+			end:   testStart.Add(3 * day),
+			want:  []float64{5},
+		},
+		{
+			desc:  "no group by, fully empty",
+			start: testStart.Add(day),
+			end:   testStart.Add(2 * day),
+			want:  []float64{0},
+		},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery("count", "usage_user", c.start, c.end, c.groupBy)
+		sqp, err := q.ToQueryPlanWithServerAggregation(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		cqp, err := q.ToQueryPlanWithoutServerAggregation(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+
+		qe := &mockQueryExecutor{respond: countRows}
+		for _, qp := range []QueryPlan{sqp, cqp} {
+			results, err := qp.Execute(context.Background(), qe)
+			if err != nil {
+				t.Fatalf("%s: %T: unexpected error: %v", c.desc, qp, err)
+			}
+			got := make([]float64, len(results))
+			for i, r := range results {
+				if r.IsAbsent(0) {
+					t.Errorf("%s: %T: absent count at %d", c.desc, qp, i)
+				}
+				got[i] = r.Values[0]
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%s: %T: incorrect counts: got %v want %v", c.desc, qp, got, c.want)
+			}
+		}
+	}
+}
+
+func TestTimeBuckets(t *testing.T) {
+	csi := newTestClientSideIndex(1, 2, "usage_user")
+	bucket := func(start, end time.Duration) *utils.TimeInterval {
+		ti, err := utils.NewTimeInterval(testStart.Add(start), testStart.Add(end))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return ti
+	}
+	// of unequal widths, across the days of the series, and leaving out the
+	// point at 26h:
+	q := newTestHLQuery("count", "usage_user", testStart, testStart.Add(2*day), time.Hour)
+	q.TimeBuckets = []*utils.TimeInterval{bucket(0, 150*time.Minute), bucket(150*time.Minute, 26*time.Hour), bucket(26*time.Hour+30*time.Minute, 2*day)}
+	want := []float64{2, 2, 1}
+
+	sqp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cqp, err := q.ToQueryPlanWithoutServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the middle bucket reads the series of both days:
+	if got := len(sqp.AllCQLQueries()); got != 4 {
+		t.Errorf("incorrect number of CQL queries: got %d want 4", got)
+	}
+	qe := &mockQueryExecutor{respond: countRows}
+	for _, qp := range []QueryPlan{sqp, cqp} {
+		results, err := qp.Execute(context.Background(), qe)
+		if err != nil {
+			t.Fatalf("%T: unexpected error: %v", qp, err)
+		}
+		got := make([]float64, len(results))
+		for i, r := range results {
+			if !r.TimeInterval.Start().Equal(q.TimeBuckets[i].Start()) || !r.TimeInterval.End().Equal(q.TimeBuckets[i].End()) {
+				t.Errorf("%T: incorrect bucket %d: got [%s, %s)", qp, i, r.TimeInterval.StartString(), r.TimeInterval.EndString())
+			}
+			got[i] = r.Values[0]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: incorrect counts: got %v want %v", qp, got, want)
+		}
+	}
+
+	// the first bucket starting after the start of the query, leaving out
+	// the point at 1h:
+	q.TimeBuckets = []*utils.TimeInterval{bucket(90*time.Minute, 17*time.Hour)}
+	for _, plan := range []func() (QueryPlan, error){
+		func() (QueryPlan, error) { return q.ToQueryPlanWithServerAggregation(csi) },
+		func() (QueryPlan, error) { return q.ToQueryPlanWithoutServerAggregation(csi) },
+	} {
+		qp, err := plan()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		results, err := qp.Execute(context.Background(), qe)
+		if err != nil {
+			t.Fatalf("%T: unexpected error: %v", qp, err)
+		}
+		if len(results) != 1 || results[0].Values[0] != 2 {
+			t.Errorf("%T: incorrect results: got %v want a count of 2", qp, results)
+		}
+	}
+
+	cases := []struct {
+		desc    string
+		buckets []*utils.TimeInterval
+		want    string
+	}{
+		{desc: "empty", buckets: []*utils.TimeInterval{bucket(time.Hour, time.Hour)}, want: "empty time bucket 0"},
+		{desc: "outside", buckets: []*utils.TimeInterval{bucket(day, 3*day)}, want: "outside of the time range"},
+		{desc: "overlapping", buckets: []*utils.TimeInterval{bucket(0, 2*time.Hour), bucket(time.Hour, 3*time.Hour)}, want: "time bucket 1 [2016-01-01T01:00:00Z, 2016-01-01T03:00:00Z) overlaps"},
+		{desc: "unsorted", buckets: []*utils.TimeInterval{bucket(2*time.Hour, 3*time.Hour), bucket(0, time.Hour)}, want: "overlaps or precedes"},
+	}
+	for _, c := range cases {
+		q.TimeBuckets = c.buckets
+		err := q.Validate()
+		if _, ok := err.(*InvalidQueryError); !ok || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: incorrect error: got %v want %s", c.desc, err, c.want)
+		}
+	}
+}
+
+func TestQueryPlanWithServerAggregationExecuteParallel(t *testing.T) {
+	csi := newTestClientSideIndex(10, 2, "usage_user")
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(36*time.Hour), time.Hour)
+	qp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	qe := &mockQueryExecutor{respond: serverAggregationRows}
+	want, err := qp.Execute(context.Background(), qe)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := len(want); got != 36 {
+		t.Fatalf("incorrect number of results: got %d want %d", got, 36)
+	}
+	for i := 1; i < len(want); i++ {
+		if !want[i-1].Start().Before(want[i].Start()) {
+			t.Fatalf("serial results not in time order at %d", i)
+		}
+	}
+
+	for _, concurrency := range []int{2, 8, 100} {
+		qp.MaxConcurrency = concurrency
+		got, err := qp.Execute(context.Background(), qe)
+		if err != nil {
+			t.Fatalf("concurrency %d: unexpected error: %v", concurrency, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("concurrency %d: parallel results differ from serial results", concurrency)
+		}
+	}
+}
+
+func TestQueryPlanWithServerAggregationExecuteError(t *testing.T) {
+	csi := newTestClientSideIndex(10, 1, "usage_user")
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(24*time.Hour), time.Hour)
+	qp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wantErr := errors.New("mock failure")
+	qe := &mockQueryExecutor{respond: func(string, []interface{}) ([][]interface{}, error) {
+		return nil, wantErr
+	}}
+	for _, concurrency := range []int{1, 4} {
+		qp.MaxConcurrency = concurrency
+		if _, err := qp.Execute(context.Background(), qe); err != wantErr {
+			t.Errorf("concurrency %d: incorrect error: got %v want %v", concurrency, err, wantErr)
+		}
+	}
+}
+
+func TestQueryPlanWithServerAggregationExecuteTimeout(t *testing.T) {
+	csi := newTestClientSideIndex(10, 1, "usage_user")
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(24*time.Hour), time.Hour)
+	qp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// without a timeout, this would take 240 * 10s:
+	qe := &mockQueryExecutor{respond: serverAggregationRows, delay: 10 * time.Second}
+	goroutines := runtime.NumGoroutine()
+	for _, concurrency := range []int{1, 8} {
+		qp.MaxConcurrency = concurrency
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		start := time.Now()
+		_, err := qp.Execute(ctx, qe)
+		elapsed := time.Since(start)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("concurrency %d: incorrect error: got %v want %v", concurrency, err, context.DeadlineExceeded)
+		}
+		if elapsed > time.Second {
+			t.Errorf("concurrency %d: execution not cancelled: took %v", concurrency, elapsed)
+		}
+	}
+	if got := runtime.NumGoroutine(); got > goroutines {
+		t.Errorf("leaked goroutines: got %d want %d", got, goroutines)
+	}
+}
+
+func BenchmarkQueryPlanWithServerAggregationExecute(b *testing.B) {
+	csi := newTestClientSideIndex(10, 1, "usage_user")
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(24*time.Hour), time.Hour)
+	qp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+
+	// simulate the round-trip latency of a real cluster:
+	qe := &mockQueryExecutor{respond: func(stmt string, args []interface{}) ([][]interface{}, error) {
+		time.Sleep(50 * time.Microsecond)
+		return serverAggregationRows(stmt, args)
+	}}
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			qp.MaxConcurrency = concurrency
+			for i := 0; i < b.N; i++ {
+				if _, err := qp.Execute(context.Background(), qe); err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// rawRows mocks the raw points of series at 1h, 2h and 3h into each of
+// their days, with the hour as value, honoring ORDER BY ... DESC and LIMIT.
+func rawRows(stmt string, args []interface{}) ([][]interface{}, error) {
+	rows, err := countRows(stmt, args)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		row[1] = float64(time.Unix(0, row[0].(int64)).UTC().Hour())
+	}
+	if strings.Contains(stmt, " DESC") {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+	if strings.HasSuffix(stmt, " LIMIT ?") {
+		if limit := args[len(args)-1].(int); limit < len(rows) {
+			rows = rows[:limit]
+		}
+	}
+	return rows, nil
+}
+
+func TestQueryPlanRawLimit(t *testing.T) {
+	csi := newTestClientSideIndex(2, 3, "usage_user")
+	cases := []struct {
+		desc      string
+		orderBy   string
+		limit     int
+		want      []float64 // of host_0, by hour
+		wantCalls int
+	}{
+		{
+			desc:      "no limit",
+			want:      []float64{1, 2, 3, 1, 2, 3, 1, 2, 3},
+			wantCalls: 6,
+		},
+		{
+			desc:      "limit within a day",
+			limit:     2,
+			want:      []float64{1, 2},
+			wantCalls: 2,
+		},
+		{
+			desc:      "limit across days",
+			limit:     4,
+			want:      []float64{1, 2, 3, 1},
+			wantCalls: 4,
+		},
+		{
+			desc:      "ascending",
+			orderBy:   "timestamp_ns asc",
+			limit:     4,
+			want:      []float64{1, 2, 3, 1},
+			wantCalls: 4,
+		},
+		{
+			desc:      "last points",
+			orderBy:   "timestamp_ns DESC",
+			limit:     4,
+			want:      []float64{3, 2, 1, 3},
+			wantCalls: 4,
+		},
+		{
+			desc:      "descending",
+			orderBy:   "timestamp_ns desc",
+			want:      []float64{3, 2, 1, 3, 2, 1, 3, 2, 1},
+			wantCalls: 6,
+		},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery("", "usage_user", testStart, testStart.Add(3*day), 0)
+		q.OrderBy = []byte(c.orderBy)
+		q.Limit = c.limit
+		qp, err := q.ToQueryPlanRaw(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		qe := &mockQueryExecutor{respond: rawRows}
+		results, err := qp.Execute(context.Background(), qe)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if got := len(results); got != 2 {
+			t.Fatalf("%s: incorrect number of results: got %d want %d", c.desc, got, 2)
+		}
+		if got, want := results[0].Series, "cpu,hostname=host_0#usage_user"; got != want {
+			t.Errorf("%s: incorrect series: got %s want %s", c.desc, got, want)
+		}
+		got := make([]float64, len(results[0].Points))
+		for i, p := range results[0].Points {
+			got[i] = p.Value
+			if i > 0 && p.Timestamp.After(results[0].Points[i-1].Timestamp) == strings.HasSuffix(strings.ToUpper(c.orderBy), "DESC") {
+				t.Errorf("%s: points out of order at %d", c.desc, i)
+			}
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: incorrect points: got %v want %v", c.desc, got, c.want)
+		}
+		if got := qe.Calls(); got != c.wantCalls {
+			t.Errorf("%s: incorrect number of CQL queries: got %d want %d", c.desc, got, c.wantCalls)
+		}
+	}
+}
+
+// mockRequestError mocks a gocql.RequestError.
+type mockRequestError struct {
+	code    int
+	message string
+}
+
+func (e mockRequestError) Code() int       { return e.code }
+func (e mockRequestError) Message() string { return e.message }
+func (e mockRequestError) Error() string   { return e.message }
+
+func TestQueryPlanRawOrderingError(t *testing.T) {
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	cases := []struct {
+		desc         string
+		err          error
+		wantOrdering bool
+	}{
+		{
+			desc:         "ordering constraint",
+			err:          mockRequestError{cqlErrInvalid, "Order by is currently only supported on the clustered columns of the PRIMARY KEY, got timestamp_ns"},
+			wantOrdering: true,
+		},
+		{
+			desc: "other invalid request",
+			err:  mockRequestError{cqlErrInvalid, "unconfigured table series_double"},
+		},
+		{
+			desc: "other error",
+			err:  errors.New("order by: connection reset"),
+		},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery("", "usage_user", testStart, testStart.Add(time.Hour), 0)
+		q.OrderBy = []byte("timestamp_ns DESC")
+		qp, err := q.ToQueryPlanRaw(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		qe := &mockQueryExecutor{respond: func(string, []interface{}) ([][]interface{}, error) { return nil, c.err }}
+		_, err = qp.Execute(context.Background(), qe)
+		oerr, ok := err.(*OrderingError)
+		if ok != c.wantOrdering {
+			t.Errorf("%s: incorrect error type: got %T (%v)", c.desc, err, err)
+			continue
+		}
+		if !ok {
+			if err != c.err {
+				t.Errorf("%s: incorrect error: got %v want %v", c.desc, err, c.err)
+			}
+			continue
+		}
+		if oerr.Err != c.err || !strings.Contains(oerr.Stmt, "ORDER BY timestamp_ns DESC") {
+			t.Errorf("%s: incorrect ordering error: got %v", c.desc, oerr)
+		}
+	}
+}
+
+func TestQueryPlanLastPoint(t *testing.T) {
+	// host_1 has no data on the last day
+	csi := NewClientSideIndex(append(newTestClientSideIndex(1, 3, "usage_user", "usage_system").seriesCollection,
+		NewSeries(testTable, "cpu,hostname=host_1#usage_user#2016-01-01"),
+		NewSeries(testTable, "cpu,hostname=host_1#usage_user#2016-01-02"),
+	))
+	cases := []struct {
+		desc  string
+		start time.Time
+		end   time.Time
+	}{
+		{desc: "whole range", start: testStart, end: testStart.Add(3 * day)},
+		{desc: "within the last day", start: testStart, end: testStart.Add(2*day + 150*time.Minute)},
+		{desc: "without the last day", start: testStart, end: testStart.Add(2 * day)},
+		{desc: "before the first point", start: testStart, end: testStart.Add(time.Hour)},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery("last", "usage_user,usage_system", c.start, c.end, 0)
+		if !q.IsLastPoint() {
+			t.Fatalf("%s: not a lastpoint query", c.desc)
+		}
+		lqp, err := q.ToQueryPlanLastPoint(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		lqe := &mockQueryExecutor{respond: rawRows}
+		got, err := lqp.Execute(context.Background(), lqe)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+
+		// the naive path scans all points of each series and keeps the last
+		q.AggregationType = nil
+		rqp, err := q.ToQueryPlanRaw(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		want, err := rqp.Execute(context.Background(), &mockQueryExecutor{respond: rawRows})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		for i := range want {
+			if n := len(want[i].Points); n > 0 {
+				want[i].Points = want[i].Points[n-1:]
+			}
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: incorrect last points:\ngot\n%v\nwant\n%v", c.desc, got, want)
+		}
+		if got := len(got); got != 3 {
+			t.Errorf("%s: incorrect number of series: got %d want %d", c.desc, got, 3)
+		}
+		if c.desc == "whole range" && lqe.Calls() != 3 {
+			t.Errorf("%s: incorrect number of CQL queries: got %d want %d", c.desc, lqe.Calls(), 3)
+		}
+	}
+}
+
+// batchRows mocks server-side aggregates over one series (as
+// serverAggregationRows) or, with series_id IN, several: their max, sum or
+// count, according to the statement.
+func batchRows(stmt string, args []interface{}) ([][]interface{}, error) {
+	ids, ok := args[0].([]string)
+	if !ok {
+		ids = []string{args[0].(string)}
+	}
+	vals := make([]float64, len(ids))
+	for i, id := range ids {
+		rows, _ := serverAggregationRows(stmt, append([]interface{}{id}, args[1:]...))
+		vals[i] = rows[0][0].(float64)
+	}
+	switch {
+	case strings.HasPrefix(stmt, "SELECT count(value)"):
+		return [][]interface{}{{int64(len(ids))}}, nil
+	case strings.HasPrefix(stmt, "SELECT sum(value)"):
+		sum := 0.0
+		for _, v := range vals {
+			sum += v
+		}
+		return [][]interface{}{{sum}}, nil
+	default:
+		max := vals[0]
+		for _, v := range vals[1:] {
+			if v > max {
+				max = v
+			}
+		}
+		return [][]interface{}{{max}}, nil
+	}
+}
+
+func TestQueryPlanWithServerAggregationBatchReads(t *testing.T) {
+	csi := newTestClientSideIndex(4, 2, "usage_user", "usage_system")
+	for _, aggr := range []string{"max", "sum", "count"} {
+		q := newTestHLQuery(aggr, "usage_user,usage_system", testStart, testStart.Add(2*day), 12*time.Hour)
+		qp, err := q.ToQueryPlanWithServerAggregation(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", aggr, err)
+		}
+		qe := &mockQueryExecutor{respond: batchRows}
+		want, err := qp.Execute(context.Background(), qe)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", aggr, err)
+		}
+		if got := qe.Calls(); got != 4*4*2 {
+			t.Fatalf("%s: incorrect number of CQL queries: got %d want %d", aggr, got, 4*4*2)
+		}
+
+		if !qp.BatchReads() {
+			t.Fatalf("%s: queries not batched", aggr)
+		}
+		for _, cq := range qp.AllCQLQueries() {
+			if !strings.Contains(cq.PreparableQueryString, "series_id IN ?") {
+				t.Errorf("%s: query not rewritten: %s", aggr, cq.PreparableQueryString)
+			}
+			if got := len(cq.Args[0].([]string)); got != 4 {
+				t.Errorf("%s: incorrect number of batched series: got %d want %d", aggr, got, 4)
+			}
+		}
+		qe = &mockQueryExecutor{respond: batchRows}
+		got, err := qp.Execute(context.Background(), qe)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", aggr, err)
+		}
+		// one query per time bucket and field:
+		if got := qe.Calls(); got != 4*2 {
+			t.Errorf("%s: incorrect number of batched CQL queries: got %d want %d", aggr, got, 4*2)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: batched results differ:\ngot\n%v\nwant\n%v", aggr, got, want)
+		}
+	}
+
+	q := newTestHLQuery("avg", "usage_user", testStart, testStart.Add(day), time.Hour)
+	qp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("avg: unexpected error: %v", err)
+	}
+	if qp.BatchReads() {
+		t.Errorf("avg: queries batched")
+	}
+	for _, cq := range qp.AllCQLQueries() {
+		if strings.Contains(cq.PreparableQueryString, " IN ") {
+			t.Errorf("avg: query rewritten: %s", cq.PreparableQueryString)
+		}
+	}
+}
+
+func TestQueryPlanPerMeasurement(t *testing.T) {
+	// cpu has data on the 1st, mem on the 2nd
+	csi := NewClientSideIndex([]Series{
+		NewSeries(testTable, "cpu,hostname=host_0#usage_user#2016-01-01"),
+		NewSeries(testTable, "cpu,hostname=host_1#usage_user#2016-01-01"),
+		NewSeries(testTable, "mem,hostname=host_0#usage_user#2016-01-02"),
+	})
+	q := newTestHLQuery("count", "usage_user", testStart, testStart.Add(2*day), day)
+	q.MeasurementName = []byte("cpu,mem")
+
+	type bucket struct {
+		measurement string
+		start       time.Time
+		count       float64
+	}
+	want := []bucket{
+		{"cpu", testStart, 6},
+		{"cpu", testStart.Add(day), 0},
+		{"mem", testStart, 0},
+		{"mem", testStart.Add(day), 3},
+	}
+	for _, plan := range []int{AggrPlanTypeWithServerAggregation, AggrPlanTypeWithoutServerAggregation} {
+		hlqe := NewHLQueryExecutor(nil, csi, 0)
+		qp, err := hlqe.queryPlan(q, HLQueryExecutorDoOptions{AggregationPlan: plan})
+		if err != nil {
+			t.Fatalf("plan %d: unexpected error: %v", plan, err)
+		}
+		if _, ok := qp.(*QueryPlanPerMeasurement); !ok {
+			t.Fatalf("plan %d: incorrect plan type: got %T", plan, qp)
+		}
+		results, err := qp.Execute(context.Background(), &mockQueryExecutor{respond: countRows})
+		if err != nil {
+			t.Fatalf("plan %d: unexpected error: %v", plan, err)
+		}
+		got := make([]bucket, len(results))
+		for i, r := range results {
+			got[i] = bucket{r.Measurement, r.Start(), r.Values[0]}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("plan %d: incorrect buckets:\ngot\n%v\nwant\n%v", plan, got, want)
+		}
+	}
+
+	// a single measurement is planned as before:
+	q.MeasurementName = []byte("cpu")
+	qp, err := NewHLQueryExecutor(nil, csi, 0).queryPlan(q, HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithServerAggregation})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := qp.(*QueryPlanWithServerAggregation); !ok {
+		t.Errorf("incorrect plan type: got %T", qp)
+	}
+}
+
+func TestQueryPlanPerTagGroup(t *testing.T) {
+	// host_0 has data on the 1st and 2nd, host_1 on the 1st only
+	csi := NewClientSideIndex([]Series{
+		NewSeries(testTable, "cpu,hostname=host_0,region=eu#usage_user#2016-01-01"),
+		NewSeries(testTable, "cpu,hostname=host_0,region=eu#usage_user#2016-01-02"),
+		NewSeries(testTable, "cpu,hostname=host_1,region=eu#usage_user#2016-01-01"),
+	})
+	q := newTestHLQuery("count", "usage_user", testStart, testStart.Add(2*day), day)
+	q.GroupByTagKeys = []byte("hostname")
+
+	type bucket struct {
+		tags  string
+		start time.Time
+		count float64
+	}
+	want := []bucket{
+		{"hostname=host_0", testStart, 3},
+		{"hostname=host_0", testStart.Add(day), 3},
+		{"hostname=host_1", testStart, 3},
+		{"hostname=host_1", testStart.Add(day), 0},
+	}
+	for _, plan := range []int{AggrPlanTypeWithServerAggregation, AggrPlanTypeWithoutServerAggregation} {
+		hlqe := NewHLQueryExecutor(nil, csi, 0)
+		qp, err := hlqe.queryPlan(q, HLQueryExecutorDoOptions{AggregationPlan: plan})
+		if err != nil {
+			t.Fatalf("plan %d: unexpected error: %v", plan, err)
+		}
+		if _, ok := qp.(*QueryPlanPerTagGroup); !ok {
+			t.Fatalf("plan %d: incorrect plan type: got %T", plan, qp)
+		}
+		results, err := qp.Execute(context.Background(), &mockQueryExecutor{respond: countRows})
+		if err != nil {
+			t.Fatalf("plan %d: unexpected error: %v", plan, err)
+		}
+		got := make([]bucket, len(results))
+		for i, r := range results {
+			got[i] = bucket{strings.Join(r.Tags, ","), r.Start(), r.Values[0]}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("plan %d: incorrect buckets:\ngot\n%v\nwant\n%v", plan, got, want)
+		}
+	}
+
+	// several keys group by each combination of their values:
+	q.GroupByTagKeys = []byte("region,hostname")
+	groups, series, err := csi.tagGroups(q, q.GroupByTags())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantGroups := [][]string{{"region=eu", "hostname=host_0"}, {"region=eu", "hostname=host_1"}}
+	if !reflect.DeepEqual(groups, wantGroups) {
+		t.Errorf("incorrect tag groups: got %v want %v", groups, wantGroups)
+	}
+	// with the series of each group, of both days for host_0:
+	for i, want := range []int{2, 1} {
+		if len(series[i]) != want {
+			t.Errorf("group %v: incorrect number of series: got %d want %d", wantGroups[i], len(series[i]), want)
+		}
+		for _, s := range series[i] {
+			for _, tag := range wantGroups[i] {
+				if _, ok := s.Tags[tag]; !ok {
+					t.Errorf("group %v: incorrect series %s", wantGroups[i], s.Id)
+				}
+			}
+		}
+	}
+}
+
+func TestQueryPlanTrace(t *testing.T) {
+	csi := newTestClientSideIndex(3, 2, "usage_user")
+	empty := "cpu,hostname=host_1#usage_user#2016-01-02"
+	// countRows, except that the empty series has no rows:
+	respond := func(stmt string, args []interface{}) ([][]interface{}, error) {
+		if args[0] == empty {
+			return countRows(stmt, append([]interface{}{args[0]}, int64(0), int64(0)))
+		}
+		return countRows(stmt, args)
+	}
+	q := newTestHLQuery("count", "usage_user", testStart, testStart.Add(2*day), day)
+	q.TagSets = [][]string{{"hostname=host_0", "hostname=host_1"}}
+
+	for _, plan := range []int{AggrPlanTypeWithServerAggregation, AggrPlanTypeWithoutServerAggregation} {
+		hlqe := NewHLQueryExecutor(nil, csi, 0)
+		for _, trace := range []bool{false, true} {
+			qp, err := hlqe.plan(q, HLQueryExecutorDoOptions{AggregationPlan: plan, Trace: trace})
+			if err != nil {
+				t.Fatalf("plan %d: unexpected error: %v", plan, err)
+			}
+			// the series selected by the plan that have rows, by day:
+			want := map[string][]string{}
+			for _, cq := range qp.AllCQLQueries() {
+				if id := cq.Args[0].(string); id != empty {
+					d := strings.Split(id, "#")[2]
+					want[d] = append(want[d], id)
+				}
+			}
+
+			results, err := qp.Execute(context.Background(), &mockQueryExecutor{respond: respond})
+			if err != nil {
+				t.Fatalf("plan %d: unexpected error: %v", plan, err)
+			}
+			if len(results) != 2 {
+				t.Fatalf("plan %d: incorrect number of results: got %d want %d", plan, len(results), 2)
+			}
+			for _, r := range results {
+				if !trace {
+					if r.SeriesIds != nil {
+						t.Errorf("plan %d: series ids set without trace: %v", plan, r.SeriesIds)
+					}
+					continue
+				}
+				d := r.Start().Format(BucketTimeLayout)
+				sort.Strings(want[d])
+				if !reflect.DeepEqual(r.SeriesIds, want[d]) {
+					t.Errorf("plan %d: %s: incorrect series ids: got %v want %v", plan, d, r.SeriesIds, want[d])
+				}
+			}
+		}
+	}
+}
+
+// boundaryRows mocks the rows of series with a point at 0h and 12h into
+// each of their days, honoring both time range conditions (see
+// cqlTimeRange).
+func boundaryRows(stmt string, args []interface{}) ([][]interface{}, error) {
+	day, err := time.Parse(BucketTimeLayout, strings.Split(args[0].(string), "#")[2])
+	if err != nil {
+		return nil, err
+	}
+	start, end := args[1].(int64), args[2].(int64)
+	rows := [][]interface{}{}
+	for _, h := range []int{0, 12} {
+		ts := day.Add(time.Duration(h) * time.Hour).UnixNano()
+		if ts >= start && (ts < end || ts == end && strings.Contains(stmt, " <= ?")) {
+			rows = append(rows, []interface{}{ts, 1.0})
+		}
+	}
+	if strings.HasPrefix(stmt, "SELECT count(value)") {
+		return [][]interface{}{{int64(len(rows))}}, nil
+	}
+	return rows, nil
+}
+
+func TestInclusiveEnd(t *testing.T) {
+	defer func(b bool) { inclusiveEnd = b }(inclusiveEnd)
+
+	// the point at the end, 2016-01-02T00:00, is in the row of 2016-01-02:
+	csi := newTestClientSideIndex(1, 2, "usage_user")
+	cases := []struct {
+		desc       string
+		inclusive  bool
+		wantCounts []float64 // of the 12h buckets
+		wantPoints int       // of the raw query
+	}{
+		{desc: "exclusive end", wantCounts: []float64{1, 1}, wantPoints: 2},
+		{desc: "inclusive end", inclusive: true, wantCounts: []float64{1, 2}, wantPoints: 3},
+	}
+	for _, c := range cases {
+		inclusiveEnd = c.inclusive
+		q := newTestHLQuery("count", "usage_user", testStart, testStart.Add(day), 12*time.Hour)
+		plans := map[string]func() (QueryPlan, error){
+			"server": func() (QueryPlan, error) { return q.ToQueryPlanWithServerAggregation(csi) },
+			"client": func() (QueryPlan, error) { return q.ToQueryPlanWithoutServerAggregation(csi) },
+		}
+		for name, plan := range plans {
+			qp, err := plan()
+			if err != nil {
+				t.Fatalf("%s: %s: unexpected error: %v", c.desc, name, err)
+			}
+			results, err := qp.Execute(context.Background(), &mockQueryExecutor{respond: boundaryRows})
+			if err != nil {
+				t.Fatalf("%s: %s: unexpected error: %v", c.desc, name, err)
+			}
+			sort.Slice(results, func(i, j int) bool { return results[i].Start().Before(results[j].Start()) })
+			got := make([]float64, len(results))
+			for i, r := range results {
+				got[i] = r.Values[0]
+			}
+			if !reflect.DeepEqual(got, c.wantCounts) {
+				t.Errorf("%s: %s: incorrect counts: got %v want %v", c.desc, name, got, c.wantCounts)
+			}
+		}
+
+		rq := newTestHLQuery("", "usage_user", testStart, testStart.Add(day), 0)
+		qp, err := rq.ToQueryPlanRaw(csi)
+		if err != nil {
+			t.Fatalf("%s: raw: unexpected error: %v", c.desc, err)
+		}
+		results, err := qp.Execute(context.Background(), &mockQueryExecutor{respond: boundaryRows})
+		if err != nil {
+			t.Fatalf("%s: raw: unexpected error: %v", c.desc, err)
+		}
+		if got := len(results[0].Points); got != c.wantPoints {
+			t.Errorf("%s: raw: incorrect number of points: got %d want %d", c.desc, got, c.wantPoints)
+		}
+		if got := qp.CQLQueries[0][0].PreparableQueryString; strings.Contains(got, "timestamp_ns <= ?") != c.inclusive {
+			t.Errorf("%s: incorrect CQL: %s", c.desc, got)
+		}
+	}
+}
+
+func TestTimeWeightedAvg(t *testing.T) {
+	defer func(b bool) { timeWeightedAvg = b }(timeWeightedAvg)
+
+	// the average of the row of 2016-01-01 is 10, and of 2016-01-02, 40:
+	dayAvgRows := func(_ string, args []interface{}) ([][]interface{}, error) {
+		if strings.HasSuffix(args[0].(string), "#2016-01-01") {
+			return [][]interface{}{{10.0}}, nil
+		}
+		return [][]interface{}{{40.0}}, nil
+	}
+
+	// the 3-day bucket from 2016-01-01 is clamped to the query, from
+	// 2016-01-01T12:00 to 2016-01-03, so that it covers 12 hours of the
+	// first row and 24 hours of the second:
+	csi := newTestClientSideIndex(1, 2, "usage_user")
+	cases := []struct {
+		desc     string
+		weighted bool
+		want     float64
+	}{
+		{desc: "unweighted", want: 25},
+		{desc: "weighted", weighted: true, want: 30},
+	}
+	for _, c := range cases {
+		timeWeightedAvg = c.weighted
+		q := newTestHLQuery("avg", "usage_user", testStart.Add(12*time.Hour), testStart.Add(2*day), 3*day)
+		qp, err := q.ToQueryPlanWithServerAggregation(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		results, err := qp.Execute(context.Background(), &mockQueryExecutor{respond: dayAvgRows})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if len(results) != 1 {
+			t.Fatalf("%s: incorrect number of results: got %d want 1", c.desc, len(results))
+		}
+		if got := results[0].Values[0]; got != c.want {
+			t.Errorf("%s: incorrect average: got %v want %v", c.desc, got, c.want)
+		}
+	}
+}
+
+func TestQueryPlanCardinality(t *testing.T) {
+	// host_3 only has data on the first day
+	csi := NewClientSideIndex(append(newTestClientSideIndex(3, 3, "usage_user", "usage_system").seriesCollection,
+		NewSeries(testTable, "cpu,hostname=host_3#usage_user#2016-01-01"),
+	))
+	cases := []struct {
+		desc    string
+		fields  string
+		tagsets [][]string
+		start   time.Time
+		end     time.Time
+		want    int
+	}{
+		{desc: "all series", fields: "usage_user", start: testStart, end: testStart.Add(3 * day), want: 4},
+		{desc: "several fields", fields: "usage_user,usage_system", start: testStart, end: testStart.Add(3 * day), want: 7},
+		{desc: "time range", fields: "usage_user", start: testStart.Add(day), end: testStart.Add(3 * day), want: 3},
+		{desc: "tagsets", fields: "usage_user", tagsets: [][]string{{"hostname=host_0", "hostname=host_3"}}, start: testStart, end: testStart.Add(3 * day), want: 2},
+		{desc: "tagsets and time range", fields: "usage_user", tagsets: [][]string{{"hostname=host_0", "hostname=host_3"}}, start: testStart.Add(day), end: testStart.Add(2 * day), want: 1},
+		{desc: "no series", fields: "usage_user", tagsets: [][]string{{"hostname=host_9"}}, start: testStart, end: testStart.Add(day), want: 0},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery("cardinality", c.fields, c.start, c.end, 0)
+		q.TagSets = c.tagsets
+		qe := &mockQueryExecutor{respond: countRows}
+		hlqe := NewHLQueryExecutor(qe, csi, 0)
+		qp, err := hlqe.plan(q, HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithServerAggregation})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if _, ok := qp.(*QueryPlanCardinality); !ok {
+			t.Fatalf("%s: incorrect query plan: got %T", c.desc, qp)
+		}
+		results, err := qp.Execute(context.Background(), qe)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if got := len(results); got != 1 {
+			t.Fatalf("%s: incorrect number of results: got %d want %d", c.desc, got, 1)
+		}
+		if got := results[0].Values; !reflect.DeepEqual(got, []float64{float64(c.want)}) {
+			t.Errorf("%s: incorrect cardinality: got %v want %d", c.desc, got, c.want)
+		}
+		if !results[0].Start().Equal(c.start) || !results[0].End().Equal(c.end) {
+			t.Errorf("%s: incorrect time range: got [%s, %s]", c.desc, results[0].Start(), results[0].End())
+		}
+		if got := qe.Calls(); got != 0 {
+			t.Errorf("%s: incorrect number of CQL queries: got %d want %d", c.desc, got, 0)
+		}
+	}
+
+	// the same series in several keyspaces are distinct:
+	series := []Series{
+		NewSeries(testTable, "cpu,hostname=host_0#usage_user#2016-01-01"),
+		NewSeries(testTable, "cpu,hostname=host_0#usage_user#2016-01-01"),
+		NewSeries(testTable, "cpu,hostname=host_0#usage_user#2016-01-02"),
+	}
+	series[0].Keyspace, series[1].Keyspace, series[2].Keyspace = "tenant_0", "tenant_1", "tenant_1"
+	q := newTestHLQuery("cardinality", "usage_user", testStart, testStart.Add(2*day), 0)
+	qp, err := q.ToQueryPlanCardinality(NewClientSideIndex(series))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if qp.Count != 2 || qp.Matched != 3 {
+		t.Errorf("incorrect cardinality of keyspaces: got %d series (%d rows) want 2 (3 rows)", qp.Count, qp.Matched)
+	}
+}
+
+// latestRows mocks the latest point of a series, at an hour of its day
+// derived from its host: host_0 and host_2 share the same one.
+func latestRows(_ string, args []interface{}) ([][]interface{}, error) {
+	parts := strings.Split(args[0].(string), "#")
+	day, err := time.Parse(BucketTimeLayout, parts[2])
+	if err != nil {
+		return nil, err
+	}
+	var h int
+	if _, err := fmt.Sscanf(parts[0], "cpu,hostname=host_%d,", &h); err != nil {
+		return nil, err
+	}
+	ts := day.Add(time.Duration(3-h%2) * time.Hour).UnixNano()
+	return [][]interface{}{{ts, float64(h)}}, nil
+}
+
+func TestQueryPlanResultOrder(t *testing.T) {
+	series := []Series{}
+	for h := 3; h >= 0; h-- {
+		id := fmt.Sprintf("cpu,hostname=host_%d,region=eu#usage_user#2016-01-01", h)
+		series = append(series, NewSeries(testTable, id))
+	}
+	csi := NewClientSideIndex(series)
+	q := newTestHLQuery("", "usage_user", testStart, testStart.Add(day), 0)
+	q.ForEveryN = []byte("hostname,1")
+	qp, err := q.ToQueryPlanForEvery(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// results are ordered by time, then by host, whatever the iteration
+	// order of the maps they are collected in:
+	var want []CQLResult
+	for i := 0; i < 20; i++ {
+		got, err := qp.Execute(context.Background(), &mockQueryExecutor{respond: latestRows})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want == nil {
+			want = got
+			var values []float64
+			for _, r := range got {
+				values = append(values, r.Values...)
+			}
+			if !reflect.DeepEqual(values, []float64{1, 3, 0, 2}) {
+				t.Fatalf("incorrect result order: got %v want %v", values, []float64{1, 3, 0, 2})
+			}
+		} else if !reflect.DeepEqual(got, want) {
+			t.Fatalf("results in a different order:\ngot\n%v\nwant\n%v", got, want)
+		}
+	}
+
+	// the buckets of a client aggregation read latest first are returned
+	// in time order too:
+	q = newTestHLQuery("max", "usage_user", testStart, testStart.Add(day), 6*time.Hour)
+	q.OrderBy = []byte("timestamp_ns DESC")
+	cqp, err := q.ToQueryPlanWithoutServerAggregation(newTestClientSideIndex(1, 1, "usage_user"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	results, err := cqp.Execute(context.Background(), &mockQueryExecutor{respond: countRows})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !sort.SliceIsSorted(results, func(i, j int) bool { return results[i].Start().Before(results[j].Start()) }) {
+		t.Errorf("client: buckets not in time order: %v", results)
+	}
+}
+
+func TestSkipEmpty(t *testing.T) {
+	// points at 1h, 2h and 3h into the first of three days:
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	wantStarts := []time.Time{testStart.Add(time.Hour), testStart.Add(2 * time.Hour), testStart.Add(3 * time.Hour)}
+	cases := []struct {
+		desc string
+		aggr string
+		plan int
+	}{
+		{desc: "server count", aggr: "count", plan: AggrPlanTypeWithServerAggregation},
+		{desc: "client count", aggr: "count", plan: AggrPlanTypeWithoutServerAggregation},
+		{desc: "client max", aggr: "max", plan: AggrPlanTypeWithoutServerAggregation},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery(c.aggr, "usage_user", testStart, testStart.Add(3*day), time.Hour)
+		for _, skip := range []bool{false, true} {
+			hlqe := NewHLQueryExecutor(&mockQueryExecutor{respond: countRows}, csi, 0)
+			qp, err := hlqe.queryPlan(q, HLQueryExecutorDoOptions{AggregationPlan: c.plan, SkipEmpty: skip})
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", c.desc, err)
+			}
+			results, err := qp.Execute(context.Background(), hlqe.session)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", c.desc, err)
+			}
+			if !skip {
+				if got := len(results); got != 72 {
+					t.Errorf("%s: incorrect number of buckets without -skip-empty: got %d want %d", c.desc, got, 72)
+				}
+				continue
+			}
+			got := make([]time.Time, len(results))
+			for i, r := range results {
+				got[i] = r.Start()
+				if r.Values[0] != 1 || r.IsAbsent(0) {
+					t.Errorf("%s: incorrect value at %s: got %v", c.desc, r.Start(), r.Values[0])
+				}
+			}
+			if !reflect.DeepEqual(got, wantStarts) {
+				t.Errorf("%s: incorrect buckets:\ngot\n%v\nwant\n%v", c.desc, got, wantStarts)
+			}
+		}
+	}
+}
+
+func TestGroupLimit(t *testing.T) {
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	hours := func(hs ...int) []time.Time {
+		starts := make([]time.Time, len(hs))
+		for i, h := range hs {
+			starts[i] = testStart.Add(time.Duration(h) * time.Hour)
+		}
+		return starts
+	}
+	cases := []struct {
+		desc    string
+		orderBy string
+		limit   int
+		want    []time.Time
+	}{
+		{desc: "from start", limit: 3, want: hours(0, 1, 2)},
+		{desc: "from end", orderBy: "timestamp_ns DESC", limit: 3, want: hours(21, 22, 23)},
+		{desc: "from end, in lower case", orderBy: "timestamp_ns  desc", limit: 3, want: hours(21, 22, 23)},
+		{desc: "larger than the buckets", orderBy: "timestamp_ns DESC", limit: 30, want: hours(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23)},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery("count", "usage_user", testStart, testStart.Add(day), time.Hour)
+		q.OrderBy = []byte(c.orderBy)
+		q.GroupLimit = c.limit
+		for _, plan := range []int{AggrPlanTypeWithServerAggregation, AggrPlanTypeWithoutServerAggregation} {
+			qe := &mockQueryExecutor{respond: countRows}
+			hlqe := NewHLQueryExecutor(qe, csi, 0)
+			qp, err := hlqe.queryPlan(q, HLQueryExecutorDoOptions{AggregationPlan: plan})
+			if err != nil {
+				t.Fatalf("%s: plan %d: unexpected error: %v", c.desc, plan, err)
+			}
+			results, err := qp.Execute(context.Background(), qe)
+			if err != nil {
+				t.Fatalf("%s: plan %d: unexpected error: %v", c.desc, plan, err)
+			}
+			got := make([]time.Time, len(results))
+			for i, r := range results {
+				got[i] = r.Start()
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%s: plan %d: incorrect buckets:\ngot\n%v\nwant\n%v", c.desc, plan, got, c.want)
+			}
+			// the limit is pushed down to the buckets executed, or to the
+			// time range read:
+			if plan == AggrPlanTypeWithServerAggregation && qe.Calls() != len(c.want) {
+				t.Errorf("%s: incorrect number of CQL queries: got %d want %d", c.desc, qe.Calls(), len(c.want))
+			}
+			if plan == AggrPlanTypeWithoutServerAggregation {
+				cqp := qp.(*QueryPlanWithoutServerAggregation)
+				want := []interface{}{c.want[0].UnixNano(), c.want[len(c.want)-1].Add(time.Hour).UnixNano()}
+				if got := cqp.CQLQueries[0].Args[1:3]; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: incorrect time range read: got %v want %v", c.desc, got, want)
+				}
+			}
+		}
+	}
+}
+
+// hourlyRows mocks a point of value 1 at each hour of each day of a series,
+// honoring ORDER BY ... DESC.
+func hourlyRows(stmt string, args []interface{}) ([][]interface{}, error) {
+	day, err := time.Parse(BucketTimeLayout, strings.Split(args[0].(string), "#")[2])
+	if err != nil {
+		return nil, err
+	}
+	start, end := args[1].(int64), args[2].(int64)
+	rows := [][]interface{}{}
+	for h := 0; h < 24; h++ {
+		if ts := day.Add(time.Duration(h) * time.Hour).UnixNano(); ts >= start && ts < end {
+			rows = append(rows, []interface{}{ts, 1.0})
+		}
+	}
+	if strings.Contains(stmt, " DESC") {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+	return rows, nil
+}
+
+// scanCountingExecutor is a QueryExecutor counting the rows scanned from the
+// results of its QueryExecutor.
+type scanCountingExecutor struct {
+	QueryExecutor
+	scans int
+}
+
+func (e *scanCountingExecutor) Query(ctx context.Context, stmt string, args ...interface{}) ResultIter {
+	return &scanCountingIter{ResultIter: e.QueryExecutor.Query(ctx, stmt, args...), scans: &e.scans}
+}
+
+type scanCountingIter struct {
+	ResultIter
+	scans *int
+}
+
+func (it *scanCountingIter) Scan(dest ...interface{}) bool {
+	ok := it.ResultIter.Scan(dest...)
+	if ok {
+		*it.scans++
+	}
+	return ok
+}
+
+func TestQueryPlanWithoutServerAggregationStopsReading(t *testing.T) {
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	bucket := func(from, to int) *utils.TimeInterval {
+		ti, err := utils.NewTimeInterval(testStart.Add(time.Duration(from)*time.Hour), testStart.Add(time.Duration(to)*time.Hour))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return ti
+	}
+	cases := []struct {
+		desc      string
+		limit     int
+		buckets   []*utils.TimeInterval
+		wantCount []float64
+		wantScans int
+	}{
+		{
+			// the rows of 9h, 8h and 7h only, as the CQL queries are
+			// limited to those buckets:
+			desc:      "group limit",
+			limit:     3,
+			wantCount: []float64{1, 1, 1},
+			wantScans: 3,
+		},
+		{
+			// the rows from 5h to 2h, past the gap at 4h and 3h:
+			desc:      "explicit buckets",
+			buckets:   []*utils.TimeInterval{bucket(2, 3), bucket(5, 6)},
+			wantCount: []float64{1, 1},
+			wantScans: 4,
+		},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery("count", "usage_user", testStart, testStart.Add(10*time.Hour), time.Hour)
+		q.OrderBy = []byte("timestamp_ns DESC")
+		q.GroupLimit = c.limit
+		q.TimeBuckets = c.buckets
+		qp, err := q.ToQueryPlanWithoutServerAggregation(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		qe := &scanCountingExecutor{QueryExecutor: &mockQueryExecutor{respond: hourlyRows}}
+		results, err := qp.Execute(context.Background(), qe)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		got := make([]float64, len(results))
+		for i, r := range results {
+			got[i] = r.Values[0]
+		}
+		if !reflect.DeepEqual(got, c.wantCount) {
+			t.Errorf("%s: incorrect counts: got %v want %v", c.desc, got, c.wantCount)
+		}
+		if qe.scans != c.wantScans {
+			t.Errorf("%s: incorrect number of rows scanned: got %d want %d", c.desc, qe.scans, c.wantScans)
+		}
+	}
+}
+
+func TestCountAll(t *testing.T) {
+	// points at 1h, 2h and 3h into the only day; the slots of 30m expect
+	// twice as many, and none after the day:
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	cases := []struct {
+		desc  string
+		start time.Time
+		end   time.Time
+		want  map[string][]float64
+	}{
+		{
+			desc:  "gaps within the day",
+			start: testStart,
+			end:   testStart.Add(5 * time.Hour),
+			want: map[string][]float64{
+				"count_nonnull": {0, 1, 1, 1, 0},
+				"count_all":     {2, 2, 2, 2, 2},
+			},
+		},
+		{
+			desc:  "unaligned start",
+			start: testStart.Add(10 * time.Minute),
+			end:   testStart.Add(2 * time.Hour),
+			want: map[string][]float64{
+				"count_nonnull": {0, 1},
+				"count_all":     {1, 2},
+			},
+		},
+		{
+			desc:  "no series row",
+			start: testStart.Add(23 * time.Hour),
+			end:   testStart.Add(25 * time.Hour),
+			want: map[string][]float64{
+				"count_nonnull": {0, 0},
+				"count_all":     {2, 0},
+			},
+		},
+	}
+	for _, c := range cases {
+		for _, aggr := range []string{"count_nonnull", "count_all"} {
+			q := newTestHLQuery(aggr, "usage_user", c.start, c.end, time.Hour)
+			qe := &mockQueryExecutor{respond: countRows}
+			hlqe := NewHLQueryExecutor(qe, csi, 0)
+			qp, err := hlqe.queryPlan(q, HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithServerAggregation, SlotInterval: 30 * time.Minute})
+			if err != nil {
+				t.Fatalf("%s: %s: unexpected error: %v", c.desc, aggr, err)
+			}
+			results, err := qp.Execute(context.Background(), qe)
+			if err != nil {
+				t.Fatalf("%s: %s: unexpected error: %v", c.desc, aggr, err)
+			}
+			got := make([]float64, len(results))
+			for i, r := range results {
+				got[i] = r.Values[0]
+			}
+			if want := c.want[aggr]; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: incorrect %s: got %v want %v", c.desc, aggr, got, want)
+			}
+			if aggr == "count_all" && qe.Calls() != 0 {
+				t.Errorf("%s: incorrect number of CQL queries: got %d want %d", c.desc, qe.Calls(), 0)
+			}
+		}
+	}
+
+	q := newTestHLQuery("count_all", "usage_user", testStart, testStart.Add(time.Hour), time.Hour)
+	if _, err := q.ToQueryPlanCountAll(csi, 0); err == nil {
+		t.Errorf("expected an error for a zero slot interval")
+	}
+}
+
+func TestSumRate(t *testing.T) {
+	// 2 hosts over 2 days, with a point every 30 minutes; host_0 counts 1
+	// per second, host_1 2 per second but restarts from 0 at 3h:
+	csi := newTestClientSideIndex(2, 2, "usage_user")
+	counterRows := func(_ string, args []interface{}) ([][]interface{}, error) {
+		id := args[0].(string)
+		day, err := time.Parse(BucketTimeLayout, strings.Split(id, "#")[2])
+		if err != nil {
+			return nil, err
+		}
+		start, end := args[1].(int64), args[2].(int64)
+		rows := [][]interface{}{}
+		for ts := day; ts.Before(day.Add(24 * time.Hour)); ts = ts.Add(30 * time.Minute) {
+			if ts.UnixNano() < start || ts.UnixNano() >= end {
+				continue
+			}
+			elapsed := ts.Sub(testStart)
+			v := elapsed.Seconds()
+			if strings.HasPrefix(id, "cpu,hostname=host_1#") {
+				if elapsed >= 3*time.Hour {
+					elapsed -= 3 * time.Hour
+				}
+				v = 2 * elapsed.Seconds()
+			}
+			rows = append(rows, []interface{}{ts.UnixNano(), v})
+		}
+		return rows, nil
+	}
+
+	cases := []struct {
+		desc    string
+		start   time.Time
+		end     time.Time
+		groupBy time.Duration
+		want    []float64
+	}{
+		{
+			// in the second bucket, host_1 increases by 3600 twice over
+			// 5400s, as its reset counts as no increase:
+			desc:    "reset",
+			start:   testStart,
+			end:     testStart.Add(4 * time.Hour),
+			groupBy: 2 * time.Hour,
+			want:    []float64{3, 1 + 4.0/3},
+		},
+		{
+			// the rows of each series on both days make a single rate:
+			desc:  "across midnight",
+			start: testStart.Add(23 * time.Hour),
+			end:   testStart.Add(25 * time.Hour),
+			want:  []float64{3},
+		},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery("sum_rate", "usage_user", c.start, c.end, c.groupBy)
+		// rates are always aggregated by the client:
+		for _, plan := range []int{AggrPlanTypeWithServerAggregation, AggrPlanTypeWithoutServerAggregation} {
+			hlqe := NewHLQueryExecutor(&mockQueryExecutor{respond: counterRows}, csi, 0)
+			qp, err := hlqe.plan(q, HLQueryExecutorDoOptions{AggregationPlan: plan})
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", c.desc, err)
+			}
+			if _, ok := qp.(*QueryPlanWithoutServerAggregation); !ok {
+				t.Fatalf("%s: incorrect query plan: got %T", c.desc, qp)
+			}
+			results, err := qp.Execute(context.Background(), hlqe.session)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", c.desc, err)
+			}
+			if len(results) != len(c.want) {
+				t.Fatalf("%s: incorrect number of results: got %d want %d", c.desc, len(results), len(c.want))
+			}
+			for i, r := range results {
+				if got := r.Values[0]; got < c.want[i]-1e-9 || got > c.want[i]+1e-9 {
+					t.Errorf("%s: incorrect rate at %s: got %v want %v", c.desc, r.Start(), got, c.want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestShareAggregation(t *testing.T) {
+	defer func(m int) { zeroTotalShares = m }(zeroTotalShares)
+
+	// the sum of host_N is N+1 on each day, and 0 in the zero region:
+	sumRows := func(_ string, args []interface{}) ([][]interface{}, error) {
+		id := args[0].(string)
+		if strings.Contains(id, "region=zero") {
+			return [][]interface{}{{0.0}}, nil
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(strings.Split(strings.Split(id, "#")[0], ",")[1], "hostname=host_"))
+		if err != nil {
+			return nil, err
+		}
+		return [][]interface{}{{float64(n + 1)}}, nil
+	}
+	csi := newTestClientSideIndex(3, 2, "usage_user")
+	q := newTestHLQuery("share_sum", "usage_user", testStart, testStart.Add(2*day), 0)
+
+	// the client plan is overridden:
+	hlqe := NewHLQueryExecutor(nil, csi, 0)
+	qp, err := hlqe.queryPlan(q, HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithoutServerAggregation, BatchReads: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	results, err := qp.Execute(context.Background(), &mockQueryExecutor{respond: sumRows})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("incorrect number of results: got %d want 1", len(results))
+	}
+	r := results[0]
+	wantSeries := []string{"cpu,hostname=host_0#usage_user", "cpu,hostname=host_1#usage_user", "cpu,hostname=host_2#usage_user"}
+	if !reflect.DeepEqual(r.ValueSeries, wantSeries) {
+		t.Errorf("incorrect series: got %v want %v", r.ValueSeries, wantSeries)
+	}
+	total := 0.0
+	for i, v := range r.Values {
+		total += v
+		if want := float64(i+1) / 6; math.Abs(v-want) > 1e-9 {
+			t.Errorf("incorrect share of %s: got %v want %v", r.ValueSeries[i], v, want)
+		}
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("incorrect total of shares: got %v want 1", total)
+	}
+
+	// buckets whose total is zero:
+	zeroCSI := NewClientSideIndex([]Series{
+		NewSeries(testTable, "cpu,region=zero,hostname=host_0#usage_user#2016-01-01"),
+		NewSeries(testTable, "cpu,region=zero,hostname=host_1#usage_user#2016-01-01"),
+	})
+	for _, mode := range []int{ZeroTotalSharesNull, ZeroTotalSharesZero} {
+		zeroTotalShares = mode
+		qp, err := NewHLQueryExecutor(nil, zeroCSI, 0).queryPlan(q, HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithServerAggregation})
+		if err != nil {
+			t.Fatalf("mode %d: unexpected error: %v", mode, err)
+		}
+		results, err := qp.Execute(context.Background(), &mockQueryExecutor{respond: sumRows})
+		if err != nil {
+			t.Fatalf("mode %d: unexpected error: %v", mode, err)
+		}
+		r := results[0]
+		if len(r.Values) != 2 || r.Values[0] != 0 || r.Values[1] != 0 {
+			t.Errorf("mode %d: incorrect shares: got %v want [0 0]", mode, r.Values)
+		}
+		if absent := r.IsAbsent(0) && r.IsAbsent(1); absent != (mode == ZeroTotalSharesNull) {
+			t.Errorf("mode %d: incorrect absent shares: got %v", mode, r.Absent)
+		}
+	}
+}
@@ -0,0 +1,816 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/timescale/tsbs/internal/utils"
+	"github.com/timescale/tsbs/query"
+)
+
+const testTable = "series_double"
+
+// newTestHLQuery builds an HLQuery over the cpu measurement for the given
+// field (or comma-separated fields).
+func newTestHLQuery(aggr, field string, start, end time.Time, groupBy time.Duration) *HLQuery {
+	return &HLQuery{Cassandra: query.Cassandra{
+		HumanLabel:      []byte("test"),
+		MeasurementName: []byte("cpu"),
+		FieldName:       []byte(field),
+		AggregationType: []byte(aggr),
+		TimeStart:       start,
+		TimeEnd:         end,
+		GroupByDuration: groupBy,
+	}}
+}
+
+func sortedBucketKeys(m map[*utils.TimeInterval][]CQLQuery) []*utils.TimeInterval {
+	keys := make([]*utils.TimeInterval, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Sort(TimeIntervals(keys))
+	return keys
+}
+
+func TestToQueryPlanWithServerAggregationGaps(t *testing.T) {
+	// host_0 has data on the 1st and 3rd, but not on the 2nd
+	csi := NewClientSideIndex([]Series{
+		NewSeries(testTable, "cpu,hostname=host_0#usage_user#2016-01-01"),
+		NewSeries(testTable, "cpu,hostname=host_0#usage_user#2016-01-03"),
+	})
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(3 * 24 * time.Hour)
+
+	cases := []struct {
+		aggr         string
+		wantZeroFill bool
+	}{
+		{aggr: "min", wantZeroFill: false},
+		{aggr: "max", wantZeroFill: false},
+		{aggr: "avg", wantZeroFill: false},
+		{aggr: "sum", wantZeroFill: true},
+		{aggr: "count", wantZeroFill: true},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery(c.aggr, "usage_user", start, end, 24*time.Hour)
+		qp, err := q.ToQueryPlanWithServerAggregation(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.aggr, err)
+		}
+		if got := qp.ZeroFillEmpty; got != c.wantZeroFill {
+			t.Errorf("%s: incorrect zero fill: got %v want %v", c.aggr, got, c.wantZeroFill)
+		}
+
+		keys := sortedBucketKeys(qp.BucketedCQLQueries)
+		if got := len(keys); got != 3 {
+			t.Fatalf("%s: incorrect number of buckets: got %d want %d", c.aggr, got, 3)
+		}
+		wantCounts := []int{1, 0, 1}
+		for i, k := range keys {
+			if got := len(qp.BucketedCQLQueries[k]); got != wantCounts[i] {
+				t.Errorf("%s: incorrect CQLQuery count for bucket %d: got %d want %d", c.aggr, i, got, wantCounts[i])
+			}
+		}
+	}
+}
+
+func TestNewAggregatedCQLResult(t *testing.T) {
+	ti, err := utils.NewTimeInterval(time.Unix(0, 0), time.Unix(60, 0))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cases := []struct {
+		desc       string
+		aggr       string
+		puts       []float64
+		zeroFill   bool
+		wantValue  float64
+		wantAbsent bool
+	}{
+		{desc: "max with values", aggr: "max", puts: []float64{1, 3, 2}, wantValue: 3},
+		{desc: "min with values", aggr: "min", puts: []float64{4, -1}, wantValue: -1},
+		{desc: "max empty", aggr: "max", wantAbsent: true},
+		{desc: "min empty", aggr: "min", wantAbsent: true},
+		{desc: "avg empty", aggr: "avg", wantAbsent: true},
+		{desc: "sum empty", aggr: "sum", zeroFill: true, wantValue: 0},
+		{desc: "sum with values", aggr: "sum", puts: []float64{1.5, 2.5}, zeroFill: true, wantValue: 4},
+	}
+	for _, c := range cases {
+		aggr, err := GetAggregator(c.aggr)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		for _, v := range c.puts {
+			aggr.Put(v)
+		}
+		res := newAggregatedCQLResult(ti, []Aggregator{aggr}, c.zeroFill)
+		if got := res.IsAbsent(0); got != c.wantAbsent {
+			t.Errorf("%s: incorrect absent: got %v want %v", c.desc, got, c.wantAbsent)
+		}
+		if !c.wantAbsent && res.Values[0] != c.wantValue {
+			t.Errorf("%s: incorrect value: got %v want %v", c.desc, res.Values[0], c.wantValue)
+		}
+	}
+}
+
+func TestNewCQLQuery(t *testing.T) {
+	const id = "cpu,hostname=host_0#usage_user#2016-01-01"
+	cases := []struct {
+		desc    string
+		aggr    string
+		orderBy string
+		want    string
+	}{
+		{
+			desc: "server aggregation",
+			aggr: "max",
+			want: "SELECT max(value) FROM series_double WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ?",
+		},
+		{
+			desc: "percentile",
+			aggr: "p99",
+			want: "SELECT value FROM series_double WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ?",
+		},
+		{
+			desc: "stddev",
+			aggr: "stddev",
+			want: "SELECT value FROM series_double WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ?",
+		},
+		{
+			desc:    "no aggregation",
+			orderBy: "timestamp_ns DESC",
+			want:    "SELECT timestamp_ns, value FROM series_double WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ? ORDER BY timestamp_ns DESC",
+		},
+	}
+	for _, c := range cases {
+		q := NewCQLQuery(c.aggr, testTable, id, c.orderBy, 1, 2)
+		if got := q.PreparableQueryString; got != c.want {
+			t.Errorf("%s: incorrect CQL:\ngot\n%s\nwant\n%s", c.desc, got, c.want)
+		}
+		if got := len(q.Args); got != 3 {
+			t.Fatalf("%s: incorrect number of args: got %d want %d", c.desc, got, 3)
+		}
+		if q.Args[0] != id || q.Args[1] != int64(1) || q.Args[2] != int64(2) {
+			t.Errorf("%s: incorrect args: got %v", c.desc, q.Args)
+		}
+		if got := q.Field; got != "usage_user" {
+			t.Errorf("%s: incorrect field: got %s want %s", c.desc, got, "usage_user")
+		}
+	}
+}
+
+func TestNewRawCQLQuery(t *testing.T) {
+	const id = "cpu,hostname=host_0#usage_user#2016-01-01"
+	cases := []struct {
+		desc     string
+		orderBy  string
+		limit    int
+		want     string
+		wantArgs []interface{}
+	}{
+		{
+			desc:     "no limit",
+			orderBy:  "timestamp_ns",
+			want:     "SELECT timestamp_ns, value FROM series_double WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ? ORDER BY timestamp_ns",
+			wantArgs: []interface{}{id, int64(1), int64(2)},
+		},
+		{
+			desc:     "ascending",
+			orderBy:  "timestamp_ns ASC",
+			want:     "SELECT timestamp_ns, value FROM series_double WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ? ORDER BY timestamp_ns ASC",
+			wantArgs: []interface{}{id, int64(1), int64(2)},
+		},
+		{
+			desc:     "limit",
+			orderBy:  "timestamp_ns DESC",
+			limit:    5,
+			want:     "SELECT timestamp_ns, value FROM series_double WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ? ORDER BY timestamp_ns DESC LIMIT ?",
+			wantArgs: []interface{}{id, int64(1), int64(2), 5},
+		},
+	}
+	for _, c := range cases {
+		q := NewRawCQLQuery(testTable, id, c.orderBy, 1, 2, c.limit)
+		if got := q.PreparableQueryString; got != c.want {
+			t.Errorf("%s: incorrect CQL:\ngot\n%s\nwant\n%s", c.desc, got, c.want)
+		}
+		if !reflect.DeepEqual(q.Args, c.wantArgs) {
+			t.Errorf("%s: incorrect args: got %v want %v", c.desc, q.Args, c.wantArgs)
+		}
+		if got := q.Field; got != "usage_user" {
+			t.Errorf("%s: incorrect field: got %s want %s", c.desc, got, "usage_user")
+		}
+	}
+}
+
+func TestNewCQLQueryColumns(t *testing.T) {
+	defer func(v, ts string) { valueColumn, timestampColumn = v, ts }(valueColumn, timestampColumn)
+	valueColumn, timestampColumn = "reading", "ts"
+
+	const id = "cpu,hostname=host_0#usage_user#2016-01-01"
+	cases := []struct {
+		desc string
+		q    CQLQuery
+		want string
+	}{
+		{
+			desc: "server aggregation",
+			q:    NewCQLQuery("max", testTable, id, "", 1, 2),
+			want: "SELECT max(reading) FROM series_double WHERE series_id = ? AND ts >= ? AND ts < ?",
+		},
+		{
+			desc: "client aggregation",
+			q:    NewCQLQuery("p99", testTable, id, "", 1, 2),
+			want: "SELECT reading FROM series_double WHERE series_id = ? AND ts >= ? AND ts < ?",
+		},
+		{
+			desc: "no aggregation",
+			q:    NewCQLQuery("", testTable, id, "timestamp_ns DESC", 1, 2),
+			want: "SELECT ts, reading FROM series_double WHERE series_id = ? AND ts >= ? AND ts < ? ORDER BY ts DESC",
+		},
+		{
+			desc: "raw",
+			q:    NewRawCQLQuery(testTable, id, "timestamp_ns", 1, 2, 5),
+			want: "SELECT ts, reading FROM series_double WHERE series_id = ? AND ts >= ? AND ts < ? ORDER BY ts LIMIT ?",
+		},
+	}
+	for _, c := range cases {
+		if got := c.q.PreparableQueryString; got != c.want {
+			t.Errorf("%s: incorrect CQL:\ngot\n%s\nwant\n%s", c.desc, got, c.want)
+		}
+	}
+}
+
+func TestNewCQLQueryTemplate(t *testing.T) {
+	defer func(tmpl *template.Template) { cqlTemplate = tmpl }(cqlTemplate)
+	var err error
+	cqlTemplate, err = parseCQLTemplate("SELECT {{.Aggregation}} FROM {{.Table}} WHERE timestamp_ns < {{.TimeEnd}} AND timestamp_ns >= {{.TimeStart}} AND series_id = {{.SeriesID}} {{.OrderBy}} ALLOW FILTERING")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	const id = "cpu,hostname=host_0#usage_user#2016-01-01"
+	cases := []struct {
+		desc    string
+		aggr    string
+		orderBy string
+		want    string
+	}{
+		{
+			desc: "server aggregation",
+			aggr: "max",
+			want: "SELECT max(value) FROM series_double WHERE timestamp_ns < ? AND timestamp_ns >= ? AND series_id = ?  ALLOW FILTERING",
+		},
+		{
+			desc:    "no aggregation",
+			orderBy: "timestamp_ns DESC",
+			want:    "SELECT timestamp_ns, value FROM series_double WHERE timestamp_ns < ? AND timestamp_ns >= ? AND series_id = ? ORDER BY timestamp_ns DESC ALLOW FILTERING",
+		},
+	}
+	for _, c := range cases {
+		q := NewCQLQuery(c.aggr, testTable, id, c.orderBy, 1, 2)
+		if got := q.PreparableQueryString; got != c.want {
+			t.Errorf("%s: incorrect CQL:\ngot\n%s\nwant\n%s", c.desc, got, c.want)
+		}
+		// Args stay in their positions, for the plans:
+		if want := []interface{}{id, int64(1), int64(2)}; !reflect.DeepEqual(q.Args, want) {
+			t.Errorf("%s: incorrect args: got %v want %v", c.desc, q.Args, want)
+		}
+		if want := []interface{}{int64(2), int64(1), id}; !reflect.DeepEqual(q.BoundArgs(), want) {
+			t.Errorf("%s: incorrect bound args: got %v want %v", c.desc, q.BoundArgs(), want)
+		}
+	}
+
+	if q := NewRawCQLQuery(testTable, id, "timestamp_ns", 1, 2, 0); !reflect.DeepEqual(q.BoundArgs(), q.Args) {
+		t.Errorf("incorrect bound args without template: got %v want %v", q.BoundArgs(), q.Args)
+	}
+}
+
+func TestParseCQLTemplate(t *testing.T) {
+	cases := []struct {
+		desc string
+		text string
+	}{
+		{desc: "syntax", text: "SELECT {{.Aggregation FROM {{.Table}}"},
+		{desc: "unknown field", text: "SELECT {{.Aggregation}} FROM {{.Keyspace}}.{{.Table}} WHERE series_id = {{.SeriesID}}"},
+		{desc: "unnamed bind marker", text: "SELECT {{.Aggregation}} FROM {{.Table}} WHERE series_id = ? AND timestamp_ns >= {{.TimeStart}}"},
+	}
+	for _, c := range cases {
+		if _, err := parseCQLTemplate(c.text); err == nil {
+			t.Errorf("%s: expected an error", c.desc)
+		}
+	}
+}
+
+func TestNewCQLQueryTemplateError(t *testing.T) {
+	defer func(tmpl *template.Template) { cqlTemplate = tmpl }(cqlTemplate)
+	var err error
+	// valid for the aggregation checked at startup, but not for all:
+	cqlTemplate, err = parseCQLTemplate(`SELECT {{if eq .Aggregation "min(value)"}}{{.Aggregation.Name}}{{else}}{{.Aggregation}}{{end}} FROM {{.Table}} WHERE series_id = {{.SeriesID}} AND timestamp_ns >= {{.TimeStart}} AND timestamp_ns < {{.TimeEnd}}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	hlqe := NewHLQueryExecutor(&mockQueryExecutor{respond: serverAggregationRows}, csi, 0)
+	opts := HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithServerAggregation}
+	_, _, _, err = hlqe.Do(newTestHLQuery("min", "usage_user", testStart, testStart.Add(time.Hour), 0), opts)
+	if err == nil || !strings.Contains(err.Error(), "cannot render CQL template") {
+		t.Errorf("incorrect error: got %v", err)
+	}
+}
+
+func TestValidateCQLIdentifier(t *testing.T) {
+	for _, s := range []string{"value", "timestamp_ns", "Reading2"} {
+		if err := validateCQLIdentifier(s); err != nil {
+			t.Errorf("%q: unexpected error: %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "2value", "value; DROP TABLE series_double", "\"value\"", "value,ts", strings.Repeat("v", 49)} {
+		if err := validateCQLIdentifier(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestNewBatchedCQLQuery(t *testing.T) {
+	queries := []CQLQuery{
+		NewCQLQuery("max", testTable, "cpu,hostname=host_0#usage_user#2016-01-01", "", 1, 2),
+		NewCQLQuery("max", testTable, "cpu,hostname=host_1#usage_user#2016-01-01", "", 1, 2),
+	}
+	q := NewBatchedCQLQuery(queries)
+	want := "SELECT max(value) FROM series_double WHERE series_id IN ? AND timestamp_ns >= ? AND timestamp_ns < ?"
+	if got := q.PreparableQueryString; got != want {
+		t.Errorf("incorrect CQL:\ngot\n%s\nwant\n%s", got, want)
+	}
+	wantArgs := []interface{}{
+		[]string{"cpu,hostname=host_0#usage_user#2016-01-01", "cpu,hostname=host_1#usage_user#2016-01-01"},
+		int64(1),
+		int64(2),
+	}
+	if !reflect.DeepEqual(q.Args, wantArgs) {
+		t.Errorf("incorrect args: got %v want %v", q.Args, wantArgs)
+	}
+	if got := q.Field; got != "usage_user" {
+		t.Errorf("incorrect field: got %s want %s", got, "usage_user")
+	}
+}
+
+func TestIsRaw(t *testing.T) {
+	cases := []struct {
+		desc  string
+		aggr  string
+		every string
+		where string
+		want  bool
+	}{
+		{desc: "empty", want: true},
+		{desc: "none", aggr: "none", want: true},
+		{desc: "aggregation", aggr: "max"},
+		{desc: "for every", every: "hostname"},
+		{desc: "where clause", where: "value > 90"},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery(c.aggr, "usage_user", testStart, testStart.Add(time.Hour), 0)
+		q.ForEveryN = []byte(c.every)
+		q.WhereClause = []byte(c.where)
+		if got := q.IsRaw(); got != c.want {
+			t.Errorf("%s: incorrect IsRaw: got %v want %v", c.desc, got, c.want)
+		}
+	}
+}
+
+func TestToQueryPlanWithServerAggregationMultipleFields(t *testing.T) {
+	allFields := []string{"usage_user", "usage_system", "usage_idle", "usage_nice", "usage_iowait"}
+	csi := newTestClientSideIndex(2, 1, allFields...)
+	start := testStart
+	end := start.Add(time.Hour)
+
+	for _, n := range []int{2, 5} {
+		fields := allFields[:n]
+		q := newTestHLQuery("avg", strings.Join(fields, ","), start, end, time.Hour)
+		qp, err := q.ToQueryPlanWithServerAggregation(csi)
+		if err != nil {
+			t.Fatalf("%d fields: unexpected error: %v", n, err)
+		}
+		if !reflect.DeepEqual(qp.Fields, fields) {
+			t.Errorf("%d fields: incorrect fields: got %v want %v", n, qp.Fields, fields)
+		}
+		keys := sortedBucketKeys(qp.BucketedCQLQueries)
+		if len(keys) != 1 {
+			t.Fatalf("%d fields: incorrect number of buckets: got %d want %d", n, len(keys), 1)
+		}
+
+		// queries are grouped by field, in the order of the fields:
+		want := []CQLQuery{}
+		for _, f := range fields {
+			for h := 0; h < 2; h++ {
+				id := fmt.Sprintf("cpu,hostname=host_%d#%s#2016-01-01", h, f)
+				want = append(want, CQLQuery{
+					PreparableQueryString: "SELECT avg(value) FROM series_double WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ?",
+					Args:                  []interface{}{id, start.UnixNano(), end.UnixNano()},
+					Field:                 f,
+				})
+			}
+		}
+		if got := qp.BucketedCQLQueries[keys[0]]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%d fields: incorrect queries:\ngot\n%v\nwant\n%v", n, got, want)
+		}
+
+		// each field averages to its position in allFields:
+		qe := &mockQueryExecutor{respond: func(_ string, args []interface{}) ([][]interface{}, error) {
+			field := strings.Split(args[0].(string), "#")[1]
+			for i, f := range allFields {
+				if f == field {
+					return [][]interface{}{{float64(i)}}, nil
+				}
+			}
+			return nil, fmt.Errorf("unknown field %s", field)
+		}}
+		results, err := qp.Execute(context.Background(), qe)
+		if err != nil {
+			t.Fatalf("%d fields: unexpected error: %v", n, err)
+		}
+		wantValues := make([]float64, n)
+		for i := range wantValues {
+			wantValues[i] = float64(i)
+		}
+		if len(results) != 1 || !reflect.DeepEqual(results[0].Values, wantValues) {
+			t.Errorf("%d fields: incorrect results: got %v want values %v", n, results, wantValues)
+		}
+	}
+}
+
+// BenchmarkToQueryPlanWithServerAggregation compares query planning using
+// the (measurement, field) index of the ClientSideIndex with a scan of all
+// of its series, on 100k series.
+func BenchmarkToQueryPlanWithServerAggregation(b *testing.B) {
+	fields := []string{"usage_user", "usage_system", "usage_idle", "usage_nice", "usage_iowait",
+		"usage_irq", "usage_softirq", "usage_steal", "usage_guest", "usage_guest_nice"}
+	csi := newTestClientSideIndex(1000, 10, fields...)
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(12*time.Hour), time.Hour)
+	q.TagSets = [][]string{{"hostname=host_1", "hostname=host_9"}}
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := q.ToQueryPlanWithServerAggregation(csi); err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+		}
+	})
+	b.Run("full scan", func(b *testing.B) {
+		all := csi.CopyOfSeriesCollection()
+		for i := 0; i < b.N; i++ {
+			tagMatcher, err := NewTagSetMatcher(q.TagSets)
+			if err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+			matches := []Series{}
+			for _, s := range all {
+				if s.MatchesMeasurementName(string(q.MeasurementName)) && s.MatchesFieldName(string(q.FieldName)) && tagMatcher.Matches(&s) {
+					matches = append(matches, s)
+				}
+			}
+		}
+	})
+}
+
+// BenchmarkToQueryPlan measures the planning of server and client
+// aggregation queries over a day, by the number of series in the index
+// (of which the query matches a tenth) and of time buckets, reporting the
+// series matched.
+func BenchmarkToQueryPlan(b *testing.B) {
+	for _, hosts := range []int{100, 1000, 10000} {
+		csi := NewSyntheticClientSideIndex(testStart, hosts, 1, "usage_user")
+		tagset := make([]string, hosts/10)
+		for h := range tagset {
+			tagset[h] = fmt.Sprintf("hostname=host_%d", 10*h)
+		}
+		for _, buckets := range []int{1, 24, 1440} {
+			q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(day), day/time.Duration(buckets))
+			q.TagSets = [][]string{tagset}
+			b.Run(fmt.Sprintf("series=%d/buckets=%d/server", hosts, buckets), func(b *testing.B) {
+				var qp *QueryPlanWithServerAggregation
+				var err error
+				for i := 0; i < b.N; i++ {
+					if qp, err = q.ToQueryPlanWithServerAggregation(csi); err != nil {
+						b.Fatalf("unexpected error: %v", err)
+					}
+				}
+				b.ReportMetric(float64(len(planSeriesIds(qp))), "series-matched")
+			})
+			b.Run(fmt.Sprintf("series=%d/buckets=%d/client", hosts, buckets), func(b *testing.B) {
+				var qp *QueryPlanWithoutServerAggregation
+				var err error
+				for i := 0; i < b.N; i++ {
+					if qp, err = q.ToQueryPlanWithoutServerAggregation(csi); err != nil {
+						b.Fatalf("unexpected error: %v", err)
+					}
+				}
+				b.ReportMetric(float64(len(planSeriesIds(qp))), "series-matched")
+			})
+		}
+	}
+}
+
+// planSeriesIds returns the distinct series_ids read by a QueryPlan.
+func planSeriesIds(qp QueryPlan) seriesIDSet {
+	ids := seriesIDSet{}
+	for _, q := range qp.AllCQLQueries() {
+		ids.add(q)
+	}
+	return ids
+}
+
+// TestToQueryPlanAllocations keeps the planning of a small query within an
+// allocation budget, to catch regressions of the selection and bucketing of
+// series (see BenchmarkToQueryPlan).
+func TestToQueryPlanAllocations(t *testing.T) {
+	csi := NewSyntheticClientSideIndex(testStart, 100, 1, "usage_user", "usage_system")
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(day), time.Hour)
+	q.TagSets = [][]string{{"hostname=host_1", "hostname=host_2", "hostname=host_3"}}
+	cases := []struct {
+		desc   string
+		plan   func() (QueryPlan, error)
+		budget float64
+	}{
+		{desc: "server", plan: func() (QueryPlan, error) { return q.ToQueryPlanWithServerAggregation(csi) }, budget: 2500},
+		{desc: "client", plan: func() (QueryPlan, error) { return q.ToQueryPlanWithoutServerAggregation(csi) }, budget: 400},
+	}
+	for _, c := range cases {
+		qp, err := c.plan()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if got := len(planSeriesIds(qp)); got != 3 {
+			t.Errorf("%s: incorrect number of series matched: got %d want 3", c.desc, got)
+		}
+		allocs := testing.AllocsPerRun(10, func() { c.plan() })
+		if allocs > c.budget {
+			t.Errorf("%s: planning over its allocation budget: got %v allocations want at most %v", c.desc, allocs, c.budget)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		desc    string
+		start   time.Time
+		end     time.Time
+		groupBy time.Duration
+		orderBy string
+		limit   int
+		want    string
+	}{
+		{
+			desc:  "empty time range",
+			start: testStart,
+			end:   testStart,
+			want:  "invalid query: TimeStart 2016-01-01T00:00:00Z is not before TimeEnd 2016-01-01T00:00:00Z",
+		},
+		{
+			desc:  "reversed time range",
+			start: testStart.Add(time.Hour),
+			end:   testStart,
+			want:  "invalid query: TimeStart 2016-01-01T01:00:00Z is not before TimeEnd 2016-01-01T00:00:00Z",
+		},
+		{
+			desc:    "negative group by",
+			start:   testStart,
+			end:     testStart.Add(time.Hour),
+			groupBy: -time.Minute,
+			want:    "invalid query: negative GroupByDuration -1m0s",
+		},
+		{
+			desc:  "negative group limit",
+			start: testStart,
+			end:   testStart.Add(time.Hour),
+			limit: -1,
+			want:  "invalid query: negative GroupLimit -1",
+		},
+		{
+			desc:    "order by value",
+			start:   testStart,
+			end:     testStart.Add(time.Hour),
+			orderBy: "value DESC",
+			want:    `invalid query: unsupported ORDER BY "value DESC": points can only be ordered by timestamp_ns, ASC or DESC`,
+		},
+		{
+			desc:    "order by unknown direction",
+			start:   testStart,
+			end:     testStart.Add(time.Hour),
+			orderBy: "timestamp_ns DOWN",
+			want:    `invalid query: unsupported ORDER BY "timestamp_ns DOWN": points can only be ordered by timestamp_ns, ASC or DESC`,
+		},
+	}
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	for _, c := range cases {
+		q := newTestHLQuery("max", "usage_user", c.start, c.end, c.groupBy)
+		q.OrderBy = []byte(c.orderBy)
+		q.GroupLimit = c.limit
+		planners := map[string]func() error{
+			"server": func() error { _, err := q.ToQueryPlanWithServerAggregation(csi); return err },
+			"client": func() error { _, err := q.ToQueryPlanWithoutServerAggregation(csi); return err },
+			"none":   func() error { _, err := q.ToQueryPlanNoAggregation(csi); return err },
+			"every":  func() error { _, err := q.ToQueryPlanForEvery(csi); return err },
+			"raw":    func() error { _, err := q.ToQueryPlanRaw(csi); return err },
+			"last":   func() error { _, err := q.ToQueryPlanLastPoint(csi); return err },
+		}
+		for name, plan := range planners {
+			err := plan()
+			if _, ok := err.(*InvalidQueryError); !ok {
+				t.Errorf("%s: %s: incorrect error type: got %T (%v)", c.desc, name, err, err)
+				continue
+			}
+			if got := err.Error(); got != c.want {
+				t.Errorf("%s: %s: incorrect error: got %s want %s", c.desc, name, got, c.want)
+			}
+		}
+	}
+
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Hour), time.Minute)
+	if err := q.Validate(); err != nil {
+		t.Errorf("valid query: unexpected error: %v", err)
+	}
+
+	for _, field := range []string{"ForEveryN", "WhereClause"} {
+		q := newTestHLQuery("none", "usage_user", testStart, testStart.Add(time.Hour), 0)
+		if field == "ForEveryN" {
+			q.ForEveryN = []byte("hostname,1")
+		} else {
+			q.WhereClause = []byte("usage_user,>,90.0")
+		}
+		want := `invalid query: aggregation "none" cannot be combined with ForEveryN or WhereClause`
+		if err := q.Validate(); err == nil || err.Error() != want {
+			t.Errorf("none with %s: incorrect error: got %v want %s", field, err, want)
+		}
+	}
+}
+
+func TestTimeIntervals(t *testing.T) {
+	if got := timeIntervals(nil); got != nil {
+		t.Errorf("no buckets: incorrect intervals: got %v want nil", got)
+	}
+
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(24*time.Hour), 0)
+	q.TimeBuckets = timeIntervals([][2]time.Time{
+		{testStart.Add(9 * time.Hour), testStart.Add(17 * time.Hour)},
+		{testStart.Add(20 * time.Hour), testStart.Add(19 * time.Hour)},
+	})
+	if got := q.TimeBuckets[0]; !got.Start().Equal(testStart.Add(9*time.Hour)) || !got.End().Equal(testStart.Add(17*time.Hour)) {
+		t.Errorf("incorrect first interval: got [%s, %s)", got.StartString(), got.EndString())
+	}
+	want := "invalid query: empty time bucket 1 [2016-01-01T20:00:00Z, 2016-01-01T20:00:00Z)"
+	if err := q.Validate(); err == nil || err.Error() != want {
+		t.Errorf("reversed bucket: incorrect error: got %v want %s", err, want)
+	}
+}
+
+func TestHLQueryExecutorNoData(t *testing.T) {
+	// 2 hosts over 2 days, with points at 1h, 2h and 3h into each day:
+	csi := newTestClientSideIndex(2, 2, "usage_user")
+	cases := []struct {
+		desc       string
+		q          *HLQuery
+		plan       int
+		respond    func(string, []interface{}) ([][]interface{}, error)
+		wantNoData bool
+	}{
+		{
+			desc: "with data",
+			q:    newTestHLQuery("max", "usage_user", testStart, testStart.Add(4*time.Hour), time.Hour),
+			plan: AggrPlanTypeWithoutServerAggregation,
+		},
+		{
+			desc:       "between points",
+			q:          newTestHLQuery("max", "usage_user", testStart.Add(5*time.Hour), testStart.Add(7*time.Hour), time.Hour),
+			plan:       AggrPlanTypeWithoutServerAggregation,
+			wantNoData: true,
+		},
+		{
+			desc:       "empty time range",
+			q:          newTestHLQuery("max", "usage_user", testStart.Add(5*day), testStart.Add(5*day+2*time.Hour), time.Hour),
+			plan:       AggrPlanTypeWithServerAggregation,
+			wantNoData: true,
+		},
+		{
+			desc:       "zero-filled counts",
+			q:          newTestHLQuery("count", "usage_user", testStart.Add(5*day), testStart.Add(5*day+2*time.Hour), time.Hour),
+			plan:       AggrPlanTypeWithServerAggregation,
+			wantNoData: true,
+		},
+		{
+			desc: "counts with data",
+			q:    newTestHLQuery("count", "usage_user", testStart, testStart.Add(4*time.Hour), time.Hour),
+			plan: AggrPlanTypeWithServerAggregation,
+		},
+		{
+			// the server counts 0 rows in each bucket:
+			desc:       "counts of 0 between points",
+			q:          newTestHLQuery("count", "usage_user", testStart.Add(5*time.Hour), testStart.Add(7*time.Hour), time.Hour),
+			plan:       AggrPlanTypeWithServerAggregation,
+			wantNoData: true,
+		},
+		{
+			desc:       "client counts between points",
+			q:          newTestHLQuery("count", "usage_user", testStart.Add(5*time.Hour), testStart.Add(7*time.Hour), time.Hour),
+			plan:       AggrPlanTypeWithoutServerAggregation,
+			wantNoData: true,
+		},
+		{
+			desc:       "aggregations with counts of 0 after the first hour",
+			q:          newTestHLQuery("max,count", "usage_user", testStart.Add(2*time.Hour), testStart.Add(4*time.Hour), time.Hour),
+			plan:       AggrPlanTypeWithServerAggregation,
+			respond:    multiAggregationRows,
+			wantNoData: true,
+		},
+		{
+			desc:    "aggregations with counts in the first hour",
+			q:       newTestHLQuery("max,count", "usage_user", testStart, testStart.Add(2*time.Hour), time.Hour),
+			plan:    AggrPlanTypeWithServerAggregation,
+			respond: multiAggregationRows,
+		},
+	}
+	for _, c := range cases {
+		respond := countRows
+		if c.respond != nil {
+			respond = c.respond
+		}
+		hlqe := NewHLQueryExecutor(&mockQueryExecutor{respond: respond}, csi, 0)
+		_, _, info, err := hlqe.Do(c.q, HLQueryExecutorDoOptions{AggregationPlan: c.plan})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if info.NoData != c.wantNoData {
+			t.Errorf("%s: incorrect no data: got %v want %v (%d buckets)", c.desc, info.NoData, c.wantNoData, info.Buckets)
+		}
+	}
+}
+
+func TestHLQueryExecutorMaxBuckets(t *testing.T) {
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	// 1440 buckets of a minute over a day:
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(day), time.Minute)
+	hlqe := NewHLQueryExecutor(&mockQueryExecutor{respond: countRows}, csi, 0)
+	opts := HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithoutServerAggregation, MaxBuckets: 100}
+
+	opts.BucketOverflow = BucketOverflowError
+	_, _, info, err := hlqe.Do(q, opts)
+	if _, ok := err.(*InvalidQueryError); !ok {
+		t.Errorf("error policy: incorrect error: got %v want an InvalidQueryError", err)
+	}
+	if !info.OverBuckets {
+		t.Errorf("error policy: query not reported over the maximum")
+	}
+
+	// coarsened to 15 minutes, i.e. 96 buckets:
+	opts.BucketOverflow = BucketOverflowCoarsen
+	_, _, info, err = hlqe.Do(q, opts)
+	if err != nil {
+		t.Fatalf("coarsen policy: unexpected error: %v", err)
+	}
+	if !info.OverBuckets {
+		t.Errorf("coarsen policy: query not reported over the maximum")
+	}
+	if info.Buckets != 96 {
+		t.Errorf("coarsen policy: incorrect number of buckets: got %d want %d", info.Buckets, 96)
+	}
+	if q.GroupByDuration != time.Minute {
+		t.Errorf("coarsen policy: query modified: got %s want %s", q.GroupByDuration, time.Minute)
+	}
+
+	// queries within the maximum are left as they are:
+	opts.MaxBuckets = 1440
+	if _, _, info, err = hlqe.Do(q, opts); err != nil || info.OverBuckets || info.Buckets != 1440 {
+		t.Errorf("within the maximum: got %d buckets, over %v (%v), want 1440", info.Buckets, info.OverBuckets, err)
+	}
+}
+
+func TestOrderByVariants(t *testing.T) {
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	for _, orderBy := range []string{"timestamp_ns DESC", "timestamp_ns desc", " timestamp_ns  Desc "} {
+		q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(3*time.Hour), time.Hour)
+		q.OrderBy = []byte(orderBy)
+		if !q.isDescending() {
+			t.Errorf("%q: not descending", orderBy)
+		}
+		qp, err := q.ToQueryPlanWithoutServerAggregation(csi)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", orderBy, err)
+		}
+		// the time buckets are planned in reverse order:
+		if got := qp.TimeBuckets[0].Start(); !got.Equal(testStart.Add(2 * time.Hour)) {
+			t.Errorf("%q: incorrect first bucket: got %v", orderBy, got)
+		}
+		for _, cq := range qp.CQLQueries {
+			if !strings.HasSuffix(cq.PreparableQueryString, "ORDER BY timestamp_ns DESC") {
+				t.Errorf("%q: incorrect CQL query: %s", orderBy, cq.PreparableQueryString)
+			}
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+// A QueryResponse is the serializable form of the results of one HLQuery.
+// It is used to validate results against those of other databases.
+type QueryResponse struct {
+	ID         uint64           `json:"id"`
+	HumanLabel string           `json:"human_label"`
+	Buckets    []ResponseBucket `json:"buckets"`
+}
+
+// A ResponseBucket is the serializable form of a CQLResult. Absent values
+// are represented as nulls.
+type ResponseBucket struct {
+	Start  time.Time  `json:"start"`
+	End    time.Time  `json:"end"`
+	Values []*float64 `json:"values"`
+
+	// set for raw queries only
+	Series string          `json:"series,omitempty"`
+	Points []ResponsePoint `json:"points,omitempty"`
+
+	// set for queries of several measurements only
+	Measurement string `json:"measurement,omitempty"`
+
+	// set for queries grouped by tag only
+	Tags []string `json:"tags,omitempty"`
+
+	// set for share aggregations only: the series of each value
+	ValueSeries []string `json:"value_series,omitempty"`
+
+	// set for queries of several aggregations only: the aggregation of
+	// each value
+	Aggregations []string `json:"aggregations,omitempty"`
+
+	// set with -trace only
+	SeriesIds []string `json:"series_ids,omitempty"`
+}
+
+// A ResponsePoint is the serializable form of a CQLPoint.
+type ResponsePoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// NewQueryResponse builds the QueryResponse of an HLQuery from its results.
+// Its timestamps are in UTC, whatever the location of the query.
+func NewQueryResponse(q *HLQuery, results []CQLResult) *QueryResponse {
+	resp := &QueryResponse{
+		ID:         q.GetID(),
+		HumanLabel: string(q.HumanLabel),
+		Buckets:    make([]ResponseBucket, len(results)),
+	}
+	for i, r := range results {
+		b := ResponseBucket{
+			Start:       r.Start().UTC(),
+			End:         r.End().UTC(),
+			Values:      make([]*float64, len(r.Values)),
+			Measurement: r.Measurement,
+			SeriesIds:   r.SeriesIds,
+			Tags:        r.Tags,
+			ValueSeries: r.ValueSeries,
+		}
+		b.Aggregations = r.Aggregations
+		for j := range r.Values {
+			if !r.IsAbsent(j) {
+				v := r.Values[j]
+				b.Values[j] = &v
+			}
+		}
+		if len(r.Series) > 0 {
+			b.Series = r.Series
+			b.Points = make([]ResponsePoint, len(r.Points))
+			for j, p := range r.Points {
+				b.Points[j] = ResponsePoint{Timestamp: p.Timestamp.UTC(), Value: p.Value}
+			}
+		}
+		resp.Buckets[i] = b
+	}
+	return resp
+}
+
+// CQLResults converts the buckets of a QueryResponse back into CQLResults.
+func (r *QueryResponse) CQLResults() ([]CQLResult, error) {
+	results := make([]CQLResult, len(r.Buckets))
+	for i, b := range r.Buckets {
+		ti, err := utils.NewTimeInterval(b.Start, b.End)
+		if err != nil {
+			return nil, err
+		}
+		res := CQLResult{TimeInterval: ti, Values: make([]float64, len(b.Values)), Measurement: b.Measurement, SeriesIds: b.SeriesIds, Tags: b.Tags, ValueSeries: b.ValueSeries, Aggregations: b.Aggregations}
+		for j, v := range b.Values {
+			if v == nil {
+				if res.Absent == nil {
+					res.Absent = make([]bool, len(b.Values))
+				}
+				res.Absent[j] = true
+				continue
+			}
+			res.Values[j] = *v
+		}
+		if len(b.Series) > 0 {
+			res.Values = nil
+			res.Series = b.Series
+			res.Points = make([]CQLPoint, len(b.Points))
+			for j, p := range b.Points {
+				res.Points[j] = CQLPoint{Timestamp: p.Timestamp, Value: p.Value}
+			}
+		}
+		results[i] = res
+	}
+	return results, nil
+}
+
+// writeJSONResponse writes a QueryResponse as a single line of JSON.
+func writeJSONResponse(w io.Writer, resp *QueryResponse) error {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	// a single write keeps lines from concurrent workers intact
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// Escapers of the InfluxDB line protocol: measurements escape commas and
+// spaces, while tag keys, tag values and field keys also escape equals
+// signs.
+var (
+	lineMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	lineKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// writeLineProtocolResponse writes the results of an HLQuery as points of
+// the InfluxDB line protocol, for re-ingestion into InfluxDB: one point per
+// result, at the start of its time interval, with a field per value of the
+// fields of the query. Raw results have a point per point of their series,
+// with the measurement, tags and field of the series.
+//
+// Points are tagged with the human label of the query, the tags that its
+// tagsets pin to a single value (e.g. hostname=host_0) and the tags of their
+// result, for queries grouped by tag. Absent and
+// non-finite values are omitted, as is a point left without fields.
+func writeLineProtocolResponse(w io.Writer, q *HLQuery, results []CQLResult) error {
+	tags := pinnedTags(q.TagSets)
+	tags = append(tags, [2]string{"label", string(q.HumanLabel)})
+	fields := strings.Split(string(q.FieldName), ",")
+	if len(q.FieldExpression) > 0 {
+		fields = []string{"value"}
+	}
+
+	var b strings.Builder
+	for _, r := range results {
+		if len(r.Series) > 0 {
+			parts := strings.Split(r.Series, "#")
+			key := strings.Split(parts[0], ",")
+			seriesTags := append(append([][2]string{}, tags...), splitTags(key[1:])...)
+			field := ""
+			if len(parts) > 1 {
+				field = parts[1]
+			}
+			for _, p := range r.Points {
+				appendLineProtocolPoint(&b, key[0], seriesTags, []string{field}, []float64{p.Value}, nil, p.Timestamp)
+			}
+			continue
+		}
+		measurement := r.Measurement
+		if len(measurement) == 0 {
+			measurement = string(q.MeasurementName)
+		}
+		pointTags := tags
+		if len(r.Tags) > 0 {
+			pointTags = append(append([][2]string{}, tags...), splitTags(r.Tags)...)
+		}
+		names := fields
+		if len(names) != len(r.Values) {
+			names = make([]string, len(r.Values))
+			for i := range names {
+				names[i] = "value_" + strconv.Itoa(i)
+			}
+		}
+		appendLineProtocolPoint(&b, measurement, pointTags, names, r.Values, r.Absent, r.Start())
+	}
+	// a single write keeps lines from concurrent workers intact
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// appendLineProtocolPoint appends a point of the line protocol, unless
+// none of its values are present and finite. Tags are sorted by key, as
+// recommended for InfluxDB, and only the first of the tags with the same key
+// is kept.
+func appendLineProtocolPoint(b *strings.Builder, measurement string, tags [][2]string, fields []string, values []float64, absent []bool, ts time.Time) {
+	var fieldSet []string
+	for i, v := range values {
+		if (absent != nil && absent[i]) || math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		fieldSet = append(fieldSet, lineKeyEscaper.Replace(fields[i])+"="+strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	if len(fieldSet) == 0 {
+		return
+	}
+	sorted := append([][2]string{}, tags...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i][0] < sorted[j][0] })
+
+	b.WriteString(lineMeasurementEscaper.Replace(measurement))
+	for i, tag := range sorted {
+		// empty tag values are not allowed, nor are duplicate keys:
+		if len(tag[1]) == 0 || (i > 0 && tag[0] == sorted[i-1][0]) {
+			continue
+		}
+		b.WriteByte(',')
+		b.WriteString(lineKeyEscaper.Replace(tag[0]))
+		b.WriteByte('=')
+		b.WriteString(lineKeyEscaper.Replace(tag[1]))
+	}
+	b.WriteByte(' ')
+	b.WriteString(strings.Join(fieldSet, ","))
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(ts.UnixNano(), 10))
+	b.WriteByte('\n')
+}
+
+// pinnedTags returns the tags that tagsets pin to a single value, i.e. the
+// tagsets of a single tag that is neither negated nor a regular expression.
+func pinnedTags(tagsets [][]string) [][2]string {
+	var tags [][2]string
+	for _, tagset := range tagsets {
+		if len(tagset) != 1 {
+			continue
+		}
+		tag := tagset[0]
+		if strings.HasPrefix(tag, tagNegationPrefix) || strings.Contains(tag, tagRegexpMarker) {
+			continue
+		}
+		tags = append(tags, splitTags([]string{tag})...)
+	}
+	return tags
+}
+
+// splitTags splits tags of the form "key=value" into their keys and values.
+func splitTags(tags []string) [][2]string {
+	var split [][2]string
+	for _, tag := range tags {
+		if kv := strings.SplitN(tag, "=", 2); len(kv) == 2 {
+			split = append(split, [2]string{kv[0], kv[1]})
+		}
+	}
+	return split
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// Header of the dumps of responses written by a responseDumpWriter, with
+// -print-responses-format=binary: a magic string, then the uvarint version
+// of the format.
+//
+// The version only changes with incompatible changes of the format. Each
+// response is a record prefixed by its length, and readers ignore the bytes
+// left in a record after the fields they know, so that fields can be added
+// at the end of records without a new version.
+const (
+	responseDumpMagic   = "TSBSRESP"
+	responseDumpVersion = 1
+)
+
+// A responseDumpWriter writes QueryResponses compactly, as binary records,
+// for runs with too many queries for JSON dumps. It keeps the full
+// precision of values, including non-finite ones. It is safe for concurrent
+// use.
+type responseDumpWriter struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+// newResponseDumpWriter writes the header of a dump of responses to w, and
+// returns the writer of its records.
+func newResponseDumpWriter(w io.Writer) (*responseDumpWriter, error) {
+	bw := bufio.NewWriter(w)
+	var header bytes.Buffer
+	header.WriteString(responseDumpMagic)
+	putUvarint(&header, responseDumpVersion)
+	if _, err := bw.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+	return &responseDumpWriter{w: bw}, nil
+}
+
+// Write writes the record of a QueryResponse.
+func (dw *responseDumpWriter) Write(resp *QueryResponse) error {
+	var rec bytes.Buffer
+	putUvarint(&rec, resp.ID)
+	putString(&rec, resp.HumanLabel)
+	putUvarint(&rec, uint64(len(resp.Buckets)))
+	for _, b := range resp.Buckets {
+		putTime(&rec, b.Start)
+		putTime(&rec, b.End)
+		putUvarint(&rec, uint64(len(b.Values)))
+		for _, v := range b.Values {
+			// absent values are a zero byte, present ones a one followed
+			// by their bits:
+			if v == nil {
+				rec.WriteByte(0)
+				continue
+			}
+			rec.WriteByte(1)
+			putFloat(&rec, *v)
+		}
+		putString(&rec, b.Series)
+		putUvarint(&rec, uint64(len(b.Points)))
+		for _, p := range b.Points {
+			putTime(&rec, p.Timestamp)
+			putFloat(&rec, p.Value)
+		}
+		putString(&rec, b.Measurement)
+		putStrings(&rec, b.Tags)
+		putStrings(&rec, b.ValueSeries)
+		putStrings(&rec, b.SeriesIds)
+	}
+
+	var length bytes.Buffer
+	putUvarint(&length, uint64(rec.Len()))
+	// a single locked write keeps the records of concurrent workers intact
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if _, err := dw.w.Write(length.Bytes()); err != nil {
+		return err
+	}
+	_, err := dw.w.Write(rec.Bytes())
+	return err
+}
+
+// Flush writes the buffered records.
+func (dw *responseDumpWriter) Flush() error {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	return dw.w.Flush()
+}
+
+// A responseDumpReader reads the QueryResponses of a dump written by a
+// responseDumpWriter.
+type responseDumpReader struct {
+	r *bufio.Reader
+}
+
+// newResponseDumpReader reads the header of a dump of responses from r,
+// failing if it is not a dump or of an unknown version.
+func newResponseDumpReader(r io.Reader) (*responseDumpReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(responseDumpMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != responseDumpMagic {
+		return nil, errors.New("not a dump of responses")
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the version of the dump: %v", err)
+	}
+	if version != responseDumpVersion {
+		return nil, fmt.Errorf("unsupported version %d of the dump (expected %d)", version, responseDumpVersion)
+	}
+	return &responseDumpReader{r: br}, nil
+}
+
+// Next returns the next QueryResponse of the dump, or io.EOF after the last
+// one.
+func (dr *responseDumpReader) Next() (*QueryResponse, error) {
+	length, err := binary.ReadUvarint(dr.r)
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read record: %v", err)
+	}
+	rec := make([]byte, length)
+	if _, err := io.ReadFull(dr.r, rec); err != nil {
+		return nil, fmt.Errorf("truncated record: %v", err)
+	}
+
+	d := &recordDecoder{b: rec}
+	resp := &QueryResponse{
+		ID:         d.uvarint(),
+		HumanLabel: d.string(),
+		Buckets:    make([]ResponseBucket, d.count()),
+	}
+	for i := range resp.Buckets {
+		b := &resp.Buckets[i]
+		b.Start = d.time()
+		b.End = d.time()
+		b.Values = make([]*float64, d.count())
+		for j := range b.Values {
+			if d.byte() == 1 {
+				v := d.float()
+				b.Values[j] = &v
+			}
+		}
+		b.Series = d.string()
+		if n := d.count(); n > 0 {
+			b.Points = make([]ResponsePoint, n)
+			for j := range b.Points {
+				b.Points[j] = ResponsePoint{Timestamp: d.time(), Value: d.float()}
+			}
+		}
+		b.Measurement = d.string()
+		b.Tags = d.strings()
+		b.ValueSeries = d.strings()
+		b.SeriesIds = d.strings()
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("invalid record of query %d: %v", resp.ID, d.err)
+	}
+	return resp, nil
+}
+
+func putUvarint(b *bytes.Buffer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func putString(b *bytes.Buffer, s string) {
+	putUvarint(b, uint64(len(s)))
+	b.WriteString(s)
+}
+
+func putStrings(b *bytes.Buffer, ss []string) {
+	putUvarint(b, uint64(len(ss)))
+	for _, s := range ss {
+		putString(b, s)
+	}
+}
+
+func putTime(b *bytes.Buffer, t time.Time) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutVarint(buf[:], t.UnixNano())])
+}
+
+func putFloat(b *bytes.Buffer, v float64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	b.Write(buf[:])
+}
+
+// A recordDecoder decodes the fields of a record in turn, keeping the first
+// error, after which it returns zero values.
+type recordDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *recordDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.b = nil
+}
+
+func (d *recordDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail(errors.New("truncated integer"))
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// count returns the number of the elements that follow, which cannot be
+// more than the bytes left.
+func (d *recordDecoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.fail(fmt.Errorf("count %d over the %d bytes left", n, len(d.b)))
+		return 0
+	}
+	return int(n)
+}
+
+func (d *recordDecoder) byte() byte {
+	if len(d.b) < 1 {
+		d.fail(errors.New("truncated value"))
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *recordDecoder) float() float64 {
+	if len(d.b) < 8 {
+		d.fail(errors.New("truncated value"))
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(d.b))
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *recordDecoder) time() time.Time {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.fail(errors.New("truncated timestamp"))
+		return time.Time{}
+	}
+	d.b = d.b[n:]
+	return time.Unix(0, v).UTC()
+}
+
+func (d *recordDecoder) string() string {
+	n := d.count()
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+func (d *recordDecoder) strings() []string {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	ss := make([]string, n)
+	for i := range ss {
+		ss[i] = d.string()
+	}
+	return ss
+}
+
+// decodeResponseDump writes the QueryResponses of a dump as lines of JSON,
+// as printed by -print-responses-format=json (e.g. for
+// tsbs_compare_responses).
+func decodeResponseDump(r io.Reader, w io.Writer) error {
+	dr, err := newResponseDumpReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := dr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := writeJSONResponse(w, resp); err != nil {
+			return fmt.Errorf("query %d: %v", resp.ID, err)
+		}
+	}
+}
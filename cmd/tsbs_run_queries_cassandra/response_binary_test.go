@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseDumpRoundTrip(t *testing.T) {
+	q := newTestHLQuery("max", "usage_user,usage_system", testStart, testStart.Add(3*time.Minute), time.Minute)
+	q.SetID(42)
+	results := newTestCQLResults(t,
+		[]*float64{float64Ptr(1.5), float64Ptr(0.1 + 0.2)},
+		[]*float64{nil, float64Ptr(-3)},
+		[]*float64{float64Ptr(math.Inf(1)), nil},
+	)
+	results[0].SeriesIds = []string{"cpu,hostname=host_0#usage_user#2016-01-01"}
+	results[1].Tags = []string{"hostname=host_1"}
+	results[1].Measurement = "cpu"
+	results[2].ValueSeries = []string{"host_0", "host_1"}
+	raw := newTestCQLResults(t, []*float64{})
+	raw[0].Values = nil
+	raw[0].Series = "cpu,hostname=host_0#usage_user#2016-01-01"
+	raw[0].Points = []CQLPoint{{Timestamp: testStart.Add(time.Second), Value: 2}, {Timestamp: testStart.Add(2 * time.Second), Value: -0.5}}
+	nan := newTestCQLResults(t, []*float64{float64Ptr(math.NaN())})
+
+	var buf bytes.Buffer
+	dw, err := newResponseDumpWriter(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	batches := [][]CQLResult{results, raw, nan, {}}
+	for i, batch := range batches {
+		q.SetID(uint64(42 + i))
+		if err := dw.Write(NewQueryResponse(q, batch)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := dw.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), responseDumpMagic) {
+		t.Errorf("dump does not start with its header")
+	}
+
+	dr, err := newResponseDumpReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, want := range batches {
+		resp, err := dr.Next()
+		if err != nil {
+			t.Fatalf("response %d: unexpected error: %v", i, err)
+		}
+		if resp.ID != uint64(42+i) || resp.HumanLabel != "test" {
+			t.Errorf("response %d: incorrect query identity: got %d, %s", i, resp.ID, resp.HumanLabel)
+		}
+		got, err := resp.CQLResults()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if i == 2 {
+			// (NaN is not equal to itself)
+			if len(got) != 1 || len(got[0].Values) != 1 || !math.IsNaN(got[0].Values[0]) {
+				t.Errorf("incorrect NaN result: got %v", got)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("response %d: round-tripped results differ:\ngot\n%v\nwant\n%v", i, got, want)
+		}
+	}
+	if _, err := dr.Next(); err != io.EOF {
+		t.Errorf("incorrect error after the last response: got %v want %v", err, io.EOF)
+	}
+
+	// a record truncated by a crashed run:
+	dr, err = newResponseDumpReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for err == nil {
+		_, err = dr.Next()
+	}
+	if err == io.EOF {
+		t.Errorf("truncated dump: expected an error")
+	}
+}
+
+func TestResponseDumpHeader(t *testing.T) {
+	cases := []struct {
+		desc   string
+		header string
+		want   string
+	}{
+		{desc: "JSON dump", header: `{"id":1}`, want: "not a dump of responses"},
+		{desc: "later version", header: responseDumpMagic + "\x02", want: "unsupported version 2"},
+	}
+	for _, c := range cases {
+		_, err := newResponseDumpReader(strings.NewReader(c.header))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: incorrect error: got %v want %s", c.desc, err, c.want)
+		}
+	}
+
+	// fields appended to records by later writers are skipped:
+	var rec bytes.Buffer
+	putUvarint(&rec, 7)
+	putString(&rec, "label")
+	putUvarint(&rec, 0)
+	rec.WriteString("new field")
+	var dump bytes.Buffer
+	dump.WriteString(responseDumpMagic)
+	putUvarint(&dump, responseDumpVersion)
+	putUvarint(&dump, uint64(rec.Len()))
+	dump.Write(rec.Bytes())
+	dr, err := newResponseDumpReader(&dump)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp, err := dr.Next()
+	if err != nil || resp.ID != 7 || resp.HumanLabel != "label" {
+		t.Errorf("record with a later field: got %+v (%v)", resp, err)
+	}
+}
+
+func TestDecodeResponseDump(t *testing.T) {
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Minute), time.Minute)
+	q.SetID(1)
+	resp := NewQueryResponse(q, newTestCQLResults(t, []*float64{float64Ptr(1.5)}))
+	var dump, want bytes.Buffer
+	dw, err := newResponseDumpWriter(&dump)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dw.Write(resp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dw.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := writeJSONResponse(&want, resp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got bytes.Buffer
+	if err := decodeResponseDump(&dump, &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("incorrect JSON: got %s want %s", got.String(), want.String())
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+// newTestCQLResults builds one CQLResult per value set, in consecutive
+// minute buckets; a nil value is absent.
+func newTestCQLResults(t *testing.T, values ...[]*float64) []CQLResult {
+	results := make([]CQLResult, len(values))
+	for i, vals := range values {
+		start := testStart.Add(time.Duration(i) * time.Minute)
+		ti, err := utils.NewTimeInterval(start, start.Add(time.Minute))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res := CQLResult{TimeInterval: ti, Values: make([]float64, len(vals))}
+		for j, v := range vals {
+			if v == nil {
+				if res.Absent == nil {
+					res.Absent = make([]bool, len(vals))
+				}
+				res.Absent[j] = true
+				continue
+			}
+			res.Values[j] = *v
+		}
+		results[i] = res
+	}
+	return results
+}
+
+func float64Ptr(v float64) *float64 {
+	return &v
+}
+
+func TestQueryResponseJSONRoundTrip(t *testing.T) {
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(3*time.Minute), time.Minute)
+	q.SetID(42)
+	results := newTestCQLResults(t,
+		[]*float64{float64Ptr(1.5)},
+		[]*float64{nil},
+		[]*float64{float64Ptr(-3)},
+	)
+
+	var buf bytes.Buffer
+	if err := writeJSONResponse(&buf, NewQueryResponse(q, results)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	line := buf.String()
+	if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, "\n") {
+		t.Errorf("response is not a single line: %q", line)
+	}
+	if !strings.Contains(line, `"start":"2016-01-01T00:01:00Z"`) {
+		t.Errorf("response does not have RFC3339 UTC timestamps: %s", line)
+	}
+	if !strings.Contains(line, `"values":[null]`) {
+		t.Errorf("response does not have null for an absent value: %s", line)
+	}
+
+	var resp QueryResponse
+	if err := json.Unmarshal(buf.Bytes(), &resp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.ID != 42 || resp.HumanLabel != "test" {
+		t.Errorf("incorrect query identity: got %d, %s", resp.ID, resp.HumanLabel)
+	}
+	got, err := resp.CQLResults()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, results) {
+		t.Errorf("round-tripped results differ:\ngot\n%v\nwant\n%v", got, results)
+	}
+}
+
+func TestQueryResponseUTC(t *testing.T) {
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Minute), time.Minute)
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	ti, err := utils.NewTimeInterval(testStart.In(loc), testStart.Add(time.Minute).In(loc))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the driver scans timestamps in the local time zone:
+	results := []CQLResult{{
+		TimeInterval: ti,
+		Series:       "host_0",
+		Points:       []CQLPoint{{Timestamp: testStart.In(loc), Value: 1}},
+	}}
+
+	var buf bytes.Buffer
+	if err := writeJSONResponse(&buf, NewQueryResponse(q, results)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	line := buf.String()
+	if !strings.Contains(line, `"start":"2016-01-01T00:00:00Z","end":"2016-01-01T00:01:00Z"`) {
+		t.Errorf("response does not have RFC3339 UTC bucket timestamps: %s", line)
+	}
+	if !strings.Contains(line, `"timestamp":"2016-01-01T00:00:00Z"`) {
+		t.Errorf("response does not have RFC3339 UTC point timestamps: %s", line)
+	}
+}
+
+func TestWriteLineProtocolResponse(t *testing.T) {
+	q := newTestHLQuery("max", "usage user,usage=system", testStart, testStart.Add(2*time.Minute), time.Minute)
+	q.MeasurementName = []byte("cpu,load avg")
+	q.HumanLabel = []byte("max cpu, 1 host")
+	q.TagSets = [][]string{{"hostname=host 0"}, {"region=eu", "region=us"}, {"!service=9"}}
+	results := newTestCQLResults(t, []*float64{float64Ptr(1.5), float64Ptr(-2)}, []*float64{nil, float64Ptr(3e9)}, []*float64{nil, nil})
+
+	var buf bytes.Buffer
+	if err := writeLineProtocolResponse(&buf, q, results); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `cpu\,load\ avg,hostname=host\ 0,label=max\ cpu\,\ 1\ host usage\ user=1.5,usage\=system=-2 1451606400000000000` + "\n" +
+		`cpu\,load\ avg,hostname=host\ 0,label=max\ cpu\,\ 1\ host usage\=system=3000000000 1451606460000000000` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("incorrect lines:\ngot\n%s\nwant\n%s", got, want)
+	}
+
+	// raw results are tagged with the tags of their series:
+	ti, err := utils.NewTimeInterval(testStart, testStart.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	raw := []CQLResult{{
+		TimeInterval: ti,
+		Series:       "cpu,hostname=host_1,region=eu#usage_user#2016-01-01",
+		Points:       []CQLPoint{{Timestamp: testStart.Add(time.Second), Value: 7}},
+	}}
+	buf.Reset()
+	q = newTestHLQuery("", "usage_user", testStart, testStart.Add(time.Minute), 0)
+	if err := writeLineProtocolResponse(&buf, q, raw); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = "cpu,hostname=host_1,label=test,region=eu usage_user=7 1451606401000000000\n"
+	if got := buf.String(); got != want {
+		t.Errorf("raw: incorrect lines:\ngot\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// resultCache holds the results of queries by their cacheKey, so that
+// identical queries within a run are only executed once. Results are only
+// read once cached. It is safe for concurrent use, and is not bounded: it
+// holds the results of every distinct query of the run.
+type resultCache struct {
+	mu      sync.RWMutex
+	results map[string][]CQLResult
+
+	hits   uint64 // accessed atomically
+	misses uint64 // accessed atomically
+}
+
+func newResultCache() *resultCache {
+	return &resultCache{results: make(map[string][]CQLResult)}
+}
+
+// get returns the cached results of a query key, if any.
+func (c *resultCache) get(key string) ([]CQLResult, bool) {
+	c.mu.RLock()
+	results, ok := c.results[key]
+	c.mu.RUnlock()
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return results, ok
+}
+
+// put caches the results of a query key.
+func (c *resultCache) put(key string, results []CQLResult) {
+	c.mu.Lock()
+	c.results[key] = results
+	c.mu.Unlock()
+}
+
+// Stats returns the number of cache hits and misses so far.
+func (c *resultCache) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// cacheKey returns a canonical form of the fields of the query that
+// determine its results. TagSets are normalized, since neither the tags of
+// a tagset nor the tagsets are ordered.
+func (q *HLQuery) cacheKey() string {
+	tagsets := make([]string, len(q.TagSets))
+	for i, tagset := range q.TagSets {
+		tags := append([]string(nil), tagset...)
+		sort.Strings(tags)
+		tagsets[i] = strings.Join(tags, "\x01")
+	}
+	sort.Strings(tagsets)
+	buckets := make([]string, len(q.TimeBuckets))
+	for i, ti := range q.TimeBuckets {
+		buckets[i] = ti.Start().UTC().Format(time.RFC3339Nano) + "\x01" + ti.End().UTC().Format(time.RFC3339Nano)
+	}
+
+	return strings.Join([]string{
+		string(q.MeasurementName),
+		string(q.FieldName),
+		string(q.FieldExpression),
+		string(q.AggregationType),
+		q.TimeStart.UTC().Format(time.RFC3339Nano),
+		q.TimeEnd.UTC().Format(time.RFC3339Nano),
+		q.GroupByDuration.String(),
+		string(q.GroupByCalendar),
+		string(q.ForEveryN),
+		string(q.WhereClause),
+		string(q.OrderBy),
+		strconv.Itoa(q.Limit),
+		strconv.Itoa(q.GroupLimit),
+		strings.Join(tagsets, "\x02"),
+		string(q.GroupByTagKeys),
+		strings.Join(buckets, "\x02"),
+	}, "\x00")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHLQueryCacheKey(t *testing.T) {
+	newQuery := func(tagsets [][]string) *HLQuery {
+		q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Hour), time.Minute)
+		q.TagSets = tagsets
+		return q
+	}
+	key := newQuery([][]string{{"hostname=host_0", "hostname=host_1"}, {"region=eu-west-1"}}).cacheKey()
+
+	same := newQuery([][]string{{"region=eu-west-1"}, {"hostname=host_1", "hostname=host_0"}})
+	if got := same.cacheKey(); got != key {
+		t.Errorf("reordered tagsets: incorrect key: got %q want %q", got, key)
+	}
+
+	for desc, q := range map[string]*HLQuery{
+		"other tagsets": newQuery([][]string{{"hostname=host_0"}, {"hostname=host_1", "region=eu-west-1"}}),
+		"other field":   newTestHLQuery("max", "usage_system", testStart, testStart.Add(time.Hour), time.Minute),
+		"other time":    newTestHLQuery("max", "usage_user", testStart, testStart.Add(2*time.Hour), time.Minute),
+		"other group":   newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Hour), time.Hour),
+		"time buckets":  withTimeBuckets(newQuery([][]string{{"hostname=host_0", "hostname=host_1"}, {"region=eu-west-1"}}), [][2]time.Time{{testStart, testStart.Add(time.Minute)}}),
+	} {
+		if q.cacheKey() == key {
+			t.Errorf("%s: same key as the original query", desc)
+		}
+	}
+}
+
+func withTimeBuckets(q *HLQuery, buckets [][2]time.Time) *HLQuery {
+	q.TimeBuckets = timeIntervals(buckets)
+	return q
+}
+
+func TestHLQueryExecutorResultCache(t *testing.T) {
+	csi := newTestClientSideIndex(2, 1, "usage_user")
+	mock := &mockQueryExecutor{respond: serverAggregationRows}
+	hlqe := NewHLQueryExecutor(mock, csi, 0)
+	opts := HLQueryExecutorDoOptions{
+		AggregationPlan: AggrPlanTypeWithServerAggregation,
+		ResultCache:     newResultCache(),
+	}
+
+	var infos []HLQueryExecutorDoInfo
+	for i := 0; i < 2; i++ {
+		q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Hour), 0)
+		_, _, info, err := hlqe.Do(q, opts)
+		if err != nil {
+			t.Fatalf("query %d: unexpected error: %v", i, err)
+		}
+		infos = append(infos, info)
+	}
+
+	// the first query is executed, the second is served by the cache:
+	if got := mock.Calls(); got != 2 {
+		t.Errorf("incorrect number of CQL queries: got %d want %d", got, 2)
+	}
+	if infos[0].Cached || !infos[1].Cached {
+		t.Errorf("incorrect cached flags: got %v, %v want false, true", infos[0].Cached, infos[1].Cached)
+	}
+	if infos[1].Buckets != infos[0].Buckets {
+		t.Errorf("incorrect number of cached buckets: got %d want %d", infos[1].Buckets, infos[0].Buckets)
+	}
+	if hits, misses := opts.ResultCache.Stats(); hits != 1 || misses != 1 {
+		t.Errorf("incorrect cache stats: got %d hits, %d misses want 1, 1", hits, misses)
+	}
+}
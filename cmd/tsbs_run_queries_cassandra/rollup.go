@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Rollup is a table holding the points of series pre-aggregated over
+// intervals of its Resolution. It has the primary key of the series tables,
+// a row at the start of each interval with points, and the columns
+// rollupColumns of their sum, count, minimum and maximum.
+type Rollup struct {
+	Table      string        // e.g. "series_double_1h"
+	Resolution time.Duration // e.g. one hour
+}
+
+// rollupColumns are the columns of rollup tables aggregated by each
+// aggregation, with the aggregate function merging their rows. The average
+// is computed by the client from the sum and count.
+var rollupColumns = map[string][]string{
+	"sum":   {"sum(value_sum)"},
+	"count": {"sum(value_count)"},
+	"min":   {"min(value_min)"},
+	"max":   {"max(value_max)"},
+	"avg":   {"sum(value_sum)", "sum(value_count)"},
+}
+
+// parseRollupTables parses a comma-separated list of rollup tables (from
+// -rollup-tables) of the form "series_table:rollup_table=resolution", e.g.
+// "series_double:series_double_1h=1h", into the rollups of each series
+// table, coarsest first.
+func parseRollupTables(s string) (map[string][]Rollup, error) {
+	rollups := map[string][]Rollup{}
+	if len(s) == 0 {
+		return rollups, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.FieldsFunc(entry, func(r rune) bool { return r == ':' || r == '=' })
+		if len(parts) != 3 || strings.Count(entry, ":") != 1 || strings.Count(entry, "=") != 1 {
+			return nil, fmt.Errorf("invalid rollup table %q: want series_table:rollup_table=resolution", entry)
+		}
+		for _, table := range parts[:2] {
+			if err := validateCQLIdentifier(table); err != nil {
+				return nil, fmt.Errorf("invalid rollup table %q: %v", entry, err)
+			}
+		}
+		resolution, err := time.ParseDuration(parts[2])
+		if err != nil || resolution <= 0 {
+			return nil, fmt.Errorf("invalid rollup table %q: bad resolution %q", entry, parts[2])
+		}
+		rollups[parts[0]] = append(rollups[parts[0]], Rollup{Table: parts[1], Resolution: resolution})
+	}
+	for _, rs := range rollups {
+		sort.SliceStable(rs, func(i, j int) bool { return rs[i].Resolution > rs[j].Resolution })
+	}
+	return rollups, nil
+}
+
+// withRollups sets the Rollups of each series to those of its table.
+func withRollups(series []Series, rollups map[string][]Rollup) []Series {
+	for i := range series {
+		series[i].Rollups = rollups[series[i].Table]
+	}
+	return series
+}
+
+// chooseRollup returns the coarsest of the rollups (coarsest first, as set
+// by withRollups) that can aggregate the points of [start, end) exactly,
+// i.e. whose intervals are aligned with both ends, or nil if the raw table
+// must be read: for other aggregations, or with -inclusive-end, whose end
+// point is not in a rollup interval of its own.
+func chooseRollup(rollups []Rollup, aggrLabel string, start, end time.Time) *Rollup {
+	if _, ok := rollupColumns[aggrLabel]; !ok || inclusiveEnd {
+		return nil
+	}
+	for i, r := range rollups {
+		n := int64(r.Resolution)
+		if start.UnixNano()%n == 0 && end.UnixNano()%n == 0 {
+			return &rollups[i]
+		}
+	}
+	return nil
+}
+
+// NewRollupCQLQuery builds a CQLQuery aggregating the rows of a series in a
+// rollup table, using prepared CQL statements. The rollup row at the start
+// of each interval holds the points of the whole interval, so the time range
+// must be aligned to its resolution (see chooseRollup).
+func NewRollupCQLQuery(aggrLabel, tableName, rowName string, timeStartNanos, timeEndNanos int64) CQLQuery {
+	columns := rollupColumns[aggrLabel]
+	rowParts := strings.Split(rowName, "#")
+	return CQLQuery{
+		PreparableQueryString: fmt.Sprintf("SELECT %s FROM %s WHERE series_id = ? AND %s", strings.Join(columns, ", "), tableName, cqlTimeRange()),
+		Args:                  []interface{}{rowName, timeStartNanos, timeEndNanos},
+		Field:                 rowParts[len(rowParts)-2],
+		SumAndCount:           len(columns) == 2,
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRollupTables(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    map[string][]Rollup
+		wantErr bool
+	}{
+		{in: "", want: map[string][]Rollup{}},
+		{
+			in: "series_double:series_double_1h=1h,series_double:series_double_1d=24h,series_bigint:series_bigint_1h=1h",
+			want: map[string][]Rollup{
+				"series_double": {{Table: "series_double_1d", Resolution: day}, {Table: "series_double_1h", Resolution: time.Hour}},
+				"series_bigint": {{Table: "series_bigint_1h", Resolution: time.Hour}},
+			},
+		},
+		{in: "series_double_1h=1h", wantErr: true},
+		{in: "series_double:series_double_1h", wantErr: true},
+		{in: "series_double:series_double_1h=1h=2h", wantErr: true},
+		{in: "series_double:series-double=1h", wantErr: true},
+		{in: "series_double:series_double_1h=hourly", wantErr: true},
+		{in: "series_double:series_double_1h=0s", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseRollupTables(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: incorrect rollups: got %v want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestRollupTableSelection(t *testing.T) {
+	rollups, err := parseRollupTables("series_double:series_double_1h=1h,series_double:series_double_1d=24h")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	csi := NewClientSideIndex(withRollups(newTestClientSideIndex(1, 2, "usage_user").CopyOfSeriesCollection(), rollups))
+	cases := []struct {
+		desc    string
+		aggr    string
+		start   time.Time
+		end     time.Time
+		groupBy time.Duration
+		want    []string // table of the query of each bucket
+	}{
+		{desc: "hourly", aggr: "max", start: testStart, end: testStart.Add(2 * time.Hour), groupBy: time.Hour, want: []string{"series_double_1h", "series_double_1h"}},
+		{desc: "daily", aggr: "sum", start: testStart, end: testStart.Add(2 * day), groupBy: day, want: []string{"series_double_1d", "series_double_1d"}},
+		{desc: "two hours", aggr: "count", start: testStart, end: testStart.Add(4 * time.Hour), groupBy: 2 * time.Hour, want: []string{"series_double_1h", "series_double_1h"}},
+		{desc: "finer than rollups", aggr: "min", start: testStart, end: testStart.Add(time.Hour), groupBy: 30 * time.Minute, want: []string{testTable, testTable}},
+		{desc: "unaligned start", aggr: "avg", start: testStart.Add(30 * time.Minute), end: testStart.Add(2 * time.Hour), groupBy: time.Hour, want: []string{testTable, "series_double_1h"}},
+		{desc: "whole range", aggr: "max", start: testStart, end: testStart.Add(day), groupBy: 0, want: []string{"series_double_1d"}},
+		{desc: "unsupported aggregation", aggr: "stddev", start: testStart, end: testStart.Add(time.Hour), groupBy: time.Hour, want: []string{testTable}},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery(c.aggr, "usage_user", c.start, c.end, c.groupBy)
+		qp, err := q.ToQueryPlanWithServerAggregation(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		got := []string{}
+		for _, cq := range qp.AllCQLQueries() {
+			got = append(got, cqlTable(cq))
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: incorrect tables: got %v want %v", c.desc, got, c.want)
+		}
+	}
+
+	// without rollups, the series table is read:
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Hour), time.Hour)
+	qp, err := q.ToQueryPlanWithServerAggregation(newTestClientSideIndex(1, 1, "usage_user"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cqlTable(qp.AllCQLQueries()[0]); got != testTable {
+		t.Errorf("no rollups: incorrect table: got %s want %s", got, testTable)
+	}
+}
+
+func TestRollupAggregation(t *testing.T) {
+	rollups := map[string][]Rollup{testTable: {{Table: "series_double_1h", Resolution: time.Hour}}}
+	csi := NewClientSideIndex(withRollups(newTestClientSideIndex(2, 1, "usage_user").CopyOfSeriesCollection(), rollups))
+
+	// each rollup row holds the sum of 4 points, and their count:
+	rollupRows := func(stmt string, args []interface{}) ([][]interface{}, error) {
+		hours := float64((args[2].(int64) - args[1].(int64)) / int64(time.Hour))
+		switch {
+		case strings.HasPrefix(stmt, "SELECT sum(value_sum), sum(value_count) "):
+			return [][]interface{}{{10 * hours, int64(4 * hours)}}, nil
+		case strings.HasPrefix(stmt, "SELECT sum(value_count) "):
+			return [][]interface{}{{int64(4 * hours)}}, nil
+		case strings.HasPrefix(stmt, "SELECT sum(value_sum) "):
+			return [][]interface{}{{10 * hours}}, nil
+		}
+		t.Fatalf("unexpected statement: %s", stmt)
+		return nil, nil
+	}
+	cases := []struct {
+		aggr string
+		want float64 // of the first bucket, over 2 hours and 2 series
+	}{
+		{aggr: "sum", want: 40},
+		{aggr: "count", want: 16},
+		{aggr: "avg", want: 2.5},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery(c.aggr, "usage_user", testStart, testStart.Add(4*time.Hour), 2*time.Hour)
+		qp, err := q.ToQueryPlanWithServerAggregation(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.aggr, err)
+		}
+		results, err := qp.Execute(context.Background(), &mockQueryExecutor{respond: rollupRows})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.aggr, err)
+		}
+		if got := results[0].Values[0]; got != c.want {
+			t.Errorf("%s: incorrect value: got %v want %v", c.aggr, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// matchedSeries returns the number of series rows of the index that an
+// HLQuery matches, from its query plan, whose CQL queries read the given
+// number of series rows (see countSeries): those, or for the plans without
+// CQL queries the rows they count, e.g. for cardinalities, so that the index
+// is not scanned again.
+func matchedSeries(qp QueryPlan, series int) int {
+	var plans []QueryPlan
+	switch qp := qp.(type) {
+	case *QueryPlanCardinality:
+		return qp.Matched
+	case *QueryPlanCountAll:
+		return qp.Matched
+	case *QueryPlanPerMeasurement:
+		plans = qp.Plans
+	case *QueryPlanPerTagGroup:
+		plans = qp.Plans
+	default:
+		return series
+	}
+	n := 0
+	for _, p := range plans {
+		n += matchedSeries(p, countSeries(p.AllCQLQueries()))
+	}
+	return n
+}
+
+// A selectivityStats accumulates the number of series rows matched by the
+// executed HLQueries, to compare with the size of the ClientSideIndex: the
+// queries matching a large share of it are the ones to expect to be slow.
+// It is safe for concurrent use.
+type selectivityStats struct {
+	mu      sync.Mutex
+	queries uint64
+	matched uint64 // by all of the queries
+	max     int
+	maxID   uint64 // of the query matching the most series rows
+}
+
+// observe records a query with the given id, matching series rows.
+func (s *selectivityStats) observe(id uint64, matched int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries++
+	s.matched += uint64(matched)
+	if matched > s.max {
+		s.max = matched
+		s.maxID = id
+	}
+}
+
+// mean returns the mean number of series rows matched per query.
+func (s *selectivityStats) mean() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queries == 0 {
+		return 0
+	}
+	return float64(s.matched) / float64(s.queries)
+}
+
+// writeTo writes the mean and maximum number of series rows matched per
+// query, out of the total in the index. Nothing is written if no query was
+// observed.
+func (s *selectivityStats) writeTo(w io.Writer, total int) error {
+	mean := s.mean()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queries == 0 {
+		return nil
+	}
+	share := 0.0
+	if total > 0 {
+		share = 100 * mean / float64(total)
+	}
+	_, err := fmt.Fprintf(w, "Series matched per query: mean %.1f (%.2f%% of %d in the client-side index), max %d (query %d)\n",
+		mean, share, total, s.max, s.maxID)
+	return err
+}
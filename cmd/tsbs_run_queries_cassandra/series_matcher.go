@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+// A SeriesMatcher selects the Series read by an HLQuery, among those of its
+// measurement and fields in the ClientSideIndex. Setting the SeriesMatcher
+// of an HLQuery allows experimenting with other selection strategies (e.g.
+// bloom filter pre-checks) without changing the query planners.
+type SeriesMatcher interface {
+	Matches(s Series, q *HLQuery) bool
+}
+
+// DefaultSeriesMatcher is the SeriesMatcher of HLQuery objects that have
+// none set: a Series matches if it has one of the measurements and one of
+// the fields of the HLQuery, matches its tagsets (see TagSetMatcher) and
+// overlaps its time range.
+//
+// Since Matches parses the tagsets of the query on every call, query plans
+// build the same match function once per query instead.
+type DefaultSeriesMatcher struct{}
+
+// Matches checks whether the Series is read by the HLQuery. A Series does
+// not match a query with invalid tagsets.
+func (DefaultSeriesMatcher) Matches(s Series, q *HLQuery) bool {
+	match, err := newDefaultSeriesMatchFunc(q)
+	if err != nil {
+		return false
+	}
+	return match(&s)
+}
+
+// A seriesMatchFunc checks whether a Series is read by a given HLQuery.
+type seriesMatchFunc func(s *Series) bool
+
+// seriesMatchFunc returns the match function of the SeriesIds of the
+// HLQuery if it has some, otherwise of its SeriesMatcher, or of the
+// DefaultSeriesMatcher if it has none.
+func (q *HLQuery) seriesMatchFunc() (seriesMatchFunc, error) {
+	if len(q.SeriesIds) > 0 {
+		return newSeriesIdsMatchFunc(q)
+	}
+	if m := q.SeriesMatcher; m != nil {
+		return func(s *Series) bool { return m.Matches(*s, q) }, nil
+	}
+	return newDefaultSeriesMatchFunc(q)
+}
+
+// newDefaultSeriesMatchFunc builds the match function of the
+// DefaultSeriesMatcher for an HLQuery. It fails if the tagsets or time range
+// of the query are invalid.
+func newDefaultSeriesMatchFunc(q *HLQuery) (seriesMatchFunc, error) {
+	end := q.TimeEnd
+	if inclusiveEnd {
+		// the rows starting at the end hold its points:
+		end = end.Add(time.Nanosecond)
+	}
+	ti, err := utils.NewTimeInterval(q.TimeStart, end)
+	if err != nil {
+		return nil, err
+	}
+	tagMatcher, err := NewTagSetMatcher(q.TagSets)
+	if err != nil {
+		return nil, err
+	}
+	measurements := q.Measurements()
+	fields := q.queriedFields()
+	return func(s *Series) bool {
+		return s.MatchesMeasurementNames(measurements) &&
+			s.MatchesFieldNames(fields) &&
+			tagMatcher.Matches(s) &&
+			s.MatchesTimeInterval(ti)
+	}, nil
+}
+
+// newSeriesIdsMatchFunc builds the match function of the SeriesIds of an
+// HLQuery: a Series matches if it is one of them and overlaps the time range
+// of the query, without matching its tagsets. A series id either names the
+// row of a single day (e.g. "cpu,hostname=host_0#usage_user#2016-01-01") or,
+// without its day, the rows of all of them (see seriesKey). The Series still
+// have to be of the measurements and fields of the query, which the query
+// plans select them from.
+func newSeriesIdsMatchFunc(q *HLQuery) (seriesMatchFunc, error) {
+	end := q.TimeEnd
+	if inclusiveEnd {
+		end = end.Add(time.Nanosecond)
+	}
+	ti, err := utils.NewTimeInterval(q.TimeStart, end)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]struct{}, len(q.SeriesIds))
+	for _, id := range q.SeriesIds {
+		ids[id] = struct{}{}
+	}
+	return func(s *Series) bool {
+		_, ok := ids[s.Id]
+		if !ok {
+			_, ok = ids[seriesKey(s.Id)]
+		}
+		return ok && s.MatchesTimeInterval(ti)
+	}, nil
+}
+
+// seriesKey returns the series id without its day, which identifies the
+// rows of a series across days, e.g. "cpu,hostname=host_0#usage_user".
+func seriesKey(id string) string {
+	if i := strings.LastIndex(id, "#"); i >= 0 {
+		return id[:i]
+	}
+	return id
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// evenHostMatcher is a SeriesMatcher selecting only the series of hosts
+// with an even index, e.g. host_0 and host_2.
+type evenHostMatcher struct{}
+
+func (evenHostMatcher) Matches(s Series, q *HLQuery) bool {
+	for tag := range s.Tags {
+		if strings.HasPrefix(tag, "hostname=host_") {
+			i, err := strconv.Atoi(strings.TrimPrefix(tag, "hostname=host_"))
+			return err == nil && i%2 == 0
+		}
+	}
+	return false
+}
+
+func TestSeriesMatcher(t *testing.T) {
+	csi := newTestClientSideIndex(6, 1, "usage_user")
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Hour), time.Hour)
+	q.SeriesMatcher = evenHostMatcher{}
+
+	// seriesIn returns the sorted series ids queried by a plan
+	seriesIn := func(qp QueryPlan) []string {
+		ids := []string{}
+		for _, cq := range qp.AllCQLQueries() {
+			ids = append(ids, cq.Args[0].(string))
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	want := []string{
+		"cpu,hostname=host_0#usage_user#2016-01-01",
+		"cpu,hostname=host_2#usage_user#2016-01-01",
+		"cpu,hostname=host_4#usage_user#2016-01-01",
+	}
+
+	sqp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cqp, err := q.ToQueryPlanWithoutServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rqp, err := q.ToQueryPlanRaw(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, qp := range []QueryPlan{sqp, cqp, rqp} {
+		if got := seriesIn(qp); !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: incorrect series: got %v want %v", qp, got, want)
+		}
+	}
+
+	results, err := sqp.Execute(context.Background(), &mockQueryExecutor{respond: serverAggregationRows})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := len(results); got != 1 {
+		t.Errorf("incorrect number of results: got %d want %d", got, 1)
+	}
+}
+
+func TestDefaultSeriesMatcher(t *testing.T) {
+	s := NewSeries(testTable, "cpu,hostname=host_0,region=eu-west-1#usage_user#2016-01-01")
+	cases := []struct {
+		desc    string
+		field   string
+		start   time.Time
+		tagsets [][]string
+		want    bool
+	}{
+		{desc: "match", field: "usage_user", start: testStart, want: true},
+		{desc: "one of the fields", field: "usage_system,usage_user", start: testStart, want: true},
+		{desc: "other field", field: "usage_system", start: testStart},
+		{desc: "other day", field: "usage_user", start: testStart.Add(day)},
+		{desc: "tagsets", field: "usage_user", start: testStart, tagsets: [][]string{{"region=eu-west-1"}}, want: true},
+		{desc: "other tagsets", field: "usage_user", start: testStart, tagsets: [][]string{{"!hostname=host_0"}}},
+		{desc: "invalid tagsets", field: "usage_user", start: testStart, tagsets: [][]string{{"hostname=~/(/"}}},
+	}
+	for _, c := range cases {
+		q := newTestHLQuery("max", c.field, c.start, c.start.Add(time.Hour), 0)
+		q.TagSets = c.tagsets
+		if got := (DefaultSeriesMatcher{}).Matches(s, q); got != c.want {
+			t.Errorf("%s: incorrect match: got %v want %v", c.desc, got, c.want)
+		}
+	}
+}
+
+func TestSeriesIds(t *testing.T) {
+	csi := newTestClientSideIndex(4, 2, "usage_user", "usage_system")
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(2*day), day)
+	q.TagSets = [][]string{{"hostname=host_3"}}
+	q.SeriesMatcher = evenHostMatcher{}
+	q.SeriesIds = []string{
+		"cpu,hostname=host_1#usage_user#2016-01-02",
+		"cpu,hostname=host_2#usage_user",
+		"cpu,hostname=host_3#usage_system",
+	}
+	want := []string{
+		"cpu,hostname=host_1#usage_user#2016-01-02",
+		"cpu,hostname=host_2#usage_user#2016-01-01",
+		"cpu,hostname=host_2#usage_user#2016-01-02",
+	}
+
+	for _, plan := range []func(*ClientSideIndex) (QueryPlan, error){
+		func(csi *ClientSideIndex) (QueryPlan, error) { return q.ToQueryPlanWithServerAggregation(csi) },
+		func(csi *ClientSideIndex) (QueryPlan, error) { return q.ToQueryPlanWithoutServerAggregation(csi) },
+	} {
+		qp, err := plan(csi)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ids := []string{}
+		for _, cq := range qp.AllCQLQueries() {
+			ids = append(ids, cq.Args[0].(string))
+		}
+		sort.Strings(ids)
+		if !reflect.DeepEqual(ids, want) {
+			t.Errorf("%T: incorrect series: got %v want %v", qp, ids, want)
+		}
+	}
+
+	unknown := csi.unknownSeriesIds(append(q.SeriesIds, "cpu,hostname=host_9#usage_user", "cpu,hostname=host_0#usage_user#2016-01-03"))
+	if want := []string{"cpu,hostname=host_9#usage_user", "cpu,hostname=host_0#usage_user#2016-01-03"}; !reflect.DeepEqual(unknown, want) {
+		t.Errorf("incorrect unknown series ids: got %v want %v", unknown, want)
+	}
+}
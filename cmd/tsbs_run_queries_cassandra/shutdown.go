@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/timescale/tsbs/query"
+)
+
+// handleShutdownSignals stops the runner on the first SIGINT or SIGTERM, so
+// that the stats of the queries processed so far are still printed: no more
+// queries are started, and those in flight are given up to grace to finish
+// before being cancelled with cancel. A second signal exits at once.
+//
+// The returned function stops handling the signals.
+func handleShutdownSignals(r *query.BenchmarkRunner, grace time.Duration, cancel context.CancelFunc) (stop func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		var timeout <-chan time.Time
+		for {
+			select {
+			case sig := <-c:
+				if timeout != nil {
+					fmt.Fprintf(os.Stderr, "received %s again: exiting without stats\n", sig)
+					os.Exit(1)
+				}
+				fmt.Fprintf(os.Stderr, "received %s: waiting up to %v for the queries in flight (again to exit at once)\n", sig, grace)
+				r.Stop()
+				timeout = time.After(grace)
+			case <-timeout:
+				fmt.Fprintf(os.Stderr, "cancelling the queries still in flight after %v\n", grace)
+				cancel()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
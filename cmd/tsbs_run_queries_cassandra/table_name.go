@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+// A TableNameResolver returns the table to query the rows of a series from,
+// for a time interval of them: a time bucket for the server aggregation plan,
+// otherwise the interval of the series row. It lets schemas partitioning
+// their tables (e.g. by day or by measurement) be queried.
+type TableNameResolver func(series Series, ti *utils.TimeInterval) string
+
+// seriesTableName is the default TableNameResolver, returning the Table
+// that the series was read from.
+func seriesTableName(series Series, _ *utils.TimeInterval) string {
+	return series.Table
+}
+
+// tableNameData is the data that the template of a
+// newTemplateTableNameResolver is executed with.
+type tableNameData struct {
+	Table       string    // of the series, e.g. "series_double"
+	Measurement string    // e.g. "cpu"
+	Field       string    // e.g. "usage_user"
+	Start       time.Time // of the time interval, e.g. the time bucket
+	End         time.Time
+}
+
+// A templateError is the error of executing a template while planning a
+// query, e.g. a -table-name-template. The planners call the
+// functions rendering them without an error to return, which panic with a
+// templateError instead: HLQueryExecutor.queryPlan recovers it, failing the
+// query (see recoverTemplateError).
+type templateError struct {
+	err error
+}
+
+func (e templateError) Error() string { return e.err.Error() }
+
+// recoverTemplateError sets *err to the error of a templateError panic, if
+// any. Other panics are not recovered.
+func recoverTemplateError(err *error) {
+	if r := recover(); r != nil {
+		te, ok := r.(templateError)
+		if !ok {
+			panic(r)
+		}
+		*err = te.err
+	}
+}
+
+// newTemplateTableNameResolver returns a TableNameResolver executing the
+// given text/template with a tableNameData, e.g.
+// `{{.Table}}_{{.Start.Format "20060102"}}`.
+func newTemplateTableNameResolver(text string) (TableNameResolver, error) {
+	tmpl, err := template.New("table").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	resolve := func(series Series, ti *utils.TimeInterval) (string, error) {
+		var b strings.Builder
+		data := tableNameData{Table: series.Table, Measurement: series.Measurement, Field: series.Field}
+		if ti != nil {
+			data.Start, data.End = ti.Start(), ti.End()
+		}
+		if err := tmpl.Execute(&b, data); err != nil {
+			return "", err
+		}
+		if b.Len() == 0 {
+			return "", fmt.Errorf("empty table name for series %s", series.Id)
+		}
+		return b.String(), nil
+	}
+
+	// catch errors once, rather than for every query:
+	sample := NewSeries("series_double", "cpu,hostname=host_0#usage_user#2016-01-01")
+	if _, err := resolve(sample, sample.TimeInterval); err != nil {
+		return nil, err
+	}
+	return func(series Series, ti *utils.TimeInterval) string {
+		name, err := resolve(series, ti)
+		if err != nil {
+			panic(templateError{fmt.Errorf("cannot resolve table name: %v", err)})
+		}
+		return name
+	}, nil
+}
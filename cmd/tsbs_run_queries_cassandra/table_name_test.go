@@ -0,0 +1,174 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+// cqlTable returns the table that a CQLQuery reads from.
+func cqlTable(q CQLQuery) string {
+	return strings.Fields(strings.SplitN(q.PreparableQueryString, " FROM ", 2)[1])[0]
+}
+
+func TestTableNameResolver(t *testing.T) {
+	csi := newTestClientSideIndex(1, 2, "usage_user")
+	csi.TableName = func(series Series, ti *utils.TimeInterval) string {
+		return series.Table + "_" + ti.Start().Format("20060102")
+	}
+	q := newTestHLQuery("max", "usage_user", testStart.Add(23*time.Hour), testStart.Add(25*time.Hour), time.Hour)
+
+	// server aggregation queries read the table of their bucket:
+	sqp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	queries := sqp.AllCQLQueries()
+	if got := len(queries); got != 2 {
+		t.Fatalf("server: incorrect number of CQL queries: got %d want %d", got, 2)
+	}
+	for _, cq := range queries {
+		want := "series_double_" + time.Unix(0, cq.Args[1].(int64)).UTC().Format("20060102")
+		if got := cqlTable(cq); got != want {
+			t.Errorf("server: incorrect table: got %s want %s", got, want)
+		}
+	}
+
+	// other queries read the table of their series row:
+	cqp, err := q.ToQueryPlanWithoutServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, cq := range cqp.AllCQLQueries() {
+		want := "series_double_" + strings.Replace(strings.Split(cq.Args[0].(string), "#")[2], "-", "", -1)
+		if got := cqlTable(cq); got != want {
+			t.Errorf("client: incorrect table: got %s want %s", got, want)
+		}
+	}
+
+	// by default, the series table is read:
+	csi.TableName = nil
+	sqp, err = q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, cq := range sqp.AllCQLQueries() {
+		if got := cqlTable(cq); got != testTable {
+			t.Errorf("default: incorrect table: got %s want %s", got, testTable)
+		}
+	}
+}
+
+func TestTemplateTableNameResolver(t *testing.T) {
+	series := NewSeries("series_double", "cpu,hostname=host_0#usage_user#2016-01-02")
+	cases := []struct {
+		desc    string
+		tmpl    string
+		want    string
+		wantErr bool
+	}{
+		{desc: "by day", tmpl: `{{.Table}}_{{.Start.Format "20060102"}}`, want: "series_double_20160102"},
+		{desc: "by measurement", tmpl: "{{.Measurement}}_{{.Table}}", want: "cpu_series_double"},
+		{desc: "syntax error", tmpl: "{{.Table", wantErr: true},
+		{desc: "unknown field", tmpl: "{{.Keyspace}}", wantErr: true},
+		{desc: "empty", tmpl: "{{if false}}x{{end}}", wantErr: true},
+	}
+	for _, c := range cases {
+		resolve, err := newTemplateTableNameResolver(c.tmpl)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.desc, err)
+			continue
+		}
+		if got := resolve(series, series.TimeInterval); got != c.want {
+			t.Errorf("%s: incorrect table: got %s want %s", c.desc, got, c.want)
+		}
+	}
+}
+
+func TestKeyspaceQualifiedTables(t *testing.T) {
+	series := []Series{
+		NewSeries(testTable, "cpu,hostname=host_0#usage_user#2016-01-01"),
+		NewSeries(testTable, "cpu,hostname=host_1#usage_user#2016-01-01"),
+	}
+	series[0].Keyspace = "tenant_0"
+	csi := NewClientSideIndex(series)
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Hour), time.Hour)
+	want := map[string]string{
+		series[0].Id: "tenant_0.series_double",
+		series[1].Id: "series_double", // in the keyspace of the session
+	}
+
+	for _, resolver := range []TableNameResolver{nil, seriesTableName} {
+		csi.TableName = resolver
+		qp, err := q.ToQueryPlanWithServerAggregation(csi)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, cq := range qp.AllCQLQueries() {
+			id := cq.Args[0].(string)
+			if got := cqlTable(cq); got != want[id] {
+				t.Errorf("%s: incorrect table: got %s want %s", id, got, want[id])
+			}
+		}
+	}
+}
+
+func TestReadKeyspace(t *testing.T) {
+	series := []Series{
+		NewSeries(testTable, "cpu,hostname=host_0#usage_user#2016-01-01"),
+		NewSeries(testTable, "cpu,hostname=host_1#usage_user#2016-01-01"),
+	}
+	series[0].Keyspace = "tenant_0"
+	csi := NewClientSideIndex(series)
+	csi.ReadKeyspace = "snapshot_1"
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Hour), time.Hour)
+
+	// whatever the keyspace of the series, and the plan:
+	plans := []func(*ClientSideIndex) (QueryPlan, error){
+		func(csi *ClientSideIndex) (QueryPlan, error) { return q.ToQueryPlanWithServerAggregation(csi) },
+		func(csi *ClientSideIndex) (QueryPlan, error) { return q.ToQueryPlanWithoutServerAggregation(csi) },
+	}
+	for _, plan := range plans {
+		qp, err := plan(csi)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		cqs := qp.AllCQLQueries()
+		if len(cqs) != 2 {
+			t.Errorf("incorrect number of CQL queries: got %d want 2", len(cqs))
+		}
+		for _, cq := range cqs {
+			if got, want := cqlTable(cq), "snapshot_1.series_double"; got != want {
+				t.Errorf("%s: incorrect table: got %s want %s", cq.Args[0], got, want)
+			}
+		}
+	}
+}
+
+func TestTemplateTableNameResolverError(t *testing.T) {
+	// valid for the sample series checked at startup, but not for all:
+	resolve, err := newTemplateTableNameResolver(`{{if eq .Field "usage_system"}}{{.Table.Name}}{{else}}{{.Table}}{{end}}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	csi := newTestClientSideIndex(1, 1, "usage_user", "usage_system")
+	csi.TableName = resolve
+	hlqe := NewHLQueryExecutor(&mockQueryExecutor{respond: serverAggregationRows}, csi, 0)
+	opts := HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithServerAggregation}
+
+	if _, _, _, err := hlqe.Do(newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Hour), 0), opts); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, _, _, err = hlqe.Do(newTestHLQuery("max", "usage_system", testStart, testStart.Add(time.Hour), 0), opts)
+	if err == nil || !strings.Contains(err.Error(), "cannot resolve table name") {
+		t.Errorf("incorrect error: got %v", err)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/timescale/tsbs/internal/utils"
@@ -16,22 +18,46 @@ func (x TimeIntervals) Less(i, j int) bool {
 	return x[i].Start().Before(x[j].Start())
 }
 
+const day = 24 * time.Hour
+
 // bucketTimeIntervals is a helper that creates a slice of TimeInterval
-// over the given span of time, in chunks of duration `window`.
+// over the given span of time, in chunks of duration `window`. A window of
+// zero (i.e. no 'group by time') yields a single bucket spanning the time.
+//
+// Windows of whole days are aligned to midnight in the location of start, so
+// that their buckets are calendar days, which are 23 or 25 hours long across
+// DST transitions. Shorter windows are aligned to multiples of the window.
 func bucketTimeIntervals(start, end time.Time, window time.Duration) []*utils.TimeInterval {
 	if end.Before(start) {
 		panic("logic error in bucketTimeIntervals: bad input times")
 	}
 	ret := []*utils.TimeInterval{}
 
-	start = start.Truncate(window)
+	if window <= 0 {
+		ti, err := utils.NewTimeInterval(start, end)
+		if err != nil {
+			panic(fmt.Sprintf("unexpected error: %v", err))
+		}
+		return append(ret, ti)
+	}
+
+	next := func(t time.Time) time.Time { return t.Add(window) }
+	if window%day == 0 {
+		days := int(window / day)
+		start = truncateDays(start, days)
+		next = func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day()+days, 0, 0, 0, 0, t.Location())
+		}
+	} else {
+		start = start.Truncate(window)
+	}
 	for start.Before(end) {
-		ti, err := utils.NewTimeInterval(start, start.Add(window))
+		ti, err := utils.NewTimeInterval(start, next(start))
 		if err != nil {
 			panic(fmt.Sprintf("unexpected error: %v", err))
 		}
 		ret = append(ret, ti)
-		start = start.Add(window)
+		start = next(start)
 	}
 
 	// sanity check
@@ -44,3 +70,108 @@ func bucketTimeIntervals(start, end time.Time, window time.Duration) []*utils.Ti
 
 	return ret
 }
+
+// bucketCount returns the number of buckets of bucketTimeIntervals, without
+// making them, so that pathological windows can be caught beforehand.
+func bucketCount(start, end time.Time, window time.Duration) int64 {
+	if !start.Before(end) {
+		return 0
+	}
+	if window <= 0 {
+		return 1
+	}
+	if window%day == 0 {
+		days := int64(window / day)
+		start = truncateDays(start, int(days))
+		end = end.In(start.Location())
+		// days from start to end, counting a partial day:
+		y, m, d := end.Date()
+		midnight := time.Date(y, m, d, 0, 0, 0, 0, end.Location())
+		n := dayNumber(midnight) - dayNumber(start)
+		if end.After(midnight) {
+			n++
+		}
+		return (n + days - 1) / days
+	}
+	start = start.Truncate(window)
+	return int64((end.Sub(start) + window - 1) / window)
+}
+
+// dayNumber returns the number of the calendar day of t since the Unix
+// epoch.
+func dayNumber(t time.Time) int64 {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / int64(day/time.Second)
+}
+
+// truncateDays returns the local midnight starting the period of the given
+// number of days that t is in. Like time.Truncate, periods are counted from
+// the zero time (in the calendar of the location of t), so that in UTC the
+// result is t.Truncate(days * 24h).
+func truncateDays(t time.Time, days int) time.Time {
+	y, m, d := t.Date()
+	// (time.Time{}.Sub would overflow; the zero time is 719162 days
+	// before the Unix epoch)
+	zeroDays := int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix()/int64(day/time.Second)) + 719162
+	return time.Date(y, m, d-zeroDays%days, 0, 0, 0, 0, t.Location())
+}
+
+// calendarUnitRegexp matches calendar unit specs, e.g. "1mo", "3mo" or "1y".
+var calendarUnitRegexp = regexp.MustCompile(`^([1-9][0-9]*)(w|mo|y)$`)
+
+// bucketCalendarIntervals creates a slice of TimeInterval over the given
+// span of time, in chunks of a number of calendar weeks ("w"), months ("mo")
+// or years ("y"), e.g. "1mo". Buckets are aligned to midnight starting the
+// week (Monday), month or year in the location of start, so they vary in
+// length with months, leap years and DST transitions.
+//
+// Like bucketTimeIntervals, chunks of several units are counted from the
+// zero time (January of year 1), so that e.g. "3mo" buckets are quarters,
+// and "5mo" or "2y" buckets are the same whatever the year of start.
+func bucketCalendarIntervals(start, end time.Time, spec string) ([]*utils.TimeInterval, error) {
+	if end.Before(start) {
+		panic("logic error in bucketCalendarIntervals: bad input times")
+	}
+	m := calendarUnitRegexp.FindStringSubmatch(spec)
+	if m == nil {
+		return nil, fmt.Errorf("invalid calendar unit %q (e.g. 1w, 1mo or 1y)", spec)
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid calendar unit %q: %v", spec, err)
+	}
+
+	var next func(time.Time) time.Time
+	y, mon, _ := start.Date()
+	loc := start.Location()
+	switch m[2] {
+	case "w":
+		// the zero time is a Monday
+		start = truncateDays(start, 7*n)
+		next = func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day()+7*n, 0, 0, 0, 0, loc)
+		}
+	case "mo":
+		months := (y-1)*12 + int(mon) - 1
+		start = time.Date(y, mon-time.Month(months%n), 1, 0, 0, 0, 0, loc)
+		next = func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month()+time.Month(n), 1, 0, 0, 0, 0, loc)
+		}
+	case "y":
+		start = time.Date(y-(y-1)%n, 1, 1, 0, 0, 0, 0, loc)
+		next = func(t time.Time) time.Time {
+			return time.Date(t.Year()+n, 1, 1, 0, 0, 0, 0, loc)
+		}
+	}
+
+	ret := []*utils.TimeInterval{}
+	for start.Before(end) {
+		ti, err := utils.NewTimeInterval(start, next(start))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ti)
+		start = next(start)
+	}
+	return ret, nil
+}
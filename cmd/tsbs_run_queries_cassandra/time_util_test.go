@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBucketTimeIntervals(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		desc      string
+		start     time.Time
+		end       time.Time
+		window    time.Duration
+		wantStart time.Time
+		wantLens  []time.Duration
+	}{
+		{
+			desc:      "UTC days",
+			start:     time.Date(2016, 3, 12, 6, 0, 0, 0, time.UTC),
+			end:       time.Date(2016, 3, 15, 0, 0, 0, 0, time.UTC),
+			window:    day,
+			wantStart: time.Date(2016, 3, 12, 0, 0, 0, 0, time.UTC),
+			wantLens:  []time.Duration{day, day, day},
+		},
+		{
+			desc:      "spring forward",
+			start:     time.Date(2016, 3, 12, 6, 0, 0, 0, ny),
+			end:       time.Date(2016, 3, 15, 0, 0, 0, 0, ny),
+			window:    day,
+			wantStart: time.Date(2016, 3, 12, 0, 0, 0, 0, ny),
+			wantLens:  []time.Duration{day, 23 * time.Hour, day},
+		},
+		{
+			desc:      "fall back",
+			start:     time.Date(2016, 11, 5, 0, 0, 0, 0, ny),
+			end:       time.Date(2016, 11, 7, 12, 0, 0, 0, ny),
+			window:    day,
+			wantStart: time.Date(2016, 11, 5, 0, 0, 0, 0, ny),
+			wantLens:  []time.Duration{day, 25 * time.Hour, day},
+		},
+		{
+			desc:      "week across spring forward",
+			start:     time.Date(2016, 3, 10, 0, 0, 0, 0, ny),
+			end:       time.Date(2016, 3, 11, 0, 0, 0, 0, ny),
+			window:    7 * day,
+			wantStart: time.Date(2016, 3, 7, 0, 0, 0, 0, ny), // a Monday, as in UTC
+			wantLens:  []time.Duration{7*day - time.Hour},
+		},
+		{
+			desc:      "hours across spring forward",
+			start:     time.Date(2016, 3, 13, 0, 0, 0, 0, ny),
+			end:       time.Date(2016, 3, 13, 4, 0, 0, 0, ny),
+			window:    time.Hour,
+			wantStart: time.Date(2016, 3, 13, 0, 0, 0, 0, ny),
+			wantLens:  []time.Duration{time.Hour, time.Hour, time.Hour},
+		},
+	}
+	for _, c := range cases {
+		tis := bucketTimeIntervals(c.start, c.end, c.window)
+		if len(tis) != len(c.wantLens) {
+			t.Errorf("%s: incorrect number of buckets: got %d want %d", c.desc, len(tis), len(c.wantLens))
+			continue
+		}
+		if got := bucketCount(c.start, c.end, c.window); got != int64(len(tis)) {
+			t.Errorf("%s: incorrect count of buckets: got %d want %d", c.desc, got, len(tis))
+		}
+		if got := tis[0].Start(); !got.Equal(c.wantStart) {
+			t.Errorf("%s: incorrect start: got %v want %v", c.desc, got, c.wantStart)
+		}
+		for i, ti := range tis {
+			if got := ti.Duration(); got != c.wantLens[i] {
+				t.Errorf("%s: incorrect length of bucket %d: got %v want %v", c.desc, i, got, c.wantLens[i])
+			}
+			if i > 0 && !tis[i-1].End().Equal(ti.Start()) {
+				t.Errorf("%s: bucket %d is not contiguous", c.desc, i)
+			}
+		}
+	}
+
+	// whole days in UTC are aligned as by time.Truncate:
+	for _, days := range []int{1, 2, 7} {
+		start := time.Date(2016, 3, 12, 6, 0, 0, 0, time.UTC)
+		window := time.Duration(days) * day
+		tis := bucketTimeIntervals(start, start.Add(time.Hour), window)
+		if got, want := tis[0].Start(), start.Truncate(window); !got.Equal(want) {
+			t.Errorf("%d days: incorrect UTC alignment: got %v want %v", days, got, want)
+		}
+	}
+}
+
+func TestBucketCalendarIntervals(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		desc      string
+		start     time.Time
+		end       time.Time
+		spec      string
+		wantStart time.Time
+		wantDays  []int
+	}{
+		{
+			desc:      "months of a leap year",
+			start:     time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+			end:       time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+			spec:      "1mo",
+			wantStart: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantDays:  []int{31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31},
+		},
+		{
+			desc:      "february of a common year",
+			start:     time.Date(2015, 2, 14, 12, 0, 0, 0, time.UTC),
+			end:       time.Date(2015, 3, 2, 0, 0, 0, 0, time.UTC),
+			spec:      "1mo",
+			wantStart: time.Date(2015, 2, 1, 0, 0, 0, 0, time.UTC),
+			wantDays:  []int{28, 31},
+		},
+		{
+			desc:      "quarters",
+			start:     time.Date(2016, 5, 10, 0, 0, 0, 0, time.UTC),
+			end:       time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC),
+			spec:      "3mo",
+			wantStart: time.Date(2016, 4, 1, 0, 0, 0, 0, time.UTC),
+			wantDays:  []int{91, 92},
+		},
+		{
+			desc:      "month boundaries",
+			start:     time.Date(2016, 3, 31, 23, 59, 59, 0, time.UTC),
+			end:       time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC),
+			spec:      "1mo",
+			wantStart: time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC),
+			wantDays:  []int{31, 30},
+		},
+		{
+			desc:      "quarter boundaries",
+			start:     time.Date(2016, 4, 1, 0, 0, 0, 0, time.UTC),
+			end:       time.Date(2016, 7, 1, 0, 0, 0, 0, time.UTC),
+			spec:      "3mo",
+			wantStart: time.Date(2016, 4, 1, 0, 0, 0, 0, time.UTC),
+			wantDays:  []int{91},
+		},
+		{
+			// 24192 months from the zero time to 2017, not a multiple of 5
+			desc:      "months across years",
+			start:     time.Date(2017, 3, 10, 0, 0, 0, 0, time.UTC),
+			end:       time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC),
+			spec:      "5mo",
+			wantStart: time.Date(2016, 11, 1, 0, 0, 0, 0, time.UTC),
+			wantDays:  []int{151, 153},
+		},
+		{
+			desc:      "years",
+			start:     time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC),
+			end:       time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC),
+			spec:      "1y",
+			wantStart: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantDays:  []int{365, 366},
+		},
+		{
+			// years counted from year 1
+			desc:      "several years",
+			start:     time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC),
+			end:       time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC),
+			spec:      "2y",
+			wantStart: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantDays:  []int{731, 730},
+		},
+		{
+			desc:      "weeks",
+			start:     time.Date(2016, 3, 10, 0, 0, 0, 0, time.UTC),
+			end:       time.Date(2016, 3, 15, 0, 0, 0, 0, time.UTC),
+			spec:      "1w",
+			wantStart: time.Date(2016, 3, 7, 0, 0, 0, 0, time.UTC), // a Monday
+			wantDays:  []int{7, 7},
+		},
+		{
+			desc:      "local months",
+			start:     time.Date(2016, 3, 1, 0, 0, 0, 0, ny),
+			end:       time.Date(2016, 4, 1, 0, 0, 0, 0, ny),
+			spec:      "1mo",
+			wantStart: time.Date(2016, 3, 1, 0, 0, 0, 0, ny),
+			wantDays:  []int{31},
+		},
+	}
+	for _, c := range cases {
+		tis, err := bucketCalendarIntervals(c.start, c.end, c.spec)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if len(tis) != len(c.wantDays) {
+			t.Errorf("%s: incorrect number of buckets: got %d want %d", c.desc, len(tis), len(c.wantDays))
+			continue
+		}
+		if got := tis[0].Start(); !got.Equal(c.wantStart) {
+			t.Errorf("%s: incorrect start: got %v want %v", c.desc, got, c.wantStart)
+		}
+		for i, ti := range tis {
+			s, e := ti.Start().In(c.start.Location()), ti.End().In(c.start.Location())
+			if s.Hour() != 0 || e.Hour() != 0 {
+				t.Errorf("%s: bucket %d is not aligned to midnight: [%v, %v)", c.desc, i, s, e)
+			}
+			// (plus an hour, for DST transitions)
+			if got := int((ti.Duration() + time.Hour) / day); got != c.wantDays[i] {
+				t.Errorf("%s: incorrect length of bucket %d: got %v want %d days", c.desc, i, ti.Duration(), c.wantDays[i])
+			}
+			if i > 0 && !tis[i-1].End().Equal(ti.Start()) {
+				t.Errorf("%s: bucket %d is not contiguous", c.desc, i)
+			}
+		}
+	}
+
+	for _, spec := range []string{"", "mo", "0mo", "1m", "1d", "-1y", "1.5w"} {
+		if _, err := bucketCalendarIntervals(testStart, testStart.Add(day), spec); err == nil {
+			t.Errorf("%q: expected error but did not get one", spec)
+		}
+	}
+}
+
+func TestGroupByCalendar(t *testing.T) {
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	q := newTestHLQuery("max", "usage_user", testStart, testStart.AddDate(1, 0, 0), time.Minute)
+	q.GroupByCalendar = []byte("1mo")
+	qp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := len(qp.BucketedCQLQueries); got != 12 {
+		t.Errorf("incorrect number of buckets: got %d want %d", got, 12)
+	}
+
+	q.GroupByCalendar = []byte("1month")
+	if _, err := q.ToQueryPlanWithoutServerAggregation(csi); err == nil {
+		t.Errorf("expected error but did not get one")
+	}
+}
+
+func TestCountAggregationTimezone(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// points at 1h-3h UTC of the 13th and 14th are on the evenings of the
+	// 12th and 13th in New York:
+	csi := NewClientSideIndex([]Series{
+		NewSeries(testTable, "cpu,hostname=host_0#usage_user#2016-03-13"),
+		NewSeries(testTable, "cpu,hostname=host_0#usage_user#2016-03-14"),
+	})
+	q := newTestHLQuery("count", "usage_user", time.Date(2016, 3, 12, 0, 0, 0, 0, time.UTC), time.Date(2016, 3, 15, 0, 0, 0, 0, time.UTC), day)
+	q.TimeStart = time.Date(2016, 3, 12, 0, 0, 0, 0, ny)
+	q.TimeEnd = time.Date(2016, 3, 15, 0, 0, 0, 0, ny)
+
+	sqp, err := q.ToQueryPlanWithServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cqp, err := q.ToQueryPlanWithoutServerAggregation(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []float64{3, 3, 0}
+	qe := &mockQueryExecutor{respond: countRows}
+	for _, qp := range []QueryPlan{sqp, cqp} {
+		results, err := qp.Execute(context.Background(), qe)
+		if err != nil {
+			t.Fatalf("%T: unexpected error: %v", qp, err)
+		}
+		got := make([]float64, len(results))
+		for i, r := range results {
+			got[i] = r.Values[0]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: incorrect counts: got %v want %v", qp, got, want)
+		}
+	}
+}
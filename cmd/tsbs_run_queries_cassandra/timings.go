@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// timingsHeader is the header row of the file written by a timingsWriter.
+var timingsHeader = []string{"id", "human_label", "plan_build_ns", "execute_ns", "bucket_count", "series_touched", "pages", "rows_scanned", "error"}
+
+// A queryTiming is the timing of one HLQuery, written as a row by a
+// timingsWriter.
+type queryTiming struct {
+	ID         uint64
+	HumanLabel string
+	PlanBuild  time.Duration
+	Execute    time.Duration
+	Info       HLQueryExecutorDoInfo
+	Err        error
+}
+
+// A timingsWriter writes queryTimings as CSV rows from a single goroutine,
+// so that workers only hand them over a channel. Rows are flushed
+// periodically, so a crashed run still leaves the timings written so far.
+type timingsWriter struct {
+	c    chan queryTiming
+	done chan error
+}
+
+// newTimingsWriter starts writing the timings header to w, followed by the
+// rows of the timings given to Write, flushing every flushInterval.
+func newTimingsWriter(w io.Writer, flushInterval time.Duration) *timingsWriter {
+	tw := &timingsWriter{
+		c:    make(chan queryTiming, 1024),
+		done: make(chan error, 1),
+	}
+	go tw.run(csv.NewWriter(w), flushInterval)
+	return tw
+}
+
+// Write queues a timing to be written. It must not be called after Close.
+func (tw *timingsWriter) Write(t queryTiming) {
+	tw.c <- t
+}
+
+// Close writes the remaining timings and returns the first write error, if
+// any.
+func (tw *timingsWriter) Close() error {
+	close(tw.c)
+	return <-tw.done
+}
+
+func (tw *timingsWriter) run(w *csv.Writer, flushInterval time.Duration) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	err := w.Write(timingsHeader)
+	for {
+		select {
+		case t, ok := <-tw.c:
+			if !ok {
+				w.Flush()
+				if err == nil {
+					err = w.Error()
+				}
+				tw.done <- err
+				return
+			}
+			if err == nil {
+				err = w.Write(t.record())
+			}
+		case <-ticker.C:
+			w.Flush()
+			if err == nil {
+				err = w.Error()
+			}
+		}
+	}
+}
+
+// record formats the timing as a CSV row.
+func (t *queryTiming) record() []string {
+	errString := ""
+	if t.Err != nil {
+		errString = t.Err.Error()
+	}
+	return []string{
+		strconv.FormatUint(t.ID, 10),
+		t.HumanLabel,
+		strconv.FormatInt(t.PlanBuild.Nanoseconds(), 10),
+		strconv.FormatInt(t.Execute.Nanoseconds(), 10),
+		strconv.Itoa(t.Info.Buckets),
+		strconv.Itoa(t.Info.Series),
+		strconv.Itoa(t.Info.Pages),
+		strconv.Itoa(t.Info.RowsScanned),
+		errString,
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimingsWriter(t *testing.T) {
+	var buf bytes.Buffer
+	tw := newTimingsWriter(&buf, time.Hour)
+	tw.Write(queryTiming{
+		ID:         1,
+		HumanLabel: "cpu max, 1 host",
+		PlanBuild:  1500 * time.Nanosecond,
+		Execute:    2 * time.Millisecond,
+		Info:       HLQueryExecutorDoInfo{Buckets: 12, Series: 3, Pages: 4, RowsScanned: 36},
+	})
+	tw.Write(queryTiming{
+		ID:         2,
+		HumanLabel: "lastpoint",
+		PlanBuild:  10,
+		Execute:    20,
+		Info:       HLQueryExecutorDoInfo{Series: 100},
+		Err:        context.DeadlineExceeded,
+	})
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := [][]string{
+		{"id", "human_label", "plan_build_ns", "execute_ns", "bucket_count", "series_touched", "pages", "rows_scanned", "error"},
+		{"1", "cpu max, 1 host", "1500", "2000000", "12", "3", "4", "36", ""},
+		{"2", "lastpoint", "10", "20", "0", "100", "0", "0", "context deadline exceeded"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect rows:\ngot\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestCountSeries(t *testing.T) {
+	queries := []CQLQuery{
+		NewCQLQuery("max", testTable, "cpu,hostname=host_0#usage_user#2016-01-01", "", 0, 1),
+		NewCQLQuery("max", testTable, "cpu,hostname=host_0#usage_user#2016-01-01", "", 1, 2),
+		NewCQLQuery("max", testTable, "cpu,hostname=host_1#usage_user#2016-01-01", "", 0, 1),
+	}
+	if got := countSeries(queries); got != 2 {
+		t.Errorf("incorrect number of series: got %d want %d", got, 2)
+	}
+	batched := []CQLQuery{NewBatchedCQLQuery(queries[1:]), queries[0]}
+	if got := countSeries(batched); got != 2 {
+		t.Errorf("batched: incorrect number of series: got %d want %d", got, 2)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// A planValidation is a query whose plan could not be built (see
+// -no-execute).
+type planValidation struct {
+	id    uint64
+	label string
+	err   error
+}
+
+// validationStats accumulates the queries planned with -no-execute, and the
+// errors of those whose plans could not be built, e.g. for an empty time
+// range or an unknown measurement. It is safe for concurrent use.
+type validationStats struct {
+	mu      sync.Mutex
+	valid   uint64
+	invalid []planValidation
+}
+
+// observe records a query with the given id and label, whose plan was
+// built with the given error, if any.
+func (s *validationStats) observe(id uint64, label string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.valid++
+		return
+	}
+	s.invalid = append(s.invalid, planValidation{id: id, label: label, err: err})
+}
+
+// counts returns the number of valid and invalid queries observed.
+func (s *validationStats) counts() (valid, invalid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.valid), len(s.invalid)
+}
+
+// writeTo writes the invalid queries, by ID, with the reason their plans
+// could not be built, followed by the number of valid and invalid queries.
+func (s *validationStats) writeTo(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sort.Slice(s.invalid, func(i, j int) bool { return s.invalid[i].id < s.invalid[j].id })
+	for _, v := range s.invalid {
+		if _, err := fmt.Fprintf(w, "ID %d (%s): %v\n", v.id, v.label, v.err); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "Query plans: %d valid, %d invalid\n", s.valid, len(s.invalid))
+	return err
+}
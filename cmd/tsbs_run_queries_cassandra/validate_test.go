@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidationStats(t *testing.T) {
+	csi := newTestClientSideIndex(2, 1, "usage_user")
+	mock := &mockQueryExecutor{respond: serverAggregationRows}
+	hlqe := NewHLQueryExecutor(mock, csi, 0)
+
+	badRegexp := newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Hour), time.Minute)
+	badRegexp.TagSets = [][]string{{"hostname=~/(/"}}
+	queries := []*HLQuery{
+		newTestHLQuery("max", "usage_user", testStart, testStart.Add(time.Hour), time.Minute),
+		newTestHLQuery("avg", "usage_user", testStart.Add(time.Hour), testStart, time.Minute),
+		newTestHLQuery("", "usage_user", testStart, testStart.Add(time.Hour), 0),
+		badRegexp,
+		newTestHLQuery("count", "usage_user", testStart, testStart.Add(time.Hour), -time.Minute),
+	}
+	var stats validationStats
+	for i, q := range queries {
+		q.SetID(uint64(len(queries) - i))
+		_, _, _, err := hlqe.Do(q, HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithServerAggregation, NoExecute: true})
+		stats.observe(q.GetID(), string(q.HumanLabel), err)
+	}
+	if got := mock.Calls(); got != 0 {
+		t.Errorf("incorrect number of CQL queries: got %d want 0", got)
+	}
+	if valid, invalid := stats.counts(); valid != 2 || invalid != 3 {
+		t.Errorf("incorrect counts: got %d valid, %d invalid want 2 valid, 3 invalid", valid, invalid)
+	}
+
+	var buf bytes.Buffer
+	if err := stats.writeTo(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("incorrect number of lines: got %d want 4:\n%s", len(lines), buf.String())
+	}
+	for i, prefix := range []string{"ID 1 (test): ", "ID 2 (test): ", "ID 4 (test): "} {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("incorrect line %d: got %q want prefix %q", i, lines[i], prefix)
+		}
+	}
+	if want := "Query plans: 2 valid, 3 invalid"; lines[3] != want {
+		t.Errorf("incorrect summary: got %q want %q", lines[3], want)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// valuePredicateOps are the operators of ValuePredicates, longest first so
+// that ">=" is not parsed as ">".
+var valuePredicateOps = []string{">=", "<=", ">", "<", "="}
+
+// A ValuePredicate filters the points selected by raw queries on their
+// value, on the server, e.g. "value > 90" for threshold or alert-style
+// reads. Cassandra only filters on a column outside of the primary key with
+// a secondary index on it or with ALLOW FILTERING (see allowFiltering).
+type ValuePredicate struct {
+	Op    string // one of valuePredicateOps
+	Value float64
+}
+
+// String returns the CQL condition of the predicate, with a bind marker.
+func (p ValuePredicate) String() string {
+	return valueColumn + " " + p.Op + " ?"
+}
+
+// parseValuePredicates parses a comma-separated list of value predicates
+// (from -value-predicates), each an operator followed by a number, e.g.
+// "> 90" or ">=10,<20".
+func parseValuePredicates(s string) ([]ValuePredicate, error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return nil, nil
+	}
+	preds := []ValuePredicate{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		op := ""
+		for _, o := range valuePredicateOps {
+			if strings.HasPrefix(entry, o) {
+				op = o
+				break
+			}
+		}
+		if len(op) == 0 {
+			return nil, fmt.Errorf("invalid value predicate %q: want one of %s followed by a number", entry, strings.Join(valuePredicateOps, ", "))
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(entry, op)), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value predicate %q: %v", entry, err)
+		}
+		preds = append(preds, ValuePredicate{Op: op, Value: v})
+	}
+	return preds, nil
+}
+
+// allowFiltering makes the raw queries with ValuePredicates end with ALLOW
+// FILTERING (set by -allow-filtering), for tables without a secondary index
+// on their value column: Cassandra then reads every point of the time
+// range of each series to filter them, so the cost of such queries is that
+// of reading all of their points, however few match.
+var allowFiltering bool
+
+// cqlValuePredicates returns the conditions of the predicates, to follow
+// those of the time range of a CQL query.
+func cqlValuePredicates(preds []ValuePredicate) string {
+	s := ""
+	for _, p := range preds {
+		s += " AND " + p.String()
+	}
+	return s
+}
+
+// A FilteringError reports a query with ValuePredicates rejected by
+// Cassandra as it would filter the points, without a secondary index on
+// their value.
+type FilteringError struct {
+	Stmt string // the rejected CQL statement
+	Err  error  // as returned by Cassandra
+}
+
+func (e *FilteringError) Error() string {
+	return fmt.Sprintf("cannot filter points on their value (it needs a secondary index on %s, or -allow-filtering): %s: %v", valueColumn, e.Stmt, e.Err)
+}
+
+// isFilteringError reports whether err is a request error (such as a
+// gocql.RequestError) rejecting a query that needs ALLOW FILTERING.
+func isFilteringError(err error) bool {
+	re, ok := err.(interface {
+		Code() int
+		Message() string
+	})
+	return ok && re.Code() == cqlErrInvalid && strings.Contains(re.Message(), "ALLOW FILTERING")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseValuePredicates(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    []ValuePredicate
+		wantErr bool
+	}{
+		{in: ""},
+		{in: "> 90", want: []ValuePredicate{{Op: ">", Value: 90}}},
+		{in: ">=10, <20.5", want: []ValuePredicate{{Op: ">=", Value: 10}, {Op: "<", Value: 20.5}}},
+		{in: "<=-1,=0", want: []ValuePredicate{{Op: "<=", Value: -1}, {Op: "=", Value: 0}}},
+		{in: "90", wantErr: true},
+		{in: "!= 90", wantErr: true},
+		{in: "> high", wantErr: true},
+		{in: ">", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseValuePredicates(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: incorrect predicates: got %v want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestValuePredicateCQL(t *testing.T) {
+	defer func() { allowFiltering = false }()
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	id := "cpu,hostname=host_0#usage_user#2016-01-01"
+	start, end := testStart, testStart.Add(time.Hour)
+	cases := []struct {
+		desc           string
+		limit          int
+		allowFiltering bool
+		wantStmt       string
+		wantArgs       []interface{}
+	}{
+		{
+			desc:     "greater than",
+			wantStmt: "SELECT timestamp_ns, value FROM series_double WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ? AND value > ? ORDER BY timestamp_ns",
+			wantArgs: []interface{}{id, start.UnixNano(), end.UnixNano(), 90.0},
+		},
+		{
+			desc:     "with a limit",
+			limit:    5,
+			wantStmt: "SELECT timestamp_ns, value FROM series_double WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ? AND value > ? ORDER BY timestamp_ns LIMIT ?",
+			wantArgs: []interface{}{id, start.UnixNano(), end.UnixNano(), 90.0, 5},
+		},
+		{
+			desc:           "allow filtering",
+			limit:          5,
+			allowFiltering: true,
+			wantStmt:       "SELECT timestamp_ns, value FROM series_double WHERE series_id = ? AND timestamp_ns >= ? AND timestamp_ns < ? AND value > ? ORDER BY timestamp_ns LIMIT ? ALLOW FILTERING",
+			wantArgs:       []interface{}{id, start.UnixNano(), end.UnixNano(), 90.0, 5},
+		},
+	}
+	for _, c := range cases {
+		allowFiltering = c.allowFiltering
+		q := newTestHLQuery("", "usage_user", start, end, 0)
+		q.Limit = c.limit
+		q.ValuePredicates = []ValuePredicate{{Op: ">", Value: 90}}
+		qp, err := q.ToQueryPlanRaw(csi)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		cq := qp.AllCQLQueries()[0]
+		if cq.PreparableQueryString != c.wantStmt {
+			t.Errorf("%s: incorrect CQL: got %s want %s", c.desc, cq.PreparableQueryString, c.wantStmt)
+		}
+		if !reflect.DeepEqual(cq.BoundArgs(), c.wantArgs) {
+			t.Errorf("%s: incorrect bound arguments: got %v want %v", c.desc, cq.BoundArgs(), c.wantArgs)
+		}
+	}
+
+	// aggregations cannot be filtered on values:
+	q := newTestHLQuery("max", "usage_user", start, end, time.Hour)
+	q.ValuePredicates = []ValuePredicate{{Op: ">", Value: 90}}
+	if _, err := q.ToQueryPlanWithServerAggregation(csi); err == nil {
+		t.Errorf("aggregation: expected an error")
+	} else if _, ok := err.(*InvalidQueryError); !ok {
+		t.Errorf("aggregation: incorrect error: got %v", err)
+	}
+}
+
+func TestQueryPlanRawFilteringError(t *testing.T) {
+	csi := newTestClientSideIndex(1, 1, "usage_user")
+	q := newTestHLQuery("", "usage_user", testStart, testStart.Add(time.Hour), 0)
+	q.ValuePredicates = []ValuePredicate{{Op: ">", Value: 90}}
+	qp, err := q.ToQueryPlanRaw(csi)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reject := func(string, []interface{}) ([][]interface{}, error) {
+		return nil, mockRequestError{cqlErrInvalid, "Cannot execute this query as it might involve data filtering and thus may have unpredictable performance. If you want to execute this query despite the performance unpredictability, use ALLOW FILTERING"}
+	}
+	_, err = qp.Execute(context.Background(), &mockQueryExecutor{respond: reject})
+	if _, ok := err.(*FilteringError); !ok {
+		t.Errorf("incorrect error: got %v (%T) want a *FilteringError", err, err)
+	}
+}
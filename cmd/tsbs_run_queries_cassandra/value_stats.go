@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+)
+
+// A valueSummary holds the minimum, sum and maximum of result values.
+type valueSummary struct {
+	n        uint64
+	min, max float64
+	sum      float64
+}
+
+// add adds a value to the summary.
+func (s *valueSummary) add(v float64) {
+	if s.n == 0 || v < s.min {
+		s.min = v
+	}
+	if s.n == 0 || v > s.max {
+		s.max = v
+	}
+	s.sum += v
+	s.n++
+}
+
+// merge adds the values of o to the summary.
+func (s *valueSummary) merge(o valueSummary) {
+	if o.n == 0 {
+		return
+	}
+	if s.n == 0 || o.min < s.min {
+		s.min = o.min
+	}
+	if s.n == 0 || o.max > s.max {
+		s.max = o.max
+	}
+	s.sum += o.sum
+	s.n += o.n
+}
+
+// mean returns the mean of the values, zero if none was added.
+func (s *valueSummary) mean() float64 {
+	if s.n == 0 {
+		return 0
+	}
+	return s.sum / float64(s.n)
+}
+
+// summarizeValues summarizes the known values of results, and the points of
+// raw results, leaving out the absent and non-finite ones, and those of the
+// time buckets without data that are zero-filled.
+func summarizeValues(results []CQLResult) valueSummary {
+	var s valueSummary
+	for i := range results {
+		r := &results[i]
+		if r.ZeroFilled {
+			continue
+		}
+		for v, x := range r.Values {
+			if !r.IsAbsent(v) && !math.IsNaN(x) && !math.IsInf(x, 0) {
+				s.add(x)
+			}
+		}
+		for _, p := range r.Points {
+			if !math.IsNaN(p.Value) && !math.IsInf(p.Value, 0) {
+				s.add(p.Value)
+			}
+		}
+	}
+	return s
+}
+
+// A valueStats accumulates the result values of the executed HLQueries by
+// human label (set by -value-stats), for a sanity check of their range: a
+// mean CPU usage of 5000% reveals a mismatch of schema or of units. It is
+// safe for concurrent use.
+type valueStats struct {
+	mu     sync.Mutex
+	labels map[string]*valueSummary
+}
+
+// observe records the result values of a query of the given human label.
+func (s *valueStats) observe(label string, values valueSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.labels == nil {
+		s.labels = map[string]*valueSummary{}
+	}
+	sum, ok := s.labels[label]
+	if !ok {
+		sum = &valueSummary{}
+		s.labels[label] = sum
+	}
+	sum.merge(values)
+}
+
+// writeTo writes the minimum, mean and maximum of the values of each label,
+// one per line in the order of labels. Nothing is written if no query was
+// observed.
+func (s *valueStats) writeTo(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.labels) == 0 {
+		return nil
+	}
+	labels := make([]string, 0, len(s.labels))
+	for l := range s.labels {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	if _, err := fmt.Fprintln(w, "Result values per query type:"); err != nil {
+		return err
+	}
+	for _, l := range labels {
+		sum := s.labels[l]
+		var err error
+		if sum.n == 0 {
+			_, err = fmt.Fprintf(w, "%s: no values\n", l)
+		} else {
+			_, err = fmt.Fprintf(w, "%s: min %g, mean %g, max %g (%d values)\n", l, sum.min, sum.mean(), sum.max, sum.n)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
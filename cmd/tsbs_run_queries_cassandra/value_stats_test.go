@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSummarizeValues(t *testing.T) {
+	v := float64Ptr
+	results := newTestCQLResults(t,
+		[]*float64{v(20), v(80)},
+		[]*float64{nil, v(50)}, // absent buckets are left out
+		[]*float64{v(math.NaN()), v(math.Inf(1))},
+	)
+	// the points of raw results count too:
+	results = append(results, CQLResult{Series: "cpu,hostname=host_0", Points: []CQLPoint{{Value: 10}, {Value: math.NaN()}}})
+
+	got := summarizeValues(results)
+	if got.n != 4 || got.min != 10 || got.max != 80 || got.mean() != 40 {
+		t.Errorf("incorrect summary: got %d values, min %v, mean %v, max %v want 4 values, min 10, mean 40, max 80",
+			got.n, got.min, got.mean(), got.max)
+	}
+	if empty := summarizeValues(newTestCQLResults(t, []*float64{nil})); empty.n != 0 || empty.mean() != 0 {
+		t.Errorf("absent values: incorrect summary: got %+v", empty)
+	}
+}
+
+func TestValueStats(t *testing.T) {
+	csi := newTestClientSideIndex(2, 1, "usage_user")
+	hlqe := NewHLQueryExecutor(&mockQueryExecutor{respond: countRows}, csi, 0)
+	opts := HLQueryExecutorDoOptions{AggregationPlan: AggrPlanTypeWithServerAggregation, ValueStats: true}
+	var s valueStats
+	queries := []*HLQuery{
+		newTestHLQuery("count", "usage_user", testStart, testStart.Add(4*time.Hour), time.Hour), // 0 (zero-filled), 2, 2 and 2 points, of both series
+		newTestHLQuery("count", "usage_user", testStart, testStart.Add(2*time.Hour), 0),         // the points at 1h of both series
+		newTestHLQuery("max", "usage_user", testStart.Add(4*time.Hour), testStart.Add(5*time.Hour), 0),
+	}
+	queries[2].HumanLabel = []byte("Cassandra max, empty")
+	for i, q := range queries {
+		_, _, info, err := hlqe.Do(q, opts)
+		if err != nil {
+			t.Fatalf("query %d: unexpected error: %v", i, err)
+		}
+		s.observe(string(q.HumanLabel), info.Values)
+	}
+
+	var buf bytes.Buffer
+	if err := s.writeTo(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Result values per query type:\n" +
+		"Cassandra max, empty: no values\n" +
+		string(queries[0].HumanLabel) + ": min 2, mean 2, max 2 (4 values)\n"
+	if got := buf.String(); got != want {
+		t.Errorf("incorrect summary: got %q want %q", got, want)
+	}
+
+	var empty valueStats
+	buf.Reset()
+	if err := empty.writeTo(&buf); err != nil || buf.Len() > 0 {
+		t.Errorf("no queries: got %q (%v) want nothing", buf.String(), err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A bucketSpread is a value of a time bucket that differs across the
+// repetitions of a query (see -verify-repeat), e.g. because replicas
+// disagree under a low consistency level.
+type bucketSpread struct {
+	Start, End  time.Time
+	Series      string // of raw results
+	Measurement string // of results of several measurements
+	Tags        string // of results grouped by tag, comma-separated
+	Value       int    // index of the value, or of the point of raw results
+	Min, Max    float64
+	Absent      bool // from some of the repetitions
+}
+
+// Spread returns the difference between the extreme values.
+func (s bucketSpread) Spread() float64 {
+	return s.Max - s.Min
+}
+
+// repeatResults executes a query plan again, opts.VerifyRepeat times in
+// all counting the first execution, and returns the values that differ
+// from those of the first results. Each repetition has its own
+// opts.Timeout.
+func (qe *HLQueryExecutor) repeatResults(q *HLQuery, qp QueryPlan, first []CQLResult, opts HLQueryExecutorDoOptions) ([]bucketSpread, error) {
+	runs := [][]CQLResult{first}
+	for i := 1; i < opts.VerifyRepeat; i++ {
+		ctx := opts.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		cancel := func() {}
+		if opts.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		}
+		if logs.Enabled(LogLevelWarn) {
+			ctx = withQueryLog(ctx, q)
+		}
+		results, err := qp.Execute(ctx, qe.session)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if results, _, err = postProcessResults(results, opts); err != nil {
+			return nil, err
+		}
+		runs = append(runs, results)
+	}
+	return compareRepetitions(runs, opts.VerifyTolerance), nil
+}
+
+// compareRepetitions returns the values of the buckets that differ across
+// the results of several executions of a query, in bucket order. Values are
+// equal within the tolerance: absolutely for values up to 1, relatively
+// above (as with tsbs_compare_responses). A value absent from some of the
+// executions differs.
+func compareRepetitions(runs [][]CQLResult, tolerance float64) []bucketSpread {
+	type valueKey struct {
+		measurement, tags, series string
+		start, end                int64
+		value                     int
+	}
+	spreads := map[valueKey]*bucketSpread{}
+	seen := map[valueKey]int{} // executions with the value
+	var keys []valueKey
+	for _, results := range runs {
+		for _, r := range results {
+			values := r.Values
+			if len(r.Series) > 0 {
+				values = make([]float64, len(r.Points))
+				for i, p := range r.Points {
+					values[i] = p.Value
+				}
+			}
+			for i, v := range values {
+				if len(r.Series) == 0 && r.IsAbsent(i) {
+					continue
+				}
+				tags := strings.Join(r.Tags, ",")
+				k := valueKey{r.Measurement, tags, r.Series, r.StartUnixNano(), r.EndUnixNano(), i}
+				s, ok := spreads[k]
+				if !ok {
+					s = &bucketSpread{Start: r.Start(), End: r.End(), Series: r.Series, Measurement: r.Measurement, Tags: tags, Value: i, Min: v, Max: v}
+					spreads[k] = s
+					keys = append(keys, k)
+				}
+				s.Min = math.Min(s.Min, v)
+				s.Max = math.Max(s.Max, v)
+				seen[k]++
+			}
+		}
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.start != b.start {
+			return a.start < b.start
+		}
+		if a.measurement != b.measurement {
+			return a.measurement < b.measurement
+		}
+		if a.tags != b.tags {
+			return a.tags < b.tags
+		}
+		if a.series != b.series {
+			return a.series < b.series
+		}
+		return a.value < b.value
+	})
+	var differing []bucketSpread
+	for _, k := range keys {
+		s := spreads[k]
+		s.Absent = seen[k] < len(runs)
+		scale := math.Max(1, math.Max(math.Abs(s.Min), math.Abs(s.Max)))
+		if s.Absent || !(s.Spread() <= tolerance*scale) {
+			differing = append(differing, *s)
+		}
+	}
+	return differing
+}
+
+// repeatStats counts the queries whose results differ across repetitions.
+// It is safe for concurrent use.
+type repeatStats struct {
+	mu        sync.Mutex
+	queries   uint64
+	differing uint64
+}
+
+// observe records the values of a query that differ across repetitions,
+// logging each of them as a warning.
+func (s *repeatStats) observe(id uint64, label string, differing []bucketSpread) {
+	s.mu.Lock()
+	s.queries++
+	if len(differing) > 0 {
+		s.differing++
+	}
+	s.mu.Unlock()
+
+	for _, d := range differing {
+		fields := []interface{}{"query_id", id, "label", label,
+			"start", d.Start.UTC().Format(time.RFC3339Nano), "end", d.End.UTC().Format(time.RFC3339Nano)}
+		if len(d.Measurement) > 0 {
+			fields = append(fields, "measurement", d.Measurement)
+		}
+		if len(d.Tags) > 0 {
+			fields = append(fields, "tags", d.Tags)
+		}
+		if len(d.Series) > 0 {
+			fields = append(fields, "series", d.Series)
+		}
+		fields = append(fields, "value", d.Value, "min", d.Min, "max", d.Max, "spread", d.Spread(), "absent", d.Absent)
+		logs.Log(LogLevelWarn, "query results differ across repetitions", fields...)
+	}
+}
+
+// writeTo writes the number of queries whose results differ across the
+// given number of repetitions. Nothing is written if no query was observed.
+func (s *repeatStats) writeTo(w io.Writer, repeat int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queries == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "Queries with results differing across %d repetitions: %d of %d\n", repeat, s.differing, s.queries)
+	return err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVerifyRepeat(t *testing.T) {
+	// the max of host_1 in the second hour grows with each execution, from
+	// 20 to 60:
+	var mu sync.Mutex
+	calls := map[string]int{}
+	unstableRows := func(stmt string, args []interface{}) ([][]interface{}, error) {
+		id := args[0].(string)
+		start := args[1].(int64)
+		mu.Lock()
+		defer mu.Unlock()
+		calls[id]++
+		if id == "cpu,hostname=host_1#usage_user#2016-01-01" && start == testStart.Add(time.Hour).UnixNano() {
+			return [][]interface{}{{float64(10 * calls[id])}}, nil
+		}
+		return [][]interface{}{{1.0}}, nil
+	}
+	csi := newTestClientSideIndex(2, 1, "usage_user")
+	cases := []struct {
+		desc      string
+		repeat    int
+		tolerance float64
+		wantCalls int
+		want      []bucketSpread
+	}{
+		{desc: "no repetition", repeat: 1, wantCalls: 4},
+		{
+			desc: "three repetitions", repeat: 3, tolerance: 1e-9, wantCalls: 12,
+			want: []bucketSpread{{Start: testStart.Add(time.Hour), End: testStart.Add(2 * time.Hour), Min: 20, Max: 60}},
+		},
+		{desc: "large tolerance", repeat: 3, tolerance: 1, wantCalls: 12},
+	}
+	for _, c := range cases {
+		calls = map[string]int{}
+		mock := &mockQueryExecutor{respond: unstableRows}
+		hlqe := NewHLQueryExecutor(mock, csi, 0)
+		q := newTestHLQuery("max", "usage_user", testStart, testStart.Add(2*time.Hour), time.Hour)
+		_, _, info, err := hlqe.Do(q, HLQueryExecutorDoOptions{
+			AggregationPlan: AggrPlanTypeWithServerAggregation,
+			VerifyRepeat:    c.repeat,
+			VerifyTolerance: c.tolerance,
+		})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if got := mock.Calls(); got != c.wantCalls {
+			t.Errorf("%s: incorrect number of CQL queries: got %d want %d", c.desc, got, c.wantCalls)
+		}
+		if len(info.Differing) != len(c.want) {
+			t.Fatalf("%s: incorrect differing values: got %v want %v", c.desc, info.Differing, c.want)
+		}
+		for i, got := range info.Differing {
+			want := c.want[i]
+			if !got.Start.Equal(want.Start) || !got.End.Equal(want.End) || got.Min != want.Min || got.Max != want.Max || got.Absent {
+				t.Errorf("%s: incorrect differing value %d: got %+v want %+v", c.desc, i, got, want)
+			}
+			if got.Spread() != 40 {
+				t.Errorf("%s: incorrect spread: got %v want %v", c.desc, got.Spread(), 40)
+			}
+		}
+	}
+}
+
+func TestCompareRepetitionsAbsent(t *testing.T) {
+	first := newTestCQLResults(t, []*float64{float64Ptr(1)}, []*float64{float64Ptr(2)})
+	second := newTestCQLResults(t, []*float64{float64Ptr(1)}, []*float64{nil})
+	got := compareRepetitions([][]CQLResult{first, second}, 1e-9)
+	if len(got) != 1 || !got[0].Absent || !got[0].Start.Equal(testStart.Add(time.Minute)) {
+		t.Errorf("incorrect differing values: got %+v want the absent second bucket", got)
+	}
+}
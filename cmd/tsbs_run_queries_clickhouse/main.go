@@ -7,6 +7,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"strings"
 	"time"
 
@@ -73,6 +74,9 @@ func init() {
 
 func main() {
 	runner.Run(&query.ClickHousePool, newProcessor)
+	if n := runner.Regressions(); n > 0 {
+		log.Fatalf("%d regressions from the baseline", n)
+	}
 }
 
 // Get the connection string for a connection to PostgreSQL.
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"time"
@@ -66,6 +67,9 @@ func init() {
 
 func main() {
 	runner.Run(&query.CrateDBPool, newProcessor)
+	if n := runner.Regressions(); n > 0 {
+		log.Fatalf("%d regressions from the baseline", n)
+	}
 }
 
 type processor struct {
@@ -76,6 +76,9 @@ func main() {
 		log.Fatal(err)
 	}
 	runner.Run(&query.MongoPool, newProcessor)
+	if n := runner.Regressions(); n > 0 {
+		log.Fatalf("%d regressions from the baseline", n)
+	}
 }
 
 type processor struct {
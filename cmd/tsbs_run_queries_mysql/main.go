@@ -9,6 +9,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"strings"
 	"time"
 
@@ -79,6 +80,9 @@ func init() {
 
 func main() {
 	runner.Run(&query.MysqlPool, newProcessor)
+	if n := runner.Regressions(); n > 0 {
+		log.Fatalf("%d regressions from the baseline", n)
+	}
 }
 
 func getConnectString(workerNumber int, dbName string) string {
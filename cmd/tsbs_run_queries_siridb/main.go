@@ -107,6 +107,9 @@ func main() {
 	CreateGroups()
 
 	runner.Run(&query.SiriDBPool, newProcessor)
+	if n := runner.Regressions(); n > 0 {
+		log.Fatalf("%d regressions from the baseline", n)
+	}
 	siridbConnector.Close()
 }
 
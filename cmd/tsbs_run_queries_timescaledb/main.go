@@ -9,6 +9,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"regexp"
 	"strings"
 	"time"
@@ -97,6 +98,9 @@ func init() {
 
 func main() {
 	runner.Run(&query.TimescaleDBPool, newProcessor)
+	if n := runner.Regressions(); n > 0 {
+		log.Fatalf("%d regressions from the baseline", n)
+	}
 }
 
 // Get the connection string for a connection to PostgreSQL.
@@ -59,6 +59,9 @@ func init() {
 
 func main() {
 	runner.Run(&query.HTTPPool, newProcessor)
+	if n := runner.Regressions(); n > 0 {
+		log.Fatalf("%d regressions from the baseline", n)
+	}
 }
 
 func newProcessor() query.Processor {
@@ -1,16 +1,26 @@
 package utils
 
 import (
+	"strings"
+
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
+// EnvPrefix is the prefix of the environment variables that set flags, e.g.
+// TSBS_MAX_QUERIES for -max-queries (see BindEnv).
+const EnvPrefix = "TSBS"
+
 // SetupConfigFile defines the settings for the configuration file support.
+// Flags may also be set by environment variables (see BindEnv).
 func SetupConfigFile() error {
 	viper.SetConfigName("config")
 	viper.AddConfigPath(".")
 
 	viper.BindPFlags(pflag.CommandLine)
+	if err := BindEnv(viper.GetViper(), pflag.CommandLine, EnvPrefix); err != nil {
+		return err
+	}
 
 	if err := viper.ReadInConfig(); err != nil {
 		// Ignore error if config file not found.
@@ -21,3 +31,24 @@ func SetupConfigFile() error {
 
 	return nil
 }
+
+// BindEnv binds each flag of fs to an environment variable named after it,
+// upper-cased with dashes replaced by underscores and the given prefix, e.g.
+// TSBS_MAX_QUERIES for max-queries. Flags set on the command line take
+// precedence over the environment, which takes precedence over the config
+// file and the defaults.
+func BindEnv(v *viper.Viper, fs *pflag.FlagSet, prefix string) error {
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if err == nil {
+			err = v.BindEnv(f.Name, EnvName(prefix, f.Name))
+		}
+	})
+	return err
+}
+
+// EnvName returns the name of the environment variable setting a flag (see
+// BindEnv).
+func EnvName(prefix, flag string) string {
+	return prefix + "_" + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func TestEnvName(t *testing.T) {
+	if got, want := EnvName(EnvPrefix, "max-queries"), "TSBS_MAX_QUERIES"; got != want {
+		t.Errorf("incorrect env var name: got %s want %s", got, want)
+	}
+}
+
+func TestBindEnv(t *testing.T) {
+	env := map[string]string{
+		"TSBS_MAX_QUERIES":  "5",
+		"TSBS_DB_NAME":      "from-env",
+		"TSBS_READ_TIMEOUT": "3s",
+	}
+	for k, val := range env {
+		os.Setenv(k, val)
+		defer os.Unsetenv(k)
+	}
+
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.Uint64("max-queries", 0, "")
+	fs.String("db-name", "benchmark", "")
+	fs.Duration("read-timeout", time.Second, "")
+	fs.Uint("workers", 1, "")
+	if err := fs.Parse([]string{"--db-name=from-flag"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v := viper.New()
+	v.BindPFlags(fs)
+	if err := BindEnv(v, fs, EnvPrefix); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var config struct {
+		Limit   uint64        `mapstructure:"max-queries"`
+		DBName  string        `mapstructure:"db-name"`
+		Timeout time.Duration `mapstructure:"read-timeout"`
+		Workers uint          `mapstructure:"workers"`
+	}
+	if err := v.Unmarshal(&config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.Limit != 5 {
+		t.Errorf("env var: incorrect max-queries: got %d want %d", config.Limit, 5)
+	}
+	if config.Timeout != 3*time.Second {
+		t.Errorf("env var: incorrect read-timeout: got %v want %v", config.Timeout, 3*time.Second)
+	}
+	if config.DBName != "from-flag" {
+		t.Errorf("flag and env var: incorrect db-name: got %s want %s", config.DBName, "from-flag")
+	}
+	if config.Workers != 1 {
+		t.Errorf("default: incorrect workers: got %d want %d", config.Workers, 1)
+	}
+	if got := v.GetInt("max-queries"); got != 5 {
+		t.Errorf("env var: incorrect max-queries from Get: got %d want %d", got, 5)
+	}
+}
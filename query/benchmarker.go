@@ -3,9 +3,12 @@ package query
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"os"
 	"runtime/pprof"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,39 +21,71 @@ const (
 	labelColdQueries = "cold queries"
 	labelWarmQueries = "warm queries"
 
+	labelIntervalQueries = "interval queries"
+
 	defaultReadSize = 4 << 20 // 4 MB
 )
 
 // BenchmarkRunnerConfig is the configuration of the benchmark runner.
 type BenchmarkRunnerConfig struct {
-	DBName           string `mapstructure:"db-name"`
-	Limit            uint64 `mapstructure:"max-queries"`
-	LimitRPS         uint64 `mapstructure:"max-rps"`
-	MemProfile       string `mapstructure:"memprofile"`
-	HDRLatenciesFile string `mapstructure:"hdr-latencies"`
-	Workers          uint   `mapstructure:"workers"`
-	PrintResponses   bool   `mapstructure:"print-responses"`
-	Debug            int    `mapstructure:"debug"`
-	FileName         string `mapstructure:"file"`
-	BurnIn           uint64 `mapstructure:"burn-in"`
-	PrintInterval    uint64 `mapstructure:"print-interval"`
-	PrewarmQueries   bool   `mapstructure:"prewarm-queries"`
+	DBName              string        `mapstructure:"db-name"`
+	Limit               uint64        `mapstructure:"max-queries"`
+	LimitRPS            uint64        `mapstructure:"max-rps"`
+	MemProfile          string        `mapstructure:"memprofile"`
+	HDRLatenciesFile    string        `mapstructure:"hdr-latencies"`
+	Workers             uint          `mapstructure:"workers"`
+	PrintResponses      bool          `mapstructure:"print-responses"`
+	Debug               int           `mapstructure:"debug"`
+	FileName            string        `mapstructure:"file"`
+	Gzip                bool          `mapstructure:"gzip"`
+	QueryFormat         string        `mapstructure:"query-format"`
+	BurnIn              uint64        `mapstructure:"burn-in"`
+	PrintInterval       uint64        `mapstructure:"print-interval"`
+	PrewarmQueries      bool          `mapstructure:"prewarm-queries"`
+	PrintPercentiles    bool          `mapstructure:"print-percentiles"`
+	WarmupDuration      time.Duration `mapstructure:"warmup-duration"`
+	QPSWindow           time.Duration `mapstructure:"qps-window"`
+	ReplayTrace         string        `mapstructure:"replay-trace"`
+	ReplaySpeed         float64       `mapstructure:"replay-speed"`
+	SampleRate          float64       `mapstructure:"sample-rate"`
+	Seed                int64         `mapstructure:"seed"`
+	Shuffle             bool          `mapstructure:"shuffle"`
+	ShuffleBuffer       int           `mapstructure:"shuffle-buffer"`
+	TargetQPS           float64       `mapstructure:"target-qps"`
+	SummaryFile         string        `mapstructure:"summary-json"`
+	Baseline            string        `mapstructure:"baseline"`
+	RegressionThreshold float64       `mapstructure:"regression-threshold"`
 }
 
 // AddToFlagSet adds command line flags needed by the BenchmarkRunnerConfig to the flag set.
 func (c BenchmarkRunnerConfig) AddToFlagSet(fs *pflag.FlagSet) {
 	fs.String("db-name", "benchmark", "Name of database to use for queries")
 	fs.Uint64("burn-in", 0, "Number of queries to ignore before collecting statistics.")
+	fs.Duration("warmup-duration", 0, "Duration from the start of the run during which queries are executed but left out of the statistics (before any burn-in).")
 	fs.Uint64("max-queries", 0, "Limit the number of queries to send, 0 = no limit")
 	fs.Uint64("max-rps", 0, "Limit the rate of queries per second, 0 = no limit")
+	fs.Float64("target-qps", 0, "Dispatch queries at this fixed rate per second across workers, reporting the depth of the queue of queries due but not dispatched yet (0 to run as fast as possible).")
 	fs.Uint64("print-interval", 100, "Print timing stats to stderr after this many queries (0 to disable)")
+	fs.Duration("qps-window", 10*time.Second, "Duration of the sliding window over which the query rate printed at each print interval is computed (0 to disable).")
 	fs.String("memprofile", "", "Write a memory profile to this file.")
 	fs.String("hdr-latencies", "", "Write the High Dynamic Range (HDR) Histogram of Response Latencies to this file.")
+	fs.String("summary-json", "", "Write the summary of the run (latencies by label and query rate) as JSON to this file, e.g. as the -baseline of later runs.")
+	fs.String("baseline", "", "Compare the run with the summary of a previous run in this file (as written by -summary-json), printing the changes of latencies and query rate.")
+	fs.Float64("regression-threshold", 10, "Change from the -baseline, in percent, beyond which a higher latency or a lower query rate is marked as a regression.")
 	fs.Uint("workers", 1, "Number of concurrent requests to make.")
 	fs.Bool("prewarm-queries", false, "Run each query twice in a row so the warm query is guaranteed to be a cache hit")
+	fs.Bool("print-percentiles", false, "Print latency percentiles (p50, p90, p95, p99, max) one metric per line, for the whole run and for each print interval.")
 	fs.Bool("print-responses", false, "Pretty print response bodies for correctness checking (default false).")
 	fs.Int("debug", 0, "Whether to print debug messages.")
 	fs.String("file", "", "File name to read queries from")
+	fs.Bool("gzip", false, "Whether the queries are gzip-compressed (implied by a -file ending in .gz).")
+	fs.String("query-format", QueryFormatGob, "Encoding of the queries read from -file or stdin (choices: gob, ndjson); ndjson reads one JSON query per line, e.g. from generators not written in Go.")
+	fs.String("replay-trace", "", "File name to read a query trace from (instead of -file), issuing each query at its recorded offset from the start of the run.")
+	fs.Float64("sample-rate", 1, "Fraction (between 0 and 1) of the queries to execute, each decoded query being sampled at random with this probability (0 or 1 to execute all of them).")
+	fs.Int64("seed", 0, "PRNG seed of -sample-rate and -shuffle (default: 0, which uses the current timestamp)")
+	fs.Bool("shuffle", false, "Execute the queries in a random order, rather than in the order of the input (see -shuffle-buffer).")
+	fs.Int("shuffle-buffer", 0, "Maximum number of queries held in memory by -shuffle, each one being shuffled with those read around it (0 to read and shuffle all of them).")
+	fs.Float64("replay-speed", 1, "Speed-up of the replay of -replay-trace, e.g. 2 issues queries twice as fast as recorded.")
 }
 
 // BenchmarkRunner contains the common components for running a query benchmarking
@@ -61,19 +96,43 @@ type BenchmarkRunner struct {
 	sp      statProcessor
 	scanner *scanner
 	ch      chan Query
+
+	stop     chan struct{} // closed by Stop
+	stopOnce sync.Once
+
+	warmupEnd time.Time // queries started before it are burned
+	pacer     *pacer    // of the dispatch of queries, with TargetQPS
 }
 
 // NewBenchmarkRunner creates a new instance of BenchmarkRunner which is
 // common functionality to be used by query benchmarker programs
 func NewBenchmarkRunner(config BenchmarkRunnerConfig) *BenchmarkRunner {
-	runner := &BenchmarkRunner{BenchmarkRunnerConfig: config}
-	runner.scanner = newScanner(&runner.Limit)
+	runner := &BenchmarkRunner{BenchmarkRunnerConfig: config, stop: make(chan struct{})}
+	runner.scanner = newScanner(&runner.Limit).setFormat(runner.QueryFormat)
+	sampling := runner.SampleRate > 0 && runner.SampleRate < 1
+	if sampling || runner.Shuffle {
+		if runner.Seed == 0 {
+			runner.Seed = time.Now().UnixNano()
+		}
+		rng := rand.New(rand.NewSource(runner.Seed))
+		if sampling {
+			runner.scanner.setSampling(runner.SampleRate, rng)
+		}
+		if runner.Shuffle {
+			runner.scanner.setShuffle(runner.ShuffleBuffer, rng)
+		}
+	}
 	spArgs := &statProcessorArgs{
-		limit:          &runner.Limit,
-		printInterval:  runner.PrintInterval,
-		prewarmQueries: runner.PrewarmQueries,
-		burnIn:         runner.BurnIn,
-		hdrLatenciesFile: runner.HDRLatenciesFile,
+		limit:               &runner.Limit,
+		printInterval:       runner.PrintInterval,
+		prewarmQueries:      runner.PrewarmQueries,
+		burnIn:              runner.BurnIn,
+		hdrLatenciesFile:    runner.HDRLatenciesFile,
+		printPercentiles:    runner.PrintPercentiles,
+		warmupDuration:      runner.WarmupDuration,
+		qpsWindow:           runner.QPSWindow,
+		summaryFile:         runner.SummaryFile,
+		regressionThreshold: runner.RegressionThreshold,
 	}
 
 	runner.sp = newStatProcessor(spArgs)
@@ -85,6 +144,24 @@ func (b *BenchmarkRunner) SetLimit(limit uint64) {
 	b.Limit = limit
 }
 
+// Stop makes Run stop reading queries: queries being processed finish, but
+// those not yet started are dropped, and Run returns after printing the stats
+// of the queries processed so far. It may be called from any goroutine (e.g.
+// a signal handler), and more than once.
+func (b *BenchmarkRunner) Stop() {
+	b.stopOnce.Do(func() { close(b.stop) })
+}
+
+// stopped reports whether Stop has been called.
+func (b *BenchmarkRunner) stopped() bool {
+	select {
+	case <-b.stop:
+		return true
+	default:
+		return false
+	}
+}
+
 // DoPrintResponses indicates whether responses for queries should be printed
 func (b *BenchmarkRunner) DoPrintResponses() bool {
 	return b.PrintResponses
@@ -100,6 +177,13 @@ func (b *BenchmarkRunner) DatabaseName() string {
 	return b.DBName
 }
 
+// Regressions returns the number of regressions from the -baseline once Run
+// has returned, so that a run with any can exit with a non-zero status after
+// its own output has been written
+func (b *BenchmarkRunner) Regressions() int {
+	return b.sp.getArgs().regressions
+}
+
 // ProcessorCreate is a function that creates a new Processor (called in Run)
 type ProcessorCreate func() Processor
 
@@ -115,17 +199,27 @@ type Processor interface {
 // GetBufferedReader returns the buffered Reader that should be used by the loader
 func (b *BenchmarkRunner) GetBufferedReader() *bufio.Reader {
 	if b.br == nil {
+		var r io.Reader
+		name := "stdin"
 		if len(b.FileName) > 0 {
 			// Read from specified file
 			file, err := os.Open(b.FileName)
 			if err != nil {
 				panic(fmt.Sprintf("cannot open file for read %s: %v", b.FileName, err))
 			}
-			b.br = bufio.NewReaderSize(file, defaultReadSize)
+			r, name = file, b.FileName
 		} else {
 			// Read from STDIN
-			b.br = bufio.NewReaderSize(os.Stdin, defaultReadSize)
+			r = os.Stdin
+		}
+		if b.Gzip || strings.HasSuffix(b.FileName, ".gz") {
+			zr, err := newGzipReader(r, name)
+			if err != nil {
+				panic(err.Error())
+			}
+			r = zr
 		}
+		b.br = bufio.NewReaderSize(r, defaultReadSize)
 	}
 	return b.br
 }
@@ -142,24 +236,68 @@ func (b *BenchmarkRunner) Run(queryPool *sync.Pool, processorCreateFn ProcessorC
 	if spArgs.burnIn > b.Limit {
 		panic("burn-in is larger than limit")
 	}
+	if len(b.ReplayTrace) > 0 && b.ReplaySpeed <= 0 {
+		panic("replay speed must be positive")
+	}
+	if b.SampleRate < 0 || b.SampleRate > 1 {
+		panic("sample rate must be between 0 and 1")
+	}
+	if b.Shuffle && len(b.ReplayTrace) > 0 {
+		panic("cannot shuffle the queries of a replayed trace")
+	}
+	if _, err := newQueryDecoder(nil, b.QueryFormat); err != nil {
+		panic(err.Error())
+	}
+	if b.QueryFormat == QueryFormatNDJSON && len(b.ReplayTrace) > 0 {
+		panic("replayed traces are gob streams, whatever the query format")
+	}
+	if b.ShuffleBuffer < 0 {
+		panic("shuffle buffer must not be negative")
+	}
+	if b.TargetQPS < 0 {
+		panic("target qps must not be negative")
+	}
+	if b.TargetQPS > 0 && (b.LimitRPS > 0 || len(b.ReplayTrace) > 0) {
+		panic("target qps cannot be combined with max-rps or replay-trace")
+	}
+	if b.RegressionThreshold < 0 {
+		panic("regression threshold must not be negative")
+	}
+	if len(b.Baseline) > 0 {
+		// read now, not to fail at the end of the run:
+		baseline, err := readRunSummary(b.Baseline)
+		if err != nil {
+			panic(fmt.Sprintf("cannot read baseline: %v", err))
+		}
+		b.sp.getArgs().baseline = baseline
+	}
 	b.ch = make(chan Query, b.Workers)
 
 	// Launch the stats processor:
+	b.sp.init(b.Workers)
 	go b.sp.process(b.Workers)
 
-	rateLimiter := getRateLimiter(b.LimitRPS,b.Workers)
+	rateLimiter := getRateLimiter(b.LimitRPS, b.Workers)
 
 	// Launch query processors
+	b.warmupEnd = time.Now().Add(b.WarmupDuration)
+	if b.TargetQPS > 0 {
+		b.pacer = newPacer(b.TargetQPS, time.Now(), os.Stderr)
+	}
 	var wg sync.WaitGroup
 	for i := 0; i < int(b.Workers); i++ {
 		wg.Add(1)
-		go b.processorHandler(&wg, rateLimiter, queryPool, processorCreateFn(), i)
+		go b.processorHandler(&wg, rateLimiter, processorCreateFn(), i)
 	}
 
 	// Read in jobs, closing the job channel when done:
 	// Wall clock start time
 	wallStart := time.Now()
-	b.scanner.setReader(b.GetBufferedReader()).scan(queryPool, b.ch)
+	if len(b.ReplayTrace) > 0 {
+		b.replay(queryPool)
+	} else {
+		b.scanner.setReader(b.GetBufferedReader()).scan(queryPool, b.ch, b.stop)
+	}
 	close(b.ch)
 
 	// Block for workers to finish sending requests, closing the stats channel when done:
@@ -169,10 +307,26 @@ func (b *BenchmarkRunner) Run(queryPool *sync.Pool, processorCreateFn ProcessorC
 	// Wall clock end time
 	wallEnd := time.Now()
 	wallTook := wallEnd.Sub(wallStart)
+	if b.scanner.rng != nil {
+		_, err := fmt.Printf("sampled %d of %d queries (sample rate %v, seed %d)\n", b.scanner.sampled, b.scanner.read, b.SampleRate, b.Seed)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if b.Shuffle {
+		if _, err := fmt.Printf("shuffled queries (seed %d)\n", b.Seed); err != nil {
+			log.Fatal(err)
+		}
+	}
 	_, err := fmt.Printf("wall clock time: %fsec\n", float64(wallTook.Nanoseconds())/1e9)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if b.pacer != nil {
+		if err := b.pacer.writeTo(os.Stdout, wallTook); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// (Optional) create a memory profile:
 	if len(b.MemProfile) > 0 {
@@ -185,23 +339,39 @@ func (b *BenchmarkRunner) Run(queryPool *sync.Pool, processorCreateFn ProcessorC
 	}
 }
 
-func (b *BenchmarkRunner) processorHandler(wg *sync.WaitGroup, rateLimiter *rate.Limiter, queryPool *sync.Pool, processor Processor, workerNum int) {
+func (b *BenchmarkRunner) processorHandler(wg *sync.WaitGroup, rateLimiter *rate.Limiter, processor Processor, workerNum int) {
 	processor.Init(workerNum)
 	for query := range b.ch {
-		r := rateLimiter.Reserve()
-		time.Sleep(r.Delay())
+		// queries still queued once stopped are dropped:
+		if b.stopped() {
+			query.Release()
+			continue
+		}
+		if b.pacer != nil {
+			b.pacer.wait()
+		} else {
+			r := rateLimiter.Reserve()
+			time.Sleep(r.Delay())
+		}
 
+		// Queries started during the warmup are executed, but their stats
+		// are only counted as burned:
+		warmup := time.Now().Before(b.warmupEnd)
 		stats, err := processor.ProcessQuery(query, false)
 		if err != nil {
 			panic(err)
 		}
-		b.sp.send(stats)
+		if warmup {
+			b.sp.sendWarmup(stats)
+		} else {
+			b.sp.send(stats)
+		}
 
 		// If PrewarmQueries is set, we run the query as 'cold' first (see above),
 		// then we immediately run it a second time and report that as the 'warm' stat.
 		// This guarantees that the warm stat will reflect optimal cache performance.
 		spArgs := b.sp.getArgs()
-		if spArgs.prewarmQueries {
+		if spArgs.prewarmQueries && !warmup {
 			// Warm run
 			stats, err = processor.ProcessQuery(query, true)
 			if err != nil {
@@ -209,7 +379,10 @@ func (b *BenchmarkRunner) processorHandler(wg *sync.WaitGroup, rateLimiter *rate
 			}
 			b.sp.sendWarm(stats)
 		}
-		queryPool.Put(query)
+		// Release resets the query before returning it to its pool, as
+		// decoding the next query into it does not overwrite fields that
+		// are zero in the encoded query:
+		query.Release()
 	}
 	wg.Done()
 }
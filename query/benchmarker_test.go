@@ -43,8 +43,8 @@ func TestProcessorHandler(t *testing.T) {
 	var requestBurst = 0
 	var rateLimiter *rate.Limiter = rate.NewLimiter(requestRate, requestBurst)
 
-	go b.processorHandler(&wg, rateLimiter, qPool, p1, 0)
-	go b.processorHandler(&wg, rateLimiter, qPool, p2, 5)
+	go b.processorHandler(&wg, rateLimiter, p1, 0)
+	go b.processorHandler(&wg, rateLimiter, p2, 5)
 	for i := 0; i < qLimit; i++ {
 		q := qPool.Get().(*testQuery)
 		b.ch <- q
@@ -85,8 +85,8 @@ func TestProcessorHandlerPreWarm(t *testing.T) {
 	var wg sync.WaitGroup
 	qPool := &testQueryPool
 	wg.Add(2)
-	go b.processorHandler(&wg, rateLimiter, qPool, p1, 0)
-	go b.processorHandler(&wg, rateLimiter, qPool, p2, 5)
+	go b.processorHandler(&wg, rateLimiter, p1, 0)
+	go b.processorHandler(&wg, rateLimiter, p2, 5)
 	for i := 0; i < qLimit; i++ {
 		q := qPool.Get().(*testQuery)
 		b.ch <- q
@@ -104,6 +104,36 @@ func TestProcessorHandlerPreWarm(t *testing.T) {
 		t.Errorf("total queries wrong: want %d got %d", 2*qLimit, p1.count+p2.count)
 	}
 }
+
+func TestProcessorHandlerStop(t *testing.T) {
+	qLimit := 5
+	p := &testProcessor{}
+	b := NewBenchmarkRunner(BenchmarkRunnerConfig{})
+	b.ch = make(chan Query, qLimit)
+	qPool := &testQueryPool
+	for i := 0; i < qLimit; i++ {
+		b.ch <- qPool.Get().(*testQuery)
+	}
+	close(b.ch)
+	b.Stop()
+	b.Stop() // stopping twice is fine
+
+	// queries queued before Stop are dropped:
+	var wg sync.WaitGroup
+	wg.Add(1)
+	b.processorHandler(&wg, rate.NewLimiter(rate.Inf, 0), p, 0)
+	if p.count != 0 {
+		t.Errorf("queries processed after Stop: want 0 got %d", p.count)
+	}
+
+	// and no more queries are scanned:
+	c := make(chan Query, 1)
+	b.scanner.setReader(strings.NewReader("not a query")).scan(qPool, c, b.stop)
+	if len(c) != 0 {
+		t.Errorf("queries scanned after Stop: want 0 got %d", len(c))
+	}
+}
+
 func TestBenchmarkRunnerGetBufferedReaderPanicOnMissingFile(t *testing.T) {
 	dumbFileName := "some-random-file-that-should-not-exist"
 	_, err := os.Stat(dumbFileName)
@@ -316,6 +346,12 @@ func (m *mockStatProcessor) sendWarm(stats []*Stat) {
 		m.onSend(stats)
 	}
 }
+func (m *mockStatProcessor) sendWarmup(stats []*Stat) {
+	if m.onSend != nil {
+		m.onSend(stats)
+	}
+}
+func (m *mockStatProcessor) init(workers uint) {}
 func (m *mockStatProcessor) process(workers uint) {
 	if m.onProcess != nil {
 		m.onProcess(workers)
@@ -1,6 +1,9 @@
 package query
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -13,17 +16,22 @@ type Cassandra struct {
 	HumanDescription []byte
 	id               uint64
 
-	MeasurementName []byte // e.g. "cpu"
+	MeasurementName []byte // e.g. "cpu", or "cpu,mem" for several
 	FieldName       []byte // e.g. "usage_user"
+	FieldExpression []byte // e.g. "usage_user + usage_system", aggregated instead of FieldName
 	AggregationType []byte // e.g. "avg" or "sum". used literally in the cassandra query.
 	TimeStart       time.Time
 	TimeEnd         time.Time
 	GroupByDuration time.Duration
+	GroupByCalendar []byte // e.g. "1mo", "1y" or "1w"; overrides GroupByDuration
 	ForEveryN       []byte // e.g. "hostname,1"
 	WhereClause     []byte // e.g. "usage_user,>,90.0"
 	OrderBy         []byte // e.g. "timestamp_ns DESC"
 	Limit           int
-	TagSets         [][]string // semantically, each subgroup is OR'ed and they are all AND'ed together
+	GroupLimit      int            // of time buckets: the first ones, or the last ones for OrderBy "timestamp_ns DESC"
+	TagSets         [][]string     // semantically, each subgroup is OR'ed and they are all AND'ed together
+	GroupByTagKeys  []byte         // e.g. "hostname", or comma-separated for several; results are grouped by their values
+	TimeBuckets     [][2]time.Time // e.g. business hours: the start and end of each time bucket, instead of those of GroupByDuration or GroupByCalendar
 }
 
 //CassandraPool is a sync.Pool of Cassandra Query types
@@ -34,11 +42,15 @@ var CassandraPool = sync.Pool{
 			HumanDescription: []byte{},
 			MeasurementName:  []byte{},
 			FieldName:        []byte{},
+			FieldExpression:  []byte{},
 			AggregationType:  []byte{},
+			GroupByCalendar:  []byte{},
 			ForEveryN:        []byte{},
 			WhereClause:      []byte{},
 			OrderBy:          []byte{},
 			TagSets:          [][]string{},
+			GroupByTagKeys:   []byte{},
+			TimeBuckets:      [][2]time.Time{},
 		}
 	},
 }
@@ -60,7 +72,7 @@ func (q *Cassandra) SetID(n uint64) {
 
 // String produces a debug-ready description of a Query.
 func (q *Cassandra) String() string {
-	return fmt.Sprintf("HumanLabel: %s, HumanDescription: %s, MeasurementName: %s, AggregationType: %s, TimeStart: %s, TimeEnd: %s, GroupByDuration: %s, TagSets: %s", q.HumanLabel, q.HumanDescription, q.MeasurementName, q.AggregationType, q.TimeStart, q.TimeEnd, q.GroupByDuration, q.TagSets)
+	return fmt.Sprintf("HumanLabel: %s, HumanDescription: %s, MeasurementName: %s, FieldExpression: %s, AggregationType: %s, TimeStart: %s, TimeEnd: %s, GroupByDuration: %s, GroupByCalendar: %s, GroupLimit: %d, TagSets: %s, GroupByTagKeys: %s, TimeBuckets: %v", q.HumanLabel, q.HumanDescription, q.MeasurementName, q.FieldExpression, q.AggregationType, q.TimeStart, q.TimeEnd, q.GroupByDuration, q.GroupByCalendar, q.GroupLimit, q.TagSets, q.GroupByTagKeys, q.TimeBuckets)
 }
 
 // HumanLabelName returns the human readable name of this Query
@@ -81,15 +93,87 @@ func (q *Cassandra) Release() {
 
 	q.MeasurementName = q.MeasurementName[:0]
 	q.FieldName = q.FieldName[:0]
+	q.FieldExpression = q.FieldExpression[:0]
 	q.AggregationType = q.AggregationType[:0]
 	q.GroupByDuration = 0
+	q.GroupByCalendar = q.GroupByCalendar[:0]
 	q.TimeStart = time.Time{}
 	q.TimeEnd = time.Time{}
 	q.ForEveryN = q.ForEveryN[:0]
 	q.WhereClause = q.WhereClause[:0]
 	q.OrderBy = q.OrderBy[:0]
 	q.Limit = 0
+	q.GroupLimit = 0
 	q.TagSets = q.TagSets[:0]
+	q.GroupByTagKeys = q.GroupByTagKeys[:0]
+	q.TimeBuckets = q.TimeBuckets[:0]
 
 	CassandraPool.Put(q)
 }
+
+// UnmarshalJSON decodes a query of an NDJSON stream (see -query-format),
+// whose []byte fields are plain strings or {"base64": "..."} objects, and
+// whose GroupByDuration is a number of nanoseconds or a duration string.
+// The record must have a HumanLabel, a MeasurementName, and a time range and
+// TimeBuckets that do not end before they start.
+func (q *Cassandra) UnmarshalJSON(data []byte) error {
+	var r struct {
+		HumanLabel       ndjsonBytes
+		HumanDescription ndjsonBytes
+		MeasurementName  ndjsonBytes
+		FieldName        ndjsonBytes
+		FieldExpression  ndjsonBytes
+		AggregationType  ndjsonBytes
+		TimeStart        time.Time
+		TimeEnd          time.Time
+		GroupByDuration  ndjsonDuration
+		GroupByCalendar  ndjsonBytes
+		ForEveryN        ndjsonBytes
+		WhereClause      ndjsonBytes
+		OrderBy          ndjsonBytes
+		Limit            int
+		GroupLimit       int
+		TagSets          [][]string
+		GroupByTagKeys   ndjsonBytes
+		TimeBuckets      [][2]time.Time
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&r); err != nil {
+		return err
+	}
+	switch {
+	case len(r.HumanLabel) == 0:
+		return errors.New("missing HumanLabel")
+	case len(r.MeasurementName) == 0:
+		return errors.New("missing MeasurementName")
+	case r.TimeEnd.Before(r.TimeStart):
+		return fmt.Errorf("TimeEnd %s before TimeStart %s", r.TimeEnd, r.TimeStart)
+	}
+	for i, b := range r.TimeBuckets {
+		if b[1].Before(b[0]) {
+			return fmt.Errorf("time bucket %d ends at %s before it starts at %s", i, b[1], b[0])
+		}
+	}
+
+	// reuse the buffers of pooled queries, as gob does:
+	q.HumanLabel = append(q.HumanLabel[:0], r.HumanLabel...)
+	q.HumanDescription = append(q.HumanDescription[:0], r.HumanDescription...)
+	q.MeasurementName = append(q.MeasurementName[:0], r.MeasurementName...)
+	q.FieldName = append(q.FieldName[:0], r.FieldName...)
+	q.FieldExpression = append(q.FieldExpression[:0], r.FieldExpression...)
+	q.AggregationType = append(q.AggregationType[:0], r.AggregationType...)
+	q.TimeStart = r.TimeStart
+	q.TimeEnd = r.TimeEnd
+	q.GroupByDuration = time.Duration(r.GroupByDuration)
+	q.GroupByCalendar = append(q.GroupByCalendar[:0], r.GroupByCalendar...)
+	q.ForEveryN = append(q.ForEveryN[:0], r.ForEveryN...)
+	q.WhereClause = append(q.WhereClause[:0], r.WhereClause...)
+	q.OrderBy = append(q.OrderBy[:0], r.OrderBy...)
+	q.Limit = r.Limit
+	q.GroupLimit = r.GroupLimit
+	q.TagSets = append(q.TagSets[:0], r.TagSets...)
+	q.GroupByTagKeys = append(q.GroupByTagKeys[:0], r.GroupByTagKeys...)
+	q.TimeBuckets = append(q.TimeBuckets[:0], r.TimeBuckets...)
+	return nil
+}
@@ -1,6 +1,7 @@
 package query
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -14,6 +15,9 @@ func TestNewCassandra(t *testing.T) {
 		if got := len(q.FieldName); got != 0 {
 			t.Errorf("new query has non-0 field name: got %d", got)
 		}
+		if got := len(q.FieldExpression); got != 0 {
+			t.Errorf("new query has non-0 field expression: got %d", got)
+		}
 		if got := len(q.AggregationType); got != 0 {
 			t.Errorf("new query has non-0 agg type: got %d", got)
 		}
@@ -35,6 +39,15 @@ func TestNewCassandra(t *testing.T) {
 		if got := q.GroupByDuration; got != 0 {
 			t.Errorf("new query has non-0 group by duration: got %v", q.GroupByDuration)
 		}
+		if got := len(q.GroupByCalendar); got != 0 {
+			t.Errorf("new query has non-0 group by calendar: got %d", got)
+		}
+		if got := len(q.GroupByTagKeys); got != 0 {
+			t.Errorf("new query has non-0 group by tag keys: got %d", got)
+		}
+		if got := len(q.TimeBuckets); got != 0 {
+			t.Errorf("new query has non-0 time buckets: got %d", got)
+		}
 	}
 	q := NewCassandra()
 	check(q)
@@ -42,13 +55,17 @@ func TestNewCassandra(t *testing.T) {
 	q.HumanDescription = []byte("bar")
 	q.MeasurementName = []byte("baz")
 	q.FieldName = []byte("quaz")
+	q.FieldExpression = []byte("quaz * 2")
 	q.AggregationType = []byte("client")
 	q.GroupByDuration = time.Second
+	q.GroupByCalendar = []byte("1mo")
 	q.ForEveryN = []byte("5m")
 	q.WhereClause = []byte("TRUE > FALSE")
 	q.OrderBy = []byte("quaz ASC")
 	q.Limit = 5
 	q.TagSets = append(q.TagSets, []string{"foo"})
+	q.GroupByTagKeys = []byte("hostname")
+	q.TimeBuckets = append(q.TimeBuckets, [2]time.Time{time.Unix(0, 0), time.Unix(60, 0)})
 	q.SetID(1)
 	if got := string(q.HumanLabelName()); got != "foo" {
 		t.Errorf("incorrect label name: got %s", got)
@@ -71,3 +88,17 @@ func TestCassandraSetAndGetID(t *testing.T) {
 		q.Release()
 	}
 }
+
+func TestCassandraString(t *testing.T) {
+	q := NewCassandra()
+	defer q.Release()
+	q.FieldExpression = []byte("usage_user + usage_system")
+	q.GroupByCalendar = []byte("1mo")
+	q.GroupLimit = 5
+	got := q.String()
+	for _, want := range []string{"FieldExpression: usage_user + usage_system,", "GroupByCalendar: 1mo,", "GroupLimit: 5,"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("incorrect string: got %s want one containing %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package query
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// gzipReader decompresses a gzip-compressed stream of queries, reporting
+// its read errors (e.g. of a truncated file) as such, rather than as gob
+// decoding errors.
+type gzipReader struct {
+	zr   *gzip.Reader
+	name string
+}
+
+// newGzipReader returns a reader of the decompressed queries of r, read
+// from the file (or stdin) of the given name.
+func newGzipReader(r io.Reader, name string) (io.Reader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read gzip-compressed queries from %s: %v", name, err)
+	}
+	return &gzipReader{zr: zr, name: name}, nil
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	n, err := r.zr.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("gzip-compressed queries from %s are truncated or corrupt: %v", r.name, err)
+	}
+	return n, err
+}
@@ -0,0 +1,75 @@
+package query
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// gzipQueries returns a gzip-compressed gob stream of test queries with the
+// given labels.
+func gzipQueries(t *testing.T, labels ...string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := gob.NewEncoder(zw)
+	for _, l := range labels {
+		if err := enc.Encode(&testQuery{HumanLabel: []byte(l)}); err != nil {
+			t.Fatalf("encode error: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("compress error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestBenchmarkRunnerGetBufferedReaderGzip(t *testing.T) {
+	f, err := ioutil.TempFile("", "queries_*.gz")
+	if err != nil {
+		t.Fatalf("could not create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(gzipQueries(t, "a", "b", "c")); err != nil {
+		t.Fatalf("could not write temp file: %v", err)
+	}
+	f.Close()
+
+	b := &BenchmarkRunner{BenchmarkRunnerConfig: BenchmarkRunnerConfig{FileName: f.Name()}}
+	dec := gob.NewDecoder(b.GetBufferedReader())
+	var got []string
+	for i := 0; i < 3; i++ {
+		q := &testQuery{}
+		if err := dec.Decode(q); err != nil {
+			t.Fatalf("decode error: %v", err)
+		}
+		got = append(got, string(q.HumanLabel))
+	}
+	if strings.Join(got, ",") != "a,b,c" {
+		t.Errorf("incorrect queries: got %v want [a b c]", got)
+	}
+}
+
+func TestGzipReaderErrors(t *testing.T) {
+	compressed := gzipQueries(t, strings.Repeat("x", 1000))
+	cases := []struct {
+		desc string
+		data []byte
+		want string
+	}{
+		{desc: "not compressed", data: []byte("not gzip at all"), want: "cannot read gzip-compressed queries from test.gz"},
+		{desc: "truncated", data: compressed[:len(compressed)/2], want: "gzip-compressed queries from test.gz are truncated or corrupt"},
+	}
+	for _, c := range cases {
+		r, err := newGzipReader(bytes.NewReader(c.data), "test.gz")
+		if err == nil {
+			err = gob.NewDecoder(r).Decode(&testQuery{})
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), c.want) {
+			t.Errorf("%s: incorrect error: got %v want %s", c.desc, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package query
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Formats of the queries read by a scanner (see -query-format).
+const (
+	QueryFormatGob    = "gob"    // a gob stream, as written by the Go generator
+	QueryFormatNDJSON = "ndjson" // one JSON query per line
+)
+
+// A queryDecoder decodes the queries read by a scanner, one at a time.
+type queryDecoder interface {
+	Decode(e interface{}) error
+}
+
+// newQueryDecoder returns the decoder of the queries of r in the given
+// format, gob if empty.
+func newQueryDecoder(r io.Reader, format string) (queryDecoder, error) {
+	switch format {
+	case "", QueryFormatGob:
+		return gob.NewDecoder(r), nil
+	case QueryFormatNDJSON:
+		return &ndjsonDecoder{r: bufio.NewReader(r)}, nil
+	default:
+		return nil, fmt.Errorf("unknown query format %q (choices: %s, %s)", format, QueryFormatGob, QueryFormatNDJSON)
+	}
+}
+
+// An ndjsonDecoder decodes newline-delimited JSON queries, one JSON object
+// per line, so that queries can be generated by programs not written in Go.
+// Blank lines are skipped. Queries are decoded by encoding/json, with
+// unknown fields rejected; those implementing json.Unmarshaler, such as
+// Cassandra, also validate their records. Errors report the line number.
+type ndjsonDecoder struct {
+	r    *bufio.Reader
+	line int
+}
+
+// Decode decodes the query of the next non-blank line into e, returning
+// io.EOF at the end of the input.
+func (d *ndjsonDecoder) Decode(e interface{}) error {
+	for {
+		b, err := d.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(b) > 0 {
+			d.line++
+		}
+		if len(bytes.TrimSpace(b)) == 0 {
+			if err == io.EOF {
+				return io.EOF
+			}
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(e); err != nil {
+			return fmt.Errorf("invalid query on line %d: %v", d.line, err)
+		}
+		if dec.More() {
+			return fmt.Errorf("invalid query on line %d: more than one JSON value", d.line)
+		}
+		return nil
+	}
+}
+
+// ndjsonBytes decodes the []byte fields of NDJSON queries, either from a
+// plain JSON string or from an object {"base64": "..."} for arbitrary bytes.
+type ndjsonBytes []byte
+
+func (b *ndjsonBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*b = ndjsonBytes(s)
+		return nil
+	}
+	var encoded struct {
+		Base64 *string `json:"base64"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&encoded); err != nil || encoded.Base64 == nil {
+		return fmt.Errorf("want a string or an object {\"base64\": \"...\"}, got %s", data)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(*encoded.Base64)
+	if err != nil {
+		return fmt.Errorf("invalid base64 %q: %v", *encoded.Base64, err)
+	}
+	*b = decoded
+	return nil
+}
+
+// ndjsonDuration decodes the durations of NDJSON queries, either from a
+// number of nanoseconds, as encoding/json writes a time.Duration, or from a
+// string parsed by time.ParseDuration, e.g. "1h".
+type ndjsonDuration time.Duration
+
+func (d *ndjsonDuration) UnmarshalJSON(data []byte) error {
+	var ns int64
+	if err := json.Unmarshal(data, &ns); err == nil {
+		*d = ndjsonDuration(ns)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("want a number of nanoseconds or a duration string, got %s", data)
+	}
+	parsed, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil {
+		return err
+	}
+	*d = ndjsonDuration(parsed)
+	return nil
+}
@@ -0,0 +1,99 @@
+package query
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNDJSONDecoderCassandra(t *testing.T) {
+	input := `{"HumanLabel": "Cassandra max cpu, rand 8 hosts, 1h by 5m", "MeasurementName": "cpu", "FieldName": "usage_user", "AggregationType": "max", "TimeStart": "2016-01-01T00:00:00Z", "TimeEnd": "2016-01-01T01:00:00Z", "GroupByDuration": "5m", "TagSets": [["hostname=host_1", "hostname=host_2"]]}
+
+{"HumanLabel": {"base64": "bGFzdHBvaW50"}, "MeasurementName": "cpu", "ForEveryN": "hostname,1", "GroupByDuration": 60000000000, "Limit": 1, "OrderBy": "timestamp_ns DESC"}
+{"HumanLabel": "business hours", "MeasurementName": "cpu", "FieldName": "usage_user", "AggregationType": "avg", "TimeStart": "2016-01-01T00:00:00Z", "TimeEnd": "2016-01-02T00:00:00Z", "TimeBuckets": [["2016-01-01T09:00:00Z", "2016-01-01T17:00:00Z"]]}
+`
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	want := []*Cassandra{
+		{
+			HumanLabel:      []byte("Cassandra max cpu, rand 8 hosts, 1h by 5m"),
+			MeasurementName: []byte("cpu"),
+			FieldName:       []byte("usage_user"),
+			AggregationType: []byte("max"),
+			TimeStart:       start,
+			TimeEnd:         start.Add(time.Hour),
+			GroupByDuration: 5 * time.Minute,
+			TagSets:         [][]string{{"hostname=host_1", "hostname=host_2"}},
+		},
+		{
+			HumanLabel:      []byte("lastpoint"),
+			MeasurementName: []byte("cpu"),
+			ForEveryN:       []byte("hostname,1"),
+			GroupByDuration: time.Minute,
+			Limit:           1,
+			OrderBy:         []byte("timestamp_ns DESC"),
+		},
+		{
+			HumanLabel:      []byte("business hours"),
+			MeasurementName: []byte("cpu"),
+			FieldName:       []byte("usage_user"),
+			AggregationType: []byte("avg"),
+			TimeStart:       start,
+			TimeEnd:         start.Add(24 * time.Hour),
+			TimeBuckets:     [][2]time.Time{{start.Add(9 * time.Hour), start.Add(17 * time.Hour)}},
+		},
+	}
+
+	dec, err := newQueryDecoder(strings.NewReader(input), QueryFormatNDJSON)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, w := range want {
+		q := &Cassandra{}
+		if err := dec.Decode(q); err != nil {
+			t.Fatalf("query %d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(q, w) {
+			t.Errorf("query %d: incorrect query: got %s want %s", i, q, w)
+		}
+	}
+	if err := dec.Decode(&Cassandra{}); err != io.EOF {
+		t.Errorf("incorrect error at the end of the input: got %v want %v", err, io.EOF)
+	}
+}
+
+func TestNDJSONDecoderErrors(t *testing.T) {
+	valid := `{"HumanLabel": "q", "MeasurementName": "cpu"}`
+	cases := []struct {
+		desc  string
+		input string
+		want  string
+	}{
+		{desc: "malformed", input: valid + "\n{\"HumanLabel\": \n", want: "line 2"},
+		{desc: "unknown field", input: valid + "\n\n" + `{"HumanLabel": "q", "MeasurementName": "cpu", "Field": "usage_user"}`, want: "line 3"},
+		{desc: "missing label", input: `{"MeasurementName": "cpu"}`, want: "line 1: missing HumanLabel"},
+		{desc: "missing measurement", input: `{"HumanLabel": "q"}`, want: "line 1: missing MeasurementName"},
+		{desc: "time range", input: `{"HumanLabel": "q", "MeasurementName": "cpu", "TimeStart": "2016-01-02T00:00:00Z", "TimeEnd": "2016-01-01T00:00:00Z"}`, want: "TimeEnd"},
+		{desc: "time bucket", input: `{"HumanLabel": "q", "MeasurementName": "cpu", "TimeBuckets": [["2016-01-02T00:00:00Z", "2016-01-01T00:00:00Z"]]}`, want: "line 1: time bucket 0"},
+		{desc: "invalid base64", input: `{"HumanLabel": {"base64": "!"}, "MeasurementName": "cpu"}`, want: "line 1"},
+		{desc: "invalid duration", input: `{"HumanLabel": "q", "MeasurementName": "cpu", "GroupByDuration": "hourly"}`, want: "line 1"},
+		{desc: "two values", input: valid + " " + valid, want: "line 1: more than one JSON value"},
+	}
+	for _, c := range cases {
+		dec, err := newQueryDecoder(strings.NewReader(c.input), QueryFormatNDJSON)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		for err == nil {
+			err = dec.Decode(&Cassandra{})
+		}
+		if err == io.EOF || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: incorrect error: got %v want one containing %q", c.desc, err, c.want)
+		}
+	}
+
+	if _, err := newQueryDecoder(strings.NewReader(""), "csv"); err == nil {
+		t.Errorf("unknown format: expected an error")
+	}
+}
@@ -0,0 +1,97 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// A pacer holds the dispatch of queries to the workers at a target rate
+// (set by -target-qps), with a token bucket shared across them, instead of
+// running as fast as possible. The queries offered at that rate but not
+// dispatched yet, because all workers are busy, make its queue: a queue
+// depth that keeps growing shows that the database cannot keep up with the
+// target rate. It is safe for concurrent use.
+type pacer struct {
+	limiter *rate.Limiter
+	rate    float64 // in queries per second
+	start   time.Time
+	w       io.Writer // of the reports of the queue depth growing
+
+	mu           sync.Mutex
+	dispatched   uint64
+	maxDepth     uint64
+	maxDepthAt   time.Duration // from start
+	growingSince time.Duration // from start, of the current backlog, or -1
+	reported     uint64        // queue depth last reported
+}
+
+// newPacer returns a pacer of the given rate from start on, reporting the
+// growth of its queue to w.
+func newPacer(qps float64, start time.Time, w io.Writer) *pacer {
+	return &pacer{
+		limiter:      rate.NewLimiter(rate.Limit(qps), 1),
+		rate:         qps,
+		start:        start,
+		w:            w,
+		growingSince: -1,
+	}
+}
+
+// wait blocks until the next query is due, then records its dispatch.
+func (p *pacer) wait() {
+	p.limiter.Wait(context.Background())
+	p.dispatch(time.Now())
+}
+
+// dispatch records a query dispatched at now, returning the depth of the
+// queue left: the queries due by then (the first one being due at start)
+// that are not dispatched yet.
+func (p *pacer) dispatch(now time.Time) uint64 {
+	elapsed := now.Sub(p.start)
+	due := uint64(elapsed.Seconds()*p.rate) + 1
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dispatched++
+	var depth uint64
+	if due > p.dispatched {
+		depth = due - p.dispatched
+	}
+	if depth == 0 {
+		p.growingSince, p.reported = -1, 0
+		return 0
+	}
+	if p.growingSince < 0 {
+		p.growingSince = elapsed
+	}
+	if depth > p.maxDepth {
+		p.maxDepth, p.maxDepthAt = depth, elapsed
+	}
+	// each doubling is reported, so that the saturation point shows
+	// without a line per query:
+	if depth >= 2 && depth >= 2*p.reported {
+		p.reported = depth
+		fmt.Fprintf(p.w, "queue depth %d at %.1fsec (target rate %g queries/sec)\n", depth, elapsed.Seconds(), p.rate)
+	}
+	return depth
+}
+
+// writeTo writes the rate achieved over took, compared with the target,
+// the maximum queue depth, and since when queries were queued if they still
+// were at the last dispatch.
+func (p *pacer) writeTo(w io.Writer, took time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	msg := fmt.Sprintf("target rate: %g queries/sec, achieved %.2f queries/sec; max queue depth %d at %.1fsec",
+		p.rate, float64(p.dispatched)/took.Seconds(), p.maxDepth, p.maxDepthAt.Seconds())
+	if p.growingSince >= 0 {
+		msg += fmt.Sprintf(", still queued at the end (since %.1fsec)", p.growingSince.Seconds())
+	}
+	_, err := fmt.Fprintln(w, msg)
+	return err
+}
@@ -0,0 +1,72 @@
+package query
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacerRate(t *testing.T) {
+	const qps, window, workers = 200, 300 * time.Millisecond, 4
+	var buf bytes.Buffer
+	p := newPacer(qps, time.Now(), &buf)
+
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(window)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				p.wait()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the first query is due at once, then one every 5ms:
+	want := float64(qps)*window.Seconds() + 1
+	if got := float64(p.dispatched); got < 0.8*want || got > 1.2*want+float64(workers) {
+		t.Errorf("incorrect number of queries dispatched: got %v want about %v", got, want)
+	}
+}
+
+func TestPacerQueueDepth(t *testing.T) {
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	p := newPacer(10, start, &buf)
+
+	cases := []struct {
+		desc  string
+		at    time.Duration
+		depth uint64
+	}{
+		{desc: "first query", at: 0, depth: 0},
+		{desc: "on time", at: 100 * time.Millisecond, depth: 0},
+		{desc: "late", at: time.Second, depth: 8},       // 11 due, 3 dispatched
+		{desc: "later", at: 3 * time.Second, depth: 27}, // 31 due, 4 dispatched
+		{desc: "catching up", at: 3 * time.Second, depth: 26},
+	}
+	for _, c := range cases {
+		if got := p.dispatch(start.Add(c.at)); got != c.depth {
+			t.Errorf("%s: incorrect queue depth: got %d want %d", c.desc, got, c.depth)
+		}
+	}
+	if p.maxDepth != 27 || p.maxDepthAt != 3*time.Second {
+		t.Errorf("incorrect max queue depth: got %d at %v want 27 at 3s", p.maxDepth, p.maxDepthAt)
+	}
+	want := "queue depth 8 at 1.0sec (target rate 10 queries/sec)\nqueue depth 27 at 3.0sec (target rate 10 queries/sec)\n"
+	if got := buf.String(); got != want {
+		t.Errorf("incorrect reports:\ngot\n%s\nwant\n%s", got, want)
+	}
+
+	buf.Reset()
+	if err := p.writeTo(&buf, 4*time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := buf.String(); !strings.HasPrefix(got, "target rate: 10 queries/sec, achieved 1.25 queries/sec; max queue depth 27 at 3.0sec, still queued at the end (since 1.0sec)") {
+		t.Errorf("incorrect summary: %s", got)
+	}
+}
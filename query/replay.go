@@ -0,0 +1,133 @@
+package query
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A query trace is a gob stream of queries, each preceded by the offset
+// (an int64 of nanoseconds) from the start of the trace at which it was
+// issued. Replaying it issues each query at its offset, divided by the
+// replay speed, from the start of the run, reproducing the arrival pattern
+// of the traced load instead of saturating the database.
+
+// WriteTraceEntry encodes a query issued at offset from the start of a trace.
+func WriteTraceEntry(enc *gob.Encoder, offset time.Duration, q Query) error {
+	if err := enc.Encode(int64(offset)); err != nil {
+		return err
+	}
+	return enc.Encode(q)
+}
+
+// A tracedQuery is a query read from a trace, with its offset.
+type tracedQuery struct {
+	q      Query
+	offset time.Duration
+}
+
+// scanTrace reads the entries of a trace and places them into a channel,
+// until the reader is exhausted, the limit is reached or stop is closed.
+func (s *scanner) scanTrace(pool *sync.Pool, c chan<- tracedQuery, stop <-chan struct{}) {
+	decoder := gob.NewDecoder(s.r)
+
+	n := uint64(0)
+	for {
+		if *s.limit > 0 && n >= *s.limit {
+			break
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		var offset int64
+		err := decoder.Decode(&offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		q := pool.Get().(Query)
+		if err := decoder.Decode(q); err != nil {
+			log.Fatal(err)
+		}
+
+		id := s.read
+		if s.skip() {
+			q.Release()
+			continue
+		}
+		q.SetID(id)
+		select {
+		case c <- tracedQuery{q: q, offset: time.Duration(offset)}:
+		case <-stop:
+			q.Release()
+			return
+		}
+		n++
+	}
+}
+
+// schedule sends the queries read from in to out once they are due: at
+// their offset divided by speed after start. It returns when in is closed,
+// or when stop is, releasing the queries not sent yet.
+func schedule(in <-chan tracedQuery, out chan<- Query, start time.Time, speed float64, stop <-chan struct{}) {
+	for tq := range in {
+		due := start.Add(time.Duration(float64(tq.offset) / speed))
+		if wait := time.Until(due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-stop:
+				timer.Stop()
+			}
+		}
+		select {
+		case <-stop:
+			tq.q.Release()
+			continue
+		default:
+		}
+		select {
+		case out <- tq.q:
+		case <-stop:
+			tq.q.Release()
+		}
+	}
+}
+
+// replay issues the queries of the ReplayTrace to the workers at their
+// recorded times. Queries wait for a free worker once due, so -workers
+// should cover the concurrency of the traced load.
+func (b *BenchmarkRunner) replay(queryPool *sync.Pool) {
+	file, err := os.Open(b.ReplayTrace)
+	if err != nil {
+		panic(fmt.Sprintf("cannot open file for read %s: %v", b.ReplayTrace, err))
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if b.Gzip || strings.HasSuffix(b.ReplayTrace, ".gz") {
+		if r, err = newGzipReader(file, b.ReplayTrace); err != nil {
+			panic(err.Error())
+		}
+	}
+
+	traced := make(chan tracedQuery, b.Workers)
+	done := make(chan struct{})
+	go func() {
+		schedule(traced, b.ch, time.Now(), b.ReplaySpeed, b.stop)
+		close(done)
+	}()
+	b.scanner.setReader(bufio.NewReaderSize(r, defaultReadSize)).scanTrace(queryPool, traced, b.stop)
+	close(traced)
+	<-done
+}
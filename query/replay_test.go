@@ -0,0 +1,49 @@
+package query
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReplayTrace(t *testing.T) {
+	f, err := ioutil.TempFile("", "trace_*")
+	if err != nil {
+		t.Fatalf("could not create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	enc := gob.NewEncoder(f)
+	for i, offset := range []time.Duration{0, 200 * time.Millisecond} {
+		q := &testQuery{HumanLabel: []byte{byte('a' + i)}}
+		if err := WriteTraceEntry(enc, offset, q); err != nil {
+			t.Fatalf("encode error: %v", err)
+		}
+	}
+	f.Close()
+
+	b := NewBenchmarkRunner(BenchmarkRunnerConfig{Workers: 1, ReplayTrace: f.Name(), ReplaySpeed: 2})
+	b.ch = make(chan Query, 2)
+	go func() {
+		b.replay(&testQueryPool)
+		close(b.ch)
+	}()
+
+	var labels []string
+	var issued []time.Time
+	for q := range b.ch {
+		labels = append(labels, string(q.HumanLabelName()))
+		issued = append(issued, time.Now())
+	}
+	if len(labels) != 2 || labels[0] != "a" || labels[1] != "b" {
+		t.Fatalf("incorrect queries: got %v want [a b]", labels)
+	}
+
+	// at twice the recorded speed, the second query is issued 100ms after
+	// the first:
+	delay := issued[1].Sub(issued[0])
+	if delay < 90*time.Millisecond || delay >= 190*time.Millisecond {
+		t.Errorf("incorrect inter-issue delay: got %v want about %v", delay, 100*time.Millisecond)
+	}
+}
@@ -1,17 +1,31 @@
 package query
 
 import (
-	"encoding/gob"
 	"io"
 	"log"
+	"math/rand"
 	"sync"
 )
 
 // scanner is used to read in Queries from a Reader where they are
-// Go-encoded and then distribute them to workers
+// Go-encoded (or NDJSON-encoded, see setFormat) and then distribute them to
+// workers
 type scanner struct {
 	r     io.Reader
 	limit *uint64
+
+	// if rng is set, each query is only sent with probability sampleRate:
+	sampleRate float64
+	rng        *rand.Rand
+	read       uint64 // queries decoded
+	sampled    uint64 // queries sent
+
+	// if shuffleRNG is set, queries are sent in a random order, drawn from
+	// shuffleRNG, among up to shuffleBuffer of them (0 for all):
+	shuffleRNG    *rand.Rand
+	shuffleBuffer int
+
+	format string // of the queries, see newQueryDecoder
 }
 
 // newScanner returns a new scanner for a given Reader and its limit
@@ -25,9 +39,56 @@ func (s *scanner) setReader(r io.Reader) *scanner {
 	return s
 }
 
-// scan reads encoded Queries and places them into a channel
-func (s *scanner) scan(pool *sync.Pool, c chan Query) {
-	decoder := gob.NewDecoder(s.r)
+// setSampling makes the scanner send each query it reads with probability
+// rate, drawn from rng, and skip the others.
+func (s *scanner) setSampling(rate float64, rng *rand.Rand) *scanner {
+	s.sampleRate = rate
+	s.rng = rng
+	return s
+}
+
+// setShuffle makes the scanner send the queries it reads in a random order,
+// drawn from rng. With a positive buffer, at most that many queries are held
+// at once: once the buffer is full, each query read takes the place of one
+// sent at random from the buffer, so that queries are only shuffled with
+// those read around them. Otherwise all of the queries are read first.
+func (s *scanner) setShuffle(buffer int, rng *rand.Rand) *scanner {
+	s.shuffleBuffer = buffer
+	s.shuffleRNG = rng
+	return s
+}
+
+// setFormat sets the format of the queries the scanner reads, gob by
+// default.
+func (s *scanner) setFormat(format string) *scanner {
+	s.format = format
+	return s
+}
+
+// skip counts a decoded query, and reports whether it is left out of the
+// sample.
+func (s *scanner) skip() bool {
+	s.read++
+	if s.rng != nil && s.rng.Float64() >= s.sampleRate {
+		return true
+	}
+	s.sampled++
+	return false
+}
+
+// scan reads encoded Queries and places them into a channel, until the
+// reader is exhausted, the limit is reached or stop is closed
+func (s *scanner) scan(pool *sync.Pool, c chan Query, stop <-chan struct{}) {
+	decoder, err := newQueryDecoder(s.r, s.format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var buffer []Query
+	defer func() {
+		for _, q := range buffer {
+			q.Release()
+		}
+	}()
 
 	n := uint64(0)
 	for {
@@ -35,6 +96,12 @@ func (s *scanner) scan(pool *sync.Pool, c chan Query) {
 			// request queries limit reached, time to quit
 			break
 		}
+		select {
+		case <-stop:
+			// stopped, e.g. on interrupt
+			return
+		default:
+		}
 
 		q := pool.Get().(Query)
 		err := decoder.Decode(q)
@@ -47,11 +114,48 @@ func (s *scanner) scan(pool *sync.Pool, c chan Query) {
 			log.Fatal(err)
 		}
 
-		// We have a query, send it to the runner
-		q.SetID(n)
-		c <- q
+		// We have a query, send it to the runner, unless it is not sampled;
+		// its ID is its position in the input:
+		id := s.read
+		if s.skip() {
+			q.Release()
+			continue
+		}
+		q.SetID(id)
+		if s.shuffleRNG != nil {
+			// hold the query, sending one at random once the buffer is full:
+			buffer = append(buffer, q)
+			if s.shuffleBuffer <= 0 || len(buffer) <= s.shuffleBuffer {
+				n++
+				continue
+			}
+			i := s.shuffleRNG.Intn(len(buffer))
+			q = buffer[i]
+			buffer[i] = buffer[len(buffer)-1]
+			buffer = buffer[:len(buffer)-1]
+		}
+		select {
+		case c <- q:
+		case <-stop:
+			q.Release()
+			return
+		}
 
 		// Queries counter
 		n++
 	}
+
+	// send the queries left in the buffer, shuffled:
+	if s.shuffleRNG == nil {
+		return
+	}
+	s.shuffleRNG.Shuffle(len(buffer), func(i, j int) { buffer[i], buffer[j] = buffer[j], buffer[i] })
+	for len(buffer) > 0 {
+		select {
+		case c <- buffer[0]:
+			buffer = buffer[1:]
+		case <-stop:
+			return
+		}
+	}
 }
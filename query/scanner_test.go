@@ -5,6 +5,10 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -66,7 +70,7 @@ func runScan(t *testing.T, b *bytes.Buffer, limit, numQueries uint64, pool *sync
 		wg.Done()
 	}()
 	input := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), 1<<20)
-	scanner.setReader(input).scan(pool, queryChan)
+	scanner.setReader(input).scan(pool, queryChan, nil)
 	close(queryChan)
 	wg.Wait()
 	if got != numQueries {
@@ -150,3 +154,132 @@ func TestScanTimescaleDB(t *testing.T) {
 		return nil
 	})
 }
+
+func TestScannerSampling(t *testing.T) {
+	totalQueries := uint64(100)
+	var b bytes.Buffer
+	err := encodeQueries(&b, totalQueries, func(i uint64) Query {
+		return &testQuery{HumanLabel: []byte(fmt.Sprintf("q%d", i))}
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// sampleIDs returns the IDs of the queries sampled at rate 0.5 with seed.
+	sampleIDs := func(seed int64) []uint64 {
+		limit := uint64(0)
+		s := newScanner(&limit).setSampling(0.5, rand.New(rand.NewSource(seed)))
+		c := make(chan Query, totalQueries)
+		s.setReader(bytes.NewReader(b.Bytes())).scan(&testQueryPool, c, nil)
+		close(c)
+		ids := []uint64{}
+		for q := range c {
+			// the ID of a sampled query is its position in the input:
+			if want := fmt.Sprintf("q%d", q.GetID()); string(q.HumanLabelName()) != want {
+				t.Errorf("incorrect ID of %s: got %d", q.HumanLabelName(), q.GetID())
+			}
+			ids = append(ids, q.GetID())
+		}
+		if s.read != totalQueries || s.sampled != uint64(len(ids)) {
+			t.Errorf("incorrect counts: got %d of %d want %d of %d", s.sampled, s.read, len(ids), totalQueries)
+		}
+		return ids
+	}
+
+	ids := sampleIDs(42)
+	if len(ids) < 30 || len(ids) > 70 {
+		t.Errorf("incorrect sample size: got %d of %d", len(ids), totalQueries)
+	}
+	if again := sampleIDs(42); !reflect.DeepEqual(again, ids) {
+		t.Errorf("sample not deterministic for a fixed seed:\ngot\n%v\nwant\n%v", again, ids)
+	}
+	if other := sampleIDs(43); reflect.DeepEqual(other, ids) {
+		t.Errorf("same sample for different seeds: %v", ids)
+	}
+}
+
+func TestScannerShuffle(t *testing.T) {
+	totalQueries := uint64(100)
+	var b bytes.Buffer
+	err := encodeQueries(&b, totalQueries, func(i uint64) Query {
+		return &testQuery{HumanLabel: []byte(fmt.Sprintf("q%d", i))}
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// shuffledIDs returns the IDs of the queries in the order sent when
+	// shuffled with seed and buffer, up to limit.
+	shuffledIDs := func(seed int64, buffer int, limit uint64) []uint64 {
+		s := newScanner(&limit).setShuffle(buffer, rand.New(rand.NewSource(seed)))
+		c := make(chan Query, totalQueries)
+		s.setReader(bytes.NewReader(b.Bytes())).scan(&testQueryPool, c, nil)
+		close(c)
+		ids := []uint64{}
+		for q := range c {
+			if want := fmt.Sprintf("q%d", q.GetID()); string(q.HumanLabelName()) != want {
+				t.Errorf("incorrect ID of %s: got %d", q.HumanLabelName(), q.GetID())
+			}
+			ids = append(ids, q.GetID())
+		}
+		return ids
+	}
+	inOrder := make([]uint64, totalQueries)
+	for i := range inOrder {
+		inOrder[i] = uint64(i)
+	}
+
+	cases := []struct {
+		desc   string
+		buffer int
+	}{
+		{desc: "unbounded", buffer: 0},
+		{desc: "buffer of 10", buffer: 10},
+	}
+	for _, c := range cases {
+		ids := shuffledIDs(42, c.buffer, 0)
+		if reflect.DeepEqual(ids, inOrder) {
+			t.Errorf("%s: queries not shuffled", c.desc)
+		}
+		sorted := append([]uint64{}, ids...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		if !reflect.DeepEqual(sorted, inOrder) {
+			t.Errorf("%s: incorrect queries: got %v", c.desc, ids)
+		}
+		if again := shuffledIDs(42, c.buffer, 0); !reflect.DeepEqual(again, ids) {
+			t.Errorf("%s: order not deterministic for a fixed seed:\ngot\n%v\nwant\n%v", c.desc, again, ids)
+		}
+		if other := shuffledIDs(43, c.buffer, 0); reflect.DeepEqual(other, ids) {
+			t.Errorf("%s: same order for different seeds: %v", c.desc, ids)
+		}
+	}
+
+	// with a buffer, a query is sent at most a buffer ahead of its position:
+	ids := shuffledIDs(42, 10, 0)
+	for i, id := range ids {
+		if id > uint64(i+10) {
+			t.Errorf("query %d sent at position %d, more than a buffer ahead", id, i)
+		}
+	}
+
+	// the limit holds for the shuffled queries:
+	if got := len(shuffledIDs(42, 10, 25)); got != 25 {
+		t.Errorf("incorrect number of queries with a limit: got %d want %d", got, 25)
+	}
+}
+
+func TestScannerNDJSON(t *testing.T) {
+	input := "{\"ID\": 7, \"HumanLabel\": \"cTA=\"}\n\n{\"HumanLabel\": \"cTE=\"}\n"
+	limit := uint64(0)
+	c := make(chan Query, 2)
+	newScanner(&limit).setFormat(QueryFormatNDJSON).setReader(strings.NewReader(input)).scan(&testQueryPool, c, nil)
+	close(c)
+	got := []string{}
+	for q := range c {
+		// the ID of a query is its position in the input, as with gob:
+		got = append(got, fmt.Sprintf("%d %s", q.GetID(), q.HumanLabelName()))
+	}
+	if want := []string{"0 q0", "1 q1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect queries: got %v want %v", got, want)
+	}
+}
@@ -2,6 +2,7 @@ package query
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -15,25 +16,34 @@ type statProcessor interface {
 	getArgs() *statProcessorArgs
 	send(stats []*Stat)
 	sendWarm(stats []*Stat)
+	sendWarmup(stats []*Stat)
+	init(workers uint)
 	process(workers uint)
 	CloseAndWait()
 }
 
 type statProcessorArgs struct {
-	prewarmQueries bool    // PrewarmQueries tells the StatProcessor whether we're running each query twice to prewarm the cache
-	limit          *uint64 // limit is the number of statistics to analyze before stopping
-	burnIn         uint64  // burnIn is the number of statistics to ignore before analyzing
-	printInterval  uint64  // printInterval is how often print intermediate stats (number of queries)
-	hdrLatenciesFile string // hdrLatenciesFile is the filename to Write the High Dynamic Range (HDR) Histogram of Response Latencies to
+	prewarmQueries      bool          // PrewarmQueries tells the StatProcessor whether we're running each query twice to prewarm the cache
+	limit               *uint64       // limit is the number of statistics to analyze before stopping
+	burnIn              uint64        // burnIn is the number of statistics to ignore before analyzing
+	printInterval       uint64        // printInterval is how often print intermediate stats (number of queries)
+	hdrLatenciesFile    string        // hdrLatenciesFile is the filename to Write the High Dynamic Range (HDR) Histogram of Response Latencies to
+	printPercentiles    bool          // printPercentiles tells the StatProcessor to also print latency percentiles, one metric per line
+	warmupDuration      time.Duration // warmupDuration is how long queries are started for before their stats are analyzed
+	qpsWindow           time.Duration // qpsWindow is the duration of the sliding window of the printed query rate, if positive
+	summaryFile         string        // summaryFile is the filename to Write the JSON summary of the run to
+	baseline            *RunSummary   // baseline is the summary of a previous run to compare the run with, if any
+	regressionThreshold float64       // regressionThreshold is the change from the baseline, in percent, marked as a regression
+	regressions         int           // regressions is the number of regressions from the baseline, once the run is complete
 
 }
 
 // statProcessor is used to collect, analyze, and print query execution statistics.
 type defaultStatProcessor struct {
-	args *statProcessorArgs
-	wg   sync.WaitGroup
-	c    chan *Stat // c is the channel for Stats to be sent for processing
-	opsCount 	uint64
+	args     *statProcessorArgs
+	wg       sync.WaitGroup
+	c        chan *Stat // c is the channel for Stats to be sent for processing
+	opsCount uint64
 }
 
 func newStatProcessor(args *statProcessorArgs) statProcessor {
@@ -68,11 +78,30 @@ func (sp *defaultStatProcessor) sendWarm(stats []*Stat) {
 	sp.send(stats)
 }
 
+// sendWarmup sends the stats of a query started during the warmup, which
+// are only counted as burned.
+func (sp *defaultStatProcessor) sendWarmup(stats []*Stat) {
+	if stats == nil {
+		return
+	}
+
+	for _, s := range stats {
+		s.isWarmup = true
+	}
+	sp.send(stats)
+}
+
+// init prepares the channel of stats for processing. It must be called
+// before process is started and stats are sent, so that workers never send
+// on a nil channel.
+func (sp *defaultStatProcessor) init(workers uint) {
+	sp.c = make(chan *Stat, workers)
+	sp.wg.Add(1)
+}
+
 // process collects latency results, aggregating them into summary
 // statistics. Optionally, they are printed to stderr at regular intervals.
 func (sp *defaultStatProcessor) process(workers uint) {
-	sp.c = make(chan *Stat, workers)
-	sp.wg.Add(1)
 	const allQueriesLabel = labelAllQueries
 	statMapping := map[string]*statGroup{
 		allQueriesLabel: newStatGroup(*sp.args.limit),
@@ -83,13 +112,41 @@ func (sp *defaultStatProcessor) process(workers uint) {
 		statMapping[labelWarmQueries] = newStatGroup(*sp.args.limit)
 	}
 
+	// intervalGroup holds the latencies since the last print, and is reset
+	// after every print
+	intervalGroup := newStatGroup(*sp.args.limit)
+
 	i := uint64(0)
+	warmedUp := uint64(0) // queries burned by the warmup
+	warmupDone := false
 	start := time.Now()
 	prevTime := start
 	prevRequestCount := uint64(0)
 
+	// window holds the queries completed recently, including those burned
+	var window *rateWindow
+	if sp.args.qpsWindow > 0 {
+		window = newRateWindow(sp.args.qpsWindow, start)
+	}
+
 	for stat := range sp.c {
 		atomic.AddUint64(&sp.opsCount, 1)
+		if window != nil && !stat.isPartial {
+			window.add(time.Now(), 1)
+		}
+		if stat.isWarmup {
+			if !stat.isPartial {
+				warmedUp++
+			}
+			statPool.Put(stat)
+			continue
+		} else if warmedUp > 0 && !warmupDone {
+			warmupDone = true
+			_, err := fmt.Fprintf(os.Stderr, "warmup of %v complete after %d queries with %d workers\n", sp.args.warmupDuration, warmedUp, workers)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 		if i < sp.args.burnIn {
 			i++
 			statPool.Put(stat)
@@ -108,6 +165,7 @@ func (sp *defaultStatProcessor) process(workers uint) {
 
 		if !stat.isPartial {
 			statMapping[allQueriesLabel].push(stat.value)
+			intervalGroup.push(stat.value)
 
 			// Only needed when differentiating between cold & warm
 			if sp.args.prewarmQueries {
@@ -135,7 +193,7 @@ func (sp *defaultStatProcessor) process(workers uint) {
 			took := now.Sub(prevTime)
 			intervalQueryRate := float64(sp.opsCount-prevRequestCount) / float64(took.Seconds())
 			overallQueryRate := float64(sp.opsCount) / float64(sinceStart.Seconds())
-			_, err := fmt.Fprintf(os.Stderr, "After %d queries with %d workers:\nInterval query rate: %0.2f queries/sec\tOverall query rate: %0.2f queries/sec\n",
+			_, err := fmt.Fprintf(os.Stderr, "After %d queries with %d workers:\nInterval query rate: %0.2f queries/sec\tOverall query rate: %0.2f queries/sec",
 				i-sp.args.burnIn,
 				workers,
 				intervalQueryRate,
@@ -144,10 +202,36 @@ func (sp *defaultStatProcessor) process(workers uint) {
 			if err != nil {
 				log.Fatal(err)
 			}
+			if window != nil {
+				_, err = fmt.Fprintf(os.Stderr, "\tWindowed (%v) query rate: %0.2f queries/sec", sp.args.qpsWindow, window.rate(now))
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+			_, err = fmt.Fprintln(os.Stderr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			// like the other stats, without the burn-in queries:
+			total := *sp.args.limit
+			if total > 0 {
+				total -= sp.args.burnIn
+			}
+			err = writeProgress(os.Stderr, i-sp.args.burnIn, total, sinceStart)
+			if err != nil {
+				log.Fatal(err)
+			}
 			err = writeStatGroupMap(os.Stderr, statMapping)
 			if err != nil {
 				log.Fatal(err)
 			}
+			if sp.args.printPercentiles {
+				err = intervalGroup.writePercentiles(os.Stderr, labelIntervalQueries)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+			intervalGroup.reset()
 			_, err = fmt.Fprintf(os.Stderr, "\n")
 			if err != nil {
 				log.Fatal(err)
@@ -159,16 +243,28 @@ func (sp *defaultStatProcessor) process(workers uint) {
 	sinceStart := time.Now().Sub(start)
 	overallQueryRate := float64(sp.opsCount) / float64(sinceStart.Seconds())
 	// the final stats output goes to stdout:
-	_, err := fmt.Printf("Run complete after %d queries with %d workers (Overall query rate %0.2f queries/sec):\n", i-sp.args.burnIn, workers,overallQueryRate)
+	_, err := fmt.Printf("Run complete after %d queries with %d workers (Overall query rate %0.2f queries/sec):\n", i-sp.args.burnIn, workers, overallQueryRate)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if warmedUp > 0 {
+		_, err = fmt.Printf("Queries burned by warmup (not in stats): %d\n", warmedUp)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	err = writeStatGroupMap(os.Stdout, statMapping)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if sp.args.printPercentiles {
+		err = writeStatGroupMapPercentiles(os.Stdout, statMapping)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	if len(sp.args.hdrLatenciesFile) > 0  {
+	if len(sp.args.hdrLatenciesFile) > 0 {
 		_, _ = fmt.Printf("Saving High Dynamic Range (HDR) Histogram of Response Latencies to %s\n", sp.args.hdrLatenciesFile)
 
 		d1 := []byte(statMapping[allQueriesLabel].latencyHDRHistogram.PercentilesPrint(10, 1000.0))
@@ -179,9 +275,44 @@ func (sp *defaultStatProcessor) process(workers uint) {
 
 	}
 
+	if len(sp.args.summaryFile) > 0 || sp.args.baseline != nil {
+		summary := newRunSummary(statMapping, i-sp.args.burnIn, workers, overallQueryRate)
+		if sp.args.baseline != nil {
+			sp.args.regressions, err = compareRunSummaries(os.Stdout, sp.args.baseline, summary, sp.args.regressionThreshold)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if len(sp.args.summaryFile) > 0 {
+			_, _ = fmt.Printf("Saving run summary to %s\n", sp.args.summaryFile)
+			err = writeRunSummary(sp.args.summaryFile, summary)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
 	sp.wg.Done()
 }
 
+// writeProgress writes the progress of the run after completed queries out
+// of total (0 if unknown, i.e. without -max-queries), with the rate of the
+// queries completed so far and, if total is known, the estimated time until
+// the run is complete.
+func writeProgress(w io.Writer, completed, total uint64, elapsed time.Duration) error {
+	rate := float64(completed) / elapsed.Seconds()
+	if total == 0 {
+		_, err := fmt.Fprintf(w, "Progress: %d queries, %0.2f queries/sec\n", completed, rate)
+		return err
+	}
+	eta := "unknown"
+	if rate > 0 && completed <= total {
+		eta = time.Duration(float64(total-completed) / rate * float64(time.Second)).Round(time.Second).String()
+	}
+	_, err := fmt.Fprintf(w, "Progress: %d/%d queries (%0.1f%%), %0.2f queries/sec, ETA %s\n", completed, total, 100*float64(completed)/float64(total), rate, eta)
+	return err
+}
+
 // CloseAndWait closes the stats channel and blocks until the StatProcessor has finished all the stats on its channel.
 func (sp *defaultStatProcessor) CloseAndWait() {
 	close(sp.c)
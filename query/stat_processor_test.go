@@ -1,6 +1,9 @@
 package query
 
 import (
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -77,3 +80,160 @@ func TestStatProcessorSendWarm(t *testing.T) {
 		t.Errorf("empty stat array changed channel length: got %d want %d", got, wantLen)
 	}
 }
+
+// captureOutput returns what fn prints to stdout and stderr, where the
+// stat processor prints its final stats and its progress.
+func captureOutput(t *testing.T, fn func()) string {
+	f, err := ioutil.TempFile("", "stat_processor")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = f, f
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+
+	fn()
+
+	out, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return string(out)
+}
+
+func TestStatProcessorProcessLabels(t *testing.T) {
+	out := captureOutput(t, func() {
+		limit := uint64(0)
+		sp := newStatProcessor(&statProcessorArgs{limit: &limit})
+		sp.init(1)
+		go sp.process(1)
+		for _, v := range []float64{1, 2, 3} {
+			sp.send([]*Stat{GetStat().Init([]byte("fast"), v)})
+		}
+		for _, v := range []float64{100, 300} {
+			sp.send([]*Stat{GetStat().Init([]byte("slow"), v)})
+		}
+		sp.CloseAndWait()
+	})
+
+	lines := strings.Split(out, "\n")
+	stats := map[string]string{}
+	for i := 0; i+1 < len(lines); i++ {
+		if strings.HasSuffix(lines[i], ":") {
+			stats[strings.TrimSpace(strings.TrimSuffix(lines[i], ":"))] = lines[i+1]
+		}
+	}
+	cases := []struct {
+		label string
+		want  []string
+	}{
+		{label: "fast", want: []string{"min:     1.00ms", "mean:     2.00ms", "max:    3.00ms", "count: 3"}},
+		{label: "slow", want: []string{"min:   100.00ms", "mean:   200.00ms", "count: 2"}},
+		{label: labelAllQueries, want: []string{"min:     1.00ms", "count: 5"}},
+	}
+	for _, c := range cases {
+		got, ok := stats[c.label]
+		if !ok {
+			t.Errorf("%s: label not reported in:\n%s", c.label, out)
+			continue
+		}
+		for _, w := range c.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%s: stats do not contain %q: %s", c.label, w, got)
+			}
+		}
+	}
+}
+
+func TestStatProcessorProcessWarmup(t *testing.T) {
+	out := captureOutput(t, func() {
+		limit := uint64(0)
+		sp := newStatProcessor(&statProcessorArgs{limit: &limit, warmupDuration: time.Second})
+		sp.init(1)
+		go sp.process(1)
+		// 3 queries burned by the warmup, each with a partial stat:
+		for _, v := range []float64{1000, 2000, 3000} {
+			sp.sendWarmup([]*Stat{GetPartialStat().Init([]byte("q-qp"), v), GetStat().Init([]byte("q"), v)})
+		}
+		for _, v := range []float64{1, 3} {
+			sp.send([]*Stat{GetPartialStat().Init([]byte("q-qp"), v), GetStat().Init([]byte("q"), v)})
+		}
+		sp.CloseAndWait()
+	})
+
+	for _, want := range []string{
+		"Run complete after 2 queries",
+		"Queries burned by warmup (not in stats): 3\n",
+		"max:    3.00ms",
+		"count: 2",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "count: 5") || strings.Contains(out, "count: 3") {
+		t.Errorf("warmup queries counted in stats:\n%s", out)
+	}
+}
+
+func TestStatProcessorProcessProgress(t *testing.T) {
+	cases := []struct {
+		desc  string
+		limit uint64
+		want  []string
+	}{
+		{desc: "known total", limit: 5, want: []string{"Progress: 2/5 queries (40.0%)", "Progress: 4/5 queries (80.0%)"}},
+		{desc: "unknown total", want: []string{"Progress: 2 queries,", "Progress: 4 queries,"}},
+	}
+	for _, c := range cases {
+		out := captureOutput(t, func() {
+			limit := c.limit
+			sp := newStatProcessor(&statProcessorArgs{limit: &limit, printInterval: 2})
+			sp.init(1)
+			go sp.process(1)
+			for _, v := range []float64{1, 2, 3, 4, 5} {
+				sp.send([]*Stat{GetStat().Init([]byte("q"), v)})
+			}
+			sp.CloseAndWait()
+		})
+
+		var got []string
+		for _, line := range strings.Split(out, "\n") {
+			if strings.HasPrefix(line, "Progress: ") {
+				got = append(got, line)
+			}
+		}
+		if len(got) != len(c.want) {
+			t.Fatalf("%s: incorrect number of progress lines: got %d want %d:\n%s", c.desc, len(got), len(c.want), out)
+		}
+		for j, w := range c.want {
+			if !strings.HasPrefix(got[j], w) {
+				t.Errorf("%s: incorrect progress line %d: got %q want prefix %q", c.desc, j, got[j], w)
+			}
+		}
+	}
+}
+
+func TestWriteProgress(t *testing.T) {
+	cases := []struct {
+		desc      string
+		completed uint64
+		total     uint64
+		want      string
+	}{
+		{desc: "known total", completed: 100, total: 400, want: "Progress: 100/400 queries (25.0%), 20.00 queries/sec, ETA 15s\n"},
+		{desc: "unknown total", completed: 100, want: "Progress: 100 queries, 20.00 queries/sec\n"},
+		{desc: "none completed", total: 400, want: "Progress: 0/400 queries (0.0%), 0.00 queries/sec, ETA unknown\n"},
+	}
+	for _, c := range cases {
+		var buf strings.Builder
+		if err := writeProgress(&buf, c.completed, c.total, 5*time.Second); err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if got := buf.String(); got != c.want {
+			t.Errorf("%s: incorrect progress: got %q want %q", c.desc, got, c.want)
+		}
+	}
+}
@@ -5,11 +5,16 @@ import (
 	"io"
 	"sort"
 	"sync"
+	"time"
+
 	"github.com/filipecosta90/hdrhistogram"
 )
 
 var (
 	hdrScaleFactor = 1e3
+
+	// percentileQuantiles are the quantiles reported by writePercentiles.
+	percentileQuantiles = []float64{50.0, 90.0, 95.0, 99.0}
 )
 
 // Stat represents one statistical measurement, typically used to store the
@@ -19,6 +24,7 @@ type Stat struct {
 	value     float64
 	isWarm    bool
 	isPartial bool
+	isWarmup  bool
 }
 
 var statPool = &sync.Pool{
@@ -48,6 +54,7 @@ func (s *Stat) Init(label []byte, value float64) *Stat {
 	s.label = append(s.label, label...)
 	s.value = value
 	s.isWarm = false
+	s.isWarmup = false
 	return s
 }
 
@@ -56,6 +63,7 @@ func (s *Stat) reset() *Stat {
 	s.value = 0.0
 	s.isWarm = false
 	s.isPartial = false
+	s.isWarmup = false
 	return s
 }
 
@@ -106,6 +114,28 @@ func (s *statGroup) write(w io.Writer) error {
 	return err
 }
 
+// writePercentiles writes the latency percentiles (and maximum) of the
+// statGroup in a machine-parseable form, one metric per line:
+//
+//	<label>\t<metric>\t<value in milliseconds>
+func (s *statGroup) writePercentiles(w io.Writer, label string) error {
+	for _, q := range percentileQuantiles {
+		v := float64(s.latencyHDRHistogram.ValueAtQuantile(q)) / hdrScaleFactor
+		if _, err := fmt.Fprintf(w, "%s\tp%g\t%.2f\n", label, q, v); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s\tmax\t%.2f\n", label, s.Max())
+	return err
+}
+
+// reset clears all values pushed to the statGroup.
+func (s *statGroup) reset() {
+	s.latencyHDRHistogram.Reset()
+	s.sum = 0
+	s.count = 0
+}
+
 // Median returns the Median value of the StatGroup in milliseconds
 func (s *statGroup) Median() float64 {
 	return float64(s.latencyHDRHistogram.ValueAtQuantile(50.0))/ hdrScaleFactor
@@ -162,3 +192,84 @@ func writeStatGroupMap(w io.Writer, statGroups map[string]*statGroup) error {
 	}
 	return nil
 }
+
+// writeStatGroupMapPercentiles writes the percentiles of a map of StatGroups
+// (see statGroup.writePercentiles) in an ordered fashion by key
+func writeStatGroupMapPercentiles(w io.Writer, statGroups map[string]*statGroup) error {
+	keys := make([]string, 0, len(statGroups))
+	for k := range statGroups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := statGroups[k].writePercentiles(w, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultRateWindowSlots is the number of slots of a rateWindow.
+const defaultRateWindowSlots = 10
+
+// rateWindow computes the rate of completed queries over a sliding window,
+// with a ring buffer of counts of the queries completed in each slot of the
+// window (e.g. each second of a 10s window).
+type rateWindow struct {
+	start   time.Time // rates are not computed over time before it
+	slotDur time.Duration
+	slots   []rateSlot
+}
+
+// rateSlot holds the count of a slot of a rateWindow.
+type rateSlot struct {
+	n     int64 // of the slot since the Unix epoch, in slot durations
+	count uint64
+}
+
+// newRateWindow returns a rateWindow over the given duration, for queries
+// completed from start on.
+func newRateWindow(window time.Duration, start time.Time) *rateWindow {
+	slotDur := window / defaultRateWindowSlots
+	if slotDur <= 0 {
+		slotDur = 1
+	}
+	return &rateWindow{
+		start:   start,
+		slotDur: slotDur,
+		slots:   make([]rateSlot, defaultRateWindowSlots),
+	}
+}
+
+// add records count queries completed at t.
+func (w *rateWindow) add(t time.Time, count uint64) {
+	n := t.UnixNano() / int64(w.slotDur)
+	s := &w.slots[n%int64(len(w.slots))]
+	if s.n != n {
+		s.n = n
+		s.count = 0
+	}
+	s.count += count
+}
+
+// rate returns the rate, in queries/sec, of the queries completed in the
+// window ending at now (or since start, if more recent).
+func (w *rateWindow) rate(now time.Time) float64 {
+	last := now.UnixNano() / int64(w.slotDur)
+	first := last - int64(len(w.slots)) + 1
+	count := uint64(0)
+	for _, s := range w.slots {
+		if s.n >= first && s.n <= last {
+			count += s.count
+		}
+	}
+	from := time.Unix(0, first*int64(w.slotDur))
+	if from.Before(w.start) {
+		from = w.start
+	}
+	elapsed := now.Sub(from)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(count) / elapsed.Seconds()
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetPartialStat(t *testing.T) {
@@ -405,3 +406,75 @@ func TestWriteStatGroupMap(t *testing.T) {
 		}
 	}
 }
+
+func TestWritePercentiles(t *testing.T) {
+	sg := newStatGroup(0)
+	for i := 1; i <= 100; i++ {
+		sg.push(float64(i))
+	}
+
+	var buf bytes.Buffer
+	err := sg.writePercentiles(&buf, "foo")
+	if err != nil {
+		t.Errorf("unexpected error for writePercentiles: %v", err)
+	}
+	want := "foo\tp50\t50.00\nfoo\tp90\t90.00\nfoo\tp95\t95.00\nfoo\tp99\t99.00\nfoo\tmax\t100.00\n"
+	if got := buf.String(); got != want {
+		t.Errorf("incorrect percentiles output:\ngot\n%s\nwant\n%s", got, want)
+	}
+
+	// Test error case
+	err = sg.writePercentiles(&errWriter{}, "foo")
+	if err == nil {
+		t.Errorf("expected error but did not get one")
+	}
+
+	sg.reset()
+	if sg.count != 0 || sg.sum != 0 || sg.latencyHDRHistogram.TotalCount() != 0 {
+		t.Errorf("reset did not clear stat group: count %d, sum %f", sg.count, sg.sum)
+	}
+}
+
+func TestRateWindow(t *testing.T) {
+	start := time.Unix(1000, 0)
+	w := newRateWindow(10*time.Second, start)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	// 10 queries/sec for 10s, then none. The window holds 9 slots of 1s
+	// before the current one:
+	for s := 0; s < 10; s++ {
+		for q := 0; q < 10; q++ {
+			w.add(at(time.Duration(s)*time.Second+time.Duration(q)*100*time.Millisecond), 1)
+		}
+		if s == 1 {
+			// the window does not reach before the start
+			if got := w.rate(at(2 * time.Second)); got != 10 {
+				t.Errorf("after 2s: incorrect rate: got %v want %v", got, 10.0)
+			}
+		}
+	}
+	cases := []struct {
+		at   time.Duration
+		want float64
+	}{
+		{at: 10 * time.Second, want: 10},
+		{at: 15 * time.Second, want: 40.0 / 9},
+		{at: 15*time.Second + 500*time.Millisecond, want: 40.0 / 9.5},
+		{at: 20 * time.Second, want: 0},
+		{at: 30 * time.Second, want: 0},
+	}
+	for _, c := range cases {
+		if got := w.rate(at(c.at)); got != c.want {
+			t.Errorf("after %v: incorrect rate: got %v want %v", c.at, got, c.want)
+		}
+	}
+
+	// a burst in the latest slot counts again, with the old ones gone:
+	w.add(at(30*time.Second+500*time.Millisecond), 50)
+	if got, want := w.rate(at(31*time.Second)), 50.0/9; got != want {
+		t.Errorf("after burst: incorrect rate: got %v want %v", got, want)
+	}
+	if got := newRateWindow(10*time.Second, start).rate(start); got != 0 {
+		t.Errorf("at start: incorrect rate: got %v want %v", got, 0.0)
+	}
+}
@@ -0,0 +1,169 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// A RunSummary is the outcome of a run, as written to -summary-json: the
+// latencies of each label and the overall query rate. A summary written by
+// a previous run is the baseline (set by -baseline) the run is compared with.
+type RunSummary struct {
+	Queries   uint64                  `json:"queries"`
+	Workers   uint                    `json:"workers"`
+	QueryRate float64                 `json:"query_rate"` // in queries per second
+	Labels    map[string]LabelSummary `json:"labels"`
+}
+
+// A LabelSummary holds the latencies of the queries of a label, in
+// milliseconds.
+type LabelSummary struct {
+	Count  int64   `json:"count"`
+	Min    float64 `json:"min"`
+	Median float64 `json:"median"`
+	Mean   float64 `json:"mean"`
+	P90    float64 `json:"p90"`
+	P95    float64 `json:"p95"`
+	P99    float64 `json:"p99"`
+	Max    float64 `json:"max"`
+	StdDev float64 `json:"stddev"`
+}
+
+// newRunSummary returns the summary of a run from its statGroups by label.
+func newRunSummary(statGroups map[string]*statGroup, queries uint64, workers uint, queryRate float64) *RunSummary {
+	s := &RunSummary{
+		Queries:   queries,
+		Workers:   workers,
+		QueryRate: queryRate,
+		Labels:    make(map[string]LabelSummary, len(statGroups)),
+	}
+	for k, g := range statGroups {
+		quantile := func(q float64) float64 {
+			return float64(g.latencyHDRHistogram.ValueAtQuantile(q)) / hdrScaleFactor
+		}
+		s.Labels[k] = LabelSummary{
+			Count:  g.count,
+			Min:    g.Min(),
+			Median: g.Median(),
+			Mean:   g.Mean(),
+			P90:    quantile(90.0),
+			P95:    quantile(95.0),
+			P99:    quantile(99.0),
+			Max:    g.Max(),
+			StdDev: g.StdDev(),
+		}
+	}
+	return s
+}
+
+// readRunSummary reads a summary written by writeRunSummary.
+func readRunSummary(path string) (*RunSummary, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &RunSummary{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("cannot parse run summary %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// writeRunSummary writes s as JSON to the file at path.
+func writeRunSummary(path string, s *RunSummary) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// comparedLatencies are the latencies of each label that compareRunSummaries
+// reports on.
+var comparedLatencies = []struct {
+	name  string
+	value func(LabelSummary) float64
+}{
+	{"median", func(l LabelSummary) float64 { return l.Median }},
+	{"mean", func(l LabelSummary) float64 { return l.Mean }},
+	{"p99", func(l LabelSummary) float64 { return l.P99 }},
+	{"max", func(l LabelSummary) float64 { return l.Max }},
+}
+
+// percentDelta returns the change from baseline to current, in percent, or
+// NaN if the baseline is zero.
+func percentDelta(baseline, current float64) float64 {
+	if baseline == 0 {
+		return math.NaN()
+	}
+	return (current - baseline) / baseline * 100
+}
+
+// compareRunSummaries writes side by side the latencies of each label and
+// the overall query rate of the baseline and current runs, with their
+// change in percent. A latency higher, or a query rate lower, than the
+// baseline by more than threshold percent is marked as a regression; it
+// returns the number of them.
+func compareRunSummaries(w io.Writer, baseline, current *RunSummary, threshold float64) (int, error) {
+	regressions := 0
+	line := func(metric, unit string, b, c float64, higherIsWorse bool) error {
+		delta := percentDelta(b, c)
+		mark := ""
+		if !math.IsNaN(delta) && ((higherIsWorse && delta > threshold) || (!higherIsWorse && -delta > threshold)) {
+			mark = " REGRESSION"
+			regressions++
+		}
+		deltaStr := "n/a"
+		if !math.IsNaN(delta) {
+			deltaStr = fmt.Sprintf("%+.1f%%", delta)
+		}
+		_, err := fmt.Fprintf(w, "  %-10s %12.2f%s %12.2f%s %9s%s\n", metric+":", b, unit, c, unit, deltaStr, mark)
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "Comparison with baseline (regression threshold %g%%):\n  %-10s %14s %14s %9s\n", threshold, "", "baseline", "current", "delta")
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]string, 0, len(current.Labels))
+	for k := range current.Labels {
+		keys = append(keys, k)
+	}
+	for k := range baseline.Labels {
+		if _, ok := current.Labels[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b, inBaseline := baseline.Labels[k]
+		c, inCurrent := current.Labels[k]
+		var err error
+		switch {
+		case !inBaseline:
+			_, err = fmt.Fprintf(w, "%s: not in baseline\n", k)
+		case !inCurrent:
+			_, err = fmt.Fprintf(w, "%s: not in this run\n", k)
+		default:
+			_, err = fmt.Fprintf(w, "%s:\n", k)
+			for _, l := range comparedLatencies {
+				if err != nil {
+					break
+				}
+				err = line(l.name, "ms", l.value(b), l.value(c), true)
+			}
+		}
+		if err != nil {
+			return regressions, err
+		}
+	}
+	if err := line("rate", "/s", baseline.QueryRate, current.QueryRate, false); err != nil {
+		return regressions, err
+	}
+	_, err = fmt.Fprintf(w, "Regressions beyond %g%%: %d\n", threshold, regressions)
+	return regressions, err
+}
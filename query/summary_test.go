@@ -0,0 +1,94 @@
+package query
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewRunSummary(t *testing.T) {
+	g := newStatGroup(0)
+	for _, v := range []float64{1, 2, 3, 4} {
+		g.push(v)
+	}
+	s := newRunSummary(map[string]*statGroup{labelAllQueries: g}, 4, 2, 8)
+	got := s.Labels[labelAllQueries]
+	if got.Count != 4 || got.Min != 1 || got.Max != 4 || got.Mean != 2.5 {
+		t.Errorf("incorrect label summary: got %+v", got)
+	}
+	if s.Queries != 4 || s.Workers != 2 || s.QueryRate != 8 {
+		t.Errorf("incorrect run summary: got %+v", s)
+	}
+
+	dir, err := ioutil.TempDir("", "summary")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "summary.json")
+	if err := writeRunSummary(path, s); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	read, err := readRunSummary(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if read.Labels[labelAllQueries] != got || read.QueryRate != s.QueryRate {
+		t.Errorf("incorrect summary read: got %+v want %+v", read, s)
+	}
+}
+
+func TestCompareRunSummaries(t *testing.T) {
+	baseline := &RunSummary{
+		QueryRate: 100,
+		Labels: map[string]LabelSummary{
+			"cpu-max": {Count: 10, Median: 10, Mean: 10, P99: 20, Max: 30},
+			"removed": {Count: 10, Median: 5, Mean: 5, P99: 5, Max: 5},
+		},
+	}
+	current := &RunSummary{
+		QueryRate: 85,
+		Labels: map[string]LabelSummary{
+			"cpu-max": {Count: 10, Median: 11, Mean: 12, P99: 0, Max: 15},
+			"added":   {Count: 10, Median: 5, Mean: 5, P99: 5, Max: 5},
+		},
+	}
+	var buf bytes.Buffer
+	regressions, err := compareRunSummaries(&buf, baseline, current, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// (the mean is 20% higher and the query rate 15% lower)
+	if regressions != 2 {
+		t.Errorf("incorrect regressions: got %d want 2", regressions)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"added: not in baseline\n",
+		"cpu-max:\n",
+		"  median:           10.00ms        11.00ms    +10.0%\n",
+		"  mean:             10.00ms        12.00ms    +20.0% REGRESSION\n",
+		"  p99:              20.00ms         0.00ms   -100.0%\n",
+		"  max:              30.00ms        15.00ms    -50.0%\n",
+		"removed: not in this run\n",
+		"  rate:            100.00/s        85.00/s    -15.0% REGRESSION\n",
+		"Regressions beyond 10%: 2\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing line %q in output:\n%s", want, out)
+		}
+	}
+
+	buf.Reset()
+	baseline.Labels["cpu-max"] = LabelSummary{}
+	regressions, err = compareRunSummaries(&buf, baseline, current, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "  mean:              0.00ms        12.00ms       n/a\n") || regressions != 1 {
+		t.Errorf("zero baseline: incorrect output (%d regressions):\n%s", regressions, buf.String())
+	}
+}